@@ -0,0 +1,203 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/marcopeereboom/scomms/core"
+)
+
+// wire format of everything the server sends
+type incoming struct {
+	Id     *uint64         `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Error  *Error          `json:"error"`
+}
+
+type Client struct {
+	conn net.Conn
+
+	mtx     sync.Mutex
+	enc     *json.Encoder
+	id      uint64
+	replies map[uint64]chan *Error
+	err     error
+
+	events chan interface{}
+}
+
+// Dial connects to a control socket.
+func Dial(filename string) (*Client, error) {
+	nc, err := net.Dial("unix", filename)
+	if err != nil {
+		return nil, err
+	}
+	c := Client{
+		conn:    nc,
+		enc:     json.NewEncoder(nc),
+		replies: make(map[uint64]chan *Error),
+		events:  make(chan interface{}, 100),
+	}
+	go c.read()
+
+	return &c, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) read() {
+	var err error
+	defer func() {
+		c.mtx.Lock()
+		c.err = err
+		for k, v := range c.replies {
+			close(v)
+			delete(c.replies, k)
+		}
+		c.mtx.Unlock()
+		close(c.events)
+	}()
+
+	r := bufio.NewReader(c.conn)
+	for {
+		var line []byte
+		line, err = r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		in := incoming{}
+		err = json.Unmarshal(line, &in)
+		if err != nil {
+			return
+		}
+
+		// reply
+		if in.Id != nil {
+			c.mtx.Lock()
+			reply, ok := c.replies[*in.Id]
+			delete(c.replies, *in.Id)
+			c.mtx.Unlock()
+			if ok {
+				reply <- in.Error
+			}
+			continue
+		}
+
+		// event
+		f, ok := events[in.Method]
+		if !ok {
+			continue
+		}
+		m := f()
+		err = json.Unmarshal(in.Params, m)
+		if err != nil {
+			return
+		}
+		c.events <- m
+	}
+}
+
+// Call invokes method and waits for the reply.
+func (c *Client) Call(method string, params interface{}) error {
+	var (
+		p   []byte
+		err error
+	)
+	if params != nil {
+		p, err = json.Marshal(params)
+		if err != nil {
+			return err
+		}
+	}
+	reply := make(chan *Error, 1)
+
+	c.mtx.Lock()
+	if c.err != nil {
+		c.mtx.Unlock()
+		return c.err
+	}
+	c.id++
+	id := c.id
+	c.replies[id] = reply
+	raw := json.RawMessage(fmt.Sprintf("%v", id))
+	req := Request{
+		JsonRpc: jsonRpcVersion,
+		Id:      &raw,
+		Method:  method,
+		Params:  p,
+	}
+	err = c.enc.Encode(req)
+	c.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	rerr, ok := <-reply
+	if !ok {
+		return fmt.Errorf("connection closed")
+	}
+	if rerr != nil {
+		return rerr
+	}
+	return nil
+}
+
+// Subscribe starts event delivery.  With prompts set the caller is expected
+// to answer public identity confirmations.
+func (c *Client) Subscribe(prompts bool) error {
+	return c.Call("Subscribe", &Subscribe{Prompts: prompts})
+}
+
+// Decline hands a prompt back, it is decided without the caller.
+func (c *Client) Decline(id core.PromptId) error {
+	return c.Call("Decline", &Decline{Id: id})
+}
+
+// SendCore sends a core message to the remote core.
+func (c *Client) SendCore(m interface{}) error {
+	name := TypeName(m)
+	if name == "UiReady" {
+		return c.Call(name, nil)
+	}
+	if _, ok := commands[name]; !ok {
+		return fmt.Errorf("%v can not be sent over the control "+
+			"socket", name)
+	}
+	return c.Call(name, m)
+}
+
+// Receive returns the next event.
+func (c *Client) Receive() (interface{}, error) {
+	m, ok := <-c.events
+	if !ok {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		if c.err != nil {
+			return nil, c.err
+		}
+		return nil, fmt.Errorf("connection closed")
+	}
+	return m, nil
+}
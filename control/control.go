@@ -0,0 +1,587 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+// Package control exposes a running core to other local programs.
+//
+// The API is JSON-RPC 2.0 over a unix domain socket, one JSON object per
+// line.  Methods are named after the core messages they map to and take the
+// message as parameters, e.g.
+//
+//	{"jsonrpc":"2.0","id":1,"method":"SendFile",
+//	 "params":{"To":"bob@example.com","Filename":"/tmp/x","Mime":"text/plain"}}
+//
+// In addition there are three control methods:
+//
+//	Subscribe	{"Prompts":bool} start receiving events; with Prompts set
+//			the subscriber is asked to confirm public identities and
+//			key changes
+//	UiReady		replay current identity, trust and inbox to the caller
+//	Decline		{"Id":id} hand a prompt back, it is decided without
+//			the caller
+//
+// Subscribers receive core to UI messages as notifications named after the
+// message type, e.g.
+//
+//	{"jsonrpc":"2.0","method":"UiPopup","params":{"Title":"","Message":""}}
+//
+// Subscribers that do not keep reading are disconnected.
+//
+// A UiConfirmPublicIdentity notification is answered by calling
+// UiConfirmPublicIdentityReply with the same Id, a UiKeyChange by calling
+// UiKeyChangeReply, see core.Frontend.  Prompts that are not answered in time
+// or whose subscribers all went away are decided without them.
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marcopeereboom/scomms/core"
+)
+
+const (
+	SocketFilename = "/scomms.sock"
+
+	jsonRpcVersion = "2.0"
+
+	// JSON-RPC error codes
+	ErrParse          = -32700
+	ErrInvalidRequest = -32600
+	ErrMethodNotFound = -32601
+	ErrInvalidParams  = -32602
+	ErrInternal       = -32603
+)
+
+type Request struct {
+	JsonRpc string           `json:"jsonrpc"`
+	Id      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+}
+
+type Response struct {
+	JsonRpc string           `json:"jsonrpc"`
+	Id      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"` // notifications
+	Params  interface{}      `json:"params,omitempty"` // notifications
+	Result  interface{}      `json:"result,omitempty"`
+	Error   *Error           `json:"error,omitempty"`
+}
+
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v (%v)", e.Message, e.Code)
+}
+
+// Parameters of the Subscribe method.
+type Subscribe struct {
+	Prompts bool
+}
+
+// Parameters of the Decline method.
+type Decline struct {
+	Id core.PromptId
+}
+
+// Messages a client may send to core.
+var commands = map[string]func() interface{}{
+	"SendFile":                     func() interface{} { return &core.SendFile{} },
+	"UpdateTrustRecord":            func() interface{} { return &core.UpdateTrustRecord{} },
+	"TrustDelete":                  func() interface{} { return &core.TrustDelete{} },
+	"TrustHistoryView":             func() interface{} { return &core.TrustHistoryView{} },
+	"TrustRevert":                  func() interface{} { return &core.TrustRevert{} },
+	"UiConfirmPublicIdentityReply": func() interface{} { return &core.UiConfirmPublicIdentityReply{} },
+	"UiKeyChangeReply":             func() interface{} { return &core.UiKeyChangeReply{} },
+	"FetchMailbox":                 func() interface{} { return &core.FetchMailbox{} },
+	"AuditView":                    func() interface{} { return &core.AuditView{} },
+	"InboxOpen":                    func() interface{} { return &core.InboxOpen{} },
+	"InboxMark":                    func() interface{} { return &core.InboxMark{} },
+	"InboxDelete":                  func() interface{} { return &core.InboxDelete{} },
+	"InboxSearch":                  func() interface{} { return &core.InboxSearch{} },
+	"MailExport":                   func() interface{} { return &core.MailExport{} },
+	"HistoryView":                  func() interface{} { return &core.HistoryView{} },
+}
+
+// Messages core may send to clients.
+var events = map[string]func() interface{}{
+	"UiPopup":                 func() interface{} { return &core.UiPopup{} },
+	"UiRenderIdentity":        func() interface{} { return &core.UiRenderIdentity{} },
+	"UiConfirmPublicIdentity": func() interface{} { return &core.UiConfirmPublicIdentity{} },
+	"UiRenderTrust":           func() interface{} { return &core.UiRenderTrust{} },
+	"UiSendProgress":          func() interface{} { return &core.UiSendProgress{} },
+	"UiSendFileResult":        func() interface{} { return &core.UiSendFileResult{} },
+	"UiNewMessage":            func() interface{} { return &core.UiNewMessage{} },
+	"UiRenderAudit":           func() interface{} { return &core.UiRenderAudit{} },
+	"UiRenderInbox":           func() interface{} { return &core.UiRenderInbox{} },
+	"UiInboxItem":             func() interface{} { return &core.UiInboxItem{} },
+	"UiSearchResult":          func() interface{} { return &core.UiSearchResult{} },
+	"UiRenderHistory":         func() interface{} { return &core.UiRenderHistory{} },
+	"UiRenderTrustHistory":    func() interface{} { return &core.UiRenderTrustHistory{} },
+	"UiKeyChange":             func() interface{} { return &core.UiKeyChange{} },
+}
+
+// TypeName returns the name a core message is known by on the wire.
+func TypeName(m interface{}) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", m), "*core.")
+}
+
+// Sender is the part of core the server needs.
+type Sender interface {
+	SendCore(m interface{}) error
+}
+
+const (
+	// sendQueue is the number of responses a connection may have
+	// outstanding, a subscriber that falls further behind is dropped.
+	sendQueue = 64
+
+	// writeTimeout drops a subscriber that stops reading.
+	writeTimeout = 10 * time.Second
+
+	// promptTimeout is how long subscribers have to answer a prompt.
+	promptTimeout = 5 * time.Minute
+)
+
+// prompt is a question that is waiting for a subscriber to answer it.
+type prompt struct {
+	conns    map[*conn]struct{} // asked and still connected
+	fallback func()
+	timer    *time.Timer
+}
+
+// conn is a client connection.  Responses are queued and written by
+// writer so that a slow client does not hold up core or other clients.
+type conn struct {
+	net.Conn
+
+	enc        *json.Encoder
+	out        chan *Response
+	closed     chan struct{}
+	once       sync.Once
+	subscribed bool
+	prompts    bool
+}
+
+func newConn(nc net.Conn) *conn {
+	c := &conn{
+		Conn:   nc,
+		enc:    json.NewEncoder(nc),
+		out:    make(chan *Response, sendQueue),
+		closed: make(chan struct{}),
+	}
+	go c.writer()
+	return c
+}
+
+// write queues r.  The connection is closed if the queue is full.
+func (c *conn) write(r *Response) error {
+	r.JsonRpc = jsonRpcVersion
+	select {
+	case <-c.closed:
+		return fmt.Errorf("connection closed")
+	default:
+	}
+
+	select {
+	case c.out <- r:
+		return nil
+	default:
+		c.Close()
+		return fmt.Errorf("send queue full")
+	}
+}
+
+func (c *conn) writer() {
+	for {
+		select {
+		case r := <-c.out:
+			c.SetWriteDeadline(time.Now().Add(writeTimeout))
+			err := c.enc.Encode(r)
+			if err != nil {
+				c.Close()
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *conn) Close() error {
+	err := fmt.Errorf("connection closed")
+	c.once.Do(func() {
+		close(c.closed)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+type Server struct {
+	core     Sender
+	filename string
+	l        net.Listener
+
+	mtx      sync.Mutex
+	conns    map[*conn]struct{}
+	identity *core.UiRenderIdentity
+	trust    *core.UiRenderTrust
+	inbox    *core.UiRenderInbox
+	pending  map[core.PromptId]*prompt
+}
+
+// NewServer listens on filename.  The socket is only accessible by the
+// current user.
+func NewServer(c Sender, filename string) (*Server, error) {
+	// a stale socket from a previous run prevents listening
+	if cc, err := net.Dial("unix", filename); err == nil {
+		cc.Close()
+		return nil, fmt.Errorf("%v is in use", filename)
+	}
+	os.Remove(filename)
+
+	l, err := net.Listen("unix", filename)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(filename, 0600)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	s := Server{
+		core:     c,
+		filename: filename,
+		l:        l,
+		conns:    make(map[*conn]struct{}),
+		pending:  make(map[core.PromptId]*prompt),
+	}
+	go s.accept()
+
+	return &s, nil
+}
+
+func (s *Server) Close() error {
+	err := s.l.Close()
+	os.Remove(s.filename)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+
+	return err
+}
+
+func (s *Server) accept() {
+	for {
+		nc, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		c := newConn(nc)
+		s.mtx.Lock()
+		s.conns[c] = struct{}{}
+		s.mtx.Unlock()
+
+		go s.serve(c)
+	}
+}
+
+func (s *Server) serve(c *conn) {
+	defer func() {
+		s.mtx.Lock()
+		delete(s.conns, c)
+		s.mtx.Unlock()
+		c.Close()
+		s.forget(c)
+	}()
+
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		req := Request{}
+		err = json.Unmarshal(line, &req)
+		if err != nil {
+			c.write(&Response{Error: &Error{ErrParse, err.Error()}})
+			continue
+		}
+		rerr := s.handle(c, &req)
+		if req.Id == nil {
+			// notification, no reply
+			continue
+		}
+		reply := &Response{Id: req.Id}
+		if rerr != nil {
+			reply.Error = rerr
+		} else {
+			reply.Result = true
+		}
+		if c.write(reply) != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) handle(c *conn, req *Request) *Error {
+	if req.JsonRpc != jsonRpcVersion {
+		return &Error{ErrInvalidRequest, "invalid version"}
+	}
+
+	switch req.Method {
+	case "Subscribe":
+		sub := Subscribe{}
+		if len(req.Params) != 0 {
+			err := json.Unmarshal(req.Params, &sub)
+			if err != nil {
+				return &Error{ErrInvalidParams, err.Error()}
+			}
+		}
+		s.mtx.Lock()
+		c.subscribed = true
+		c.prompts = sub.Prompts
+		s.mtx.Unlock()
+		return nil
+
+	case "Decline":
+		d := Decline{}
+		err := json.Unmarshal(req.Params, &d)
+		if err != nil {
+			return &Error{ErrInvalidParams, err.Error()}
+		}
+		s.mtx.Lock()
+		p, ok := s.pending[d.Id]
+		if ok {
+			_, ok = p.conns[c]
+		}
+		orphan := ok && s.unask(c, d.Id, p)
+		s.mtx.Unlock()
+		if !ok {
+			return &Error{ErrInvalidParams, fmt.Sprintf("no "+
+				"pending confirmation %v", d.Id)}
+		}
+		if orphan {
+			p.fallback()
+		}
+		return nil
+
+	case "UiReady":
+		// core is already running, just tell the caller what it missed
+		s.mtx.Lock()
+		replay := []interface{}{}
+		if s.identity != nil {
+			replay = append(replay, s.identity)
+		}
+		if s.trust != nil {
+			replay = append(replay, s.trust)
+		}
+		if s.inbox != nil {
+			replay = append(replay, s.inbox)
+		}
+		s.mtx.Unlock()
+		for _, v := range replay {
+			c.write(&Response{Method: TypeName(v), Params: v})
+		}
+		return nil
+	}
+
+	f, ok := commands[req.Method]
+	if !ok {
+		return &Error{ErrMethodNotFound, "unknown method " + req.Method}
+	}
+	m := f()
+	if len(req.Params) != 0 {
+		err := json.Unmarshal(req.Params, m)
+		if err != nil {
+			return &Error{ErrInvalidParams, err.Error()}
+		}
+	}
+
+	// only answer prompts that are still open
+	if id, ok := promptId(m); ok {
+		if s.release(id) == nil {
+			return &Error{ErrInvalidParams, fmt.Sprintf("no "+
+				"pending confirmation %v", id)}
+		}
+	}
+
+	err := s.core.SendCore(m)
+	if err != nil {
+		return &Error{ErrInternal, err.Error()}
+	}
+	return nil
+}
+
+// broadcast queues m for all subscribers.  Returns the number of
+// recipients.
+func (s *Server) broadcast(m interface{}) int {
+	s.mtx.Lock()
+	conns := make([]*conn, 0, len(s.conns))
+	for c := range s.conns {
+		if !c.subscribed {
+			continue
+		}
+		conns = append(conns, c)
+	}
+	s.mtx.Unlock()
+
+	n := 0
+	for _, c := range conns {
+		err := c.write(&Response{Method: TypeName(m), Params: m})
+		if err != nil {
+			continue
+		}
+		n++
+	}
+
+	return n
+}
+
+// Event forwards a core to UI message to subscribers.  Public identity
+// confirmations and key changes must go through Prompt instead.
+func (s *Server) Event(m interface{}) {
+	s.mtx.Lock()
+	switch msg := m.(type) {
+	case *core.UiRenderIdentity:
+		s.identity = msg
+	case *core.UiRenderTrust:
+		s.trust = msg
+	case *core.UiRenderInbox:
+		s.inbox = msg
+	}
+	s.mtx.Unlock()
+
+	if _, ok := events[TypeName(m)]; !ok {
+		return
+	}
+	s.broadcast(m)
+}
+
+// promptId returns the Id of a prompt or of the reply to one.
+func promptId(m interface{}) (core.PromptId, bool) {
+	switch msg := m.(type) {
+	case *core.UiConfirmPublicIdentity:
+		return msg.Id, true
+	case *core.UiConfirmPublicIdentityReply:
+		return msg.Id, true
+	case *core.UiKeyChange:
+		return msg.Id, true
+	case *core.UiKeyChangeReply:
+		return msg.Id, true
+	}
+	return 0, false
+}
+
+// Prompt asks subscribers to confirm a public identity or a key change, m
+// is a UiConfirmPublicIdentity or a UiKeyChange.  It returns false if nobody
+// is around to answer and the caller has to decide.  Otherwise fallback is
+// called to decide if nobody answers within promptTimeout or all subscribers
+// that were asked went away.
+func (s *Server) Prompt(m interface{}, fallback func()) bool {
+	id, ok := promptId(m)
+	if !ok {
+		return false
+	}
+	p := &prompt{
+		conns:    make(map[*conn]struct{}),
+		fallback: fallback,
+	}
+	s.mtx.Lock()
+	for c := range s.conns {
+		if c.subscribed && c.prompts {
+			p.conns[c] = struct{}{}
+		}
+	}
+	if len(p.conns) == 0 {
+		s.mtx.Unlock()
+		return false
+	}
+	s.pending[id] = p
+	p.timer = time.AfterFunc(promptTimeout, func() {
+		if s.release(id) != nil {
+			fallback()
+		}
+	})
+	conns := make([]*conn, 0, len(p.conns))
+	for c := range p.conns {
+		conns = append(conns, c)
+	}
+	s.mtx.Unlock()
+
+	// a subscriber that can not be asked is gone, see serve
+	for _, c := range conns {
+		c.write(&Response{Method: TypeName(m), Params: m})
+	}
+	return true
+}
+
+// release removes a pending prompt and returns it, nil if it was not
+// pending anymore.
+func (s *Server) release(id core.PromptId) *prompt {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	p, ok := s.pending[id]
+	if !ok {
+		return nil
+	}
+	delete(s.pending, id)
+	p.timer.Stop()
+	return p
+}
+
+// unask stops waiting for c to answer p and returns true if nobody is left
+// to answer it.  Must be called with the mutex held.
+func (s *Server) unask(c *conn, id core.PromptId, p *prompt) bool {
+	delete(p.conns, c)
+	if len(p.conns) != 0 {
+		return false
+	}
+	delete(s.pending, id)
+	p.timer.Stop()
+	return true
+}
+
+// forget stops waiting for c to answer prompts.  Prompts nobody else was
+// asked are decided by their fallback.
+func (s *Server) forget(c *conn) {
+	s.mtx.Lock()
+	orphans := make([]*prompt, 0)
+	for id, p := range s.pending {
+		if _, ok := p.conns[c]; ok && s.unask(c, id, p) {
+			orphans = append(orphans, p)
+		}
+	}
+	s.mtx.Unlock()
+
+	for _, p := range orphans {
+		p.fallback()
+	}
+}
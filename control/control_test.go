@@ -0,0 +1,225 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package control
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcopeereboom/scomms/core"
+)
+
+type fakeCore struct {
+	sent chan interface{}
+}
+
+func (f *fakeCore) SendCore(m interface{}) error {
+	f.sent <- m
+	return nil
+}
+
+// listen starts a server in a new directory and connects a client to it.
+// The returned function closes both and removes the directory.
+func listen(t *testing.T) (*fakeCore, *Server, *Client, func()) {
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeCore{sent: make(chan interface{}, 10)}
+	server, err := NewServer(fake, dir+SocketFilename)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	client, err := Dial(dir + SocketFilename)
+	if err != nil {
+		server.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return fake, server, client, func() {
+		client.Close()
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestServerInUse(t *testing.T) {
+	fake, server, _, done := listen(t)
+	defer done()
+
+	// second server must refuse
+	_, err := NewServer(fake, server.filename)
+	if err == nil {
+		t.Fatal("socket in use not detected")
+	}
+}
+
+func TestCommand(t *testing.T) {
+	fake, _, client, done := listen(t)
+	defer done()
+
+	err := client.SendCore(&core.SendFile{To: "bob@localhost",
+		Filename: "/tmp/x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf, ok := (<-fake.sent).(*core.SendFile)
+	if !ok || sf.To != "bob@localhost" || sf.Filename != "/tmp/x" {
+		t.Fatalf("unexpected command %v", sf)
+	}
+
+	// not a command
+	err = client.SendCore(&core.Shutdown{})
+	if err == nil {
+		t.Fatal("Shutdown allowed")
+	}
+	err = client.Call("Shutdown", nil)
+	if err == nil {
+		t.Fatal("Shutdown allowed")
+	}
+}
+
+func TestEvent(t *testing.T) {
+	_, server, client, done := listen(t)
+	defer done()
+
+	err := client.Subscribe(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Event(&core.UiPopup{Title: "t", Message: "m"})
+	m, err := client.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, ok := m.(*core.UiPopup)
+	if !ok || p.Title != "t" || p.Message != "m" {
+		t.Fatalf("unexpected event %v", m)
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	_, server, _, done := listen(t)
+	defer done()
+
+	// subscribe and then stop reading
+	nc, err := net.Dial("unix", server.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	_, err = nc.Write([]byte(`{"jsonrpc":"2.0","id":1,` +
+		`"method":"Subscribe"}` + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bufio.NewReader(nc).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := make(chan int)
+	go func() {
+		m := &core.UiPopup{Message: strings.Repeat("x", 64*1024)}
+		n := 1
+		for i := 0; i < 10*sendQueue && n != 0; i++ {
+			n = server.broadcast(m)
+		}
+		c <- n
+	}()
+	select {
+	case n := <-c:
+		if n != 0 {
+			t.Fatalf("slow subscriber not dropped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("broadcast blocked on a slow subscriber")
+	}
+}
+
+func TestPromptGone(t *testing.T) {
+	fake, server, client, done := listen(t)
+	defer done()
+
+	err := client.Subscribe(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decided := make(chan core.PromptId, 2)
+	prompt := func(id core.PromptId) bool {
+		return server.Prompt(&core.UiKeyChange{Id: id}, func() {
+			decided <- id
+		})
+	}
+
+	// answered prompts are not decided twice
+	if !prompt(1) {
+		t.Fatal("subscriber not asked")
+	}
+	_, err = client.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.SendCore(&core.UiKeyChangeReply{Id: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-fake.sent
+
+	// so are prompts handed back
+	if !prompt(2) {
+		t.Fatal("subscriber not asked")
+	}
+	_, err = client.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Decline(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := <-decided; id != 2 {
+		t.Fatalf("prompt %v decided", id)
+	}
+	err = client.Decline(2)
+	if err == nil {
+		t.Fatal("declined twice")
+	}
+
+	// a prompt nobody can answer anymore is decided without them
+	if !prompt(3) {
+		t.Fatal("subscriber not asked")
+	}
+	client.Close()
+	select {
+	case id := <-decided:
+		if id != 3 {
+			t.Fatalf("prompt %v decided", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("prompt left pending")
+	}
+	if prompt(4) {
+		t.Fatal("nobody there to ask")
+	}
+}
@@ -0,0 +1,327 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/marcopeereboom/mcrypt"
+)
+
+// Audit log
+//
+// Security relevant events are appended to audit.log, one JSON auditLine
+// per line.  The record itself is encrypted to self.  Lines are chained:
+//
+//	Mac(n) = HMAC-SHA256(key, Mac(n-1) || Seq(n) || Payload(n))
+//
+// The HMAC key is random and stored encrypted to self in audit.key.  The
+// last Seq and Mac are kept in audit.head so that truncating the log is
+// detected as well.  Rolling back log and head together to an older copy is
+// not detected.
+const (
+	auditFilename     = "/audit.log"
+	auditKeyFilename  = "/audit.key"
+	auditHeadFilename = "/audit.head"
+)
+
+// audit events
+const (
+	AuditSession       = "session"              // incoming session
+	AuditTrustAdd      = "trust add"            // trust record created
+	AuditTrustUpdate   = "trust update"         // trust record changed
+	AuditTrustDelete   = "trust delete"         // trust record removed
+	AuditMismatch      = "identity mismatch"    // peer is not who we expected
+	AuditKeyChange     = "key change"           // known address, other key
+	AuditDenied        = "denied"               // confirmation refused
+	AuditVerifyFailure = "audit verify failure" // log did not verify on start
+	AuditRetention     = "retention"            // messages purged by policy
+)
+
+// AuditRecord is a single audit log entry.
+type AuditRecord struct {
+	Seq         uint64
+	Time        time.Time
+	Event       string
+	Address     string `json:",omitempty"`
+	Fingerprint string `json:",omitempty"`
+	Detail      string `json:",omitempty"`
+}
+
+type auditLine struct {
+	Seq     uint64
+	Payload []byte // mcrypt.Message of AuditRecord
+	Mac     []byte
+}
+
+type auditHead struct {
+	Seq uint64
+	Mac []byte
+}
+
+type Audit struct {
+	mtx sync.Mutex
+	dir string
+	id  *mcrypt.Identity
+	key []byte
+	seq uint64
+	mac []byte
+	f   *os.File
+}
+
+// sealToSelf encrypts and marshals v to self.
+func sealToSelf(id *mcrypt.Identity, v interface{}) ([]byte, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := id.Encrypt(id.PublicIdentity.Key, payload)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Marshal()
+}
+
+// openFromSelf reverses sealToSelf.
+func openFromSelf(id *mcrypt.Identity, blob []byte, v interface{}) error {
+	msg, err := mcrypt.UnmarshalMessage(blob)
+	if err != nil {
+		return err
+	}
+	payload, err := id.Decrypt(id.PublicIdentity.Key, msg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, v)
+}
+
+// writeFileAtomic replaces filename with data.
+func writeFileAtomic(filename string, data []byte) error {
+	tmp := filename + tmpExtension
+	err := ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+func auditMac(key, prev []byte, seq uint64, payload []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(prev)
+	binary.Write(h, binary.BigEndian, seq)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+// auditKey returns the chain key, create creates it when missing.
+func auditKey(dir string, id *mcrypt.Identity, create bool) ([]byte, error) {
+	key, err := selfKey(dir+auditKeyFilename, id, create)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("audit key: %v", err)
+	}
+	return key, err
+}
+
+func readAuditHead(dir string, id *mcrypt.Identity) (*auditHead, error) {
+	blob, err := ioutil.ReadFile(dir + auditHeadFilename)
+	if err != nil {
+		return nil, err
+	}
+	h := auditHead{}
+	err = openFromSelf(id, blob, &h)
+	if err != nil {
+		return nil, fmt.Errorf("audit head: %v", err)
+	}
+	return &h, nil
+}
+
+// OpenAudit opens the audit log in dir for appending.
+func OpenAudit(dir string, id *mcrypt.Identity) (*Audit, error) {
+	key, err := auditKey(dir, id, true)
+	if err != nil {
+		return nil, err
+	}
+
+	a := Audit{
+		dir: dir,
+		id:  id,
+		key: key,
+	}
+	h, err := readAuditHead(dir, id)
+	if err == nil {
+		a.seq = h.Seq
+		a.mac = h.Mac
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	a.f, err = os.OpenFile(dir+auditFilename,
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+func (a *Audit) Close() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.f.Close()
+}
+
+// Log appends an event.  pid may be nil.
+func (a *Audit) Log(event string, pid *mcrypt.PublicIdentity,
+	format string, args ...interface{}) error {
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	r := AuditRecord{
+		Seq:    a.seq + 1,
+		Time:   time.Now(),
+		Event:  event,
+		Detail: fmt.Sprintf(format, args...),
+	}
+	if pid != nil {
+		r.Address = pid.Address
+		r.Fingerprint = pid.Fingerprint()
+	}
+	payload, err := sealToSelf(a.id, &r)
+	if err != nil {
+		return err
+	}
+	l := auditLine{
+		Seq:     r.Seq,
+		Payload: payload,
+		Mac:     auditMac(a.key, a.mac, r.Seq, payload),
+	}
+	j, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(a.f, "%s\n", j)
+	if err != nil {
+		return err
+	}
+	err = a.f.Sync()
+	if err != nil {
+		return err
+	}
+
+	// move head last, a crash in between shows up as an unverified line
+	a.seq = l.Seq
+	a.mac = l.Mac
+	blob, err := sealToSelf(a.id, &auditHead{Seq: a.seq, Mac: a.mac})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(a.dir+auditHeadFilename, blob)
+}
+
+// VerifyAudit reads and verifies the audit log in dir.  It returns the
+// records that verified and an error describing the first problem found.
+// It does not need a running core.
+func VerifyAudit(dir string, id *mcrypt.Identity) ([]*AuditRecord, error) {
+	key, err := auditKey(dir, id, false)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// never written, but a log without a key is suspicious
+			if _, err := os.Stat(dir + auditFilename); err == nil {
+				return nil, fmt.Errorf("audit key missing")
+			}
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	f, err := os.Open(dir + auditFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := make([]*AuditRecord, 0, 100)
+	var (
+		seq uint64
+		mac []byte
+	)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		l := auditLine{}
+		err = json.Unmarshal(s.Bytes(), &l)
+		if err != nil {
+			return records, fmt.Errorf("audit line %v: %v", seq+1,
+				err)
+		}
+		if l.Seq != seq+1 {
+			return records, fmt.Errorf("audit line %v: sequence %v",
+				seq+1, l.Seq)
+		}
+		if !hmac.Equal(l.Mac, auditMac(key, mac, l.Seq, l.Payload)) {
+			return records, fmt.Errorf("audit line %v: chain broken",
+				l.Seq)
+		}
+		r := AuditRecord{}
+		err = openFromSelf(id, l.Payload, &r)
+		if err != nil {
+			return records, fmt.Errorf("audit line %v: %v", l.Seq,
+				err)
+		}
+		if r.Seq != l.Seq {
+			return records, fmt.Errorf("audit line %v: record "+
+				"sequence %v", l.Seq, r.Seq)
+		}
+		records = append(records, &r)
+		seq = l.Seq
+		mac = l.Mac
+	}
+	err = s.Err()
+	if err != nil {
+		return records, err
+	}
+
+	h, err := readAuditHead(dir, id)
+	if err != nil {
+		if os.IsNotExist(err) && seq == 0 {
+			return records, nil
+		}
+		return records, err
+	}
+	switch {
+	case h.Seq > seq:
+		return records, fmt.Errorf("audit log truncated: %v records, "+
+			"expected %v", seq, h.Seq)
+	case h.Seq < seq:
+		return records, fmt.Errorf("audit log has %v records not "+
+			"covered by head %v", seq-h.Seq, h.Seq)
+	case !bytes.Equal(h.Mac, mac):
+		return records, fmt.Errorf("audit head does not match log")
+	}
+
+	return records, nil
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/marcopeereboom/mcrypt"
+)
+
+// writeAudit logs four records about bob to the audit log in dir, across a
+// reopen to make sure the chain continues.
+func writeAudit(t *testing.T, dir string, id *mcrypt.Identity) {
+	bob, err := mcrypt.NewIdentity("Bob", "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		a, err := OpenAudit(dir, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = a.Log(AuditSession, &bob.PublicIdentity, "from %v", i)
+		if err == nil {
+			err = a.Log(AuditTrustAdd, &bob.PublicIdentity,
+				"Queued")
+		}
+		a.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id, err := mcrypt.NewIdentity("Alice", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing written yet
+	records, err := VerifyAudit(dir, id)
+	if err != nil || len(records) != 0 {
+		t.Fatalf("empty audit log: %v %v", records, err)
+	}
+
+	writeAudit(t, dir, id)
+	records, err = VerifyAudit(dir, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("got %v records", len(records))
+	}
+	if records[2].Event != AuditSession || records[2].Detail != "from 1" ||
+		records[2].Address != "bob@example.com" {
+		t.Fatalf("unexpected record %v", records[2])
+	}
+
+	// encrypted at rest
+	log, err := ioutil.ReadFile(dir + auditFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(log, []byte("bob@example.com")) {
+		t.Fatalf("audit log not encrypted")
+	}
+}
+
+func TestAuditTamper(t *testing.T) {
+	id, err := mcrypt.NewIdentity("Alice", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		edit   func(lines []string) []string
+		detail string // expected in the error
+	}{
+		{"removed line", func(l []string) []string {
+			return append(append([]string{}, l[:1]...), l[2:]...)
+		}, ""},
+		{"truncation", func(l []string) []string {
+			return l[:3]
+		}, "truncated"},
+		{"reordering", func(l []string) []string {
+			return append([]string{l[1], l[0]}, l[2:]...)
+		}, ""},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir(os.TempDir(), "audit")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		writeAudit(t, dir, id)
+		log, err := ioutil.ReadFile(dir + auditFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.SplitAfter(string(log), "\n")
+		edited := strings.Join(test.edit(lines), "")
+		err = ioutil.WriteFile(dir+auditFilename, []byte(edited), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = VerifyAudit(dir, id)
+		if err == nil || !strings.Contains(err.Error(), test.detail) {
+			t.Errorf("%v not detected: %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+const configFilename = "/config.json"
+
+// Quota limits what peers may store with us, 0 means unlimited.  Bytes and
+// Messages apply to all peers together.  PeerBytes and PeerMessages are
+// copied into the settings of new trust records where they can be changed
+// per peer, see QuotaBytes and QuotaMessages.
+type Quota struct {
+	Bytes        int64 `json:"bytes"`
+	Messages     int   `json:"messages"`
+	PeerBytes    int64 `json:"peerbytes"`
+	PeerMessages int   `json:"peermessages"`
+}
+
+// Config holds user settings, it is stored in plaintext in config.json and
+// may be edited by hand.  Retention applies to peers that do not have their
+// own, see RetentionDays and RetentionAction.
+type Config struct {
+	Quota     Quota     `json:"quota"`
+	Retention Retention `json:"retention"`
+}
+
+// DefaultConfig is used for settings that are not in config.json.  There are
+// no quotas unless the user sets them.
+var DefaultConfig = Config{
+	Retention: Retention{
+		Action: RetainDelete,
+	},
+}
+
+// LoadConfig reads config.json in the scomms directory dir.  A missing file
+// yields DefaultConfig.
+func LoadConfig(dir string) (*Config, error) {
+	cfg := DefaultConfig
+	j, err := ioutil.ReadFile(dir + configFilename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &cfg, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(j, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// SaveConfig writes cfg to config.json in the scomms directory dir.
+func SaveConfig(dir string, cfg *Config) error {
+	j, err := json.MarshalIndent(cfg, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dir+configFilename, append(j, '\n'))
+}
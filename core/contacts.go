@@ -0,0 +1,209 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Contact metadata in TrustRecord.FreeToUse, it is only kept locally.
+const (
+	Nickname = "Nickname" // name a contact is known by
+	Notes    = "Notes"    // free form
+	Tags     = "Tags"     // comma separated, see ParseTags
+)
+
+// TagPrefix addresses every allowed contact carrying a tag, e.g. "tag:ops",
+// when sending and filters on it when searching.
+const TagPrefix = "tag:"
+
+// ParseTags returns the lower case tags in a comma or space separated list,
+// sorted and without duplicates.  Tags consist of letters, digits, '-', '_'
+// and '.'.
+func ParseTags(s string) ([]string, error) {
+	seen := make(map[string]bool)
+	tags := make([]string, 0)
+	for _, t := range strings.FieldsFunc(strings.ToLower(s),
+		func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		for _, r := range t {
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) &&
+				!strings.ContainsRune("-_.", r) {
+				return nil, fmt.Errorf("invalid tag %v", t)
+			}
+		}
+		if !seen[t] {
+			seen[t] = true
+			tags = append(tags, t)
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// ContactTags returns the tags of a contact.
+func ContactTags(tr *TrustRecord) []string {
+	tags, err := ParseTags(tr.FreeToUse[Tags])
+	if err != nil {
+		return nil
+	}
+	return tags
+}
+
+// SetContact sets the nickname, notes and tags of a contact, empty values
+// are removed.
+func SetContact(tr *TrustRecord, nickname, notes string, tags []string) {
+	if tr.FreeToUse == nil {
+		tr.FreeToUse = make(map[string]string)
+	}
+	for k, v := range map[string]string{
+		Nickname: strings.TrimSpace(nickname),
+		Notes:    strings.TrimSpace(notes),
+		Tags:     strings.Join(tags, ","),
+	} {
+		if v == "" {
+			delete(tr.FreeToUse, k)
+		} else {
+			tr.FreeToUse[k] = v
+		}
+	}
+}
+
+// MatchTrust returns the trust records that match all words of text, ignoring
+// case.  A word matches if it is part of the name, address, nickname, notes
+// or tags of a record, tag:<tag> only matches records with that tag.  Empty
+// text matches all.  The result is sorted by address.
+func MatchTrust(trs []*TrustRecord, text string) []*TrustRecord {
+	words := strings.Fields(strings.ToLower(text))
+	found := make([]*TrustRecord, 0)
+	for _, tr := range trs {
+		if tr != nil && matchTrust(tr, words) {
+			found = append(found, tr)
+		}
+	}
+	sort.Slice(found, func(a, b int) bool {
+		return found[a].PublicIdentity.Address <
+			found[b].PublicIdentity.Address
+	})
+	return found
+}
+
+func matchTrust(tr *TrustRecord, words []string) bool {
+	tags := ContactTags(tr)
+	s := strings.ToLower(strings.Join([]string{
+		tr.PublicIdentity.Name,
+		tr.PublicIdentity.Address,
+		tr.FreeToUse[Nickname],
+		tr.FreeToUse[Notes],
+		strings.Join(tags, " "),
+	}, "\n"))
+	for _, w := range words {
+		if strings.HasPrefix(w, TagPrefix) {
+			i := sort.SearchStrings(tags, w[len(TagPrefix):])
+			if i == len(tags) || tags[i] != w[len(TagPrefix):] {
+				return false
+			}
+			continue
+		}
+		if !strings.Contains(s, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// Contacts returns the allowed trust records that match text, see
+// MatchTrust.
+func Contacts(trs []*TrustRecord, text string) []*TrustRecord {
+	found := make([]*TrustRecord, 0)
+	for _, tr := range MatchTrust(trs, text) {
+		if tr.State == StateAllowed {
+			found = append(found, tr)
+		}
+	}
+	return found
+}
+
+// Tagged returns the allowed contacts that carry tag.
+func Tagged(trs []*TrustRecord, tag string) []*TrustRecord {
+	return Contacts(trs, TagPrefix+strings.ToLower(tag))
+}
+
+// AllTags returns the tags of all allowed contacts, sorted.
+func AllTags(trs []*TrustRecord) []string {
+	seen := make(map[string]bool)
+	all := make([]string, 0)
+	for _, tr := range Contacts(trs, "") {
+		for _, t := range ContactTags(tr) {
+			if !seen[t] {
+				seen[t] = true
+				all = append(all, t)
+			}
+		}
+	}
+	sort.Strings(all)
+	return all
+}
+
+// SendTag returns the tag a recipient addresses, if any.
+func SendTag(to string) (string, bool) {
+	if !strings.HasPrefix(to, TagPrefix) {
+		return "", false
+	}
+	return strings.ToLower(to[len(TagPrefix):]), true
+}
+
+// Completions returns what a recipient entry offers for a contact: the
+// address and "name <address>" for its name and nickname.
+func Completions(tr *TrustRecord) []string {
+	pid := tr.PublicIdentity
+	c := []string{pid.Address}
+	for _, n := range []string{pid.Name, tr.FreeToUse[Nickname]} {
+		if n != "" {
+			c = append(c, fmt.Sprintf("%v <%v>", n, pid.Address))
+		}
+	}
+	return c
+}
+
+// RecipientAddress returns the address in a recipient entry, either a plain
+// address or "name <address>".
+func RecipientAddress(to string) string {
+	to = strings.TrimSpace(to)
+	if i := strings.LastIndex(to, "<"); i >= 0 && strings.HasSuffix(to, ">") {
+		return strings.TrimSpace(to[i+1 : len(to)-1])
+	}
+	return to
+}
+
+// IsContact returns true if address has an allowed trust record or is a tag
+// that allowed contacts carry.  Sending to anybody else dials a peer that may
+// not know us.
+func IsContact(trs []*TrustRecord, address string) bool {
+	if tag, ok := SendTag(address); ok {
+		return len(Tagged(trs, tag)) != 0
+	}
+	for _, tr := range trs {
+		if tr != nil && tr.State == StateAllowed &&
+			tr.PublicIdentity.Address == address {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/marcopeereboom/mcrypt"
+)
+
+func TestContacts(t *testing.T) {
+	tr := func(name, address, nick string, state int) *TrustRecord {
+		return &TrustRecord{
+			PublicIdentity: &mcrypt.PublicIdentity{
+				Name:    name,
+				Address: address,
+			},
+			State:     state,
+			FreeToUse: map[string]string{Nickname: nick},
+		}
+	}
+	trs := []*TrustRecord{
+		tr("Robert", "bob@example.com", "Bobby", StateAllowed),
+		tr("Alice", "alice@example.com", "", StateAllowed),
+		tr("Mallory", "mallory@example.com", "", StateDenied),
+		tr("Eve", "eve@example.com", "", StateQueued),
+		nil,
+	}
+
+	for _, test := range []struct {
+		text string
+		want []string
+	}{
+		{"", []string{"alice@example.com", "bob@example.com"}},
+		{"BOBBY", []string{"bob@example.com"}},
+		{"rob", []string{"bob@example.com"}},
+		{"example", []string{"alice@example.com", "bob@example.com"}},
+		{"mallory", nil},
+		{"eve", nil},
+	} {
+		found := Contacts(trs, test.text)
+		if len(found) != len(test.want) {
+			t.Errorf("%q: got %v want %v", test.text, len(found),
+				len(test.want))
+			continue
+		}
+		for i, f := range found {
+			if f.PublicIdentity.Address != test.want[i] {
+				t.Errorf("%q: got %v want %v", test.text,
+					f.PublicIdentity.Address, test.want[i])
+			}
+		}
+	}
+
+	c := Completions(trs[0])
+	if len(c) != 3 || c[0] != "bob@example.com" ||
+		c[1] != "Robert <bob@example.com>" ||
+		c[2] != "Bobby <bob@example.com>" {
+		t.Errorf("completions %v", c)
+	}
+	for _, s := range c {
+		if RecipientAddress(s) != "bob@example.com" {
+			t.Errorf("address %q", s)
+		}
+	}
+	if !IsContact(trs, "alice@example.com") ||
+		IsContact(trs, "mallory@example.com") ||
+		IsContact(trs, "carol@example.com") {
+		t.Error("IsContact")
+	}
+}
+
+func TestContactsTags(t *testing.T) {
+	tags, err := ParseTags("Vendor, ops ops,,eu-west")
+	if err != nil || strings.Join(tags, ",") != "eu-west,ops,vendor" {
+		t.Errorf("tags %v %v", tags, err)
+		return
+	}
+	_, err = ParseTags("ops, tag:x")
+	if err == nil {
+		t.Error("invalid tag should have tripped")
+		return
+	}
+
+	tr := func(address string, state int, nick, notes string,
+		tags ...string) *TrustRecord {
+		r := &TrustRecord{
+			PublicIdentity: &mcrypt.PublicIdentity{Address: address},
+			State:          state,
+		}
+		SetContact(r, nick, notes, tags)
+		return r
+	}
+	trs := []*TrustRecord{
+		tr("bob@example.com", StateAllowed, "bobby", "on call tuesdays",
+			"ops"),
+		tr("carol@example.com", StateAllowed, "", "", "ops", "vendor"),
+		tr("dave@example.com", StateDenied, "", "", "ops"),
+		tr("erin@example.com", StateAllowed, "", ""),
+	}
+	if _, ok := trs[3].FreeToUse[Tags]; ok || len(trs[3].FreeToUse) != 0 {
+		t.Errorf("empty values stored %v", trs[3].FreeToUse)
+		return
+	}
+
+	for _, test := range []struct {
+		text string
+		all  bool
+		want string
+	}{
+		{"tag:ops", true, "bob carol dave"},
+		{"tag:ops", false, "bob carol"},
+		{"tag:OPS tag:vendor", false, "carol"},
+		{"tag:op", false, ""},
+		{"tuesdays", false, "bob"},
+		{"vendor", false, "carol"},
+		{"", false, "bob carol erin"},
+	} {
+		var found []*TrustRecord
+		if test.all {
+			found = MatchTrust(trs, test.text)
+		} else {
+			found = Contacts(trs, test.text)
+		}
+		var got []string
+		for _, f := range found {
+			got = append(got, strings.Split(f.PublicIdentity.Address,
+				"@")[0])
+		}
+		if strings.Join(got, " ") != test.want {
+			t.Errorf("%q: got %v want %v", test.text, got, test.want)
+		}
+	}
+
+	if len(Tagged(trs, "Vendor")) != 1 ||
+		strings.Join(AllTags(trs), ",") != "ops,vendor" {
+		t.Errorf("tagged %v all %v", Tagged(trs, "vendor"), AllTags(trs))
+	}
+	tag, ok := SendTag("tag:Ops")
+	if !ok || tag != "ops" {
+		t.Errorf("send tag %v %v", tag, ok)
+	}
+	if _, ok := SendTag("bob@example.com"); ok {
+		t.Error("address is not a tag")
+	}
+	if !IsContact(trs, "tag:vendor") || IsContact(trs, "tag:nobody") {
+		t.Error("IsContact tag")
+	}
+}
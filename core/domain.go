@@ -0,0 +1,482 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marcopeereboom/mcrypt"
+)
+
+// hosted domain mode
+//
+// A domain host accepts sessions for every registered user of a domain.  The
+// host presents the registered public identity of the user that the client is
+// looking for and stores whatever is sent in a per-user mailbox.  Senders
+// encrypt content to the hosted user so the host never sees plaintext.
+// Mailboxes are limited like a local inbox, see Domain.Quota.
+//
+// Hosted users collect their mailbox by connecting to the host as a client.
+// The host proves that the client owns the hosted identity by sending it a
+// challenge that can only be decrypted with the hosted private key.  While
+// collecting, the hosted user pushes its trust decisions to the host which
+// keeps a trust database per user.
+
+const (
+	domainDir      = "/domain/"
+	domainRegistry = "users.json"
+)
+
+type HostedUser struct {
+	PublicIdentity *mcrypt.PublicIdentity
+	Registered     time.Time
+}
+
+// Content stored on behalf of a hosted user.
+type MailboxItem struct {
+	Id       string                 `json:"id"`
+	From     *mcrypt.PublicIdentity `json:"from"`
+	Filename string                 `json:"filename"`
+	Mime     string                 `json:"mime"`
+	Content  []byte                 `json:"content"` // sealed to hosted user
+	Received time.Time              `json:"received"`
+	Expires  time.Time              `json:"expires"` // host clock
+	ViewOnce bool                   `json:"viewonce"`
+
+	// seconds left until Expires when handed out, 0 for never
+	ExpireSeconds int64 `json:"expireseconds,omitempty"`
+
+	MessageId string `json:"messageid,omitempty"`
+	InReplyTo string `json:"inreplyto,omitempty"`
+}
+
+type Domain struct {
+	Name string
+
+	// limits per hosted user, PeerBytes and PeerMessages are defaults
+	// for senders without a setting of their own
+	Quota Quota
+
+	dir   string
+	mtx   sync.Mutex
+	users map[string]*HostedUser // keyed by address
+	trust map[string]*Trust      // keyed by address
+	usage map[string]*mailboxUsage
+}
+
+// mailboxUsage is what a mailbox holds so deliveries need not read it.
+type mailboxUsage struct {
+	items map[string]mailboxEntry // keyed by id
+}
+
+type mailboxEntry struct {
+	from string // sender address
+	size int64
+}
+
+func NewDomain(path, name string) (*Domain, error) {
+	if name == "" || strings.ContainsAny(name, "@/") {
+		return nil, fmt.Errorf("invalid domain %v", name)
+	}
+
+	d := Domain{
+		Name:  name,
+		dir:   path + domainDir,
+		users: make(map[string]*HostedUser),
+		trust: make(map[string]*Trust),
+		usage: make(map[string]*mailboxUsage),
+	}
+	err := os.MkdirAll(d.dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	j, err := ioutil.ReadFile(d.dir + domainRegistry)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &d, nil
+		}
+		return nil, err
+	}
+	var users []*HostedUser
+	err = json.Unmarshal(j, &users)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range users {
+		d.users[v.PublicIdentity.Address] = v
+	}
+
+	return &d, nil
+}
+
+func (d *Domain) Close() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	for k, v := range d.trust {
+		v.Close()
+		delete(d.trust, k)
+	}
+}
+
+// userDir returns the directory that holds a hosted user's state.  It is
+// derived from the public key so that addresses never end up in paths.
+func userDir(pid *mcrypt.PublicIdentity) string {
+	return hex.EncodeToString(pid.Key[:]) + "/"
+}
+
+// save writes the registry.  Must be called with the mutex held.
+func (d *Domain) save() error {
+	users := make([]*HostedUser, 0, len(d.users))
+	for _, v := range d.users {
+		users = append(users, v)
+	}
+	j, err := json.MarshalIndent(users, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// write new registry next to the old one and swap them
+	err = ioutil.WriteFile(d.dir+domainRegistry+".tmp", j, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(d.dir+domainRegistry+".tmp", d.dir+domainRegistry)
+}
+
+// Register adds a user to the domain.
+func (d *Domain) Register(pid *mcrypt.PublicIdentity) error {
+	if pid == nil || pid.Key == nil {
+		return fmt.Errorf("invalid public identity")
+	}
+	if !strings.HasSuffix(pid.Address, "@"+d.Name) {
+		return fmt.Errorf("%v is not part of domain %v", pid.Address,
+			d.Name)
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if _, ok := d.users[pid.Address]; ok {
+		return fmt.Errorf("%v already registered", pid.Address)
+	}
+	d.users[pid.Address] = &HostedUser{
+		PublicIdentity: pid,
+		Registered:     time.Now(),
+	}
+
+	return d.save()
+}
+
+// Unregister removes a user from the domain.  Mailbox and trust database are
+// left on disk.
+func (d *Domain) Unregister(address string) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if _, ok := d.users[address]; !ok {
+		return fmt.Errorf("unknown user %v", address)
+	}
+	if t, ok := d.trust[address]; ok {
+		t.Close()
+		delete(d.trust, address)
+	}
+	delete(d.users, address)
+
+	return d.save()
+}
+
+// Lookup returns the hosted user for address.
+func (d *Domain) Lookup(address string) (*HostedUser, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	hu, ok := d.users[address]
+	if !ok {
+		return nil, fmt.Errorf("unknown user %v", address)
+	}
+	return hu, nil
+}
+
+// Users returns all hosted users sorted by address.
+func (d *Domain) Users() []*HostedUser {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	users := make([]*HostedUser, 0, len(d.users))
+	for _, v := range d.users {
+		users = append(users, v)
+	}
+	sort.Sort(hostedUsers(users))
+
+	return users
+}
+
+type hostedUsers []*HostedUser
+
+func (h hostedUsers) Len() int      { return len(h) }
+func (h hostedUsers) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h hostedUsers) Less(i, j int) bool {
+	return h[i].PublicIdentity.Address < h[j].PublicIdentity.Address
+}
+
+// Trust returns the trust database of a hosted user.  Records are encrypted
+// with the identity of the domain host since it does not have access to the
+// hosted private keys.
+func (d *Domain) Trust(address string) (*Trust, error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	hu, ok := d.users[address]
+	if !ok {
+		return nil, fmt.Errorf("unknown user %v", address)
+	}
+	t, ok := d.trust[address]
+	if ok {
+		return t, nil
+	}
+	t, err := NewTrust(d.dir + userDir(hu.PublicIdentity))
+	if err != nil {
+		return nil, err
+	}
+	d.trust[address] = t
+
+	return t, nil
+}
+
+func (d *Domain) mailboxDir(hu *HostedUser) string {
+	return d.dir + userDir(hu.PublicIdentity) + "mailbox/"
+}
+
+// mailboxUsage returns the usage of a mailbox and reads it the first time.
+// Must be called with the mutex held.
+func (d *Domain) mailboxUsage(hu *HostedUser) (*mailboxUsage, error) {
+	u, ok := d.usage[hu.PublicIdentity.Address]
+	if ok {
+		return u, nil
+	}
+	u = &mailboxUsage{items: make(map[string]mailboxEntry)}
+	fis, err := ioutil.ReadDir(d.mailboxDir(hu))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, fi := range fis {
+		if strings.HasSuffix(fi.Name(), tmpExtension) {
+			continue // interrupted delivery
+		}
+		j, err := ioutil.ReadFile(d.mailboxDir(hu) + fi.Name())
+		if err != nil {
+			return nil, err
+		}
+		mi := MailboxItem{}
+		err = json.Unmarshal(j, &mi)
+		if err != nil {
+			return nil, err
+		}
+		from := ""
+		if mi.From != nil {
+			from = mi.From.Address
+		}
+		u.items[fi.Name()] = mailboxEntry{from: from,
+			size: int64(len(mi.Content))}
+	}
+	d.usage[hu.PublicIdentity.Address] = u
+	return u, nil
+}
+
+// check returns a QuotaError if size more bytes from sender do not fit.
+// peerBytes and peerMessages are the limits for sender.
+func (u *mailboxUsage) check(q *Quota, from string, size, peerBytes int64,
+	peerMessages int) error {
+	peer := QuotaUsage{MaxBytes: peerBytes, MaxMessages: peerMessages}
+	total := QuotaUsage{MaxBytes: q.Bytes, MaxMessages: q.Messages}
+	for _, v := range u.items {
+		if v.from == from {
+			peer.Bytes += v.size
+			peer.Messages++
+		}
+		total.Bytes += v.size
+		total.Messages++
+	}
+	return overQuota(&peer, &total, size)
+}
+
+// forget drops a removed item from the usage of a hosted user.  Must be
+// called with the mutex held.
+func (d *Domain) forget(address, id string) {
+	if u, ok := d.usage[address]; ok {
+		delete(u.items, id)
+	}
+}
+
+// Deliver stores sealed content in the mailbox of a hosted user.  The
+// mailbox is limited by Quota, tr is the hosted user's record of the sender
+// and may carry limits of its own.
+func (d *Domain) Deliver(address string, from *mcrypt.PublicIdentity,
+	tr *TrustRecord, rsf *RpcSendFile) error {
+
+	if !rsf.Sealed {
+		return fmt.Errorf("content for hosted user is not sealed")
+	}
+	hu, err := d.Lookup(address)
+	if err != nil {
+		return err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	u, err := d.mailboxUsage(hu)
+	if err != nil {
+		return err
+	}
+	peerBytes, peerMessages := peerQuota(tr, &d.Quota)
+	err = u.check(&d.Quota, from.Address, int64(len(rsf.Content)),
+		peerBytes, peerMessages)
+	if err != nil {
+		return err
+	}
+
+	dir := d.mailboxDir(hu)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	mi := MailboxItem{
+		Id:        hex.EncodeToString(id),
+		From:      from,
+		Filename:  rsf.Filename,
+		Mime:      rsf.Mime,
+		Content:   rsf.Content,
+		Received:  now,
+		Expires:   expiresAt(now, rsf.ExpireSeconds),
+		ViewOnce:  rsf.ViewOnce,
+		MessageId: rsf.MessageId,
+		InReplyTo: rsf.InReplyTo,
+	}
+	j, err := json.Marshal(mi)
+	if err != nil {
+		return err
+	}
+	if !fitsFrame(len(j)) {
+		return fmt.Errorf("content too large: %v", len(rsf.Content))
+	}
+	err = writeFileAtomic(dir+mi.Id, j)
+	if err != nil {
+		return err
+	}
+	u.items[mi.Id] = mailboxEntry{from: from.Address,
+		size: int64(len(mi.Content))}
+
+	return nil
+}
+
+// Mailbox returns all items that are waiting for a hosted user.
+func (d *Domain) Mailbox(address string) ([]*MailboxItem, error) {
+	hu, err := d.Lookup(address)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	fis, err := ioutil.ReadDir(d.mailboxDir(hu))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	items := make([]*MailboxItem, 0, len(fis))
+	now := time.Now()
+	for _, fi := range fis {
+		if strings.HasSuffix(fi.Name(), tmpExtension) {
+			continue
+		}
+		filename := d.mailboxDir(hu) + fi.Name()
+		j, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		mi := MailboxItem{}
+		err = json.Unmarshal(j, &mi)
+		if err != nil {
+			return nil, err
+		}
+
+		// expired before it was collected
+		if !mi.Expires.IsZero() {
+			left := mi.Expires.Sub(now)
+			if left < time.Second {
+				err = secureRemove(filename)
+				if err != nil {
+					return nil, err
+				}
+				d.forget(address, fi.Name())
+				continue
+			}
+			mi.ExpireSeconds = int64(left / time.Second)
+		}
+		items = append(items, &mi)
+	}
+
+	return items, nil
+}
+
+// Remove deletes an item from the mailbox of a hosted user.
+func (d *Domain) Remove(address, id string) error {
+	hu, err := d.Lookup(address)
+	if err != nil {
+		return err
+	}
+
+	// ids are generated by us, reject anything else
+	_, err = hex.DecodeString(id)
+	if err != nil || len(id) != 32 {
+		return fmt.Errorf("invalid mailbox id %v", id)
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	err = secureRemove(d.mailboxDir(hu) + id)
+	if err != nil {
+		return err
+	}
+	d.forget(address, id)
+
+	return nil
+}
@@ -0,0 +1,269 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/marcopeereboom/mcrypt"
+)
+
+// openDomain opens example.com in a new directory with carol registered.
+// The caller removes the directory.
+func openDomain(t *testing.T) (string, *Domain, *mcrypt.Identity) {
+	dir, err := ioutil.TempDir(os.TempDir(), "domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDomain(dir, "example.com")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	carol, err := mcrypt.NewIdentity("Carol", "carol@example.com")
+	if err == nil {
+		err = d.Register(&carol.PublicIdentity)
+	}
+	if err != nil {
+		d.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir, d, carol
+}
+
+func TestDomainRegister(t *testing.T) {
+	dir, d, carol := openDomain(t)
+	defer os.RemoveAll(dir)
+	defer func() { d.Close() }()
+
+	dave, err := mcrypt.NewIdentity("Dave", "dave@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Register(&carol.PublicIdentity)
+	if err == nil {
+		t.Fatal("dup should have tripped")
+	}
+	err = d.Register(&dave.PublicIdentity)
+	if err == nil {
+		t.Fatal("foreign domain should have tripped")
+	}
+
+	// registry must survive a reopen
+	d.Close()
+	d, err = NewDomain(dir, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hu, err := d.Lookup("carol@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *hu.PublicIdentity.Key != *carol.PublicIdentity.Key {
+		t.Fatal("wrong public identity")
+	}
+}
+
+func TestDomainMailbox(t *testing.T) {
+	dir, d, _ := openDomain(t)
+	defer os.RemoveAll(dir)
+	defer d.Close()
+
+	dave, err := mcrypt.NewIdentity("Dave", "dave@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsf := &RpcSendFile{
+		Filename: "moo",
+		Content:  []byte("meh"),
+	}
+
+	// unsealed content must be rejected
+	err = d.Deliver("carol@example.com", &dave.PublicIdentity, nil, rsf)
+	if err == nil {
+		t.Fatal("unsealed content should have tripped")
+	}
+
+	rsf.Sealed = true
+	err = d.Deliver("carol@example.com", &dave.PublicIdentity, nil, rsf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// what an interrupted delivery leaves behind is not an item
+	hu, err := d.Lookup("carol@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(d.mailboxDir(hu)+"partial"+tmpExtension,
+		[]byte("{"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := d.Mailbox("carol@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Filename != "moo" {
+		t.Fatalf("unexpected mailbox %v", items)
+	}
+
+	err = d.Remove("carol@example.com", "../../users.json")
+	if err == nil {
+		t.Fatal("invalid id should have tripped")
+	}
+	err = d.Remove("carol@example.com", items[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err = d.Mailbox("carol@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 0 {
+		t.Fatalf("mailbox not empty %v", items)
+	}
+}
+
+func TestDomainExpire(t *testing.T) {
+	dir, d, _ := openDomain(t)
+	defer os.RemoveAll(dir)
+	defer d.Close()
+
+	dave, err := mcrypt.NewIdentity("Dave", "dave@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// expired before collection
+	rsf := &RpcSendFile{
+		Filename:      "short",
+		Content:       []byte("meh"),
+		Sealed:        true,
+		ExpireSeconds: 1,
+	}
+	err = d.Deliver("carol@example.com", &dave.PublicIdentity, nil, rsf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsf.Filename = "long"
+	rsf.ExpireSeconds = 3600
+	rsf.ViewOnce = true
+	err = d.Deliver("carol@example.com", &dave.PublicIdentity, nil, rsf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := d.Mailbox("carol@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Filename != "long" ||
+		!items[0].ViewOnce || items[0].ExpireSeconds <= 3590 ||
+		items[0].ExpireSeconds > 3600 {
+		t.Fatalf("unexpected mailbox %v", items)
+	}
+}
+
+func TestDomainQuota(t *testing.T) {
+	dir, d, _ := openDomain(t)
+	defer os.RemoveAll(dir)
+	defer func() { d.Close() }()
+
+	d.Quota = Quota{Bytes: 30, Messages: 3, PeerBytes: 20,
+		PeerMessages: 2}
+	dave, err := mcrypt.NewIdentity("Dave", "dave@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	erin, err := mcrypt.NewIdentity("Erin", "erin@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliver := func(from *mcrypt.Identity, tr *TrustRecord,
+		content string) error {
+		return d.Deliver("carol@example.com", &from.PublicIdentity, tr,
+			&RpcSendFile{Content: []byte(content), Sealed: true})
+	}
+
+	err = deliver(dave, nil, "0123456789")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = deliver(dave, nil, "01234567890")
+	if qe, ok := err.(*QuotaError); !ok || qe.What != "bytes" || qe.All {
+		t.Errorf("expected peer bytes error, got %v", err)
+	}
+	err = deliver(dave, nil, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = deliver(dave, nil, "")
+	if qe, ok := err.(*QuotaError); !ok || qe.What != "messages" {
+		t.Errorf("expected peer messages error, got %v", err)
+	}
+	err = deliver(erin, nil, "01234567890123456789")
+	if qe, ok := err.(*QuotaError); !ok || !qe.All {
+		t.Errorf("expected global bytes error, got %v", err)
+	}
+
+	// the hosted user's record of the sender wins
+	tr := &TrustRecord{FreeToUse: map[string]string{QuotaMessages: "0",
+		QuotaBytes: "0"}}
+	err = deliver(dave, tr, "y")
+	if err != nil {
+		t.Errorf("peer setting ignored: %v", err)
+	}
+
+	// content larger than a frame is never stored
+	d.Quota = Quota{}
+	err = deliver(erin, nil, string(make([]byte, 6*1024*1024)))
+	if err == nil {
+		t.Errorf("oversized content stored")
+	}
+
+	// collected items free their space, also after a restart
+	items, err := d.Mailbox("carol@example.com")
+	if err != nil || len(items) != 3 {
+		t.Fatalf("mailbox %v %v", len(items), err)
+	}
+	for _, v := range items {
+		err = d.Remove("carol@example.com", v.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Quota.PeerMessages = 1
+	err = deliver(dave, nil, "z")
+	if err != nil {
+		t.Errorf("removed items still counted: %v", err)
+	}
+	d.Close()
+	d, err = NewDomain(dir, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Quota.PeerMessages = 1
+	err = deliver(dave, nil, "z")
+	if qe, ok := err.(*QuotaError); !ok || qe.What != "messages" {
+		t.Errorf("usage lost on restart, got %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Messages can be sent with an expiry; either a duration after which the
+// receiver deletes them or view once, in which case the receiver deletes them
+// once they were shown.  Durations are sent in seconds and are relative to
+// receipt so that clocks do not need to agree.
+
+const (
+	sweepInterval = time.Minute // how often expired messages are removed
+	ExpireOnce    = "once"
+)
+
+// ParseExpiry parses a user supplied expiry: empty for none, "once" for view
+// once or a duration like 90m, 12h or 7d.
+func ParseExpiry(s string) (time.Duration, bool, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	switch {
+	case s == "":
+		return 0, false, nil
+	case s == ExpireOnce:
+		return 0, true, nil
+	case strings.HasSuffix(s, "d"):
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days <= 0 {
+			return 0, false, fmt.Errorf("invalid expiry %v", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, false, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < time.Second {
+		return 0, false, fmt.Errorf("invalid expiry %v", s)
+	}
+	return d, false, nil
+}
+
+// expiresAt returns when content received at t expires, zero for never.
+func expiresAt(t time.Time, seconds int64) time.Time {
+	if seconds <= 0 {
+		return time.Time{}
+	}
+	return t.Add(time.Duration(seconds) * time.Second)
+}
+
+// Expired reports whether the item must no longer be shown.
+func (i *InboxItem) Expired(now time.Time) bool {
+	return !i.Expires.IsZero() && !now.Before(i.Expires)
+}
+
+// Expired reports whether the entry must no longer be shown.
+func (se *SpoolEntry) Expired(now time.Time) bool {
+	return !se.Meta.Expires.IsZero() && !now.Before(se.Meta.Expires)
+}
+
+// sweeper removes expired messages and applies retention until core exits.
+func (c *Core) sweeper() {
+	for {
+		time.Sleep(sweepInterval)
+		c.sweep()
+	}
+}
+
+// sweep deletes expired messages including sent copies, applies retention
+// policies, keeps the search index current and drops index entries and
+// exports whose content was removed behind our back, e.g. a view once message
+// read with an older version of the CLI.
+func (c *Core) sweep() {
+	// the trust tab shows usage, only render it when that changed
+	before, _, err := c.inbox.Usage(c.identity)
+	if err != nil {
+		c.debugCore("sweep: %v", err)
+	}
+
+	c.mtxSpool.Lock()
+	err = c.inbox.Sync(c.identity)
+	c.mtxSpool.Unlock()
+	if err != nil {
+		c.debugCore("sweep: %v", err)
+	}
+	items, err := c.inbox.List(c.identity)
+	if err != nil {
+		c.debugCore("sweep: %v", err)
+		return
+	}
+	now := time.Now()
+	kept := make([]*InboxItem, 0, len(items))
+	for _, v := range items {
+		if !v.Expired(now) {
+			kept = append(kept, v)
+			continue
+		}
+		err = c.inboxDelete(v.Id)
+		if err != nil {
+			c.debugCore("sweep: %v %v", v.Id, err)
+			continue
+		}
+		c.debugCore("sweep: expired %v", v.Id)
+	}
+	c.sentSweep(now)
+	err = exportSweep(c.scommsDir)
+	if err != nil {
+		c.debugCore("sweep: %v", err)
+	}
+	c.searchSync(kept)
+	c.retain(kept, now)
+	c.renderInbox()
+
+	after, _, err := c.inbox.Usage(c.identity)
+	if err != nil || !reflect.DeepEqual(before, after) {
+		c.renderTrust()
+	}
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/marcopeereboom/mcrypt"
+)
+
+func TestExpireParse(t *testing.T) {
+	tests := []struct {
+		s    string
+		d    time.Duration
+		once bool
+		fail bool
+	}{
+		{s: ""},
+		{s: "once", once: true},
+		{s: " Once ", once: true},
+		{s: "90m", d: 90 * time.Minute},
+		{s: "7d", d: 7 * 24 * time.Hour},
+		{s: "0d", fail: true},
+		{s: "-1h", fail: true},
+		{s: "10ms", fail: true},
+		{s: "soon", fail: true},
+	}
+	for _, v := range tests {
+		d, once, err := ParseExpiry(v.s)
+		if v.fail {
+			if err == nil {
+				t.Errorf("%q should have tripped", v.s)
+			}
+			continue
+		}
+		if err != nil || d != v.d || once != v.once {
+			t.Errorf("%q: %v %v %v", v.s, d, once, err)
+		}
+	}
+
+	now := time.Now()
+	if !expiresAt(now, 0).IsZero() {
+		t.Error("0 seconds must not expire")
+	}
+	item := &InboxItem{Expires: expiresAt(now, 60)}
+	if item.Expired(now) || !item.Expired(now.Add(time.Minute)) {
+		t.Errorf("unexpected expiry %v", item.Expires)
+	}
+}
+
+// spoolExpiring spools kept, which expires in an hour, once, which is view
+// once, and gone, which has expired, and returns their spool ids.
+func spoolExpiring(t *testing.T, dir string, id *mcrypt.Identity,
+	now time.Time) (string, string, string) {
+
+	write := func(filename string, meta *MetaRecord) string {
+		meta.Created = now
+		meta.From = "bob@example.com"
+		meta.Filename = filename
+		spoolId, err := spoolWrite(dir, id, meta,
+			bytes.NewReader([]byte(filename)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return spoolId
+	}
+	return write("kept", &MetaRecord{Expires: now.Add(time.Hour)}),
+		write("once", &MetaRecord{ViewOnce: true}),
+		write("gone", &MetaRecord{Expires: now.Add(-time.Second)})
+}
+
+func TestExpireSpool(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "expire")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id, err := mcrypt.NewIdentity("Alice", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Core{scommsDir: dir, identity: id}
+	c.inbox, err = NewInbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.inbox.Close()
+
+	now := time.Now()
+	kept, once, gone := spoolExpiring(t, dir, id, now)
+
+	// frontends may only read content that is neither
+	f, err := c.SpoolOpen(kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	for _, v := range []string{once, gone} {
+		_, err = c.SpoolOpen(v)
+		if err == nil {
+			t.Errorf("%v should not open", v)
+		}
+		_, err = c.SpoolExport(v)
+		if err == nil {
+			t.Errorf("%v should not export", v)
+		}
+	}
+
+	// sync picks up the expiry
+	err = c.inbox.Sync(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := c.inbox.List(id)
+	if err != nil || len(items) != 3 {
+		t.Fatalf("unexpected items %v %v", items, err)
+	}
+	for _, v := range items {
+		switch v.Id {
+		case kept:
+			if v.Expired(now) || v.ViewOnce {
+				t.Errorf("kept %v", v)
+			}
+		case once:
+			if v.Expired(now) || !v.ViewOnce {
+				t.Errorf("once %v", v)
+			}
+		case gone:
+			if !v.Expired(now) {
+				t.Errorf("gone %v", v)
+			}
+		}
+	}
+}
+
+func TestExpireRemove(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "expire")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id, err := mcrypt.NewIdentity("Alice", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := dir + "/secret"
+	err = ioutil.WriteFile(filename, bytes.Repeat([]byte{'x'}, 100000),
+		0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = secureRemove(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("%v not removed: %v", filename, err)
+	}
+
+	// spool entries are removed the same way
+	_, once, _ := spoolExpiring(t, dir, id, time.Now())
+	_, err = spoolDelete(dir, id, once)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SpoolGet(dir, id, once)
+	if err == nil {
+		t.Errorf("%v still there", once)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/marcopeereboom/mcrypt"
+)
+
+// openForget returns a trust database in a new directory in which alice
+// allowed bob and carol.  The caller closes the database and removes the
+// directory.
+func openForget(t *testing.T) (string, *Trust, *mcrypt.Identity,
+	[]*mcrypt.Identity) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "forget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trust, err := NewTrust(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	alice, err := mcrypt.NewIdentity("Alice", "alice@example.com")
+	if err != nil {
+		trust.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	peers := make([]*mcrypt.Identity, 0, 2)
+	for _, a := range []string{"bob@example.com", "carol@example.com"} {
+		id, err := mcrypt.NewIdentity(a, a)
+		if err == nil {
+			err = trust.Add(alice, &id.PublicIdentity, StateAllowed,
+				map[string]string{Nickname: a}, false)
+		}
+		if err != nil {
+			trust.Close()
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+		peers = append(peers, id)
+	}
+	return dir, trust, alice, peers
+}
+
+func TestForgetDelete(t *testing.T) {
+	dir, trust, alice, peers := openForget(t)
+	defer os.RemoveAll(dir)
+	defer trust.Close()
+
+	bob := &peers[0].PublicIdentity
+	err := trust.Delete(alice, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = trust.Get(alice, bob)
+	if err == nil {
+		t.Fatal("deleted record still there")
+	}
+	err = trust.Delete(alice, bob)
+	if err == nil {
+		t.Fatal("deleting twice should have tripped")
+	}
+
+	// unknown again
+	err = trust.Add(alice, bob, StateQueued, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForgetTombstone(t *testing.T) {
+	dir, trust, alice, peers := openForget(t)
+	defer os.RemoveAll(dir)
+	defer trust.Close()
+
+	carol := &peers[1].PublicIdentity
+	err := trust.Forget(alice, carol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := trust.Get(alice, carol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := tr.PublicIdentity
+	if tr.State != StateDenied || tr.FreeToUse[Tombstone] == "" ||
+		len(tr.FreeToUse) != 1 || pid.Name != "" ||
+		pid.Address != carol.Address || *pid.Key != *carol.Key ||
+		pid.Signature != nil || len(pid.Identifiers) != 0 {
+		t.Fatalf("unexpected tombstone %+v %+v", tr, pid)
+	}
+
+	// the key comes back and can not be added as new
+	err = trust.Add(alice, carol, StateQueued, nil, false)
+	if err == nil {
+		t.Fatal("forgotten key should have tripped")
+	}
+	trs, err := trust.GetAll(alice)
+	if err != nil || len(trs) != 2 {
+		t.Fatalf("records %v %v", len(trs), err)
+	}
+
+	err = trust.Forget(alice, &alice.PublicIdentity)
+	if err == nil {
+		t.Error("forgetting an unknown key should have tripped")
+	}
+}
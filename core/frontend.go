@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"github.com/marcopeereboom/mcrypt"
+)
+
+// Frontend protocol
+//
+// A user interface talks to core through two message streams.
+//
+// Commands, sent with Core.SendCore:
+//	UiReady				UI is up; core answers with identity and trust
+//	SendFile			send a file to a remote identity
+//	UpdateTrustRecord		change a trust record
+//	TrustDelete			delete or forget a trust record
+//	TrustHistoryView		ask for the versions of a trust record
+//	TrustRevert			go back to a version of a trust record
+//	FetchMailbox			collect messages from our domain host
+//	AuditView			ask for the audit log
+//	InboxOpen			open an inbox item
+//	InboxSearch			search the inbox
+//	MailExport			export to a Maildir or mbox
+//	HistoryView			ask for the conversation with a peer
+//	InboxMark			set inbox item flags
+//	InboxDelete			delete an inbox item
+//	UiConfirmIdentityReply		answer to UiConfirmIdentity
+//	UiConfirmPublicIdentityReply	answer to UiConfirmPublicIdentity
+//	UiKeyChangeReply		answer to UiKeyChange
+//	Shutdown			stop core; core answers with Exit
+//
+// Events, delivered to the Frontend methods by Core.Run or Dispatch:
+//	UiRenderIdentity, UiConfirmIdentity, UiPopup, UiConfirmPublicIdentity,
+//	UiRenderTrust, UiSendProgress, UiSendFileResult, UiNewMessage,
+//	UiRenderAudit, UiRenderInbox, UiInboxItem, UiSearchResult,
+//	UiRenderHistory, UiRenderTrustHistory and UiKeyChange.
+//
+// Prompts (UiConfirmIdentity, UiConfirmPublicIdentity and UiKeyChange) carry
+// an Id that the reply must carry as well.  Every prompt must be answered
+// exactly once; core drops replies to prompts it does not know or that were
+// already answered.  Prompt methods must not block on the user since core
+// keeps sending events while a prompt is open.
+
+// PromptId correlates a prompt with its reply.  Ids are not reused while
+// core runs.
+type PromptId uint64
+
+// Frontend is what every user interface implements.
+type Frontend interface {
+	RenderIdentity(*UiRenderIdentity)
+	ConfirmIdentity(*UiConfirmIdentity)
+	Popup(*UiPopup)
+	ConfirmPublicIdentity(*UiConfirmPublicIdentity)
+	RenderTrust(*UiRenderTrust)
+	SendProgress(*UiSendProgress)
+	SendFileResult(*UiSendFileResult)
+	NewMessage(*UiNewMessage)
+	RenderAudit(*UiRenderAudit)
+	RenderInbox(*UiRenderInbox)
+	InboxItem(*UiInboxItem)
+	SearchResult(*UiSearchResult)
+	RenderHistory(*UiRenderHistory)
+	RenderTrustHistory(*UiRenderTrustHistory)
+	KeyChange(*UiKeyChange)
+}
+
+// Dispatch calls the Frontend method for core to UI message m.  It returns
+// false if m is not an event, e.g. Exit.
+func Dispatch(f Frontend, m interface{}) bool {
+	switch msg := m.(type) {
+	case *UiRenderIdentity:
+		f.RenderIdentity(msg)
+	case *UiConfirmIdentity:
+		f.ConfirmIdentity(msg)
+	case *UiPopup:
+		f.Popup(msg)
+	case *UiConfirmPublicIdentity:
+		f.ConfirmPublicIdentity(msg)
+	case *UiRenderTrust:
+		f.RenderTrust(msg)
+	case *UiSendProgress:
+		f.SendProgress(msg)
+	case *UiSendFileResult:
+		f.SendFileResult(msg)
+	case *UiNewMessage:
+		f.NewMessage(msg)
+	case *UiRenderAudit:
+		f.RenderAudit(msg)
+	case *UiRenderInbox:
+		f.RenderInbox(msg)
+	case *UiInboxItem:
+		f.InboxItem(msg)
+	case *UiSearchResult:
+		f.SearchResult(msg)
+	case *UiRenderHistory:
+		f.RenderHistory(msg)
+	case *UiRenderTrustHistory:
+		f.RenderTrustHistory(msg)
+	case *UiKeyChange:
+		f.KeyChange(msg)
+	default:
+		return false
+	}
+	return true
+}
+
+// Run tells core that f is ready and delivers events to f until core exits.
+func (c *Core) Run(f Frontend) error {
+	err := c.SendCore(&UiReady{})
+	if err != nil {
+		return err
+	}
+
+	for {
+		m, err := c.ReceiveUi()
+		if err != nil {
+			return err
+		}
+		c.DebugUi("received %T\n", m.Message)
+		if _, ok := m.Message.(*Exit); ok {
+			return nil
+		}
+		if !Dispatch(f, m.Message) {
+			c.DebugUi("unhandled message %T\n", m.Message)
+		}
+	}
+}
+
+// prompt is an open question to the UI.
+type prompt struct {
+	pid      *mcrypt.PublicIdentity // nil when confirming our identity
+	previous *TrustRecord           // set on key changes
+	host     string                 // address contacted on key changes
+	callback func(error)
+}
+
+// addPrompt registers a prompt and returns its id.
+func (c *Core) addPrompt(p *prompt) PromptId {
+	c.mtxPrompts.Lock()
+	defer c.mtxPrompts.Unlock()
+
+	c.promptId++
+	c.prompts[c.promptId] = p
+	return c.promptId
+}
+
+// takePrompt removes and returns an open identity or public identity
+// prompt, nil if there is none of the expected kind.
+func (c *Core) takePrompt(id PromptId, public bool) *prompt {
+	return c.takePromptIf(id, func(p *prompt) bool {
+		return (p.pid != nil) == public && p.previous == nil
+	})
+}
+
+// keyChangePending returns true if a key change to pid is waiting for an
+// answer.
+func (c *Core) keyChangePending(pid *mcrypt.PublicIdentity) bool {
+	c.mtxPrompts.Lock()
+	defer c.mtxPrompts.Unlock()
+
+	for _, p := range c.prompts {
+		if p.previous != nil && *p.pid.Key == *pid.Key {
+			return true
+		}
+	}
+	return false
+}
+
+// takeKeyChange removes and returns an open key change prompt.
+func (c *Core) takeKeyChange(id PromptId) *prompt {
+	return c.takePromptIf(id, func(p *prompt) bool {
+		return p.previous != nil
+	})
+}
+
+func (c *Core) takePromptIf(id PromptId, kind func(*prompt) bool) *prompt {
+	c.mtxPrompts.Lock()
+	defer c.mtxPrompts.Unlock()
+
+	p, ok := c.prompts[id]
+	if !ok || !kind(p) {
+		return nil
+	}
+	delete(c.prompts, id)
+	return p
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	stdlog "log"
+	"testing"
+
+	"github.com/marcopeereboom/dbglog"
+	"github.com/marcopeereboom/mcrypt"
+)
+
+// fakeFrontend records the events it was handed.
+type fakeFrontend struct {
+	events []string
+}
+
+func (f *fakeFrontend) record(m interface{}) {
+	f.events = append(f.events, fmt.Sprintf("%T", m))
+}
+
+func (f *fakeFrontend) RenderIdentity(m *UiRenderIdentity)               { f.record(m) }
+func (f *fakeFrontend) ConfirmIdentity(m *UiConfirmIdentity)             { f.record(m) }
+func (f *fakeFrontend) Popup(m *UiPopup)                                 { f.record(m) }
+func (f *fakeFrontend) ConfirmPublicIdentity(m *UiConfirmPublicIdentity) { f.record(m) }
+func (f *fakeFrontend) RenderTrust(m *UiRenderTrust)                     { f.record(m) }
+func (f *fakeFrontend) SendProgress(m *UiSendProgress)                   { f.record(m) }
+func (f *fakeFrontend) SendFileResult(m *UiSendFileResult)               { f.record(m) }
+func (f *fakeFrontend) NewMessage(m *UiNewMessage)                       { f.record(m) }
+func (f *fakeFrontend) RenderAudit(m *UiRenderAudit)                     { f.record(m) }
+func (f *fakeFrontend) RenderInbox(m *UiRenderInbox)                     { f.record(m) }
+func (f *fakeFrontend) InboxItem(m *UiInboxItem)                         { f.record(m) }
+func (f *fakeFrontend) SearchResult(m *UiSearchResult)                   { f.record(m) }
+func (f *fakeFrontend) RenderHistory(m *UiRenderHistory)                 { f.record(m) }
+func (f *fakeFrontend) RenderTrustHistory(m *UiRenderTrustHistory)       { f.record(m) }
+func (f *fakeFrontend) KeyChange(m *UiKeyChange)                         { f.record(m) }
+
+// promptCore returns a core that only knows how to prompt and an identity
+// to prompt about.
+func promptCore(t *testing.T) (*Core, *mcrypt.Identity) {
+	c := &Core{
+		DbgLogger: dbglog.New(ioutil.Discard, "", stdlog.LstdFlags),
+		prompts:   make(map[PromptId]*prompt),
+	}
+	pid, err := mcrypt.NewIdentity("Alice", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, pid
+}
+
+func TestDispatch(t *testing.T) {
+	f := &fakeFrontend{}
+	events := []interface{}{
+		&UiRenderIdentity{},
+		&UiConfirmIdentity{},
+		&UiPopup{},
+		&UiConfirmPublicIdentity{},
+		&UiRenderTrust{},
+		&UiSendProgress{},
+		&UiSendFileResult{},
+		&UiNewMessage{},
+		&UiRenderAudit{},
+		&UiRenderInbox{},
+		&UiInboxItem{},
+		&UiSearchResult{},
+		&UiRenderHistory{},
+		&UiRenderTrustHistory{},
+		&UiKeyChange{},
+	}
+	for _, v := range events {
+		if !Dispatch(f, v) {
+			t.Errorf("not dispatched %T", v)
+		}
+	}
+	for i, v := range events {
+		if f.events[i] != fmt.Sprintf("%T", v) {
+			t.Errorf("got %v, want %T", f.events[i], v)
+		}
+	}
+
+	if Dispatch(f, &Exit{}) {
+		t.Errorf("Exit dispatched")
+	}
+}
+
+func TestPrompt(t *testing.T) {
+	c, pid := promptCore(t)
+
+	identity := c.addPrompt(&prompt{})
+	public := c.addPrompt(&prompt{pid: &pid.PublicIdentity})
+	if identity == public {
+		t.Errorf("prompt id reused")
+		return
+	}
+
+	// wrong kind must not consume the prompt
+	if c.takePrompt(identity, true) != nil {
+		t.Errorf("took identity prompt as public identity prompt")
+		return
+	}
+	if c.takePrompt(identity, false) == nil {
+		t.Errorf("identity prompt not found")
+		return
+	}
+	if c.takePrompt(identity, false) != nil {
+		t.Errorf("identity prompt answered twice")
+		return
+	}
+	if c.takePrompt(public, true) == nil {
+		t.Errorf("public identity prompt not found")
+		return
+	}
+}
+
+func TestPromptCancel(t *testing.T) {
+	c, pid := promptCore(t)
+
+	var got []error
+	id := c.addPrompt(&prompt{
+		pid: &pid.PublicIdentity,
+		callback: func(err error) {
+			got = append(got, err)
+		},
+	})
+
+	// unknown id is dropped
+	c.handleUiConfirmPublicIdentityReply(
+		&UiConfirmPublicIdentityReply{Id: id + 1})
+	if len(got) != 0 {
+		t.Errorf("unknown prompt answered")
+		return
+	}
+
+	c.handleUiConfirmPublicIdentityReply(
+		&UiConfirmPublicIdentityReply{Id: id, State: StateInvalid})
+	c.handleUiConfirmPublicIdentityReply(
+		&UiConfirmPublicIdentityReply{Id: id, State: StateInvalid})
+	if len(got) != 1 || got[0] != errVerifyCanceled {
+		t.Errorf("unexpected callbacks %v", got)
+		return
+	}
+}
@@ -0,0 +1,602 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/marcopeereboom/mcrypt"
+)
+
+const (
+	challengeSize = 32
+
+	// domain host public identity, pinned on the first collection
+	hostFilename = "/host.pid"
+
+	// first part of every challenge plaintext
+	challengePrefix = "scomms challenge v1\x00"
+)
+
+// Challenges
+//
+// A challenge is sealed to the key that must be proven and reads
+// challengePrefix, the hash of both session keys and a random nonce.  Only
+// the nonce is sent back, and only when the rest matches the session the
+// challenge arrived on.  Answering therefore never decrypts anything for a
+// peer that was not sealed as a challenge for that very session.
+
+// challengeBinding returns what ties a challenge to s: a hash of the session
+// keys, server first.
+func (s *Session) challengeBinding() []byte {
+	server, client := s.sid.PublicIdentity.Key, s.speer.Key
+	if !s.server {
+		server, client = client, server
+	}
+	h := sha256.New()
+	h.Write([]byte(challengePrefix))
+	h.Write(server[:])
+	h.Write(client[:])
+	return append([]byte(challengePrefix), h.Sum(nil)...)
+}
+
+// newChallenge seals a challenge from id to the key to for this session and
+// returns it with the nonce the reply must carry.
+func (s *Session) newChallenge(id *mcrypt.Identity,
+	to *mcrypt.PublicIdentity) (*RpcChallenge, []byte, error) {
+	nonce := make([]byte, challengeSize)
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, err := id.Encrypt(to.Key, append(s.challengeBinding(), nonce...))
+	if err != nil {
+		return nil, nil, err
+	}
+	rc := RpcChallenge{
+		Server: &id.PublicIdentity,
+	}
+	rc.Challenge, err = msg.Marshal()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &rc, nonce, nil
+}
+
+// openChallenge decrypts a challenge that from sealed to id and returns its
+// nonce.  Anything else, including challenges of other sessions, is refused.
+func (s *Session) openChallenge(id *mcrypt.Identity,
+	from *mcrypt.PublicIdentity, challenge []byte) ([]byte, error) {
+	msg, err := mcrypt.UnmarshalMessage(challenge)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := id.Decrypt(from.Key, msg)
+	if err != nil {
+		return nil, err
+	}
+	binding := s.challengeBinding()
+	if len(plaintext) != len(binding)+challengeSize ||
+		subtle.ConstantTimeCompare(plaintext[:len(binding)],
+			binding) != 1 {
+		return nil, fmt.Errorf("not a challenge for this session")
+	}
+	return plaintext[len(binding):], nil
+}
+
+// HostDomain turns on hosted domain mode.  Must be called before the UI
+// signals that it is ready.
+func (c *Core) HostDomain(name string) (err error) {
+	c.domain, err = NewDomain(c.scommsDir, name)
+	if err == nil {
+		c.domain.Quota = c.config.Quota
+	}
+	return
+}
+
+// Domain returns the hosted domain or nil when not in hosted domain mode.
+func (c *Core) Domain() *Domain {
+	return c.domain
+}
+
+// RegisterHostedUser adds the public identity stored in filename to the
+// hosted domain.
+func (c *Core) RegisterHostedUser(filename string) error {
+	if c.domain == nil {
+		return fmt.Errorf("not in hosted domain mode")
+	}
+	j, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	pid := mcrypt.PublicIdentity{}
+	err = json.Unmarshal(j, &pid)
+	if err != nil {
+		return err
+	}
+
+	return c.domain.Register(&pid)
+}
+
+// ExportPublicIdentity writes the public part of the local identity to
+// filename.  This is what a domain host needs to register a user.
+func (c *Core) ExportPublicIdentity(filename string) error {
+	if c.identity == nil {
+		err := c.identityOpen()
+		if err != nil {
+			return err
+		}
+	}
+	pid := c.identity.PublicIdentity
+	j, err := pid.Marshal()
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, j, 0600)
+}
+
+// hostedCallback handles a session on behalf of a hosted user.  The session
+// is either a peer that wants to send something to the hosted user or the
+// hosted user itself collecting its mailbox.
+func (c *Core) hostedCallback(s *Session, hu *HostedUser) {
+	c.debugServer("hostedCallback %v", hu.PublicIdentity.Address)
+
+	err := s.DefaultSession(hu.PublicIdentity)
+	if err != nil {
+		c.debugServer("hostedCallback DefaultSession %v", err)
+		return
+	}
+
+	if *s.peer.Key == *hu.PublicIdentity.Key {
+		c.serveOwner(s, hu)
+		return
+	}
+
+	t, err := c.domain.Trust(hu.PublicIdentity.Address)
+	if err != nil {
+		c.debugServer("hostedCallback %v", err)
+		return
+	}
+	confirmation, err := c.serverConfirmation(t, s.peer)
+	if err != nil {
+		c.debugServer("hostedCallback %v", err)
+		return
+	}
+	confirmation.Hosted = true
+
+	err = s.ConfirmationPhase(confirmation)
+	if err != nil {
+		c.debugServer("hostedCallback ConfirmationPhase %v", err)
+		return
+	}
+	if confirmation.Error != "" {
+		s.conn.Close()
+		return
+	}
+
+	err = s.BecomeReady()
+	if err != nil {
+		c.debugServer("hostedCallback BecomeReady %v", err)
+		return
+	}
+
+	for {
+		cmd, err := s.RpcReceive()
+		if err != nil {
+			c.debugServer("hostedCallback RpcReceive %v", err)
+			return
+		}
+		switch command := cmd.(type) {
+		case *RpcSendFile:
+			tr, err := t.Get(c.identity, s.peer)
+			if err != nil {
+				tr = nil // domain defaults
+			}
+			err = c.domain.Deliver(hu.PublicIdentity.Address,
+				s.peer, tr, command)
+			if err != nil {
+				c.debugServer("hostedCallback Deliver %v", err)
+			}
+			err = s.RpcSend(sendFileReply(err))
+			if err != nil {
+				c.debugServer("hostedCallback %v", err)
+				return
+			}
+		default:
+			c.debugServer("hostedCallback invalid type %T", cmd)
+		}
+	}
+}
+
+// serveOwner lets a hosted user collect its mailbox.
+func (c *Core) serveOwner(s *Session, hu *HostedUser) {
+	address := hu.PublicIdentity.Address
+	c.debugServer("serveOwner %v", address)
+	defer s.conn.Close()
+
+	confirmation := &Confirmation{
+		MaxFrameSize: maxFrameSize,
+		State:        StateAllowed,
+		Hosted:       true,
+	}
+	err := s.ConfirmationPhase(confirmation)
+	if err != nil {
+		c.debugServer("serveOwner ConfirmationPhase %v", err)
+		return
+	}
+	err = s.BecomeReady()
+	if err != nil {
+		c.debugServer("serveOwner BecomeReady %v", err)
+		return
+	}
+
+	// anyone can claim a public identity, make the client prove it
+	rc, nonce, err := s.newChallenge(c.identity, hu.PublicIdentity)
+	if err != nil {
+		c.debugServer("serveOwner %v", err)
+		return
+	}
+	err = s.RpcSend(rc)
+	if err != nil {
+		c.debugServer("serveOwner RpcSend %v", err)
+		return
+	}
+	cmd, err := s.RpcReceive()
+	if err != nil {
+		c.debugServer("serveOwner RpcReceive %v", err)
+		return
+	}
+	rcr, ok := cmd.(*RpcChallengeReply)
+	if !ok || subtle.ConstantTimeCompare(rcr.Response, nonce) != 1 {
+		c.debugServer("serveOwner challenge failed for %v", address)
+		c.auditLog(AuditDenied, s.peer, "mailbox challenge failed for %v",
+			address)
+		return
+	}
+
+	t, err := c.domain.Trust(address)
+	if err != nil {
+		c.debugServer("serveOwner %v", err)
+		return
+	}
+
+	for {
+		cmd, err := s.RpcReceive()
+		if err != nil {
+			c.debugServer("serveOwner RpcReceive %v", err)
+			return
+		}
+		switch command := cmd.(type) {
+		case *RpcFetch:
+			err := c.hostedTrustSync(t, command.Decisions)
+			if err != nil {
+				c.debugServer("serveOwner hostedTrustSync %v",
+					err)
+				return
+			}
+			rm, err := c.hostedMailbox(t, address)
+			if err != nil {
+				c.debugServer("serveOwner hostedMailbox %v", err)
+				return
+			}
+			err = s.RpcSend(rm)
+			if err != nil {
+				c.debugServer("serveOwner RpcSend %v", err)
+				return
+			}
+		case *RpcMailboxAck:
+			for _, id := range command.Ids {
+				err := c.domain.Remove(address, id)
+				if err != nil {
+					c.debugServer("serveOwner Remove %v",
+						err)
+				}
+			}
+		default:
+			c.debugServer("serveOwner invalid type %T", cmd)
+		}
+	}
+}
+
+// pinHost checks that pid is the domain host we collected from before.  The
+// first host is remembered.  Remove host.pid after the host moved to a new
+// key.
+func (c *Core) pinHost(pid *mcrypt.PublicIdentity) error {
+	filename := c.scommsDir + hostFilename
+	j, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		j, err = pid.Marshal()
+		if err != nil {
+			return err
+		}
+		c.debugClient("pinHost %v %v", pid.Address, pid.Fingerprint())
+		return ioutil.WriteFile(filename, j, 0600)
+	} else if err != nil {
+		return err
+	}
+	pinned := mcrypt.PublicIdentity{}
+	err = json.Unmarshal(j, &pinned)
+	if err != nil {
+		return err
+	}
+	if pinned.Key == nil || *pinned.Key != *pid.Key {
+		c.auditLog(AuditMismatch, pid, "domain host key changed from %v",
+			pinned.Fingerprint())
+		return fmt.Errorf("domain host key changed from %v to %v, "+
+			"remove %v if this is expected", pinned.Fingerprint(),
+			pid.Fingerprint(), filename)
+	}
+	return nil
+}
+
+// hostedTrustSync records the trust decisions of a hosted user.
+func (c *Core) hostedTrustSync(t *Trust, decisions []*RpcTrustDecision) error {
+	for _, v := range decisions {
+		if v.PublicIdentity == nil || v.PublicIdentity.Key == nil {
+			continue
+		}
+		switch v.State {
+		case StateAllowed, StateDenied:
+		default:
+			continue
+		}
+		tr, err := t.Get(c.identity, v.PublicIdentity)
+		if err != nil {
+			err = t.Add(c.identity, v.PublicIdentity, v.State, nil,
+				false)
+		} else if tr.State != v.State {
+			tr.State = v.State
+			err = t.Update(c.identity, tr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hostedMailbox assembles the mailbox reply for a hosted user.  Items that do
+// not fit are left for the next fetch.
+func (c *Core) hostedMailbox(t *Trust, address string) (*RpcMailbox, error) {
+	var err error
+
+	rm := RpcMailbox{}
+	trs, err := t.ListByState(c.identity, StateQueued)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range trs {
+		rm.Queued = append(rm.Queued, v.PublicIdentity)
+	}
+	j, err := json.Marshal(rm)
+	if err != nil {
+		return nil, err
+	}
+
+	// as many items as fit in one reply
+	items, err := c.domain.Mailbox(address)
+	if err != nil {
+		return nil, err
+	}
+	size := len(j)
+	for _, v := range items {
+		j, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		if !fitsFrame(size + len(j) + 1) {
+			rm.More = true
+			break
+		}
+		size += len(j) + 1
+		rm.Items = append(rm.Items, v)
+	}
+
+	return &rm, nil
+}
+
+// handleFetchMailbox connects to our domain host and collects everything that
+// was sent to us while we were away.
+func (c *Core) handleFetchMailbox() {
+	c.debugClient("handleFetchMailbox")
+
+	address := c.identity.PublicIdentity.Address
+	client, err := c.p2pConnect(address)
+	if err != nil {
+		c.popup("Connection Failed", "%v", err)
+		return
+	}
+	defer client.conn.Close()
+
+	if *client.peer.Key != *c.identity.PublicIdentity.Key {
+		c.popup("Collect messages failed", "%v is not hosting "+
+			"our identity", strings.SplitN(address, "@", 2)[1])
+		return
+	}
+	confirmation := Confirmation{
+		LookingFor:   address,
+		MaxFrameSize: maxFrameSize,
+	}
+	err = client.ConfirmationPhase(&confirmation)
+	if err != nil {
+		c.popup("Confirmation failed", "%v", err)
+		return
+	}
+	err = client.BecomeReady()
+	if err != nil {
+		c.popup("Could not enter message phase", "%v", err)
+		return
+	}
+
+	// prove that we own the identity
+	cmd, err := client.RpcReceive()
+	if err != nil {
+		c.popup("Collect messages failed", "%v", err)
+		return
+	}
+	rc, ok := cmd.(*RpcChallenge)
+	if !ok || rc.Server == nil || rc.Server.Key == nil {
+		c.popup("Collect messages failed", "expected challenge")
+		return
+	}
+	err = c.pinHost(rc.Server)
+	if err != nil {
+		c.popup("Collect messages failed", "%v", err)
+		return
+	}
+	rcr := RpcChallengeReply{}
+	rcr.Response, err = client.openChallenge(c.identity, rc.Server,
+		rc.Challenge)
+	if err != nil {
+		c.popup("Collect messages failed", "%v", err)
+		return
+	}
+	err = client.RpcSend(&rcr)
+	if err != nil {
+		c.popup("Collect messages failed", "%v", err)
+		return
+	}
+
+	// push our trust decisions and ask for the mailbox
+	trs, err := c.trust.GetAll(c.identity)
+	if err != nil {
+		c.popup("Collect messages failed", "%v", err)
+		return
+	}
+	rf := RpcFetch{}
+	for _, v := range trs {
+		rf.Decisions = append(rf.Decisions, &RpcTrustDecision{
+			PublicIdentity: v.PublicIdentity,
+			State:          v.State,
+		})
+	}
+	for {
+		more, err := c.fetchMailbox(client, &rf)
+		if err != nil {
+			c.popup("Collect messages failed", "%v", err)
+			return
+		}
+		if !more {
+			return
+		}
+		rf.Decisions = nil // pushed already
+	}
+}
+
+// fetchMailbox asks for the mailbox, stores what it gets and tells the host
+// what can be removed.  It returns true when the host has more items that
+// did not fit in its reply.
+func (c *Core) fetchMailbox(client *Client, rf *RpcFetch) (bool, error) {
+	err := client.RpcSend(rf)
+	if err != nil {
+		return false, err
+	}
+	cmd, err := client.RpcReceive()
+	if err != nil {
+		return false, err
+	}
+	rm, ok := cmd.(*RpcMailbox)
+	if !ok {
+		return false, fmt.Errorf("expected mailbox")
+	}
+
+	// identities that want to talk to us end up queued locally as well
+	for _, v := range rm.Queued {
+		_, err := c.trust.Get(c.identity, v)
+		if err == nil {
+			continue
+		}
+		err = c.trust.Add(c.identity, v, StateQueued,
+			c.peerDefaults(), false)
+		if err != nil {
+			c.debugClient("fetchMailbox %v", err)
+		}
+	}
+	if len(rm.Queued) != 0 {
+		c.renderTrust()
+	}
+
+	ack := RpcMailboxAck{}
+	var full error
+	for _, v := range rm.Items {
+		err := c.unsealMailboxItem(v)
+		if err != nil {
+			c.debugClient("fetchMailbox %v: %v", v.Id, err)
+			if _, ok := err.(*QuotaError); ok {
+				full = err
+			}
+			continue
+		}
+		ack.Ids = append(ack.Ids, v.Id)
+	}
+	if full != nil {
+		// not acked so they can be collected once there is room
+		c.popup("Messages left on domain host", "%v", full)
+	}
+	err = client.RpcSend(&ack)
+	if err != nil {
+		return false, err
+	}
+
+	// the same items would come back if nothing was acked
+	return rm.More && full == nil && len(ack.Ids) != 0, nil
+}
+
+// unsealMailboxItem decrypts a mailbox item and spools it as if it was
+// received directly from the sender.
+func (c *Core) unsealMailboxItem(mi *MailboxItem) error {
+	if mi.From == nil || mi.From.Key == nil {
+		return fmt.Errorf("no sender")
+	}
+	msg, err := mcrypt.UnmarshalMessage(mi.Content)
+	if err != nil {
+		return err
+	}
+	content, err := c.identity.Decrypt(mi.From.Key, msg)
+	if err != nil {
+		return err
+	}
+
+	// drop content from identities we no longer trust
+	tr, err := c.trust.Get(c.identity, mi.From)
+	if err != nil || tr.State != StateAllowed {
+		c.debugClient("unsealMailboxItem dropped content from %v",
+			mi.From.Address)
+		return nil
+	}
+
+	rsf := RpcSendFile{
+		Filename:      mi.Filename,
+		Mime:          mi.Mime,
+		Content:       content,
+		ExpireSeconds: mi.ExpireSeconds,
+		ViewOnce:      mi.ViewOnce,
+		MessageId:     mi.MessageId,
+		InReplyTo:     mi.InReplyTo,
+	}
+	return c.serverSendFile(&rsf, mi.From)
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	stdlog "log"
+	"os"
+	"testing"
+
+	"github.com/marcopeereboom/dbglog"
+	"github.com/marcopeereboom/mcrypt"
+)
+
+// sessions returns both ends of a session between a server and a client
+// with fresh session identities.
+func sessions(t *testing.T) (*Session, *Session) {
+	sid, err := mcrypt.NewIdentity("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cid, err := mcrypt.NewIdentity("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Session{server: true, sid: sid, speer: &cid.PublicIdentity}
+	c := &Session{sid: cid, speer: &sid.PublicIdentity}
+	return s, c
+}
+
+func TestHostedChallenge(t *testing.T) {
+	host, err := mcrypt.NewIdentity("Host", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := mcrypt.NewIdentity("Alice", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, c := sessions(t)
+
+	rc, nonce, err := s.newChallenge(host, &alice.PublicIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.openChallenge(alice, rc.Server, rc.Challenge)
+	if err != nil || !bytes.Equal(got, nonce) {
+		t.Errorf("challenge %x %v", got, err)
+	}
+
+	// not for another session
+	_, other := sessions(t)
+	_, err = other.openChallenge(alice, rc.Server, rc.Challenge)
+	if err == nil {
+		t.Errorf("answered challenge of another session")
+	}
+
+	// content that is not a challenge stays sealed
+	for _, v := range [][]byte{nonce, append(c.challengeBinding(),
+		[]byte("sealed mailbox content")...)} {
+		msg, err := host.Encrypt(alice.PublicIdentity.Key, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j, err := msg.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.openChallenge(alice, rc.Server, j)
+		if err == nil {
+			t.Errorf("decrypted %q", v)
+		}
+	}
+}
+
+func TestHostedPin(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "hosted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &Core{
+		DbgLogger: dbglog.New(ioutil.Discard, "", stdlog.LstdFlags),
+		scommsDir: dir,
+	}
+
+	host, err := mcrypt.NewIdentity("Host", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.pinHost(&host.PublicIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.pinHost(&host.PublicIdentity)
+	if err != nil {
+		t.Errorf("pinned host refused: %v", err)
+	}
+	other, err := mcrypt.NewIdentity("Host", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.pinHost(&other.PublicIdentity)
+	if err == nil {
+		t.Errorf("other host key accepted")
+	}
+}
+
+func TestHostedMailboxBatch(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "hosted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := DefaultConfig
+	c := &Core{
+		DbgLogger: dbglog.New(ioutil.Discard, "", stdlog.LstdFlags),
+		scommsDir: dir,
+		config:    &cfg,
+	}
+	c.identity, err = mcrypt.NewIdentity("Alice", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.trust, err = NewTrust(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.trust.Close()
+	err = c.HostDomain("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.domain.Close()
+
+	carol, err := mcrypt.NewIdentity("Carol", "carol@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.domain.Register(&carol.PublicIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dave, err := mcrypt.NewIdentity("Dave", "dave@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		err = c.domain.Deliver("carol@example.com", &dave.PublicIdentity,
+			nil, &RpcSendFile{Content: make([]byte, 3*1024*1024),
+				Sealed: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tr, err := c.domain.Trust("carol@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every reply fits in a frame, the rest follows
+	for left := 3; left > 0; left-- {
+		rm, err := c.hostedMailbox(tr, "carol@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rm.Items) != 1 || rm.More != (left > 1) {
+			t.Fatalf("%v left: %v items, more %v", left,
+				len(rm.Items), rm.More)
+		}
+		j, err := json.Marshal(rm)
+		if err != nil || !fitsFrame(len(j)) {
+			t.Fatalf("reply too large %v %v", len(j), err)
+		}
+		err = c.domain.Remove("carol@example.com", rm.Items[0].Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
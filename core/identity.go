@@ -28,6 +28,9 @@ const (
 	identityFilename = "/scomms.id"
 	certFilename     = "/scomms.cert"
 	keyFilename      = "/scomms.key"
+
+	// previous identities, one per file, see retiredIdentities
+	retiredDir = "/retired/"
 )
 
 func (c *Core) identityExists() bool {
@@ -38,17 +41,46 @@ func (c *Core) identityExists() bool {
 	return true
 }
 
-func (c *Core) identityOpen() error {
-	s, err := ioutil.ReadFile(c.scommsDir + identityFilename)
+func (c *Core) identityOpen() (err error) {
+	c.identity, err = OpenIdentity(c.scommsDir)
+	return
+}
+
+// OpenIdentity reads the identity in the scomms directory dir.
+func OpenIdentity(dir string) (*mcrypt.Identity, error) {
+	s, err := ioutil.ReadFile(dir + identityFilename)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	c.identity, err = mcrypt.UnmarshalIdentity(s)
+	return mcrypt.UnmarshalIdentity(s)
+}
+
+// retiredIdentities returns the identities kept in the retired directory.
+// Keeping the previous scomms.id there after moving to a new key lets peers
+// verify the change.
+func (c *Core) retiredIdentities() []*mcrypt.Identity {
+	fis, err := ioutil.ReadDir(c.scommsDir + retiredDir)
 	if err != nil {
-		return err
+		return nil
 	}
-
-	return nil
+	ids := make([]*mcrypt.Identity, 0, len(fis))
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
+		}
+		s, err := ioutil.ReadFile(c.scommsDir + retiredDir + fi.Name())
+		if err != nil {
+			c.debugCore("retiredIdentities %v", err)
+			continue
+		}
+		id, err := mcrypt.UnmarshalIdentity(s)
+		if err != nil {
+			c.debugCore("retiredIdentities %v: %v", fi.Name(), err)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
 }
 
 func (c *Core) identitySave() error {
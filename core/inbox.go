@@ -0,0 +1,431 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/marcopeereboom/mcrypt"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// blobPrefix prefixes the number of items that refer to stored content.
+const blobPrefix = "blob/"
+
+// Inbox indexes received content in the spool.  Records are keyed by spool
+// id and encrypted to self like trust records.  Identical content is stored
+// once, the index counts the items that refer to it.
+type Inbox struct {
+	dir string // scomms directory
+	db  *leveldb.DB
+	mtx sync.Mutex
+
+	// running totals by sender address and for everybody, nil until
+	// Usage first needs them
+	usage map[string]*QuotaUsage
+	total QuotaUsage
+}
+
+type InboxItem struct {
+	Id       string // spool id, random and unique
+	Blob     string // stored content, empty if indexed by an older version
+	From     string
+	Filename string
+	Mime     string
+	Size     int64
+	Received time.Time
+	Read     bool
+	Archived bool
+	Flagged  bool      // exempt from retention
+	Expires  time.Time // zero for never
+	ViewOnce bool
+	Parts    []*Part // body and attachments of multipart content
+
+	MessageId string // empty if the sender did not send one
+	InReplyTo string // message id this answers
+}
+
+func NewInbox(dir string) (*Inbox, error) {
+	targetDir := dir + "/inbox/"
+	err := os.MkdirAll(targetDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	i := Inbox{dir: dir}
+	i.db, err = leveldb.OpenFile(targetDir, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+func (i *Inbox) Close() {
+	i.db.Close()
+}
+
+func (i *Inbox) put(id *mcrypt.Identity, item *InboxItem) error {
+	blob, err := sealToSelf(id, item)
+	if err != nil {
+		return err
+	}
+	return i.db.Put([]byte(item.Id), blob, nil)
+}
+
+func (i *Inbox) get(id *mcrypt.Identity, itemId string) (*InboxItem, error) {
+	blob, err := i.db.Get([]byte(itemId), nil)
+	if err != nil {
+		return nil, fmt.Errorf("inbox item %v: %v", itemId, err)
+	}
+	item := InboxItem{}
+	err = openFromSelf(id, blob, &item)
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// isItem tells item keys from reference counts.
+func isItem(key []byte) bool {
+	return !bytes.HasPrefix(key, []byte(blobPrefix))
+}
+
+// ref adds n to the number of items that refer to blob and returns the
+// result.  Must be called with the mutex held.
+func (i *Inbox) ref(blob string, n int) (int, error) {
+	key := []byte(blobPrefix + blob)
+	refs := 0
+	value, err := i.db.Get(key, nil)
+	if err == nil {
+		refs, err = strconv.Atoi(string(value))
+		if err != nil {
+			return 0, fmt.Errorf("references %v: %v", blob, err)
+		}
+	} else if err != leveldb.ErrNotFound {
+		return 0, err
+	}
+	refs += n
+	if refs <= 0 {
+		return 0, i.db.Delete(key, nil)
+	}
+	return refs, i.db.Put(key, []byte(strconv.Itoa(refs)), nil)
+}
+
+// count adds or, for n -1, removes item from the running totals.  Must be
+// called with the mutex held.
+func (i *Inbox) count(item *InboxItem, n int) {
+	if i.usage == nil {
+		return
+	}
+	u, ok := i.usage[item.From]
+	if !ok {
+		u = &QuotaUsage{}
+		i.usage[item.From] = u
+	}
+	u.Bytes += int64(n) * item.Size
+	u.Messages += n
+	if u.Messages <= 0 {
+		delete(i.usage, item.From)
+	}
+	i.total.Bytes += int64(n) * item.Size
+	i.total.Messages += n
+}
+
+// Add indexes newly received content.
+func (i *Inbox) Add(id *mcrypt.Identity, item *InboxItem) error {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	known, err := i.db.Has([]byte(item.Id), nil)
+	if err != nil {
+		return err
+	}
+	err = i.put(id, item)
+	if err != nil {
+		return err
+	}
+	if known {
+		return nil
+	}
+	if item.Blob != "" {
+		_, err = i.ref(item.Blob, 1)
+		if err != nil {
+			return err
+		}
+	}
+	i.count(item, 1)
+	return nil
+}
+
+// Usage returns what is stored by sender address and in total.  The inbox
+// is read once, after that the totals are kept up to date.
+func (i *Inbox) Usage(id *mcrypt.Identity) (map[string]QuotaUsage,
+	QuotaUsage, error) {
+
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	if i.usage == nil {
+		usage := make(map[string]*QuotaUsage)
+		total := QuotaUsage{}
+		iter := i.db.NewIterator(nil, nil)
+		for iter.Next() {
+			if !isItem(iter.Key()) {
+				continue
+			}
+			item := InboxItem{}
+			err := openFromSelf(id, iter.Value(), &item)
+			if err != nil {
+				iter.Release()
+				return nil, QuotaUsage{}, err
+			}
+			u, ok := usage[item.From]
+			if !ok {
+				u = &QuotaUsage{}
+				usage[item.From] = u
+			}
+			u.Bytes += item.Size
+			u.Messages++
+			total.Bytes += item.Size
+			total.Messages++
+		}
+		iter.Release()
+		err := iter.Error()
+		if err != nil {
+			return nil, QuotaUsage{}, err
+		}
+		i.usage, i.total = usage, total
+	}
+
+	peers := make(map[string]QuotaUsage, len(i.usage))
+	for k, v := range i.usage {
+		peers[k] = *v
+	}
+	return peers, i.total, nil
+}
+
+func (i *Inbox) Get(id *mcrypt.Identity, itemId string) (*InboxItem, error) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	return i.get(id, itemId)
+}
+
+// List returns all items, newest first.
+func (i *Inbox) List(id *mcrypt.Identity) ([]*InboxItem, error) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	items := make([]*InboxItem, 0, 100)
+	iter := i.db.NewIterator(nil, nil)
+	for iter.Next() {
+		if !isItem(iter.Key()) {
+			continue
+		}
+		item := InboxItem{}
+		err := openFromSelf(id, iter.Value(), &item)
+		if err != nil {
+			iter.Release()
+			return nil, err
+		}
+		items = append(items, &item)
+	}
+	iter.Release()
+	err := iter.Error()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(items, func(a, b int) bool {
+		return items[a].Received.After(items[b].Received)
+	})
+
+	return items, nil
+}
+
+// Mark sets the read and archived flags of an item.
+func (i *Inbox) Mark(id *mcrypt.Identity, itemId string, read, archived,
+	flagged bool) (*InboxItem, error) {
+
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	item, err := i.get(id, itemId)
+	if err != nil {
+		return nil, err
+	}
+	item.Read = read
+	item.Archived = archived
+	item.Flagged = flagged
+	return item, i.put(id, item)
+}
+
+// Delete removes an item from the spool and its content once no other item
+// refers to it.  The caller holds the spool lock.
+func (i *Inbox) Delete(id *mcrypt.Identity, itemId string) error {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	item, err := i.get(id, itemId)
+	if err != nil {
+		return err
+	}
+
+	blob, err := spoolDelete(i.dir, id, itemId)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if item.Blob != "" {
+		blob = item.Blob
+	}
+
+	err = i.db.Delete([]byte(itemId), nil)
+	if err != nil {
+		return err
+	}
+	i.count(item, -1)
+	if blob == "" {
+		return nil // content is gone already
+	}
+	refs, err := i.ref(blob, -1)
+	if err != nil || refs > 0 {
+		return err
+	}
+	return blobDelete(i.dir, blob)
+}
+
+// Rename moves an item to a new spool id, flags are kept.
+func (i *Inbox) Rename(id *mcrypt.Identity, oldId, newId string) error {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	item, err := i.get(id, oldId)
+	if err != nil {
+		return err
+	}
+	item.Id = newId
+	err = i.put(id, item)
+	if err != nil {
+		return err
+	}
+	return i.db.Delete([]byte(oldId), nil)
+}
+
+// Sync indexes spool content that is not in the index, e.g. content that
+// was received by an older version, drops items whose content is gone and
+// recounts the references to content.  The caller holds the spool lock.
+func (i *Inbox) Sync(id *mcrypt.Identity) error {
+	entries, err := SpoolList(i.dir, id)
+	if err != nil {
+		return err
+	}
+
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	seen := make(map[string]bool, len(entries))
+	refs := make(map[string]int, len(entries))
+	for _, se := range entries {
+		seen[se.Id] = true
+		refs[se.Meta.Blob]++
+		ok, err := i.db.Has([]byte(se.Id), nil)
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+		item := &InboxItem{
+			Id:        se.Id,
+			Blob:      se.Meta.Blob,
+			From:      se.From,
+			Filename:  se.Filename,
+			Mime:      se.Meta.Mime,
+			Size:      se.Size,
+			Received:  se.Meta.Created,
+			Expires:   se.Meta.Expires,
+			ViewOnce:  se.Meta.ViewOnce,
+			Parts:     se.Meta.Parts,
+			MessageId: se.Meta.MessageId,
+			InReplyTo: se.Meta.InReplyTo,
+		}
+		err = i.put(id, item)
+		if err != nil {
+			return err
+		}
+		i.count(item, 1)
+	}
+
+	iter := i.db.NewIterator(nil, nil)
+	gone := make([]string, 0)
+	counted := make(map[string]int, len(refs))
+	for iter.Next() {
+		key := string(iter.Key())
+		if !isItem(iter.Key()) {
+			counted[key[len(blobPrefix):]], _ =
+				strconv.Atoi(string(iter.Value()))
+		} else if !seen[key] {
+			gone = append(gone, key)
+		}
+	}
+	iter.Release()
+	err = iter.Error()
+	if err != nil {
+		return err
+	}
+	for _, v := range gone {
+		item, err := i.get(id, v)
+		if err != nil {
+			return err
+		}
+		err = i.db.Delete([]byte(v), nil)
+		if err != nil {
+			return err
+		}
+		i.count(item, -1)
+	}
+
+	// only write counts that changed
+	for blob := range counted {
+		if _, ok := refs[blob]; ok {
+			continue
+		}
+		err = i.db.Delete([]byte(blobPrefix+blob), nil)
+		if err != nil {
+			return err
+		}
+	}
+	for blob, n := range refs {
+		if counted[blob] == n {
+			continue
+		}
+		err = i.db.Put([]byte(blobPrefix+blob),
+			[]byte(strconv.Itoa(n)), nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,354 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/marcopeereboom/mcrypt"
+)
+
+// spoolFile writes content and meta the way serverSendFile does and
+// returns the spool id.
+func spoolFile(t *testing.T, dir string, id *mcrypt.Identity, from,
+	filename string, created time.Time) string {
+
+	spoolId, err := spoolWrite(dir, id, &MetaRecord{
+		Mime:     "text/plain",
+		Created:  created,
+		From:     from,
+		Filename: filename,
+	}, bytes.NewReader([]byte("hello "+filename)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spoolId
+}
+
+// openInbox returns an inbox in a new directory that indexed old and new
+// from bob and middle from carol, and their spool ids by filename.  The
+// caller closes the inbox and removes the directory.
+func openInbox(t *testing.T) (string, *mcrypt.Identity, *Inbox,
+	map[string]string) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "inbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := mcrypt.NewIdentity("Alice", "alice@example.com")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	inbox, err := NewInbox(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	ids := map[string]string{
+		"old": spoolFile(t, dir, id, "bob@example.com", "old",
+			now.Add(-time.Hour)),
+		"new": spoolFile(t, dir, id, "bob@example.com", "new", now),
+		"middle": spoolFile(t, dir, id, "carol@example.com", "middle",
+			now.Add(-time.Minute)),
+	}
+	err = inbox.Sync(id)
+	if err != nil {
+		inbox.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir, id, inbox, ids
+}
+
+func TestInboxEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "inbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id, err := mcrypt.NewIdentity("Alice", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbox, err := NewInbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inbox.Close()
+
+	items, err := inbox.List(id)
+	if err != nil || len(items) != 0 {
+		t.Fatalf("empty inbox: %v %v", items, err)
+	}
+}
+
+func TestInboxSync(t *testing.T) {
+	dir, id, inbox, ids := openInbox(t)
+	defer os.RemoveAll(dir)
+	defer inbox.Close()
+
+	items, err := inbox.List(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 {
+		t.Fatalf("expected 3 items, got %v", len(items))
+	}
+
+	// newest first
+	for i, name := range []string{"new", "middle", "old"} {
+		if items[i].Id != ids[name] {
+			t.Errorf("item %v: expected %v, got %v", i, name,
+				items[i].Filename)
+		}
+		if items[i].Read || items[i].Archived {
+			t.Errorf("item %v: new items must be unread", i)
+		}
+	}
+	if items[0].From != "bob@example.com" || items[0].Filename != "new" ||
+		items[0].Mime != "text/plain" || items[0].Size != 9 {
+		t.Errorf("invalid item %v", items[0])
+	}
+
+	// content that disappeared is dropped from the index
+	err = os.Remove(dir + spoolDir + metaDir + ids["middle"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inbox.Sync(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = inbox.Get(id, ids["middle"])
+	if err == nil {
+		t.Errorf("expected stale item to be dropped")
+	}
+}
+
+func TestInboxMark(t *testing.T) {
+	dir, id, inbox, ids := openInbox(t)
+	defer os.RemoveAll(dir)
+	defer inbox.Close()
+
+	item, err := inbox.Mark(id, ids["new"], true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !item.Read || !item.Archived || !item.Flagged {
+		t.Errorf("flags not set %v", item)
+	}
+
+	// flags persist and survive a sync
+	err = inbox.Sync(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err = inbox.Get(id, ids["new"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !item.Read || !item.Archived || !item.Flagged {
+		t.Errorf("flags lost %v", item)
+	}
+
+	_, err = inbox.Mark(id, "nobody@example.com/x", true, false,
+		false)
+	if err == nil {
+		t.Errorf("expected error marking unknown item")
+	}
+}
+
+func TestInboxRename(t *testing.T) {
+	dir, id, inbox, ids := openInbox(t)
+	defer os.RemoveAll(dir)
+	defer inbox.Close()
+
+	_, err := inbox.Mark(id, ids["new"], true, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newId, err := newSpoolId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inbox.Rename(id, ids["new"], newId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := inbox.Get(id, newId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Id != newId || !item.Read || !item.Archived {
+		t.Errorf("rename lost flags %v", item)
+	}
+	_, err = inbox.Get(id, ids["new"])
+	if err == nil {
+		t.Errorf("old id still indexed")
+	}
+}
+
+func TestInboxDelete(t *testing.T) {
+	dir, id, inbox, ids := openInbox(t)
+	defer os.RemoveAll(dir)
+	defer inbox.Close()
+
+	se, err := SpoolGet(dir, id, ids["old"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inbox.Delete(id, ids["old"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(dir + spoolDir + metaDir + ids["old"])
+	if !os.IsNotExist(err) {
+		t.Errorf("meta not deleted: %v", err)
+	}
+	_, err = os.Stat(dir + spoolDir + blobDir + se.Meta.Blob)
+	if !os.IsNotExist(err) {
+		t.Errorf("content not deleted: %v", err)
+	}
+	items, err := inbox.List(id)
+	if err != nil || len(items) != 2 {
+		t.Errorf("expected 2 items: %v %v", items, err)
+	}
+
+	// only indexed items can be deleted
+	err = inbox.Delete(id, "bob@example.com/../../inbox")
+	if err == nil {
+		t.Errorf("expected error deleting unknown item")
+	}
+}
+
+func TestInboxShared(t *testing.T) {
+	dir, id, inbox, ids := openInbox(t)
+	defer os.RemoveAll(dir)
+	defer inbox.Close()
+
+	// the same content from carol, indexed as serverSendFile does
+	meta := &MetaRecord{From: "carol@example.com", Filename: "old"}
+	spoolId, err := spoolWrite(dir, id, meta,
+		bytes.NewReader([]byte("hello old")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inbox.Add(id, &InboxItem{
+		Id:   spoolId,
+		Blob: meta.Blob,
+		From: meta.From,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// content stays until the last item that refers to it is deleted
+	blob := dir + spoolDir + blobDir + meta.Blob
+	err = inbox.Delete(id, ids["old"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(blob); err != nil {
+		t.Errorf("shared content deleted: %v", err)
+	}
+	err = inbox.Delete(id, spoolId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(blob); !os.IsNotExist(err) {
+		t.Errorf("content not deleted: %v", err)
+	}
+
+	// a sync counts references to the content it indexes
+	again := spoolFile(t, dir, id, "carol@example.com", "new",
+		time.Now())
+	err = inbox.Sync(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	se, err := SpoolGet(dir, id, again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inbox.Delete(id, again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(dir + spoolDir + blobDir + se.Meta.Blob)
+	if err != nil {
+		t.Errorf("shared content deleted: %v", err)
+	}
+	items, err := inbox.List(id)
+	if err != nil || len(items) != 2 {
+		t.Errorf("expected 2 items: %v %v", items, err)
+	}
+}
+
+func TestInboxUsage(t *testing.T) {
+	dir, id, inbox, ids := openInbox(t)
+	defer os.RemoveAll(dir)
+	defer inbox.Close()
+
+	check := func(bob, total int, bytes int64) {
+		peers, all, err := inbox.Usage(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if peers["bob@example.com"].Messages != bob ||
+			all.Messages != total ||
+			all.Bytes != bytes {
+			t.Errorf("usage %v %v", peers, all)
+		}
+	}
+	check(2, 3, 30)
+
+	// totals follow changes without reading the inbox again
+	err := inbox.Delete(id, ids["old"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(1, 2, 21)
+	newer := spoolFile(t, dir, id, "bob@example.com", "xyz", time.Now())
+	se, err := SpoolGet(dir, id, newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := &InboxItem{Id: newer, From: se.From, Size: se.Size}
+	for i := 0; i < 2; i++ {
+		err = inbox.Add(id, item)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(2, 3, 30)
+	err = os.Remove(dir + spoolDir + metaDir + ids["middle"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = inbox.Sync(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(2, 2, 18)
+}
@@ -0,0 +1,253 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"time"
+
+	"github.com/marcopeereboom/mcrypt"
+)
+
+// Key changes
+//
+// An unknown key for an address that is in the trust database is not simply
+// a new identity, it may be an impersonation.  Neither is a known key while
+// another key of the address is allowed.  verifyHost, serverConfirmation and
+// trust updates ask with a UiKeyChange that shows both fingerprints.  The
+// new key can be accepted, rejected or accepted once the previous key
+// confirmed the change: core opens another session and sends a RpcChallenge
+// encrypted to the previous key.  Peers answer such challenges with the
+// identities they retired, see retiredIdentities.
+
+// previousKey returns the record of the key address used before pid in t,
+// nil if there is none.  Allowed records win over others, then the latest
+// one.  Forgotten keys do not count.
+func (c *Core) previousKey(t *Trust, address string,
+	pid *mcrypt.PublicIdentity) (*TrustRecord, error) {
+	trs, err := t.GetByAddress(c.identity, address)
+	if err != nil {
+		return nil, err
+	}
+	var previous *TrustRecord
+	for _, tr := range trs {
+		if *tr.PublicIdentity.Key == *pid.Key {
+			continue
+		}
+		if _, ok := tr.FreeToUse[Tombstone]; ok {
+			continue
+		}
+		switch {
+		case previous == nil:
+		case (tr.State == StateAllowed) != (previous.State == StateAllowed):
+			if tr.State != StateAllowed {
+				continue
+			}
+		case !tr.LastUpdate.After(previous.LastUpdate):
+			continue
+		}
+		previous = tr
+	}
+	return previous, nil
+}
+
+// keyChange returns the record of the key that pid would replace for
+// address, nil if pid can be judged on its own record tr.  tr is nil for
+// unknown keys, they replace any other key of the address.  Known keys only
+// replace an allowed key, denied keys stay denied.
+func (c *Core) keyChange(t *Trust, address string, pid *mcrypt.PublicIdentity,
+	tr *TrustRecord) (*TrustRecord, error) {
+	previous, err := c.previousKey(t, address, pid)
+	if err != nil || previous == nil {
+		return nil, err
+	}
+	switch {
+	case tr == nil:
+	case tr.State == StateDenied, previous.State != StateAllowed:
+		return nil, nil
+	}
+	return previous, nil
+}
+
+// promptKeyChange asks whether pid replaces the key of previous for host,
+// callback gets the outcome, see handleUiKeyChangeReply.
+func (c *Core) promptKeyChange(host string, pid *mcrypt.PublicIdentity,
+	previous *TrustRecord, callback func(error)) {
+	kc := &UiKeyChange{
+		PublicIdentity: pid,
+		Previous:       previous,
+	}
+	kc.Id = c.addPrompt(&prompt{
+		pid:      pid,
+		previous: previous,
+		host:     host,
+		callback: callback,
+	})
+	c.Send(core, []string{ui}, kc)
+}
+
+// handleUiKeyChangeReply acts on the decision about a key change and
+// completes the verification that prompted for it.
+func (c *Core) handleUiKeyChangeReply(m *UiKeyChangeReply) {
+	c.debugCore("%T %v %v", m, m.Id, m.Decision)
+
+	p := c.takeKeyChange(m.Id)
+	if p == nil {
+		c.debugCore("%T unknown prompt %v", m, m.Id)
+		return
+	}
+	old := p.previous.PublicIdentity
+
+	switch m.Decision {
+	case KeyChangeAccept:
+	case KeyChangeVerify:
+		// the previous key may take a while to answer, if at all
+		go func() {
+			err := c.proveKey(p.host, old, p.pid)
+			c.Send(core, []string{core}, &keyProof{p: p, err: err})
+		}()
+		return
+	case KeyChangeReject:
+		c.auditLog(AuditKeyChange, p.pid, "rejected, previous "+
+			"fingerprint %v", old.Fingerprint())
+		tr, err := c.trust.Get(c.identity, p.pid)
+		if err == nil {
+			tr.State = StateDenied
+			err = c.trust.Update(c.identity, tr)
+		} else {
+			err = c.trust.Add(c.identity, p.pid, StateDenied,
+				c.peerDefaults(), false)
+		}
+		if err != nil {
+			c.debugCore("%T %v", m, err)
+		}
+		c.renderTrust()
+		p.callback(fmt.Errorf("You rejected the new key of %v",
+			p.host))
+		return
+	default:
+		p.callback(errVerifyCanceled)
+		return
+	}
+
+	c.replaceKey(p)
+}
+
+// keyProof is the outcome of proveKey, it is posted back to core.
+type keyProof struct {
+	p   *prompt
+	err error
+}
+
+// handleKeyProof completes a key change once the previous key answered.
+func (c *Core) handleKeyProof(m *keyProof) {
+	p := m.p
+	if m.err != nil {
+		old := p.previous.PublicIdentity
+		c.auditLog(AuditMismatch, p.pid, "previous key %v did not "+
+			"confirm: %v", old.Fingerprint(), m.err)
+		p.callback(fmt.Errorf("The previous key of %v did not "+
+			"confirm the new key: %v", p.host, m.err))
+		return
+	}
+	c.replaceKey(p)
+}
+
+// replaceKey moves the address of the previous key of p to the new one.
+func (c *Core) replaceKey(p *prompt) {
+	err := c.trust.ReplaceKey(c.identity, p.previous.PublicIdentity, p.pid)
+	if err != nil {
+		c.popup("Could not replace the key of "+p.host, "%v", err)
+		p.callback(err)
+		return
+	}
+	c.renderTrust()
+
+	p.callback(nil)
+}
+
+// proveKey connects to host, which must answer with pid, and has it decrypt
+// a challenge sent to the previous key old.  It does not run on the core
+// loop, the whole exchange is limited to rpcTimeoutSeconds.
+func (c *Core) proveKey(host string, old, pid *mcrypt.PublicIdentity) error {
+	client, err := c.NewClientSession(host)
+	if err != nil {
+		return err
+	}
+	defer client.conn.Close()
+	deadline := time.Now().Add(rpcTimeoutSeconds * time.Second)
+	client.conn.SetReadDeadline(deadline)
+	client.conn.SetWriteDeadline(deadline)
+
+	if *client.peer.Key != *pid.Key {
+		return fmt.Errorf("%v answered with yet another key", host)
+	}
+	err = client.ConfirmationPhase(&Confirmation{
+		LookingFor:   host,
+		MaxFrameSize: maxFrameSize,
+	})
+	if err != nil {
+		return err
+	}
+	err = client.BecomeReady()
+	if err != nil {
+		return err
+	}
+
+	rc, nonce, err := client.newChallenge(c.identity, old)
+	if err != nil {
+		return err
+	}
+	err = client.RpcSend(rc)
+	if err != nil {
+		return err
+	}
+	cmd, err := client.RpcReceive()
+	if err != nil {
+		return err
+	}
+	rcr, ok := cmd.(*RpcChallengeReply)
+	if !ok {
+		return fmt.Errorf("expected challenge reply")
+	}
+	if subtle.ConstantTimeCompare(rcr.Response, nonce) != 1 {
+		return fmt.Errorf("challenge failed")
+	}
+	return nil
+}
+
+// answerChallenge opens a challenge that peer sent to one of our retired
+// keys on session s.  Only challenges from peer itself for this session are
+// answered, anything else would let peers read what others sent to those
+// keys.
+func (c *Core) answerChallenge(s *Session, peer *mcrypt.PublicIdentity,
+	rc *RpcChallenge) *RpcChallengeReply {
+	rcr := RpcChallengeReply{}
+	if rc.Server == nil || rc.Server.Key == nil ||
+		*rc.Server.Key != *peer.Key {
+		return &rcr
+	}
+	for _, id := range c.retiredIdentities() {
+		nonce, err := s.openChallenge(id, peer, rc.Challenge)
+		if err == nil {
+			rcr.Response = nonce
+			break
+		}
+	}
+	return &rcr
+}
@@ -0,0 +1,370 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	stdlog "log"
+	"os"
+	"testing"
+
+	"github.com/marcopeereboom/dbglog"
+	"github.com/marcopeereboom/mcrypt"
+	"github.com/marcopeereboom/queueb"
+)
+
+// keyCore returns a core in a new directory with trust open that allowed
+// oldKey and queued otherKey, both keys of bob@example.com.  newKey is a
+// third key of bob.  The caller closes the trust database and removes the
+// directory.
+func keyCore(t *testing.T) (c *Core, oldKey, newKey,
+	otherKey *mcrypt.Identity) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "keychange")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = &Core{
+		DbgLogger: dbglog.New(ioutil.Discard, "", stdlog.LstdFlags),
+		scommsDir: dir,
+		prompts:   make(map[PromptId]*prompt),
+	}
+	c.identity, err = mcrypt.NewIdentity("Alice", "alice@example.com")
+	if err == nil {
+		c.trust, err = NewTrust(dir)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	fail := func(err error) {
+		c.trust.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	for _, v := range []**mcrypt.Identity{&oldKey, &newKey, &otherKey} {
+		*v, err = mcrypt.NewIdentity("Bob", "bob@example.com")
+		if err != nil {
+			fail(err)
+		}
+	}
+	err = c.trust.Add(c.identity, &oldKey.PublicIdentity, StateAllowed,
+		map[string]string{Nickname: "bobby"}, false)
+	if err != nil {
+		fail(err)
+	}
+	err = c.trust.Add(c.identity, &otherKey.PublicIdentity, StateQueued,
+		nil, false)
+	if err != nil {
+		fail(err)
+	}
+	return c, oldKey, newKey, otherKey
+}
+
+func closeKeyCore(c *Core) {
+	c.trust.Close()
+	os.RemoveAll(c.scommsDir)
+}
+
+func TestKeyChangePrevious(t *testing.T) {
+	c, oldKey, newKey, otherKey := keyCore(t)
+	defer closeKeyCore(c)
+
+	// allowed wins over the later queued key
+	previous, err := c.previousKey(c.trust, "bob@example.com",
+		&newKey.PublicIdentity)
+	if err != nil || previous == nil ||
+		*previous.PublicIdentity.Key != *oldKey.PublicIdentity.Key {
+		t.Fatalf("previous %v %v", previous, err)
+	}
+	previous, err = c.previousKey(c.trust, "carol@example.com",
+		&newKey.PublicIdentity)
+	if err != nil || previous != nil {
+		t.Fatalf("unknown address %v %v", previous, err)
+	}
+
+	// forgotten keys do not count
+	err = c.trust.Forget(c.identity, &otherKey.PublicIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, err = c.previousKey(c.trust, "bob@example.com",
+		&oldKey.PublicIdentity)
+	if err != nil || previous != nil {
+		t.Errorf("tombstone is previous %v %v", previous, err)
+	}
+}
+
+func TestKeyChangeReplace(t *testing.T) {
+	c, oldKey, newKey, otherKey := keyCore(t)
+	defer closeKeyCore(c)
+
+	id := c.identity
+	err := c.trust.ReplaceKey(id, &oldKey.PublicIdentity, &newKey.PublicIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := c.trust.Get(id, &newKey.PublicIdentity)
+	if err != nil || tr.State != StateAllowed ||
+		tr.FreeToUse[Nickname] != "bobby" {
+		t.Fatalf("new key %v %v", tr, err)
+	}
+	tr, err = c.trust.Get(id, &oldKey.PublicIdentity)
+	if err != nil || tr.State != StateDenied ||
+		tr.FreeToUse[ReplacedBy] != newKey.PublicIdentity.Fingerprint() {
+		t.Fatalf("old key %v %v", tr, err)
+	}
+	err = c.trust.ReplaceKey(id, &oldKey.PublicIdentity, &newKey.PublicIdentity)
+	if err == nil {
+		t.Fatal("replaced twice")
+	}
+
+	// the next change is compared with the new key
+	previous, err := c.previousKey(c.trust, "bob@example.com",
+		&otherKey.PublicIdentity)
+	if err != nil || previous == nil ||
+		*previous.PublicIdentity.Key != *newKey.PublicIdentity.Key {
+		t.Errorf("previous after replace %v %v", previous, err)
+	}
+}
+
+func TestKeyChangePrompt(t *testing.T) {
+	c, oldKey, _, otherKey := keyCore(t)
+	defer closeKeyCore(c)
+
+	tr, err := c.trust.Get(c.identity, &oldKey.PublicIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []error
+	id := c.addPrompt(&prompt{
+		pid:      &otherKey.PublicIdentity,
+		previous: tr,
+		host:     "bob@example.com",
+		callback: func(err error) {
+			got = append(got, err)
+		},
+	})
+
+	// a public identity reply must not answer a key change
+	if c.takePrompt(id, true) != nil {
+		t.Fatal("took key change as public identity prompt")
+	}
+	c.handleUiKeyChangeReply(&UiKeyChangeReply{Id: id + 1})
+	if len(got) != 0 {
+		t.Fatal("unknown prompt answered")
+	}
+	c.handleUiKeyChangeReply(&UiKeyChangeReply{Id: id})
+	c.handleUiKeyChangeReply(&UiKeyChangeReply{Id: id})
+	if len(got) != 1 || got[0] != errVerifyCanceled {
+		t.Errorf("unexpected callbacks %v", got)
+	}
+}
+
+func TestKeyChangeChallenge(t *testing.T) {
+	c, oldKey, newKey, _ := keyCore(t)
+	defer closeKeyCore(c)
+
+	// we are bob and kept the old identity
+	err := os.MkdirAll(c.scommsDir+retiredDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := oldKey.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(c.scommsDir+retiredDir+"scomms.id", j, 0400)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := &c.identity.PublicIdentity
+	server, client := sessions(t)
+	rc, nonce, err := client.newChallenge(c.identity, &oldKey.PublicIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcr := c.answerChallenge(server, alice, rc)
+	if !bytes.Equal(rcr.Response, nonce) {
+		t.Fatal("challenge not answered")
+	}
+
+	// only the peer that sent the challenge may ask
+	rcr = c.answerChallenge(server, &newKey.PublicIdentity, rc)
+	if len(rcr.Response) != 0 {
+		t.Error("answered challenge for someone else")
+	}
+
+	// and only on the session it was made for
+	other, _ := sessions(t)
+	rcr = c.answerChallenge(other, alice, rc)
+	if len(rcr.Response) != 0 {
+		t.Error("answered challenge of another session")
+	}
+
+	// anything else sealed to the retired key stays sealed
+	msg, err := c.identity.Encrypt(oldKey.PublicIdentity.Key, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Challenge, err = msg.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcr = c.answerChallenge(server, alice, rc)
+	if len(rcr.Response) != 0 {
+		t.Error("decrypted content that is not a challenge")
+	}
+}
+
+// keyQueue sets up the message queues of c, messages to the UI are read
+// with c.ReceiveUi.
+func keyQueue(t *testing.T, c *Core) {
+	var err error
+	c.Queueb, err = queueb.New("queuebs", 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{ui, core} {
+		err = c.Queueb.Register(name, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestKeyChangeKnown(t *testing.T) {
+	c, oldKey, _, otherKey := keyCore(t)
+	defer closeKeyCore(c)
+	keyQueue(t, c)
+	id := c.identity
+	other := &otherKey.PublicIdentity
+
+	// a known key is a key change while another one is allowed
+	tr, err := c.trust.Get(id, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, err := c.keyChange(c.trust, "bob@example.com", other, tr)
+	if err != nil || previous == nil ||
+		*previous.PublicIdentity.Key != *oldKey.PublicIdentity.Key {
+		t.Fatalf("known key %v %v", previous, err)
+	}
+	tr, err = c.trust.Get(id, &oldKey.PublicIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, err = c.keyChange(c.trust, "bob@example.com",
+		&oldKey.PublicIdentity, tr)
+	if err != nil || previous != nil {
+		t.Fatalf("allowed key %v %v", previous, err)
+	}
+
+	// allowing it asks instead
+	tr, err = c.trust.Get(id, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.State = StateAllowed
+	c.handleUpdateTrustRecord(tr)
+	m, _ := c.ReceiveUi()
+	if kc, ok := m.Message.(*UiKeyChange); !ok ||
+		*kc.PublicIdentity.Key != *other.Key {
+		t.Fatalf("no key change prompt %T", m.Message)
+	}
+	tr, err = c.trust.Get(id, other)
+	if err != nil || tr.State != StateQueued {
+		t.Fatalf("allowed without key change %v %v", tr, err)
+	}
+
+	// so does an incoming session, once
+	for i := 0; i < 2; i++ {
+		confirmation, err := c.serverConfirmation(c.trust, other)
+		if err != nil || confirmation.State != StateQueued ||
+			confirmation.Error == "" {
+			t.Fatalf("incoming %v %v", confirmation, err)
+		}
+	}
+	if !c.keyChangePending(other) {
+		t.Fatal("no pending key change")
+	}
+
+	// accepting replaces the allowed key
+	err = c.trust.ReplaceKey(id, &oldKey.PublicIdentity, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err = c.trust.Get(id, other)
+	if err != nil || tr.State != StateAllowed {
+		t.Fatalf("not replaced %v %v", tr, err)
+	}
+	confirmation, err := c.serverConfirmation(c.trust, other)
+	if err != nil || confirmation.Error != "" {
+		t.Errorf("replaced key refused %v %v", confirmation, err)
+	}
+}
+
+func TestKeyChangeProof(t *testing.T) {
+	c, oldKey, newKey, _ := keyCore(t)
+	defer closeKeyCore(c)
+	keyQueue(t, c)
+	var err error
+	cfg := DefaultConfig
+	c.config = &cfg
+	c.inbox, err = NewInbox(c.scommsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.inbox.Close()
+
+	id := c.identity
+	previous, err := c.trust.Get(id, &oldKey.PublicIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []error
+	p := &prompt{
+		pid:      &newKey.PublicIdentity,
+		previous: previous,
+		host:     "bob@example.com",
+		callback: func(err error) {
+			got = append(got, err)
+		},
+	}
+
+	// no answer leaves the previous key in place
+	c.handleKeyProof(&keyProof{p: p, err: fmt.Errorf("timeout")})
+	if len(got) != 1 || got[0] == nil {
+		t.Fatalf("failed proof accepted %v", got)
+	}
+	_, err = c.trust.Get(id, &newKey.PublicIdentity)
+	if err == nil {
+		t.Fatal("failed proof stored the new key")
+	}
+
+	c.handleKeyProof(&keyProof{p: p})
+	if len(got) != 2 || got[1] != nil {
+		t.Fatalf("proof not accepted %v", got)
+	}
+	tr, err := c.trust.Get(id, &newKey.PublicIdentity)
+	if err != nil || tr.State != StateAllowed {
+		t.Errorf("new key %v %v", tr, err)
+	}
+}
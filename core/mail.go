@@ -0,0 +1,396 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/marcopeereboom/mcrypt"
+)
+
+// Received content can be exported as RFC 5322 messages into a Maildir or
+// an mbox file for tools that do not speak scomms.  Text becomes the body,
+// anything else an attachment, multipart messages keep their attachments.
+// Spool ids that were exported are appended to a state file next to the
+// target so that the next run only exports what is new.  Expired and view once content is never exported.
+
+const (
+	MailMaildir = "maildir"
+	MailMbox    = "mbox"
+
+	mailStateExtension = ".scomms-exported"
+	mailLineLength     = 76 // of base64 attachments
+)
+
+// mailStateFile returns the file that lists what was exported to target.
+func mailStateFile(format, target string) string {
+	if format == MailMaildir {
+		return filepath.Join(target, mailStateExtension)
+	}
+	return target + mailStateExtension
+}
+
+// readMailState returns the spool ids that were exported before.
+func readMailState(filename string) (map[string]bool, error) {
+	done := make(map[string]bool)
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return done, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		done[s.Text()] = true
+	}
+	return done, s.Err()
+}
+
+// mailHeader encodes a header value that may not be ASCII.
+func mailHeader(s string) string {
+	return mime.QEncoding.Encode("utf-8", s)
+}
+
+// isMailText reports whether content becomes the message body.  The GTK
+// frontend sends plain text as message/rfc822.
+func isMailText(mimeType string, content []byte) bool {
+	if mimeType != "" && !strings.HasPrefix(mimeType, "text/") &&
+		mimeType != "message/rfc822" {
+		return false
+	}
+	return utf8.Valid(content)
+}
+
+// mailAttachment is a part that is attached instead of shown inline.
+type mailAttachment struct {
+	filename string
+	mime     string
+	content  []byte
+}
+
+// mailParts splits content into the message body and attachments.
+func mailParts(se *SpoolEntry, content []byte) ([]byte, []*mailAttachment,
+	error) {
+	if !IsMultipart(se.Meta.Mime) {
+		if isMailText(se.Meta.Mime, content) {
+			return content, nil, nil
+		}
+		return []byte(fmt.Sprintf("%v sent %v (%v bytes).\r\n",
+				se.From, se.Filename, len(content))),
+			[]*mailAttachment{{
+				filename: se.Filename,
+				mime:     se.Meta.Mime,
+				content:  content,
+			}}, nil
+	}
+
+	mr, err := multipartReader(se.Meta.Mime, bytes.NewReader(content))
+	if err != nil {
+		return nil, nil, err
+	}
+	var body []byte
+	attachments := make([]*mailAttachment, 0)
+	for i := 0; ; i++ {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		b, err := ioutil.ReadAll(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		if i == 0 {
+			body = b
+			continue
+		}
+		filename := p.FileName()
+		if filename == "" {
+			filename = fmt.Sprintf("attachment%v", i)
+		}
+		attachments = append(attachments, &mailAttachment{
+			filename: filename,
+			mime:     p.Header.Get("Content-Type"),
+			content:  b,
+		})
+	}
+	return body, attachments, nil
+}
+
+// mailMessage returns se as an RFC 5322 message to address with LF line
+// endings.
+func mailMessage(se *SpoolEntry, to string, content []byte) ([]byte, error) {
+	var b bytes.Buffer
+	h := func(k, v string) {
+		fmt.Fprintf(&b, "%v: %v\r\n", k, v)
+	}
+	h("From", "<"+se.From+">")
+	h("To", "<"+to+">")
+	h("Date", se.Meta.Created.Format(time.RFC1123Z))
+	h("Subject", mailHeader(se.Filename))
+	messageId := se.Id
+	if se.Meta.MessageId != "" {
+		messageId = se.Meta.MessageId
+	}
+	h("Message-ID", "<"+messageId+"@scomms>")
+	if se.Meta.InReplyTo != "" {
+		// lets mail clients thread replies
+		h("In-Reply-To", "<"+se.Meta.InReplyTo+"@scomms>")
+	}
+	h("MIME-Version", "1.0")
+	h("X-Scomms-Filename", mailHeader(se.Filename))
+	if se.Meta.Mime != "" {
+		h("X-Scomms-Mime", se.Meta.Mime)
+	}
+
+	text := func(w io.Writer, body []byte) error {
+		qp := quotedprintable.NewWriter(w)
+		_, err := qp.Write(body)
+		if err != nil {
+			return err
+		}
+		return qp.Close()
+	}
+
+	body, attachments, err := mailParts(se, content)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(attachments) == 0 {
+		mimeType := se.Meta.Mime
+		if mimeType == "" || mimeType == "message/rfc822" ||
+			IsMultipart(mimeType) {
+			mimeType = "text/plain"
+		}
+		h("Content-Type", mime.FormatMediaType(mimeType,
+			map[string]string{"charset": "utf-8"}))
+		h("Content-Transfer-Encoding", "quoted-printable")
+		b.WriteString("\r\n")
+		err := text(&b, body)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.Replace(b.Bytes(), []byte("\r\n"), []byte("\n"),
+			-1), nil
+	}
+
+	mw := multipart.NewWriter(&b)
+	h("Content-Type", mime.FormatMediaType("multipart/mixed",
+		map[string]string{"boundary": mw.Boundary()}))
+	b.WriteString("\r\n")
+
+	th := make(textproto.MIMEHeader)
+	th.Set("Content-Type", "text/plain; charset=utf-8")
+	th.Set("Content-Transfer-Encoding", "quoted-printable")
+	w, err := mw.CreatePart(th)
+	if err != nil {
+		return nil, err
+	}
+	err = text(w, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range attachments {
+		mimeType := a.mime
+		if mimeType == "" {
+			mimeType = "application/octet-stream"
+		}
+		ah := make(textproto.MIMEHeader)
+		ah.Set("Content-Type", mime.FormatMediaType(mimeType,
+			map[string]string{"name": a.filename}))
+		ah.Set("Content-Disposition", mime.FormatMediaType("attachment",
+			map[string]string{"filename": a.filename}))
+		ah.Set("Content-Transfer-Encoding", "base64")
+		w, err = mw.CreatePart(ah)
+		if err != nil {
+			return nil, err
+		}
+		enc := base64.StdEncoding.EncodeToString(a.content)
+		for len(enc) > 0 {
+			n := mailLineLength
+			if n > len(enc) {
+				n = len(enc)
+			}
+			_, err = io.WriteString(w, enc[:n]+"\r\n")
+			if err != nil {
+				return nil, err
+			}
+			enc = enc[n:]
+		}
+	}
+	err = mw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Replace(b.Bytes(), []byte("\r\n"), []byte("\n"), -1), nil
+}
+
+// writeMaildir delivers message into the Maildir target.
+func writeMaildir(target string, se *SpoolEntry, message []byte) error {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	host = strings.NewReplacer("/", "_", ":", "_").Replace(host)
+	name := fmt.Sprintf("%v.%v.%v", se.Meta.Created.Unix(), se.Id, host)
+	tmp := filepath.Join(target, "tmp", name)
+	err = ioutil.WriteFile(tmp, message, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(target, "new", name))
+}
+
+// writeMbox appends message to the mbox f, mboxrd quoting From lines.
+func writeMbox(f io.Writer, se *SpoolEntry, message []byte) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From %v %v\n", se.From,
+		se.Meta.Created.UTC().Format(time.ANSIC))
+	for _, line := range bytes.SplitAfter(message, []byte("\n")) {
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			b.WriteByte('>')
+		}
+		b.Write(line)
+	}
+	if !bytes.HasSuffix(message, []byte("\n")) {
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	_, err := f.Write(b.Bytes())
+	return err
+}
+
+// ExportMail exports received content that was not exported to target
+// before.  Format is MailMaildir, target is created if needed, or MailMbox,
+// target is appended to.  It returns the number of messages exported.
+func ExportMail(dir string, id *mcrypt.Identity, format, target string) (int,
+	error) {
+
+	if format != MailMaildir && format != MailMbox {
+		return 0, fmt.Errorf("invalid format %v", format)
+	}
+	if !filepath.IsAbs(target) {
+		return 0, fmt.Errorf("not an absolute path: %v", target)
+	}
+
+	var mbox *os.File
+	if format == MailMaildir {
+		for _, sub := range []string{"tmp", "new", "cur"} {
+			err := os.MkdirAll(filepath.Join(target, sub), 0700)
+			if err != nil {
+				return 0, err
+			}
+		}
+	} else {
+		var err error
+		mbox, err = os.OpenFile(target, os.O_WRONLY|os.O_APPEND|
+			os.O_CREATE, 0600)
+		if err != nil {
+			return 0, err
+		}
+		defer mbox.Close()
+	}
+
+	stateFile := mailStateFile(format, target)
+	done, err := readMailState(stateFile)
+	if err != nil {
+		return 0, err
+	}
+	state, err := os.OpenFile(stateFile, os.O_WRONLY|os.O_APPEND|
+		os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer state.Close()
+
+	entries, err := SpoolList(dir, id)
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Meta.Created.Before(entries[j].Meta.Created)
+	})
+
+	n := 0
+	now := time.Now()
+	for _, se := range entries {
+		if done[se.Id] || se.Meta.ViewOnce || se.Expired(now) {
+			continue
+		}
+		r, err := SpoolOpen(dir, id, se.Id)
+		if err != nil {
+			return n, err
+		}
+		content, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return n, err
+		}
+		message, err := mailMessage(se, id.PublicIdentity.Address,
+			content)
+		if err != nil {
+			return n, err
+		}
+		if format == MailMaildir {
+			err = writeMaildir(target, se, message)
+		} else {
+			err = writeMbox(mbox, se, message)
+		}
+		if err != nil {
+			return n, err
+		}
+		_, err = fmt.Fprintln(state, se.Id)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// handleMailExport exports on behalf of the UI and pops up the outcome.
+func (c *Core) handleMailExport(m *MailExport) {
+	n, err := ExportMail(c.scommsDir, c.identity, m.Format, m.Target)
+	if err != nil {
+		c.popup("Mail export failed", "%v messages exported to %v: %v",
+			n, m.Target, err)
+		return
+	}
+	c.popup("Mail export", "%v messages exported to %v", n, m.Target)
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcopeereboom/mcrypt"
+)
+
+var mailBinary = []byte{0, 1, 2, 0xff, 'F', 'r', 'o', 'm'}
+
+func mailSpool(t *testing.T, dir string, id *mcrypt.Identity, filename,
+	mimeType string, content []byte, viewOnce bool) {
+
+	_, err := spoolWrite(dir, id, &MetaRecord{
+		Mime:     mimeType,
+		Created:  time.Date(2014, 6, 15, 12, 0, 0, 0, time.UTC),
+		From:     "bob@example.com",
+		Filename: filename,
+		ViewOnce: viewOnce,
+	}, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// openMail returns a spool in a new directory that holds notes.txt,
+// blob.bin and the view once secret.txt from bob.  The caller removes the
+// directory.
+func openMail(t *testing.T) (string, *mcrypt.Identity) {
+	dir, err := ioutil.TempDir(os.TempDir(), "mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := mcrypt.NewIdentity("Alice", "alice@example.com")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	mailSpool(t, dir, id, "notes.txt", "text/plain",
+		[]byte("hello\nFrom the start\n"), false)
+	mailSpool(t, dir, id, "blob.bin", "application/octet-stream",
+		mailBinary, false)
+	mailSpool(t, dir, id, "secret.txt", "text/plain", []byte("once"), true)
+	return dir, id
+}
+
+func TestMailInvalid(t *testing.T) {
+	dir, id := openMail(t)
+	defer os.RemoveAll(dir)
+
+	_, err := ExportMail(dir, id, "zip", dir+"/x")
+	if err == nil {
+		t.Error("invalid format should have tripped")
+	}
+	_, err = ExportMail(dir, id, MailMbox, "relative")
+	if err == nil {
+		t.Error("relative path should have tripped")
+	}
+}
+
+// checkMail verifies a message exported by ExportMail.
+func checkMail(t *testing.T, m *mail.Message) {
+	if m.Header.Get("From") != "<bob@example.com>" ||
+		m.Header.Get("To") != "<alice@example.com>" {
+		t.Errorf("addresses %v", m.Header)
+		return
+	}
+	date, err := m.Header.Date()
+	if err != nil || !date.Equal(time.Date(2014, 6, 15, 12, 0, 0, 0,
+		time.UTC)) {
+		t.Errorf("date %v %v", date, err)
+		return
+	}
+	mt, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	switch m.Header.Get("Subject") {
+	case "notes.txt":
+		body, err := ioutil.ReadAll(quotedprintable.NewReader(m.Body))
+		if err != nil || mt != "text/plain" ||
+			string(body) != "hello\nFrom the start\n" {
+			t.Errorf("text %v %q %v", mt, body, err)
+		}
+	case "blob.bin":
+		if mt != "multipart/mixed" {
+			t.Errorf("blob %v", mt)
+			return
+		}
+		mr := multipart.NewReader(m.Body, params["boundary"])
+		_, err = mr.NextPart()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body, err := ioutil.ReadAll(base64.NewDecoder(
+			base64.StdEncoding, p))
+		if err != nil || p.FileName() != "blob.bin" ||
+			p.Header.Get("Content-Type") !=
+				"application/octet-stream; name=blob.bin" ||
+			!bytes.Equal(body, mailBinary) {
+			t.Errorf("attachment %v %v %v", p.Header, body, err)
+		}
+	default:
+		t.Errorf("unexpected message %v", m.Header)
+	}
+}
+
+func TestMailMaildir(t *testing.T) {
+	dir, id := openMail(t)
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "Maildir")
+	n, err := ExportMail(dir, id, MailMaildir, target)
+	if err != nil || n != 2 {
+		t.Fatalf("export %v %v", n, err)
+	}
+	fis, err := ioutil.ReadDir(filepath.Join(target, "new"))
+	if err != nil || len(fis) != 2 {
+		t.Fatalf("new %v %v", fis, err)
+	}
+	for _, fi := range fis {
+		b, err := ioutil.ReadFile(filepath.Join(target, "new", fi.Name()))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		m, err := mail.ReadMessage(bytes.NewReader(b))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		checkMail(t, m)
+	}
+
+	// only what is new is exported again
+	n, err = ExportMail(dir, id, MailMaildir, target)
+	if err != nil || n != 0 {
+		t.Fatalf("second export %v %v", n, err)
+	}
+	mailSpool(t, dir, id, "later.txt", "text/plain", []byte("later"), false)
+	n, err = ExportMail(dir, id, MailMaildir, target)
+	if err != nil || n != 1 {
+		t.Errorf("incremental export %v %v", n, err)
+	}
+}
+
+func TestMailMbox(t *testing.T) {
+	dir, id := openMail(t)
+	defer os.RemoveAll(dir)
+	mailSpool(t, dir, id, "later.txt", "text/plain", []byte("later"), false)
+
+	target := filepath.Join(dir, "mbox")
+	n, err := ExportMail(dir, id, MailMbox, target)
+	if err != nil || n != 3 {
+		t.Fatalf("export %v %v", n, err)
+	}
+	b, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte("\n>From the start")) {
+		t.Errorf("From line not quoted")
+	}
+
+	messages := strings.Split(string(b), "\n\nFrom bob@example.com ")
+	if len(messages) != 3 || !strings.HasPrefix(messages[0],
+		"From bob@example.com Sun Jun 15 12:00:00 2014\n") {
+		t.Fatalf("unexpected mbox %q", b)
+	}
+	for i, v := range messages {
+		// messages end in a blank line, drop it with the From line and
+		// undo the quoting
+		if i == len(messages)-1 {
+			v = strings.TrimSuffix(v, "\n")
+		} else {
+			v += "\n"
+		}
+		v = v[strings.Index(v, "\n")+1:]
+		v = strings.Replace(v, "\n>From ", "\nFrom ", -1)
+		m, err := mail.ReadMessage(strings.NewReader(v))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if m.Header.Get("Subject") == "later.txt" {
+			continue
+		}
+		checkMail(t, m)
+	}
+}
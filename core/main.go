@@ -18,11 +18,14 @@ package core
 
 import (
 	"fmt"
+	"io/ioutil"
 	stdlog "log"
 	"os"
 	"os/user"
 	"runtime"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/marcopeereboom/dbglog"
 	"github.com/marcopeereboom/mcrypt"
@@ -52,12 +55,41 @@ type Core struct {
 	identity *mcrypt.Identity
 
 	// net
-	s *Server
+	s         *Server
+	listeners []string
+
+	// hosted domain, nil when not hosting
+	domain *Domain
 
 	// trust database
-	trust           *Trust
-	mtxVerifyWaiter sync.Mutex
-	verifyWaiters   map[string]func()
+	trust *Trust
+
+	// received content index
+	inbox *Inbox
+
+	// blinded word index, nil until the identity is known
+	search *Search
+
+	// user settings
+	config *Config
+
+	// serializes quota checks and storing content
+	mtxQuota sync.Mutex
+
+	// serializes adding and removing spool entries, content may only be
+	// removed while nothing can start referring to it
+	mtxSpool sync.Mutex
+
+	// expired content sweeper
+	sweepOnce sync.Once
+
+	// security audit log, nil until the identity is known
+	audit *Audit
+
+	// open prompts
+	mtxPrompts sync.Mutex
+	promptId   PromptId
+	prompts    map[PromptId]*prompt
 }
 
 func init() {
@@ -69,17 +101,29 @@ func (c *Core) debugCore(format string, args ...interface{}) {
 }
 
 func (c *Core) debugClient(format string, args ...interface{}) {
-	c.DebugfM(sDbgCore, "[CLNT] "+format, args...)
+	c.DebugfM(sDbgClient, "[CLNT] "+format, args...)
 }
 
 func (c *Core) debugServer(format string, args ...interface{}) {
-	c.DebugfM(sDbgCore, "[SRV] "+format, args...)
+	c.DebugfM(sDbgServer, "[SRV] "+format, args...)
 }
 
 func (c *Core) DebugUi(format string, args ...interface{}) {
 	c.DebugfM(sDbgUi, "[UI] "+format, args...)
 }
 
+// Dir returns the scomms working directory.
+func (c *Core) Dir() string {
+	return c.scommsDir
+}
+
+// SetListeners overrides the addresses core listens on once the identity is
+// known.  No addresses means core does not accept incoming sessions.  Must be
+// called before the UI signals that it is ready.
+func (c *Core) SetListeners(listeners []string) {
+	c.listeners = listeners
+}
+
 func (c *Core) SendCore(m interface{}) error {
 	return c.Send(ui, []string{core}, m)
 }
@@ -88,17 +132,162 @@ func (c *Core) ReceiveUi() (*queueb.QueuebMessage, error) {
 	return c.Receive(ui)
 }
 
+// auditLog records a security relevant event.
+func (c *Core) auditLog(event string, pid *mcrypt.PublicIdentity,
+	format string, args ...interface{}) {
+	if c.audit == nil {
+		return
+	}
+	err := c.audit.Log(event, pid, format, args...)
+	if err != nil {
+		c.debugCore("auditLog %v", err)
+	}
+}
+
+// openAudit opens the audit log and complains if it does not verify.
+func (c *Core) openAudit() {
+	_, verr := VerifyAudit(c.scommsDir, c.identity)
+
+	var err error
+	c.audit, err = OpenAudit(c.scommsDir, c.identity)
+	if err != nil {
+		c.popup("Could not open audit log", "%v", err)
+		return
+	}
+	c.trust.audit = c.auditLog
+
+	if verr != nil {
+		c.auditLog(AuditVerifyFailure, nil, "%v", verr)
+		c.popup("Audit log verification failed", "%v", verr)
+	}
+}
+
+func (c *Core) renderInbox() {
+	items, err := c.inbox.List(c.identity)
+	if err != nil {
+		c.debugCore("renderInbox %v", err)
+		return
+	}
+
+	// expired items are hidden until the sweeper gets to them
+	now := time.Now()
+	shown := make([]*InboxItem, 0, len(items))
+	for _, v := range items {
+		if !v.Expired(now) {
+			shown = append(shown, v)
+		}
+	}
+	c.Send(core, []string{ui}, &UiRenderInbox{Items: shown})
+}
+
+// handleInboxOpen marks an item read and tells the UI to show it.  View once
+// items are handed to the UI and deleted.
+func (c *Core) handleInboxOpen(m *InboxOpen) {
+	item, err := c.inbox.Get(c.identity, m.Id)
+	if err == nil && item.Expired(time.Now()) {
+		err = fmt.Errorf("message expired")
+	}
+	if err != nil {
+		c.popup("Could not open message", "%v", err)
+		return
+	}
+	if item.ViewOnce {
+		c.handleViewOnce(item)
+		return
+	}
+	if !item.Read {
+		item, err = c.inbox.Mark(c.identity, m.Id, true, item.Archived,
+			item.Flagged)
+		if err != nil {
+			c.popup("Could not open message", "%v", err)
+			return
+		}
+		c.renderInbox()
+	}
+	c.Send(core, []string{ui}, &UiInboxItem{Item: item})
+}
+
+func (c *Core) handleViewOnce(item *InboxItem) {
+	r, err := SpoolOpen(c.scommsDir, c.identity, item.Id)
+	if err != nil {
+		c.popup("Could not open message", "%v", err)
+		return
+	}
+	content, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		c.popup("Could not open message", "%v", err)
+		return
+	}
+
+	// gone before it is shown so it can't be shown twice
+	err = c.inboxDelete(item.Id)
+	if err != nil {
+		c.popup("Could not delete view once message", "%v", err)
+		return
+	}
+	c.renderInbox()
+	c.renderTrust() // usage changed
+
+	item.Read = true
+	c.Send(core, []string{ui}, &UiInboxItem{Item: item, Content: content})
+}
+
+// handleAuditView sends the audit log to the UI.
+func (c *Core) handleAuditView() {
+	r := &UiRenderAudit{}
+	if c.identity == nil {
+		r.Error = "no identity"
+	} else {
+		var err error
+		r.Records, err = VerifyAudit(c.scommsDir, c.identity)
+		if err != nil {
+			r.Error = err.Error()
+		}
+	}
+	c.Send(core, []string{ui}, r)
+}
+
 func (c *Core) handleUiRenderIdentity(pid *mcrypt.PublicIdentity) {
+	if c.audit == nil {
+		c.openAudit()
+	}
+	if c.search == nil {
+		c.openSearch()
+	}
+
 	// tell UI to render identity
 	uir := &UiRenderIdentity{
 		PublicIdentity: pid,
 	}
 	c.Send(core, []string{ui}, uir)
 
+	// move content of older spool layouts into the blob store
+	c.mtxSpool.Lock()
+	migrated, err := spoolMigrate(c.scommsDir, c.identity)
+	c.mtxSpool.Unlock()
+	if err != nil {
+		c.popup("Spool migration failed", "%v", err)
+	}
+	for oldId, newId := range migrated {
+		err = c.inbox.Rename(c.identity, oldId, newId)
+		if err != nil {
+			c.debugCore("handleUiRenderIdentity: rename %v: %v",
+				oldId, err)
+		}
+	}
+
+	// pick up content that is not indexed yet, drop expired content and
+	// keep doing that
+	c.sweep()
+	c.renderTrust()
+	c.sweepOnce.Do(func() { go c.sweeper() })
+
 	// start listening
-	var err error
-	listeners := []string{":12345"}
-	c.s, err = NewServer(listeners,
+	if len(c.listeners) == 0 {
+		return
+	}
+	c.s, err = NewServer(c.listeners,
 		c.scommsDir+certFilename,
 		c.scommsDir+keyFilename,
 		c.ServerCallback)
@@ -116,6 +305,25 @@ func (c *Core) renderTrust() (err error) {
 	if err != nil {
 		return
 	}
+	sort.SliceStable(urt.TrustRecords, func(a, b int) bool {
+		return urt.TrustRecords[a].State < urt.TrustRecords[b].State
+	})
+
+	// storage used per contact
+	peers, total, err := c.quotaUsage()
+	if err != nil {
+		return
+	}
+	urt.Usage = make(map[string]*QuotaUsage, len(urt.TrustRecords))
+	urt.Total = total
+	for _, tr := range urt.TrustRecords {
+		u, ok := peers[tr.PublicIdentity.Address]
+		if !ok {
+			u = &QuotaUsage{}
+		}
+		u.MaxBytes, u.MaxMessages = peerQuota(tr, &c.config.Quota)
+		urt.Usage[tr.PublicIdentity.Address] = u
+	}
 	c.Send(core, []string{ui}, urt)
 
 	return
@@ -148,9 +356,13 @@ func (c *Core) handleIdentity() (err error) {
 			"Note that the ID domain *MUST* resolve and be " +
 			"reachable on port 12345!\n\n" +
 			"ID must be in email address format, e.g. " +
-			"jd@mydomain.com\nName is full name, e.g. John Doe\n"
+			"jd@mydomain.com\nName is full name, e.g. John Doe\n\n" +
+			"If this replaces an earlier identity copy its " +
+			"scomms.id to " + c.scommsDir + retiredDir + " so " +
+			"that contacts can verify the new key.\n"
 
 		uci := &UiConfirmIdentity{
+			Id:      c.addPrompt(&prompt{}),
 			Message: m,
 			Name:    usr.Name,
 			Address: usr.Username + "@" + host,
@@ -164,6 +376,12 @@ func (c *Core) handleIdentity() (err error) {
 func (c *Core) handleUiConfirmIdentityReply(m *UiConfirmIdentityReply) {
 	var err error
 
+	if c.takePrompt(m.Id, false) == nil {
+		c.debugCore("handleUiConfirmIdentityReply unknown prompt %v",
+			m.Id)
+		return
+	}
+
 	// add some sort of dialog for failures
 	if m.Error != nil {
 		c.debugCore("handleUiConfirmIdentityReply %v", m.Error)
@@ -194,13 +412,71 @@ func (c *Core) popup(title, format string, args ...interface{}) {
 	c.Send(core, []string{ui}, pu)
 }
 
+// sendFileResult tells the UI how sending a file ended.
+func (c *Core) sendFileResult(sf *SendFile, err error) {
+	r := &UiSendFileResult{
+		To:       sf.To,
+		Filename: sf.Filename,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	c.Send(core, []string{ui}, r)
+}
+
+// sendFile connects to the recipient of sf and sends it once it is trusted.
+func (c *Core) sendFile(sf *SendFile) {
+	// get connected
+	client, err := c.p2pConnect(sf.To)
+	if err != nil {
+		c.popup("Connection Failed", "%v", err)
+		c.sendFileResult(sf, err)
+		return
+	}
+	c.verifyHost(sf.To, client, func(err error) {
+		if err != nil {
+			c.sendFileResult(sf, err)
+			return
+		}
+		c.handleSendFile(client, sf)
+	})
+}
+
+// sendTag sends a copy of sf to every allowed contact carrying tag, each
+// copy is answered with its own UiSendFileResult.
+func (c *Core) sendTag(tag string, sf *SendFile) {
+	trs, err := c.trust.ListByState(c.identity, StateAllowed)
+	if err == nil {
+		trs = Tagged(trs, tag)
+		if len(trs) == 0 {
+			err = fmt.Errorf("no allowed contacts tagged %v", tag)
+		}
+	}
+	if err != nil {
+		c.popup("Send file failed", "%v", err)
+		c.sendFileResult(sf, err)
+		return
+	}
+	for _, tr := range trs {
+		m := *sf
+		m.To = tr.PublicIdentity.Address
+		c.sendFile(&m)
+	}
+}
+
 func (c *Core) handleSendFile(client *Client, sf *SendFile) {
+	var err error
+	defer func() {
+		client.conn.Close()
+		c.sendFileResult(sf, err)
+	}()
+
 	// go to message phase
 	confirmation := Confirmation{
 		LookingFor:   sf.To,
-		MaxFrameSize: 10 * 1024 * 1024,
+		MaxFrameSize: maxFrameSize,
 	}
-	err := client.ConfirmationPhase(&confirmation)
+	err = client.ConfirmationPhase(&confirmation)
 	if err != nil {
 		c.popup("Confirmation failed", "%v", err)
 		return
@@ -211,11 +487,39 @@ func (c *Core) handleSendFile(client *Client, sf *SendFile) {
 		return
 	}
 
-	err = client.Session.SendFile(sf)
+	var rsf *RpcSendFile
+	rsf, err = sf.rpc()
+	if err == nil {
+		percent := int64(-1)
+		client.Session.progress = func(sent, total int64) {
+			if sent*100/total == percent {
+				return
+			}
+			percent = sent * 100 / total
+			c.Send(core, []string{ui}, &UiSendProgress{
+				To:       sf.To,
+				Filename: rsf.Filename,
+				Sent:     sent,
+				Total:    total,
+			})
+		}
+		if client.confirmation.Hosted {
+			// domain host stores content for peer, keep it end to
+			// end
+			err = client.Session.SendSealedFile(c.identity, rsf)
+		} else {
+			err = client.Session.SendFile(rsf)
+		}
+	}
 	if err != nil {
 		c.popup("Send file failed", "%v", err)
 		return
 	}
+
+	// the message was sent, failing to keep a copy is not fatal
+	if err := c.sentAdd(sf.To, rsf); err != nil {
+		c.debugCore("handleSendFile sentAdd %v", err)
+	}
 }
 
 func (c *Core) p2pConnect(host string) (*Client, error) {
@@ -229,12 +533,19 @@ func (c *Core) p2pConnect(host string) (*Client, error) {
 	return client, nil
 }
 
-func (c *Core) verifyHost(host string, client *Client, callback func()) {
+// errVerifyCanceled is handed to verify waiters when the user did not make a
+// trust decision.
+var errVerifyCanceled = fmt.Errorf("You canceled trust")
+
+// verifyHost calls callback with a nil error once the remote identity is
+// trusted.  On failure the connection is closed and callback gets the error.
+func (c *Core) verifyHost(host string, client *Client,
+	callback func(error)) {
 	c.debugCore("verifyHost")
 
 	// this is very tricky code!
 	// read at least twice before throwing your hands up in the air!
-	finishVerify := func() {
+	finishVerify := func(canceled error) {
 		err := fmt.Errorf("Impossible condition: Error not set " +
 			"in verifyHost")
 		defer func() {
@@ -242,11 +553,15 @@ func (c *Core) verifyHost(host string, client *Client, callback func()) {
 				client.Session.conn.Close()
 				c.popup("Public Identity Verification Failed",
 					"%v", err)
-				return
 			}
-			callback()
+			callback(err)
 		}()
 
+		if canceled != nil {
+			err = canceled
+			return
+		}
+
 		tr, err := c.trust.Get(c.identity, client.Session.peer)
 		if err != nil {
 			err = fmt.Errorf("Could not read trust record: %v", err)
@@ -259,6 +574,8 @@ func (c *Core) verifyHost(host string, client *Client, callback func()) {
 		case StateDenied:
 			err = fmt.Errorf("You previously denied to trust " +
 				"this identity")
+			c.auditLog(AuditDenied, client.Session.peer,
+				"outgoing to %v", host)
 			return
 		case StateQueued:
 			err = fmt.Errorf("Remote has queued your " +
@@ -267,13 +584,15 @@ func (c *Core) verifyHost(host string, client *Client, callback func()) {
 			return
 		default:
 			// really can't happen
-			err = fmt.Errorf("You canceled trust")
-			c.removeVerifyWaiter(client.Session.peer)
+			err = errVerifyCanceled
 			return
 		}
 
 		// do more test here
 		if *tr.PublicIdentity.Key != *client.Session.peer.Key {
+			c.auditLog(AuditMismatch, client.Session.peer,
+				"contacted %v fingerprint %v", host,
+				tr.PublicIdentity.Fingerprint())
 			err = fmt.Errorf("Fingerprint does not match public "+
 				"identity fingerprint \n\nContacted %v and "+
 				"reply came from %v",
@@ -282,6 +601,8 @@ func (c *Core) verifyHost(host string, client *Client, callback func()) {
 			return
 		}
 		if host != client.Session.peer.Address {
+			c.auditLog(AuditMismatch, client.Session.peer,
+				"contacted address %v", host)
 			err = fmt.Errorf("Address does not match public "+
 				"identity address \n\nContacted %v and reply "+
 				"came from %v", host,
@@ -292,64 +613,128 @@ func (c *Core) verifyHost(host string, client *Client, callback func()) {
 
 	// check if we know this host
 	c.debugCore("trust get")
-	_, err := c.trust.Get(c.identity, client.peer)
+	tr, err := c.trust.Get(c.identity, client.peer)
 	c.debugCore("trust get %v", err)
 	if err != nil {
+		tr = nil
+	}
+
+	// a key for an address we know needs more than a fingerprint
+	previous, err := c.keyChange(c.trust, host, client.peer, tr)
+	if err != nil {
+		c.debugCore("verifyHost keyChange %v", err)
+	}
+	switch {
+	case previous != nil:
+		c.auditLog(AuditKeyChange, client.Session.peer,
+			"contacted %v, previous fingerprint %v", host,
+			previous.PublicIdentity.Fingerprint())
+		c.promptKeyChange(host, client.Session.peer, previous,
+			finishVerify)
+	case tr == nil:
 		cpid := &UiConfirmPublicIdentity{
 			PublicIdentity: client.peer,
 		}
-		c.Send(core, []string{ui}, cpid)
 
 		// wait for something
-		c.addVerifyWaiter(client.Session.peer, finishVerify)
-	} else {
-		finishVerify()
+		cpid.Id = c.addPrompt(&prompt{
+			pid:      client.Session.peer,
+			callback: finishVerify,
+		})
+		c.Send(core, []string{ui}, cpid)
+	default:
+		finishVerify(nil)
 	}
 }
 
-func (c *Core) _removeVerifyWaiter(pid *mcrypt.PublicIdentity) {
-	c.debugCore("_removeVerifyWaiter %v", pid.Fingerprint())
-	delete(c.verifyWaiters, pid.Fingerprint())
-}
-
-func (c *Core) removeVerifyWaiter(pid *mcrypt.PublicIdentity) {
-	c.mtxVerifyWaiter.Lock()
-	defer c.mtxVerifyWaiter.Unlock()
-
-	c._removeVerifyWaiter(pid)
-}
+// handleUiConfirmPublicIdentityReply records the trust decision and
+// completes the verification that prompted for it.
+func (c *Core) handleUiConfirmPublicIdentityReply(m *UiConfirmPublicIdentityReply) {
+	c.debugCore("%T %v %v", m, m.Id, m.State)
 
-func (c *Core) addVerifyWaiter(pid *mcrypt.PublicIdentity, callback func()) {
-	c.debugCore("addVerifyWaiter %v", pid.Fingerprint())
-
-	c.mtxVerifyWaiter.Lock()
-	defer c.mtxVerifyWaiter.Unlock()
+	p := c.takePrompt(m.Id, true)
+	if p == nil {
+		c.debugCore("%T unknown prompt %v", m, m.Id)
+		return
+	}
 
-	_, ok := c.verifyWaiters[pid.Fingerprint()]
-	if ok {
-		c.popup("Public Identity Verification Failed",
-			"Impossible condition, check code at %v",
-			"addVerifyWaiter")
+	switch m.State {
+	case StateAllowed:
+	case StateDenied:
+	case StateQueued:
+		// decide later, remember that we have seen it
+		err := c.trust.Add(c.identity, p.pid, StateQueued,
+			c.peerDefaults(), false)
+		if err != nil {
+			c.debugCore("%T %v", m, err)
+		}
+		c.renderTrust()
+		p.callback(fmt.Errorf("Trust decision deferred"))
+		return
+	default:
+		p.callback(errVerifyCanceled)
+		return
+	}
+	err := c.trust.Add(c.identity, p.pid, m.State, c.peerDefaults(),
+		false)
+	if err != nil {
+		c.popup("Could not add "+p.pid.Address+
+			"to the trust database", "%v", err)
+		p.callback(err)
 		return
 	}
-	c.verifyWaiters[pid.Fingerprint()] = callback
+	c.renderTrust()
+
+	p.callback(nil)
 }
 
-func (c *Core) handleVerifyWaiter(pid *mcrypt.PublicIdentity) {
-	c.debugCore("handleVerifyWaiter %v", pid.Fingerprint())
+// handleTrustHistory sends the versions of the trust record of pid.
+func (c *Core) handleTrustHistory(pid *mcrypt.PublicIdentity) {
+	r := &UiRenderTrustHistory{PublicIdentity: pid}
+	if pid == nil || pid.Key == nil {
+		r.Error = "no public identity"
+	} else {
+		var err error
+		r.Versions, err = c.trust.History(c.identity, pid)
+		if err != nil {
+			r.Error = err.Error()
+		}
+	}
+	c.Send(core, []string{ui}, r)
+}
 
-	c.mtxVerifyWaiter.Lock()
-	defer c.mtxVerifyWaiter.Unlock()
+// handleUpdateTrustRecord stores tr.  Allowing a key while another key of
+// the address is allowed is a key change and prompts for it instead.
+func (c *Core) handleUpdateTrustRecord(tr *TrustRecord) {
+	pid := tr.PublicIdentity
+	if tr.State == StateAllowed {
+		previous, err := c.keyChange(c.trust, pid.Address, pid, tr)
+		if err != nil {
+			c.popup("Could not update "+pid.Address+" in the trust "+
+				"database", "%v", err)
+			return
+		}
+		if previous != nil {
+			c.auditLog(AuditKeyChange, pid, "allowed, previous "+
+				"fingerprint %v",
+				previous.PublicIdentity.Fingerprint())
+			c.promptKeyChange(pid.Address, pid, previous,
+				func(err error) {
+					if err != nil && err != errVerifyCanceled {
+						c.popup("Key change", "%v", err)
+					}
+				})
+			return
+		}
+	}
 
-	callback, ok := c.verifyWaiters[pid.Fingerprint()]
-	if !ok {
-		c.popup("Public Identity Verification Failed",
-			"Impossible condition, check code at %v",
-			"handleVerifyWaiter")
+	err := c.trust.Update(c.identity, tr)
+	if err != nil {
+		c.popup("Could not update  "+pid.Address+
+			"in the trust database", "%v", err)
 		return
 	}
-	callback()
-	c._removeVerifyWaiter(pid)
+	c.renderTrust()
 }
 
 // handleIncoming decodes and handles incomming ui messages.
@@ -359,30 +744,47 @@ func (c *Core) handleIncoming(msg *queueb.QueuebMessage) {
 		c.handleUiConfirmIdentityReply(m)
 
 	case *UiConfirmPublicIdentityReply:
-		c.debugCore("%T %v", m, m.State)
-		switch m.State {
-		case StateAllowed:
-		case StateDenied:
-		default:
-			c.removeVerifyWaiter(m.PublicIdentity)
+		c.handleUiConfirmPublicIdentityReply(m)
+	case *UiKeyChangeReply:
+		c.handleUiKeyChangeReply(m)
+	case *keyProof:
+		c.handleKeyProof(m)
+
+	case *UpdateTrustRecord:
+		c.handleUpdateTrustRecord(m.TrustRecord)
+
+	case *TrustHistoryView:
+		c.handleTrustHistory(m.PublicIdentity)
+
+	case *TrustRevert:
+		if m.PublicIdentity == nil || m.PublicIdentity.Key == nil {
+			c.debugCore("%T no public identity", m)
 			return
 		}
-		err := c.trust.Add(c.identity, m.PublicIdentity, m.State,
-			nil, false)
+		err := c.trust.Revert(c.identity, m.PublicIdentity, m.Version)
 		if err != nil {
-			c.popup("Could not add "+m.PublicIdentity.Address+
-				"to the trust database", "%v", err)
+			c.Send(core, []string{ui}, &UiRenderTrustHistory{
+				PublicIdentity: m.PublicIdentity,
+				Error:          "Could not revert: " + err.Error(),
+			})
 			return
 		}
 		c.renderTrust()
+		c.handleTrustHistory(m.PublicIdentity)
 
-		c.handleVerifyWaiter(m.PublicIdentity)
-
-	case *UpdateTrustRecord:
-		err := c.trust.Update(c.identity, m.TrustRecord)
+	case *TrustDelete:
+		if m.PublicIdentity == nil || m.PublicIdentity.Key == nil {
+			c.debugCore("%T no public identity", m)
+			return
+		}
+		f := c.trust.Delete
+		if m.Forget {
+			f = c.trust.Forget
+		}
+		err := f(c.identity, m.PublicIdentity)
 		if err != nil {
-			c.popup("Could not update  "+m.TrustRecord.PublicIdentity.Address+
-				"in the trust database", "%v", err)
+			c.popup("Could not delete "+m.PublicIdentity.Address+
+				" from the trust database", "%v", err)
 			return
 		}
 		c.renderTrust()
@@ -396,14 +798,47 @@ func (c *Core) handleIncoming(msg *queueb.QueuebMessage) {
 		c.Send(core, []string{ui}, &Exit{})
 
 	case *SendFile:
-		// get connected
-		client, err := c.p2pConnect(m.To)
+		if tag, ok := SendTag(m.To); ok {
+			c.sendTag(tag, m)
+			return
+		}
+		c.sendFile(m)
+
+	case *FetchMailbox:
+		go c.handleFetchMailbox()
+
+	case *AuditView:
+		c.handleAuditView()
+
+	case *InboxOpen:
+		c.handleInboxOpen(m)
+
+	case *InboxSearch:
+		c.handleInboxSearch(m)
+
+	case *MailExport:
+		c.handleMailExport(m)
+
+	case *HistoryView:
+		c.handleHistoryView(m)
+
+	case *InboxMark:
+		_, err := c.inbox.Mark(c.identity, m.Id, m.Read, m.Archived,
+			m.Flagged)
+		if err != nil {
+			c.popup("Could not update message", "%v", err)
+			return
+		}
+		c.renderInbox()
+
+	case *InboxDelete:
+		err := c.inboxDelete(m.Id)
 		if err != nil {
-			c.popup("Connection Failed", "%v", err)
+			c.popup("Could not delete message", "%v", err)
 			return
 		}
-		c.verifyHost(m.To, client,
-			func() { c.handleSendFile(client, m) })
+		c.renderInbox()
+		c.renderTrust() // usage changed
 
 	default:
 		c.debugCore("unhandled message %T", msg.Message)
@@ -435,13 +870,23 @@ func (c *Core) Start() {
 	}()
 }
 
+// DefaultDir returns the scomms working directory of the current user.
+func DefaultDir() (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return usr.HomeDir + scommsDir, nil
+}
+
 func New() (*Core, error) {
 	var err error
 
 	// setup logging
 	c := Core{
-		DbgLogger:     dbglog.New(os.Stderr, "", stdlog.LstdFlags),
-		verifyWaiters: make(map[string]func()),
+		DbgLogger: dbglog.New(os.Stderr, "", stdlog.LstdFlags),
+		prompts:   make(map[PromptId]*prompt),
+		listeners: []string{":12345"},
 	}
 	var mask uint64
 	mask |= sDbgUi
@@ -466,20 +911,29 @@ func New() (*Core, error) {
 	}
 
 	// setup paths
-	usr, err := user.Current()
+	c.scommsDir, err = DefaultDir()
 	if err != nil {
 		return nil, err
 	}
-	c.scommsDir = usr.HomeDir + scommsDir
 	err = os.MkdirAll(c.scommsDir, 0700)
 	if err != nil {
 		return nil, err
 	}
 
+	c.config, err = LoadConfig(c.scommsDir)
+	if err != nil {
+		return nil, fmt.Errorf("config: %v", err)
+	}
+
 	c.trust, err = NewTrust(c.scommsDir)
 	if err != nil {
 		return nil, err
 	}
 
+	c.inbox, err = NewInbox(c.scommsDir)
+	if err != nil {
+		return nil, err
+	}
+
 	return &c, nil
 }
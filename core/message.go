@@ -16,6 +16,8 @@
 package core
 
 import (
+	"time"
+
 	"github.com/marcopeereboom/mcrypt"
 )
 
@@ -25,11 +27,121 @@ type Shutdown struct{}
 // signal queueb loop to exit
 type Exit struct{}
 
-// signal core to send file
+// signal core to send a file, the mime type is sniffed when Mime is empty;
+// with Body and Attachments, which are filenames, a multipart message is sent
+// instead and a Body alone is sent as text of type Mime or BodyMime.  Expire
+// and ViewOnce ask the receiver to delete it after a while or once it was
+// shown, see ParseExpiry.  InReplyTo is the message id of the message this
+// answers and To may be TagPrefix followed by a tag to send a copy to every
+// allowed contact with that tag
 type SendFile struct {
+	To          string
+	Filename    string
+	Mime        string
+	Body        string
+	Attachments []string
+	Expire      time.Duration
+	ViewOnce    bool
+	InReplyTo   string
+}
+
+// signal UI how much of a file was sent, Sent and Total are bytes on the wire
+type UiSendProgress struct {
+	To       string
+	Filename string
+	Sent     int64
+	Total    int64
+}
+
+// signal UI that core is done sending a file, Error is empty on success
+type UiSendFileResult struct {
 	To       string
 	Filename string
+	Error    string
+}
+
+// signal UI that a message was received
+type UiNewMessage struct {
+	Id       string
+	From     string
+	Filename string
 	Mime     string
+	Size     int64
+}
+
+// signal UI to render the inbox
+type UiRenderInbox struct {
+	Items []*InboxItem
+}
+
+// signal core to open an inbox item, core marks it read
+type InboxOpen struct {
+	Id string
+}
+
+// signal UI to show an inbox item, content is read with SpoolOpen
+// view once items are deleted right away and carry Content instead
+type UiInboxItem struct {
+	Item    *InboxItem
+	Content []byte
+}
+
+// signal core to search the inbox, see ParseQuery
+type InboxSearch struct {
+	Query string
+}
+
+// signal UI to render search results, Error is set if the query failed
+type UiSearchResult struct {
+	Query string
+	Items []*InboxItem
+	Error string
+}
+
+// signal core to export received messages, Format is MailMaildir or MailMbox
+// and Target an absolute path; core answers with a popup
+type MailExport struct {
+	Format string
+	Target string
+}
+
+// signal core to send the conversation with a peer, sent and received
+type HistoryView struct {
+	Peer string
+}
+
+// signal UI to render a conversation, Error is set if it could not be read
+// message text is read with ThreadOpen
+type UiRenderHistory struct {
+	Peer    string
+	Threads []*Thread
+	Error   string
+}
+
+// signal core to set inbox item flags, flagged items are kept regardless of
+// retention
+type InboxMark struct {
+	Id       string
+	Read     bool
+	Archived bool
+	Flagged  bool
+}
+
+// signal core to delete an inbox item and its content
+type InboxDelete struct {
+	Id string
+}
+
+// signal core to collect our mailbox from the domain host
+type FetchMailbox struct{}
+
+// signal core to send the audit log
+type AuditView struct{}
+
+// signal UI to render the audit log, Error is set if it did not verify
+type UiRenderAudit struct {
+	Records []*AuditRecord
+	Error   string
 }
 
 // signal core that the UI is up and running
@@ -48,18 +160,24 @@ type UiRenderIdentity struct {
 
 // signal UI to render dialog to confirm identity
 type UiConfirmIdentity struct {
+	Id      PromptId
 	Message string
 	Name    string
 	Address string
 }
 
-// signal UI to render identity
+// signal UI to render trust records
+// Usage is storage used by address, Total by everybody
 type UiRenderTrust struct {
 	TrustRecords []*TrustRecord
+	Usage        map[string]*QuotaUsage
+	Total        *QuotaUsage
 }
 
 //signal core that the UI has obtained an identity
+//Id must be the Id of the UiConfirmIdentity that is being answered
 type UiConfirmIdentityReply struct {
+	Id          PromptId
 	Name        string
 	Address     string
 	Identifiers []*mcrypt.Identifier
@@ -72,17 +190,73 @@ const (
 
 // signal UI to render dialog to confirm public identity
 type UiConfirmPublicIdentity struct {
+	Id             PromptId
 	PublicIdentity *mcrypt.PublicIdentity
 }
 
 //signal core that the UI has done something with the public identity
+//State is StateAllowed, StateDenied, StateQueued to decide later or anything
+//else to cancel
+//Id must be the Id of the UiConfirmPublicIdentity that is being answered,
+//core acts on the public identity it prompted for
 type UiConfirmPublicIdentityReply struct {
+	Id             PromptId
 	PublicIdentity *mcrypt.PublicIdentity
 	Error          error
 	State          int
 }
 
+// signal UI that a known address answered with a different key; Previous is
+// the record of the key it used before
+type UiKeyChange struct {
+	Id             PromptId
+	PublicIdentity *mcrypt.PublicIdentity
+	Previous       *TrustRecord
+}
+
+// answers to a key change
+const (
+	KeyChangeCancel = 0 // decide later
+	KeyChangeAccept = 1 // the new key replaces the previous one
+	KeyChangeVerify = 2 // accept once the previous key confirms the change
+	KeyChangeReject = 3 // deny the new key
+)
+
+// signal core what to do about a key change
+// Id must be the Id of the UiKeyChange that is being answered
+type UiKeyChangeReply struct {
+	Id       PromptId
+	Decision int
+}
+
 //signal core to update trust record
 type UpdateTrustRecord struct {
 	TrustRecord *TrustRecord
 }
+
+// signal core to send the versions of a trust record
+type TrustHistoryView struct {
+	PublicIdentity *mcrypt.PublicIdentity
+}
+
+// signal UI to render the versions of a trust record, oldest first, Error is
+// set if they could not be read
+type UiRenderTrustHistory struct {
+	PublicIdentity *mcrypt.PublicIdentity
+	Versions       []*TrustVersion
+	Error          string
+}
+
+// signal core to make a version of a trust record current again, core
+// answers with the new history or its Error
+type TrustRevert struct {
+	PublicIdentity *mcrypt.PublicIdentity
+	Version        int
+}
+
+// signal core to delete a trust record, Forget keeps a tombstone so that the
+// key is denied should it come back, see Trust.Forget
+type TrustDelete struct {
+	PublicIdentity *mcrypt.PublicIdentity
+	Forget         bool
+}
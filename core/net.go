@@ -17,13 +17,15 @@
 package core
 
 import (
+	"bytes"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"os"
+	neturl "net/url"
 	"path"
 	"runtime"
 	"strings"
@@ -53,6 +55,10 @@ import (
 //
 // message phase
 //	7. Client & Server can exchange	RPC messages
+//
+// The client passes the address it is looking for when it dials the server.
+// A domain host uses that to select which hosted identity to present in the
+// identity phase, see domain.go.
 
 const (
 	phaseStartOfDay   = 0
@@ -62,10 +68,21 @@ const (
 	phaseMessage      = 40
 
 	rpcTimeoutSeconds = 10
-
-	RpcIdentity        = "identity"
-	RpcConfirmation    = "confirmation"
-	RpcSendFileCommand = "sendfile"
+	progressChunk     = 64 * 1024        // bytes written between progress calls
+	maxFrameSize      = 10 * 1024 * 1024 // largest command we accept
+	frameOverhead     = 4096             // command and encryption framing
+
+	RpcIdentity             = "identity"
+	RpcConfirmation         = "confirmation"
+	RpcSendFileCommand      = "sendfile"
+	RpcSendFileReplyCommand = "sendfilereply"
+
+	// hosted domain mailbox collection
+	RpcChallengeCommand      = "challenge"
+	RpcChallengeReplyCommand = "challengereply"
+	RpcFetchCommand          = "fetch"
+	RpcMailboxCommand        = "mailbox"
+	RpcMailboxAckCommand     = "mailboxack"
 )
 
 type Rpc struct {
@@ -78,12 +95,71 @@ type Confirmation struct {
 	MaxFrameSize int    `json:"marxframesize"`
 	Error        string `json:"error"`
 	State        int    `json:"state"`
+	Hosted       bool   `json:"hosted"` // remote is a domain host
+
+	// remote answers RpcSendFile with RpcSendFileReply, older versions
+	// do not
+	Replies bool `json:"replies"`
 }
 
 type RpcSendFile struct {
 	Filename string `json:"filename"`
 	Mime     string `json:"mime"`
 	Content  []byte `json:"content"`
+	Sealed   bool   `json:"sealed"` // content is encrypted to recipient
+
+	// receiver deletes content this long after receipt or once viewed
+	ExpireSeconds int64 `json:"expireseconds,omitempty"`
+	ViewOnce      bool  `json:"viewonce,omitempty"`
+
+	// random id of this message and of the message it answers
+	MessageId string `json:"messageid,omitempty"`
+	InReplyTo string `json:"inreplyto,omitempty"`
+}
+
+// Reply to RpcSendFile, Error is empty when the content was stored.
+type RpcSendFileReply struct {
+	Error string `json:"error"`
+}
+
+// Sent by a domain host to a hosted user that wants to collect its mailbox.
+// Challenge is a marshaled mcrypt.Message encrypted from Server to the
+// hosted user.  A client sends it to a peer that changed keys, encrypted to
+// the previous key, see keychange.go.  The plaintext is described in
+// hosted.go.
+type RpcChallenge struct {
+	Server    *mcrypt.PublicIdentity `json:"server"`
+	Challenge []byte                 `json:"challenge"`
+}
+
+// Nonce of a challenge, proves that the client owns the hosted identity or
+// that the peer owns its previous key.  Empty if it could not be decrypted.
+type RpcChallengeReply struct {
+	Response []byte `json:"response"`
+}
+
+// Trust decision a hosted user pushes to its domain host.
+type RpcTrustDecision struct {
+	PublicIdentity *mcrypt.PublicIdentity `json:"publicidentity"`
+	State          int                    `json:"state"`
+}
+
+// Request mailbox contents and update trust decisions on the domain host.
+type RpcFetch struct {
+	Decisions []*RpcTrustDecision `json:"decisions"`
+}
+
+// Mailbox contents and identities that are waiting for a trust decision.
+// More is set when items did not fit, they are sent on the next fetch.
+type RpcMailbox struct {
+	Items  []*MailboxItem           `json:"items"`
+	Queued []*mcrypt.PublicIdentity `json:"queued"`
+	More   bool                     `json:"more"`
+}
+
+// Items that were safely stored by the hosted user and can be removed.
+type RpcMailboxAck struct {
+	Ids []string `json:"ids"`
 }
 
 type Session struct {
@@ -95,6 +171,10 @@ type Session struct {
 	confirmation *Confirmation          // session parameters
 	server       bool                   // server or client
 	phase        int                    // session progression
+	lookingFor   string                 // address requested at dial time
+
+	// called while a command is written, see RpcSend
+	progress func(sent, total int64)
 }
 
 func (s *Session) BecomeReady() (err error) {
@@ -173,7 +253,10 @@ func NewServer(listenAddrs []string, cert, key string,
 	serveMux.HandleFunc("/tubes", func(w http.ResponseWriter, r *http.Request) {
 		var (
 			err     error
-			session *Session = &Session{server: true}
+			session *Session = &Session{
+				server:     true,
+				lookingFor: r.URL.Query().Get("for"),
+			}
 		)
 		session.conn, err = websocket.Upgrade(w, r, w.Header(), 4096, 4096)
 		if err != nil {
@@ -182,6 +265,7 @@ func NewServer(listenAddrs []string, cert, key string,
 				r.RemoteAddr, err)
 			return
 		}
+		session.conn.SetReadLimit(maxFrameSize)
 		go callback(session)
 	})
 
@@ -195,9 +279,18 @@ func NewServer(listenAddrs []string, cert, key string,
 }
 
 func NewClient(address, port string) (*Client, error) {
+	return newClient(address, port, "")
+}
+
+// newClient dials address and tells the remote which identity we are looking
+// for.  Domain hosts need this to present the correct hosted identity.
+func newClient(address, port, lookingFor string) (*Client, error) {
 	var err error
 	addr := net.JoinHostPort(address, port)
 	url := "wss://" + addr + "/tubes"
+	if lookingFor != "" {
+		url += "?for=" + neturl.QueryEscape(lookingFor)
+	}
 	tlsConfig := &tls.Config{
 		MinVersion:         tls.VersionTLS12,
 		InsecureSkipVerify: true,
@@ -208,10 +301,12 @@ func NewClient(address, port string) (*Client, error) {
 	}
 
 	c := Client{}
+	c.lookingFor = lookingFor
 	c.conn, _, err = dialer.Dial(url, nil)
 	if err != nil {
 		return nil, err
 	}
+	c.conn.SetReadLimit(maxFrameSize)
 
 	return &c, nil
 }
@@ -452,6 +547,66 @@ func (s *Session) RpcReceive() (interface{}, error) {
 			return nil, err
 		}
 		return &rsf, nil
+	case RpcSendFileReplyCommand:
+		if s.phase != phaseMessage {
+			return nil, fmt.Errorf("not in message phase")
+		}
+		rsfr := RpcSendFileReply{}
+		err = json.Unmarshal(objmap["payload"], &rsfr)
+		if err != nil {
+			return nil, err
+		}
+		return &rsfr, nil
+	case RpcChallengeCommand:
+		if s.phase != phaseMessage {
+			return nil, fmt.Errorf("not in message phase")
+		}
+		rc := RpcChallenge{}
+		err = json.Unmarshal(objmap["payload"], &rc)
+		if err != nil {
+			return nil, err
+		}
+		return &rc, nil
+	case RpcChallengeReplyCommand:
+		if s.phase != phaseMessage {
+			return nil, fmt.Errorf("not in message phase")
+		}
+		rcr := RpcChallengeReply{}
+		err = json.Unmarshal(objmap["payload"], &rcr)
+		if err != nil {
+			return nil, err
+		}
+		return &rcr, nil
+	case RpcFetchCommand:
+		if s.phase != phaseMessage {
+			return nil, fmt.Errorf("not in message phase")
+		}
+		rf := RpcFetch{}
+		err = json.Unmarshal(objmap["payload"], &rf)
+		if err != nil {
+			return nil, err
+		}
+		return &rf, nil
+	case RpcMailboxCommand:
+		if s.phase != phaseMessage {
+			return nil, fmt.Errorf("not in message phase")
+		}
+		rm := RpcMailbox{}
+		err = json.Unmarshal(objmap["payload"], &rm)
+		if err != nil {
+			return nil, err
+		}
+		return &rm, nil
+	case RpcMailboxAckCommand:
+		if s.phase != phaseMessage {
+			return nil, fmt.Errorf("not in message phase")
+		}
+		rma := RpcMailboxAck{}
+		err = json.Unmarshal(objmap["payload"], &rma)
+		if err != nil {
+			return nil, err
+		}
+		return &rma, nil
 	default:
 		return nil, fmt.Errorf("invalid RPC command %v", command)
 	}
@@ -459,6 +614,13 @@ func (s *Session) RpcReceive() (interface{}, error) {
 	return nil, fmt.Errorf("NOT REACHED")
 }
 
+// fitsFrame reports whether a payload that marshals to n bytes can be sent.
+// Commands are marshaled, encrypted and marshaled again which encodes the
+// payload as base64 once more.
+func fitsFrame(n int) bool {
+	return base64.StdEncoding.EncodedLen(n+frameOverhead) <= maxFrameSize
+}
+
 func (s *Session) RpcSend(command interface{}) error {
 	rpc := &Rpc{}
 	switch command.(type) {
@@ -479,6 +641,36 @@ func (s *Session) RpcSend(command interface{}) error {
 			return fmt.Errorf("not in message phase")
 		}
 		rpc.Command = RpcSendFileCommand
+	case *RpcSendFileReply:
+		if s.phase != phaseMessage {
+			return fmt.Errorf("not in message phase")
+		}
+		rpc.Command = RpcSendFileReplyCommand
+	case *RpcChallenge:
+		if s.phase != phaseMessage {
+			return fmt.Errorf("not in message phase")
+		}
+		rpc.Command = RpcChallengeCommand
+	case *RpcChallengeReply:
+		if s.phase != phaseMessage {
+			return fmt.Errorf("not in message phase")
+		}
+		rpc.Command = RpcChallengeReplyCommand
+	case *RpcFetch:
+		if s.phase != phaseMessage {
+			return fmt.Errorf("not in message phase")
+		}
+		rpc.Command = RpcFetchCommand
+	case *RpcMailbox:
+		if s.phase != phaseMessage {
+			return fmt.Errorf("not in message phase")
+		}
+		rpc.Command = RpcMailboxCommand
+	case *RpcMailboxAck:
+		if s.phase != phaseMessage {
+			return fmt.Errorf("not in message phase")
+		}
+		rpc.Command = RpcMailboxAckCommand
 	default:
 		return fmt.Errorf("invalid command type %T", command)
 	}
@@ -496,13 +688,36 @@ func (s *Session) RpcSend(command interface{}) error {
 		return err
 	}
 
-	// send
-	err = s.conn.WriteJSON(ej)
+	// send in chunks so that progress can be reported
+	b, err := json.Marshal(ej)
 	if err != nil {
 		return err
 	}
+	if len(b) > maxFrameSize {
+		return fmt.Errorf("%v too large to send: %v bytes, limit is %v",
+			rpc.Command, len(b), maxFrameSize)
+	}
+	w, err := s.conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	for sent := 0; sent < len(b); {
+		n := len(b) - sent
+		if n > progressChunk {
+			n = progressChunk
+		}
+		_, err = w.Write(b[sent : sent+n])
+		if err != nil {
+			w.Close()
+			return err
+		}
+		sent += n
+		if s.progress != nil {
+			s.progress(int64(sent), int64(len(b)))
+		}
+	}
 
-	return nil
+	return w.Close()
 }
 
 // establish a new session and return the session
@@ -517,7 +732,7 @@ func (c *Core) NewClientSession(to string) (*Client, error) {
 		return nil, fmt.Errorf("invalid destination %v", to)
 	}
 
-	client, err := NewClient(a[1], "12345")
+	client, err := newClient(a[1], "12345", to)
 	if err != nil {
 		return nil, err
 	}
@@ -530,37 +745,46 @@ func (c *Core) NewClientSession(to string) (*Client, error) {
 	return client, nil
 }
 
-func (c *Core) ServerCallback(s *Session) {
-	c.debugServer("ServerCallback")
-	defer func() {
-		//s.conn.Close()
-		c.debugServer("ServerCallback done")
-	}()
-
-	err := s.DefaultSession(&c.identity.PublicIdentity)
-	if err != nil {
-		c.debugServer("ServerCallback DefaultSession %v", err)
-		return
-	}
+// serverConfirmation determines if peer is allowed to talk to us based on
+// the provided trust database.  Unknown peers are queued.
+func (c *Core) serverConfirmation(t *Trust,
+	peer *mcrypt.PublicIdentity) (*Confirmation, error) {
 
 	// go to message phase
 	confirmation := Confirmation{
-		MaxFrameSize: 10 * 1024 * 1024,
+		MaxFrameSize: maxFrameSize,
+		Replies:      true,
 	}
 
 	// see if we trust this identity
-	tr, err := c.trust.Get(c.identity, s.peer)
+	tr, err := t.Get(c.identity, peer)
 	if err != nil {
 		// not seen before, queue trust
-		err = c.trust.Add(c.identity, s.peer, StateQueued, nil, false)
+		err = t.Add(c.identity, peer, StateQueued, c.peerDefaults(),
+			false)
 		if err != nil {
-			c.debugServer("ServerCallback failed to add trust %v",
-				err)
-			return
+			return nil, fmt.Errorf("failed to add trust %v", err)
 		}
 		confirmation.State = StateQueued
-		c.renderTrust()
-	} else {
+	}
+
+	// a key for an address we know waits for a decision about the change
+	previous, err := c.keyChange(t, peer.Address, peer, tr)
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil {
+		c.auditLog(AuditKeyChange, peer, "incoming, previous "+
+			"fingerprint %v", previous.PublicIdentity.Fingerprint())
+		if t == c.trust && !c.keyChangePending(peer) {
+			c.promptKeyChange(peer.Address, peer, previous,
+				func(err error) {
+					c.debugServer("serverConfirmation key "+
+						"change %v", err)
+				})
+		}
+		confirmation.State = StateQueued
+	} else if tr != nil {
 		// verify trust
 		if tr.State != StateAllowed {
 			c.debugServer("ServerCallback denied access")
@@ -578,11 +802,53 @@ func (c *Core) ServerCallback(s *Session) {
 			"access: State %v", State[StateQueued])
 	}
 
-	err = s.ConfirmationPhase(&confirmation)
+	return &confirmation, nil
+}
+
+func (c *Core) ServerCallback(s *Session) {
+	c.debugServer("ServerCallback")
+	defer func() {
+		//s.conn.Close()
+		c.debugServer("ServerCallback done")
+	}()
+
+	// hand off to domain host if the client is looking for a hosted user
+	if c.domain != nil && s.lookingFor != c.identity.PublicIdentity.Address {
+		hu, err := c.domain.Lookup(s.lookingFor)
+		if err == nil {
+			c.hostedCallback(s, hu)
+			return
+		}
+	}
+
+	err := s.DefaultSession(&c.identity.PublicIdentity)
+	if err != nil {
+		c.debugServer("ServerCallback DefaultSession %v", err)
+		return
+	}
+	c.auditLog(AuditSession, s.peer, "from %v", s.conn.RemoteAddr())
+
+	confirmation, err := c.serverConfirmation(c.trust, s.peer)
+	if err != nil {
+		c.debugServer("ServerCallback %v", err)
+		return
+	}
+	if confirmation.State == StateQueued {
+		c.renderTrust()
+	}
+
+	err = s.ConfirmationPhase(confirmation)
 	if err != nil {
 		c.debugServer("ServerCallback ConfirmationPhase %v", err)
 		return
 	}
+	if confirmation.Error != "" {
+		// client was told to go away
+		c.auditLog(AuditDenied, s.peer, "incoming, state %v",
+			State[confirmation.State])
+		s.conn.Close()
+		return
+	}
 
 	err = s.BecomeReady()
 	if err != nil {
@@ -603,107 +869,262 @@ func (c *Core) ServerCallback(s *Session) {
 				c.debugServer("ServerCallback "+
 					"serverSendFile %v", err)
 			}
+			err = s.RpcSend(sendFileReply(err))
+			if err != nil {
+				c.debugServer("ServerCallback %v", err)
+				return
+			}
+		case *RpcChallenge:
+			// peer verifies that we moved to a new key
+			err = s.RpcSend(c.answerChallenge(s, s.peer, command))
+			if err != nil {
+				c.debugServer("ServerCallback %v", err)
+				return
+			}
 		default:
 			c.debugServer("ServerCallback invalid type %T", cmd)
 		}
 	}
 }
 
-func (s *Session) SendFile(sf *SendFile) error {
-	var err error
+// content returns the filename, mime type and content to send.  Without a
+// mime type it is sniffed.
+func (sf *SendFile) content() (string, string, []byte, error) {
+	if len(sf.Attachments) == 0 && sf.Filename == "" {
+		// composed text, never written to disk
+		mimeType := sf.Mime
+		if mimeType == "" {
+			mimeType = BodyMime
+		}
+		return messageFilename, mimeType, []byte(sf.Body), nil
+	}
+	if len(sf.Attachments) == 0 && sf.Body == "" {
+		content, err := ioutil.ReadFile(sf.Filename)
+		if err != nil {
+			return "", "", nil, err
+		}
+		filename := path.Base(sf.Filename)
+		mimeType := sf.Mime
+		if mimeType == "" {
+			mimeType = SniffMime(filename, content)
+		}
+		return filename, mimeType, content, nil
+	}
 
-	// construct command
-	rsf := RpcSendFile{
-		Filename: path.Base(sf.Filename),
-		Mime:     sf.Mime,
+	var b bytes.Buffer
+	mimeType, err := WriteMultipart(&b, sf.Body, sf.Attachments)
+	if err != nil {
+		return "", "", nil, err
 	}
-	rsf.Content, err = ioutil.ReadFile(sf.Filename)
+	return messageFilename, mimeType, b.Bytes(), nil
+}
+
+// rpc returns the command that sends sf with a new message id.
+func (sf *SendFile) rpc() (*RpcSendFile, error) {
+	if sf.InReplyTo != "" && !validMessageId(sf.InReplyTo) {
+		return nil, fmt.Errorf("invalid message id %v", sf.InReplyTo)
+	}
+	filename, mimeType, content, err := sf.content()
+	if err != nil {
+		return nil, err
+	}
+	messageId, err := newMessageId()
+	if err != nil {
+		return nil, err
+	}
+	return &RpcSendFile{
+		Filename:      filename,
+		Mime:          mimeType,
+		Content:       content,
+		ExpireSeconds: int64(sf.Expire / time.Second),
+		ViewOnce:      sf.ViewOnce,
+		MessageId:     messageId,
+		InReplyTo:     sf.InReplyTo,
+	}, nil
+}
+
+func (s *Session) SendFile(rsf *RpcSendFile) error {
+	err := s.RpcSend(rsf)
 	if err != nil {
 		return err
 	}
+	return s.sendFileResult()
+}
 
-	return s.RpcSend(&rsf)
+// sendFileReply tells the sender what happened to its content.  Only quota
+// errors are passed on, anything else is our problem.
+func sendFileReply(err error) *RpcSendFileReply {
+	r := &RpcSendFileReply{}
+	if err != nil {
+		if _, ok := err.(*QuotaError); ok {
+			r.Error = err.Error()
+		} else {
+			r.Error = "content could not be stored"
+		}
+	}
+	return r
+}
+
+// sendFileResult waits for the reply to RpcSendFile.  Peers that do not
+// reply took the content as far as we can tell.
+func (s *Session) sendFileResult() error {
+	if s.confirmation == nil || !s.confirmation.Replies {
+		return nil
+	}
+
+	s.conn.SetReadDeadline(time.Now().Add(rpcTimeoutSeconds * time.Second))
+	defer s.conn.SetReadDeadline(time.Time{})
+
+	cmd, err := s.RpcReceive()
+	if err != nil {
+		return fmt.Errorf("no reply from %v: %v", s.peer.Address, err)
+	}
+	r, ok := cmd.(*RpcSendFileReply)
+	if !ok {
+		return fmt.Errorf("unexpected reply %T", cmd)
+	}
+	if r.Error != "" {
+		return fmt.Errorf("%v refused content: %v", s.peer.Address,
+			r.Error)
+	}
+	return nil
+}
+
+// SendSealedFile sends a file whose content is encrypted from id to the
+// actual peer identity.  This is used when the peer is a domain host that
+// stores content on behalf of the peer.
+func (s *Session) SendSealedFile(id *mcrypt.Identity,
+	rsf *RpcSendFile) error {
+
+	msg, err := id.Encrypt(s.peer.Key, rsf.Content)
+	if err != nil {
+		return err
+	}
+	sealed := *rsf
+	sealed.Sealed = true
+	sealed.Content, err = msg.Marshal()
+	if err != nil {
+		return err
+	}
+
+	err = s.RpcSend(&sealed)
+	if err != nil {
+		return err
+	}
+	return s.sendFileResult()
 }
 
 // This structure is saved alongside content with some interesting information.
-// this needs lots more stuff, like encrypt at rest, keys it was sent with etc
+// Both are encrypted to self, see spool.go.
+// this needs lots more stuff, like keys it was sent with etc
 // TODO this probably deserves it's own package
 type MetaRecord struct {
-	Version uint32    `json:"version"`
-	Mime    string    `json:"mime"`
-	Created time.Time `json:"created"`
+	Version  uint32    `json:"version"`
+	Mime     string    `json:"mime"`
+	Created  time.Time `json:"created"`
+	Size     int64     `json:"size"`     // plaintext size, since version 2
+	From     string    `json:"from"`     // sender address, since version 3
+	Filename string    `json:"filename"` // suggested by sender, ditto
+	Blob     string    `json:"blob"`     // content, ditto
+	Expires  time.Time `json:"expires"`  // zero for never, since version 4
+	ViewOnce bool      `json:"viewonce"` // ditto
+	Parts    []*Part   `json:"parts"`    // of multipart content, version 5
+
+	To        string `json:"to"`        // recipient of sent content, version 6
+	MessageId string `json:"messageid"` // ditto
+	InReplyTo string `json:"inreplyto"` // ditto
 }
 
 func (c *Core) serverSendFile(rsf *RpcSendFile,
 	peer *mcrypt.PublicIdentity) error {
-	// create holding area
-	targetDir := c.scommsDir + "/spool/" + peer.Address + "/"
-	err := os.MkdirAll(targetDir, 0700)
+	// the filename is a hint for the user, it is never used as a path
+	filename := rsf.Filename
+	if filename == "" {
+		filename = "unknown"
+	}
+
+	c.mtxQuota.Lock()
+	defer c.mtxQuota.Unlock()
+
+	err := c.checkQuota(peer, int64(len(rsf.Content)))
 	if err != nil {
 		return err
 	}
 
-	// see if we were sent a filename hint
-	filename := ""
-	if rsf.Filename == "" {
-		filename, err = newRandomFileName(targetDir, "unknown")
+	// a multipart message is stored as one, remember what is in it
+	var parts []*Part
+	if IsMultipart(rsf.Mime) {
+		parts, err = ParseParts(rsf.Mime, bytes.NewReader(rsf.Content))
 		if err != nil {
-			return err
+			return fmt.Errorf("invalid multipart content: %v", err)
 		}
-	} else {
-		// sanitize filename
-		filename = rsf.Filename
 	}
 
-	// look for dups
-	_, err = os.Stat(filename)
-	if err == nil {
-		// exists, create temp file instead
-		filename, err = newRandomFileName(targetDir, filename)
-		if err != nil {
-			return err
-		}
+	// ids are only used to find each other, drop anything odd
+	messageId, inReplyTo := rsf.MessageId, rsf.InReplyTo
+	if !validMessageId(messageId) {
+		messageId = ""
+	}
+	if !validMessageId(inReplyTo) {
+		inReplyTo = ""
 	}
 
-	// write meta
+	// write content and meta encrypted to self
+	now := time.Now()
 	meta := MetaRecord{
-		Version: 1,
-		Mime:    rsf.Mime,
-		Created: time.Now(),
+		Mime:      rsf.Mime,
+		Created:   now,
+		From:      peer.Address,
+		Filename:  filename,
+		Expires:   expiresAt(now, rsf.ExpireSeconds),
+		ViewOnce:  rsf.ViewOnce,
+		Parts:     parts,
+		MessageId: messageId,
+		InReplyTo: inReplyTo,
 	}
-	metaJson, err := json.Marshal(meta)
-	if err != nil {
-		return err
-	}
-	err = ioutil.WriteFile(targetDir+filename+".meta", metaJson, 0600)
+	c.mtxSpool.Lock()
+	spoolId, err := spoolWrite(c.scommsDir, c.identity, &meta,
+		bytes.NewReader(rsf.Content))
 	if err != nil {
+		c.mtxSpool.Unlock()
 		return err
 	}
 
-	// write content
-	err = ioutil.WriteFile(targetDir+filename, rsf.Content, 0600)
+	item := &InboxItem{
+		Id:        spoolId,
+		Blob:      meta.Blob,
+		From:      peer.Address,
+		Filename:  filename,
+		Mime:      rsf.Mime,
+		Size:      meta.Size,
+		Received:  meta.Created,
+		Expires:   meta.Expires,
+		ViewOnce:  meta.ViewOnce,
+		Parts:     meta.Parts,
+		MessageId: meta.MessageId,
+		InReplyTo: meta.InReplyTo,
+	}
+	err = c.inbox.Add(c.identity, item)
+	c.mtxSpool.Unlock()
 	if err != nil {
 		return err
 	}
-
-	// TODO move this notification to Gui
-	c.popup("New message",
-		"You have received a message and it was saved in: %v\n",
-		targetDir+filename)
-
-	return nil
-}
-
-// Generate a random filename.
-func newRandomFileName(tmpDir, prefix string) (string, error) {
-	tmpFd, err := ioutil.TempFile(tmpDir, prefix)
+	err = c.searchAdd(item)
 	if err != nil {
-		return "", err
+		c.debugServer("serverSendFile: index %v", err)
 	}
-	filename := path.Base(tmpFd.Name())
-	tmpFd.Close()
-	return filename, nil
+	c.renderInbox()
+	c.renderTrust() // usage changed
+
+	c.Send(core, []string{ui}, &UiNewMessage{
+		Id:       item.Id,
+		From:     item.From,
+		Filename: item.Filename,
+		Mime:     item.Mime,
+		Size:     item.Size,
+	})
 
+	return nil
 }
 
 // parseListeners splits the list of listen addresses passed in addrs into
@@ -0,0 +1,269 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/marcopeereboom/mcrypt"
+)
+
+// A message with attachments is sent as one piece of content in MIME
+// multipart/mixed format (RFC 2046).  The first part is the text body, every
+// following part an attachment with its own filename and mime type.  Parts
+// are not transfer encoded.  The receiver stores the content as one spool
+// entry and lists the parts in its meta record.
+
+const (
+	MultipartMime = "multipart/mixed"
+	BodyMime      = "text/plain; charset=utf-8"
+
+	messageFilename = "message" // shown for composed messages
+
+	maxParts = 1000 // per message
+)
+
+// Part describes the body or an attachment of a multipart message.  The
+// body is the first part and has no filename.
+type Part struct {
+	Filename string `json:"filename"`
+	Mime     string `json:"mime"`
+	Size     int64  `json:"size"`
+}
+
+// SniffMime returns the mime type of content named filename.  The extension
+// is used when the content itself is not conclusive.
+func SniffMime(filename string, content []byte) string {
+	sniffed := http.DetectContentType(content)
+	byName := mime.TypeByExtension(path.Ext(filename))
+	if byName != "" && (sniffed == "application/octet-stream" ||
+		strings.HasPrefix(sniffed, "text/plain")) {
+		return byName
+	}
+	return sniffed
+}
+
+// IsMultipart reports whether mediaType is a multipart message.
+func IsMultipart(mediaType string) bool {
+	mt, _, err := mime.ParseMediaType(mediaType)
+	return err == nil && mt == MultipartMime
+}
+
+// WriteMultipart writes body and the files named by attachments to w.  It
+// returns the media type of what was written.
+func WriteMultipart(w io.Writer, body string, attachments []string) (string,
+	error) {
+
+	mw := multipart.NewWriter(w)
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", BodyMime)
+	h.Set("Content-Disposition", "inline")
+	pw, err := mw.CreatePart(h)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.WriteString(pw, body)
+	if err != nil {
+		return "", err
+	}
+
+	for _, v := range attachments {
+		content, err := ioutil.ReadFile(v)
+		if err != nil {
+			return "", err
+		}
+		filename := path.Base(v)
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Type", SniffMime(filename, content))
+		h.Set("Content-Disposition", mime.FormatMediaType("attachment",
+			map[string]string{"filename": filename}))
+		pw, err := mw.CreatePart(h)
+		if err != nil {
+			return "", err
+		}
+		_, err = pw.Write(content)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = mw.Close()
+	if err != nil {
+		return "", err
+	}
+	return mime.FormatMediaType(MultipartMime,
+		map[string]string{"boundary": mw.Boundary()}), nil
+}
+
+// multipartReader returns a reader of the parts of content of mediaType.
+func multipartReader(mediaType string, r io.Reader) (*multipart.Reader,
+	error) {
+
+	mt, params, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return nil, err
+	}
+	if mt != MultipartMime || params["boundary"] == "" {
+		return nil, fmt.Errorf("not a multipart message: %v", mediaType)
+	}
+	return multipart.NewReader(r, params["boundary"]), nil
+}
+
+// ParseParts returns the parts of multipart content of mediaType.
+func ParseParts(mediaType string, r io.Reader) ([]*Part, error) {
+	mr, err := multipartReader(mediaType, r)
+	if err != nil {
+		return nil, err
+	}
+	parts := make([]*Part, 0)
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) == maxParts {
+			return nil, fmt.Errorf("more than %v parts", maxParts)
+		}
+		part := &Part{Mime: p.Header.Get("Content-Type")}
+		if len(parts) != 0 {
+			part.Filename = p.FileName()
+			if part.Filename == "" {
+				part.Filename = fmt.Sprintf("attachment%v",
+					len(parts))
+			}
+		}
+		if part.Mime == "" {
+			part.Mime = "text/plain"
+		}
+		part.Size, err = io.Copy(ioutil.Discard, p)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("no parts")
+	}
+	return parts, nil
+}
+
+// ReadPart returns a reader of part n of multipart content of mediaType.  It
+// reads from r and is only valid as long as r is.
+func ReadPart(mediaType string, r io.Reader, n int) (io.Reader, error) {
+	mr, err := multipartReader(mediaType, r)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; ; i++ {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no part %v", n)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i == n {
+			return p, nil
+		}
+	}
+}
+
+// partReader closes the spool content a part is read from.
+type partReader struct {
+	io.Reader
+	io.Closer
+}
+
+// SpoolOpenPart opens part n of a received multipart message.
+func SpoolOpenPart(dir string, id *mcrypt.Identity, spoolId string,
+	n int) (io.ReadCloser, error) {
+
+	se, err := SpoolGet(dir, id, spoolId)
+	if err != nil {
+		return nil, err
+	}
+	f, err := SpoolOpen(dir, id, spoolId)
+	if err != nil {
+		return nil, err
+	}
+	r, err := ReadPart(se.Meta.Mime, f, n)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &partReader{Reader: r, Closer: f}, nil
+}
+
+// SpoolExportPart decrypts part n of a received multipart message into
+// filename, which must not exist.
+func SpoolExportPart(dir string, id *mcrypt.Identity, spoolId string, n int,
+	filename string) error {
+
+	r, err := SpoolOpenPart(dir, id, spoolId, n)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return writeExport(filename, r)
+}
+
+// SpoolOpenPart opens part n of a received multipart message.
+func (c *Core) SpoolOpenPart(spoolId string, n int) (io.ReadCloser, error) {
+	_, err := c.spoolGet(spoolId)
+	if err != nil {
+		return nil, err
+	}
+	return SpoolOpenPart(c.scommsDir, c.identity, spoolId, n)
+}
+
+// SpoolExportPart decrypts attachment n of a received multipart message
+// into the export directory and returns the filename.
+func (c *Core) SpoolExportPart(spoolId string, n int) (string, error) {
+	se, err := c.spoolGet(spoolId)
+	if err != nil {
+		return "", err
+	}
+	if n < 0 || n >= len(se.Meta.Parts) {
+		return "", fmt.Errorf("no part %v", n)
+	}
+	filename := c.scommsDir + exportDir + spoolId + "/" +
+		safeName(se.Meta.Parts[n].Filename)
+	if _, err := os.Stat(filename); err == nil {
+		return filename, nil // exported before
+	}
+	err = os.MkdirAll(path.Dir(filename), 0700)
+	if err != nil {
+		return "", err
+	}
+	err = SpoolExportPart(c.scommsDir, c.identity, spoolId, n, filename)
+	if err != nil {
+		return "", err
+	}
+	return filename, nil
+}
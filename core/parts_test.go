@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcopeereboom/mcrypt"
+)
+
+var partsPng = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+
+func TestPartsSniff(t *testing.T) {
+	tests := []struct {
+		filename string
+		content  []byte
+		mime     string
+	}{
+		{"notes", []byte("hello world\n"), "text/plain; charset=utf-8"},
+		{"notes.html", []byte("hello world\n"), "text/html; charset=utf-8"},
+		{"picture", partsPng, "image/png"},
+		{"picture.txt", partsPng, "image/png"},
+		{"blob", []byte{0, 1, 2}, "application/octet-stream"},
+		{"doc.pdf", []byte{0, 1, 2}, "application/pdf"},
+	}
+	for _, v := range tests {
+		m := SniffMime(v.filename, v.content)
+		if m != v.mime {
+			t.Errorf("%v: got %v want %v", v.filename, m, v.mime)
+		}
+	}
+}
+
+// partsDir returns a new directory holding picture.png and empty.dat.  The
+// caller removes the directory.
+func partsDir(t *testing.T) string {
+	dir, err := ioutil.TempDir(os.TempDir(), "parts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"picture.png", "empty.dat"} {
+		var content []byte
+		if v == "picture.png" {
+			content = partsPng
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, v), content, 0600)
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// partsSpool spools a message with a body and both files of partsDir
+// attached and returns the spool id.
+func partsSpool(t *testing.T, dir string, id *mcrypt.Identity) string {
+	sf := &SendFile{
+		Body: "see attached\n",
+		Attachments: []string{
+			filepath.Join(dir, "picture.png"),
+			filepath.Join(dir, "empty.dat"),
+		},
+	}
+	filename, mimeType, content, err := sf.content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts, err := ParseParts(mimeType, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spoolId, err := spoolWrite(dir, id, &MetaRecord{
+		Mime:     mimeType,
+		Created:  time.Date(2014, 6, 15, 12, 0, 0, 0, time.UTC),
+		From:     "bob@example.com",
+		Filename: filename,
+		Parts:    parts,
+	}, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spoolId
+}
+
+func TestPartsRoundTrip(t *testing.T) {
+	dir := partsDir(t)
+	defer os.RemoveAll(dir)
+
+	sf := &SendFile{
+		Body: "see attached\n",
+		Attachments: []string{
+			filepath.Join(dir, "picture.png"),
+			filepath.Join(dir, "empty.dat"),
+		},
+	}
+	filename, mimeType, content, err := sf.content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filename != messageFilename || !IsMultipart(mimeType) {
+		t.Errorf("content %v %v", filename, mimeType)
+		return
+	}
+
+	parts, err := ParseParts(mimeType, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Part{
+		{"", BodyMime, int64(len(sf.Body))},
+		{"picture.png", "image/png", int64(len(partsPng))},
+		{"empty.dat", "text/plain; charset=utf-8", 0},
+	}
+	if len(parts) != len(want) {
+		t.Errorf("parts %v", parts)
+		return
+	}
+	for i, p := range parts {
+		if *p != want[i] {
+			t.Errorf("part %v: got %v want %v", i, *p, want[i])
+		}
+	}
+
+	r, err := ReadPart(mimeType, bytes.NewReader(content), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(b, partsPng) {
+		t.Errorf("read part %v %v", b, err)
+		return
+	}
+	_, err = ReadPart(mimeType, bytes.NewReader(content), 3)
+	if err == nil {
+		t.Error("missing part should have tripped")
+		return
+	}
+	_, err = ParseParts("text/plain", bytes.NewReader(content))
+	if err == nil {
+		t.Error("single part should have tripped")
+		return
+	}
+
+	// a single file is sniffed unless the sender says otherwise
+	sf = &SendFile{Filename: filepath.Join(dir, "picture.png")}
+	filename, mimeType, _, err = sf.content()
+	if err != nil || filename != "picture.png" || mimeType != "image/png" {
+		t.Errorf("single %v %v %v", filename, mimeType, err)
+		return
+	}
+	sf.Mime = "application/x-custom"
+	_, mimeType, _, err = sf.content()
+	if err != nil || mimeType != sf.Mime {
+		t.Errorf("override %v %v", mimeType, err)
+	}
+
+	// composed text is sent from memory
+	sf = &SendFile{Body: "hello\n"}
+	filename, mimeType, content, err = sf.content()
+	if err != nil || filename != messageFilename || mimeType != BodyMime ||
+		string(content) != sf.Body {
+		t.Errorf("text %v %v %q %v", filename, mimeType, content, err)
+	}
+	sf.Mime = "text/x-log"
+	_, mimeType, _, err = sf.content()
+	if err != nil || mimeType != sf.Mime {
+		t.Errorf("text override %v %v", mimeType, err)
+	}
+}
+
+func TestPartsSpool(t *testing.T) {
+	dir := partsDir(t)
+	defer os.RemoveAll(dir)
+	id, err := mcrypt.NewIdentity("Alice", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spoolId := partsSpool(t, dir, id)
+
+	r, err := SpoolOpenPart(dir, id, spoolId, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(b) != "see attached\n" {
+		t.Errorf("body %q %v", b, err)
+		return
+	}
+
+	filename := filepath.Join(dir, "exported.png")
+	err = SpoolExportPart(dir, id, spoolId, 1, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = ioutil.ReadFile(filename)
+	if err != nil || !bytes.Equal(b, partsPng) {
+		t.Errorf("export %v %v", b, err)
+		return
+	}
+	err = SpoolExportPart(dir, id, spoolId, 1, filename)
+	if err == nil {
+		t.Error("existing file should have tripped")
+		return
+	}
+	_, err = SpoolOpenPart(dir, id, spoolId, 5)
+	if err == nil {
+		t.Error("missing part should have tripped")
+		return
+	}
+}
+
+func TestPartsMail(t *testing.T) {
+	dir := partsDir(t)
+	defer os.RemoveAll(dir)
+	id, err := mcrypt.NewIdentity("Alice", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spoolId := partsSpool(t, dir, id)
+
+	se, err := SpoolGet(dir, id, spoolId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := SpoolOpen(dir, id, spoolId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := partsText(se.Meta.Mime, content); text != "see attached\n" {
+		t.Errorf("text %q", text)
+		return
+	}
+
+	b, err := mailMessage(se, "alice@example.com", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr, err := multipartReader(m.Header.Get("Content-Type"), m.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		names = append(names, p.FileName())
+	}
+	if strings.Join(names, ",") != ",picture.png,empty.dat" {
+		t.Errorf("mail parts %v", names)
+		return
+	}
+}
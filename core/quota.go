@@ -0,0 +1,174 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/marcopeereboom/mcrypt"
+)
+
+// Per peer quota settings in TrustRecord.FreeToUse, decimal, 0 is unlimited.
+const (
+	QuotaBytes    = "QuotaBytes"
+	QuotaMessages = "QuotaMessages"
+)
+
+// QuotaUsage is what is stored for a peer, or for all peers, and the limits
+// that apply.  Max values of 0 are unlimited.
+type QuotaUsage struct {
+	Bytes       int64
+	Messages    int
+	MaxBytes    int64
+	MaxMessages int
+}
+
+// QuotaError is returned when content does not fit.  Its message is sent
+// back to the peer.
+type QuotaError struct {
+	What  string // "bytes" or "messages"
+	Used  int64
+	Limit int64
+	All   bool // global limit, otherwise per peer
+}
+
+func (e *QuotaError) Error() string {
+	whose := "per sender"
+	if e.All {
+		whose = "total"
+	}
+	return fmt.Sprintf("quota exceeded: %v %v limit is %v, %v in use",
+		whose, e.What, e.Limit, e.Used)
+}
+
+// peerDefaults returns the settings new trust records start with.  Unlimited
+// defaults are left out so that such records follow the configuration.
+func (c *Core) peerDefaults() map[string]string {
+	defaults := make(map[string]string)
+	if c.config.Quota.PeerBytes != 0 {
+		defaults[QuotaBytes] = strconv.FormatInt(c.config.Quota.PeerBytes,
+			10)
+	}
+	if c.config.Quota.PeerMessages != 0 {
+		defaults[QuotaMessages] = strconv.Itoa(c.config.Quota.PeerMessages)
+	}
+	return defaults
+}
+
+// peerQuota returns the limits of a trust record, settings that are missing
+// or invalid fall back to the configured defaults.
+func peerQuota(tr *TrustRecord, q *Quota) (int64, int) {
+	bytes, messages := q.PeerBytes, q.PeerMessages
+	if tr == nil {
+		return bytes, messages
+	}
+	v, err := strconv.ParseInt(tr.FreeToUse[QuotaBytes], 10, 64)
+	if err == nil && v >= 0 {
+		bytes = v
+	}
+	m, err := strconv.Atoi(tr.FreeToUse[QuotaMessages])
+	if err == nil && m >= 0 {
+		messages = m
+	}
+	return bytes, messages
+}
+
+// quotaUsage returns what is stored by address and in total.
+func (c *Core) quotaUsage() (map[string]*QuotaUsage, *QuotaUsage, error) {
+	usage, total, err := c.inbox.Usage(c.identity)
+	if err != nil {
+		return nil, nil, err
+	}
+	total.MaxBytes = c.config.Quota.Bytes
+	total.MaxMessages = c.config.Quota.Messages
+	peers := make(map[string]*QuotaUsage, len(usage))
+	for k := range usage {
+		u := usage[k]
+		peers[k] = &u
+	}
+	return peers, &total, nil
+}
+
+// checkQuota returns a QuotaError if size more bytes from peer do not fit.
+func (c *Core) checkQuota(peer *mcrypt.PublicIdentity, size int64) error {
+	peers, total, err := c.quotaUsage()
+	if err != nil {
+		return err
+	}
+	u, ok := peers[peer.Address]
+	if !ok {
+		u = &QuotaUsage{}
+	}
+	tr, err := c.trust.Get(c.identity, peer)
+	if err != nil {
+		tr = nil
+	}
+	u.MaxBytes, u.MaxMessages = peerQuota(tr, &c.config.Quota)
+
+	return overQuota(u, total, size)
+}
+
+// overQuota returns a QuotaError if size more bytes do not fit.  peer is what
+// the sender stores, total what everybody stores, both with their limits.
+func overQuota(peer, total *QuotaUsage, size int64) error {
+	switch {
+	case peer.MaxMessages != 0 && peer.Messages+1 > peer.MaxMessages:
+		return &QuotaError{What: "messages", Used: int64(peer.Messages),
+			Limit: int64(peer.MaxMessages)}
+	case peer.MaxBytes != 0 && peer.Bytes+size > peer.MaxBytes:
+		return &QuotaError{What: "bytes", Used: peer.Bytes,
+			Limit: peer.MaxBytes}
+	case total.MaxMessages != 0 && total.Messages+1 > total.MaxMessages:
+		return &QuotaError{What: "messages", Used: int64(total.Messages),
+			Limit: int64(total.MaxMessages), All: true}
+	case total.MaxBytes != 0 && total.Bytes+size > total.MaxBytes:
+		return &QuotaError{What: "bytes", Used: total.Bytes,
+			Limit: total.MaxBytes, All: true}
+	}
+
+	return nil
+}
+
+// humanBytes formats n for display.
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%v B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func (u *QuotaUsage) String() string {
+	if u == nil {
+		return ""
+	}
+	bytes := humanBytes(u.Bytes)
+	if u.MaxBytes != 0 {
+		bytes += " of " + humanBytes(u.MaxBytes)
+	}
+	messages := fmt.Sprintf("%v", u.Messages)
+	if u.MaxMessages != 0 {
+		messages += fmt.Sprintf(" of %v", u.MaxMessages)
+	}
+	return bytes + ", " + messages + " messages"
+}
@@ -0,0 +1,238 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/marcopeereboom/mcrypt"
+)
+
+// quotaCore returns a core in a new directory with trust and inbox open
+// and a quota of 30 bytes and 3 messages, 20 bytes and 2 messages per peer.
+// The caller closes the stores and removes the directory.
+func quotaCore(t *testing.T) *Core {
+	dir, err := ioutil.TempDir(os.TempDir(), "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig
+	cfg.Quota = Quota{Bytes: 30, Messages: 3, PeerBytes: 20,
+		PeerMessages: 2}
+	c := &Core{scommsDir: dir, config: &cfg}
+	c.identity, err = mcrypt.NewIdentity("Alice", "alice@example.com")
+	if err == nil {
+		c.trust, err = NewTrust(dir)
+	}
+	if err == nil {
+		c.inbox, err = NewInbox(dir)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return c
+}
+
+func closeQuotaCore(c *Core) {
+	c.inbox.Close()
+	c.trust.Close()
+	os.RemoveAll(c.scommsDir)
+}
+
+func TestQuotaConfig(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg, err := LoadConfig(dir)
+	if err != nil || *cfg != DefaultConfig {
+		t.Fatalf("missing config: %v %v", cfg, err)
+	}
+	cfg.Quota = Quota{Bytes: 30, Messages: 3, PeerBytes: 20,
+		PeerMessages: 2}
+	err = SaveConfig(dir, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := *cfg
+	cfg, err = LoadConfig(dir)
+	if err != nil || *cfg != saved {
+		t.Errorf("saved config: %v %v", cfg, err)
+	}
+}
+
+func TestQuotaDefaults(t *testing.T) {
+	cfg := DefaultConfig
+	c := &Core{config: &cfg}
+	if c.config.Quota != (Quota{}) {
+		t.Errorf("quota on by default %v", c.config.Quota)
+	}
+	if d := c.peerDefaults(); len(d) != 0 {
+		t.Errorf("unlimited defaults stored %v", d)
+	}
+}
+
+func TestQuotaPeer(t *testing.T) {
+	c := quotaCore(t)
+	defer closeQuotaCore(c)
+
+	q := &c.config.Quota
+	b, m := peerQuota(nil, q)
+	if b != 20 || m != 2 {
+		t.Errorf("defaults %v %v", b, m)
+	}
+	tr := &TrustRecord{FreeToUse: c.peerDefaults()}
+	b, m = peerQuota(tr, q)
+	if b != 20 || m != 2 {
+		t.Errorf("stored defaults %v %v", b, m)
+	}
+	tr.FreeToUse[QuotaBytes] = "0"
+	tr.FreeToUse[QuotaMessages] = "-1"
+	b, m = peerQuota(tr, q)
+	if b != 0 || m != 2 {
+		t.Errorf("overrides %v %v", b, m)
+	}
+}
+
+// store spools content from from if it fits the quota.
+func store(t *testing.T, c *Core, from *mcrypt.Identity,
+	content string) error {
+
+	err := c.checkQuota(&from.PublicIdentity, int64(len(content)))
+	if err != nil {
+		return err
+	}
+	id, err := spoolWrite(c.scommsDir, c.identity,
+		&MetaRecord{From: from.PublicIdentity.Address},
+		strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.inbox.Add(c.identity, &InboxItem{
+		Id:   id,
+		From: from.PublicIdentity.Address,
+		Size: int64(len(content)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nil
+}
+
+func TestQuotaCheck(t *testing.T) {
+	c := quotaCore(t)
+	defer closeQuotaCore(c)
+
+	bob, err := mcrypt.NewIdentity("Bob", "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	carol, err := mcrypt.NewIdentity("Carol", "carol@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// per peer bytes
+	err = store(t, c, bob, "0123456789")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store(t, c, bob, "01234567890")
+	if qe, ok := err.(*QuotaError); !ok || qe.What != "bytes" || qe.All {
+		t.Errorf("expected peer bytes error, got %v", err)
+	}
+
+	// per peer messages
+	err = store(t, c, bob, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store(t, c, bob, "")
+	if qe, ok := err.(*QuotaError); !ok || qe.What != "messages" {
+		t.Errorf("expected peer messages error, got %v", err)
+	}
+
+	// global
+	err = store(t, c, carol, "01234567890123456789")
+	if qe, ok := err.(*QuotaError); !ok || qe.What != "bytes" || !qe.All {
+		t.Errorf("expected global bytes error, got %v", err)
+	}
+	err = store(t, c, carol, "y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store(t, c, carol, "z")
+	if qe, ok := err.(*QuotaError); !ok || qe.What != "messages" ||
+		!qe.All {
+		t.Errorf("expected global messages error, got %v", err)
+	}
+
+	// a per peer setting overrides the default
+	err = c.trust.Add(c.identity, &carol.PublicIdentity,
+		StateAllowed, map[string]string{QuotaMessages: "1"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.config.Quota.Messages = 0
+	err = store(t, c, carol, "z")
+	if qe, ok := err.(*QuotaError); !ok || qe.What != "messages" ||
+		qe.All {
+		t.Errorf("expected peer messages error, got %v", err)
+	}
+
+	peers, total, err := c.quotaUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := peers["bob@example.com"]
+	if u == nil || u.Bytes != 11 || u.Messages != 2 || total.Bytes != 12 ||
+		total.Messages != 3 {
+		t.Errorf("usage %v %v", u, total)
+	}
+}
+
+func TestQuotaReply(t *testing.T) {
+	r := sendFileReply(nil)
+	if r.Error != "" {
+		t.Errorf("success carries error %v", r.Error)
+	}
+	r = sendFileReply(&QuotaError{What: "bytes", Used: 1, Limit: 2})
+	if !strings.Contains(r.Error, "quota exceeded") {
+		t.Errorf("quota error not passed on: %v", r.Error)
+	}
+	r = sendFileReply(os.ErrPermission)
+	if strings.Contains(r.Error, "permission") {
+		t.Errorf("internal error passed on: %v", r.Error)
+	}
+}
+
+func TestSendFileOldPeer(t *testing.T) {
+	// older peers never reply, there is nothing to wait for
+	for _, c := range []*Confirmation{nil, {}} {
+		s := &Session{confirmation: c}
+		err := s.sendFileResult()
+		if err != nil {
+			t.Errorf("%v: %v", c, err)
+		}
+	}
+}
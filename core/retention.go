@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Retention is enforced by the receiver regardless of what the sender asked
+// for.  Messages older than the policy of their sender, or the configured
+// default, are deleted or archived by the sweeper unless they are flagged.
+
+// Per peer retention settings in TrustRecord.FreeToUse.  A missing setting
+// uses the configured default.
+const (
+	RetentionDays   = "RetentionDays"   // decimal, 0 keeps forever
+	RetentionAction = "RetentionAction" // RetainDelete or RetainArchive
+)
+
+// Retention actions.
+const (
+	RetainDelete  = "delete"
+	RetainArchive = "archive"
+)
+
+// Retention is what happens to messages Days after they were received, 0
+// days keeps them forever.
+type Retention struct {
+	Days   int    `json:"days"`
+	Action string `json:"action"`
+}
+
+func (r Retention) String() string {
+	if r.Days == 0 {
+		return "keep"
+	}
+	return fmt.Sprintf("%v after %vd", r.Action, r.Days)
+}
+
+// validAction reports whether action is a known retention action.
+func validAction(action string) bool {
+	return action == RetainDelete || action == RetainArchive
+}
+
+// peerRetention returns the policy of a trust record, settings that are
+// missing or invalid fall back to r.
+func peerRetention(tr *TrustRecord, r Retention) Retention {
+	if !validAction(r.Action) {
+		r.Action = RetainDelete
+	}
+	if tr == nil {
+		return r
+	}
+	d, err := strconv.Atoi(tr.FreeToUse[RetentionDays])
+	if err == nil && d >= 0 {
+		r.Days = d
+	}
+	if a := tr.FreeToUse[RetentionAction]; validAction(a) {
+		r.Action = a
+	}
+	return r
+}
+
+// retentionDue returns the action due for item under r at now, "" if none.
+func retentionDue(item *InboxItem, r Retention, now time.Time) string {
+	if item.Flagged || r.Days == 0 {
+		return ""
+	}
+	if now.Sub(item.Received) < time.Duration(r.Days)*24*time.Hour {
+		return ""
+	}
+	if r.Action == RetainArchive && item.Archived {
+		return ""
+	}
+	return r.Action
+}
+
+// retain applies retention policies to items and records what it did in the
+// audit log.
+func (c *Core) retain(items []*InboxItem, now time.Time) {
+	trs, err := c.trust.GetAll(c.identity)
+	if err != nil {
+		c.debugCore("retain: %v", err)
+		return
+	}
+	policies := make(map[string]Retention, len(trs))
+	for _, v := range trs {
+		policies[v.PublicIdentity.Address] = peerRetention(v,
+			c.config.Retention)
+	}
+
+	done := make(map[string]map[string]int) // count by action and sender
+	for _, v := range items {
+		r, ok := policies[v.From]
+		if !ok {
+			r = peerRetention(nil, c.config.Retention)
+		}
+		action := retentionDue(v, r, now)
+		switch action {
+		case RetainDelete:
+			// content, index records and exported plaintext
+			err = c.inboxDelete(v.Id)
+		case RetainArchive:
+			_, err = c.inbox.Mark(c.identity, v.Id, v.Read, true,
+				v.Flagged)
+		default:
+			continue
+		}
+		if err != nil {
+			c.debugCore("retain: %v %v %v", action, v.Id, err)
+			continue
+		}
+		c.debugCore("retain: %v %v", action, v.Id)
+		if done[action] == nil {
+			done[action] = make(map[string]int)
+		}
+		done[action][v.From]++
+	}
+
+	for _, action := range []string{RetainDelete, RetainArchive} {
+		if len(done[action]) == 0 {
+			continue
+		}
+		c.auditLog(AuditRetention, nil, "%v %v", action,
+			retentionSummary(done[action]))
+	}
+}
+
+// retentionSummary formats message counts by sender.
+func retentionSummary(counts map[string]int) string {
+	from := make([]string, 0, len(counts))
+	total := 0
+	for k, v := range counts {
+		from = append(from, fmt.Sprintf("%v from %v", v, k))
+		total += v
+	}
+	sort.Strings(from)
+	return fmt.Sprintf("%v messages: %v", total, strings.Join(from, ", "))
+}
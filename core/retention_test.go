@@ -0,0 +1,208 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"io/ioutil"
+	stdlog "log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcopeereboom/dbglog"
+	"github.com/marcopeereboom/mcrypt"
+)
+
+func TestRetentionPeer(t *testing.T) {
+	def := Retention{Days: 30, Action: RetainDelete}
+	if r := peerRetention(nil, def); r != def {
+		t.Errorf("default %v", r)
+	}
+	if r := peerRetention(nil, Retention{Days: 1}); r.Action != RetainDelete {
+		t.Errorf("missing action %v", r)
+	}
+	tr := &TrustRecord{FreeToUse: map[string]string{
+		RetentionDays:   "365",
+		RetentionAction: RetainArchive,
+	}}
+	if r := peerRetention(tr, def); r.Days != 365 ||
+		r.Action != RetainArchive {
+		t.Errorf("override %v", r)
+	}
+	tr.FreeToUse[RetentionDays] = "0"
+	tr.FreeToUse[RetentionAction] = "shred"
+	if r := peerRetention(tr, def); r.Days != 0 ||
+		r.Action != RetainDelete {
+		t.Errorf("keep forever %v", r)
+	}
+	tr.FreeToUse[RetentionDays] = "-1"
+	if r := peerRetention(tr, def); r.Days != 30 {
+		t.Errorf("invalid days %v", r)
+	}
+}
+
+func TestRetentionDue(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	tests := []struct {
+		item   InboxItem
+		r      Retention
+		action string
+	}{
+		{InboxItem{Received: old}, Retention{2, RetainDelete}, RetainDelete},
+		{InboxItem{Received: old}, Retention{3, RetainDelete}, ""},
+		{InboxItem{Received: old}, Retention{0, RetainDelete}, ""},
+		{InboxItem{Received: old, Flagged: true},
+			Retention{1, RetainDelete}, ""},
+		{InboxItem{Received: old}, Retention{1, RetainArchive},
+			RetainArchive},
+		{InboxItem{Received: old, Archived: true},
+			Retention{1, RetainArchive}, ""},
+		{InboxItem{Received: old, Archived: true},
+			Retention{1, RetainDelete}, RetainDelete},
+	}
+	for i, v := range tests {
+		if a := retentionDue(&v.item, v.r, now); a != v.action {
+			t.Errorf("%v: got %q want %q", i, a, v.action)
+		}
+	}
+}
+
+func TestRetentionSweep(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id, err := mcrypt.NewIdentity("Alice", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := mcrypt.NewIdentity("Bob", "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig
+	cfg.Retention.Days = 7
+	c := &Core{
+		DbgLogger: dbglog.New(ioutil.Discard, "", stdlog.LstdFlags),
+		scommsDir: dir,
+		identity:  id,
+		config:    &cfg,
+	}
+	c.trust, err = NewTrust(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.trust.Close()
+	c.inbox, err = NewInbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.inbox.Close()
+	c.audit, err = OpenAudit(dir, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.audit.Close()
+
+	// bob is archived after a year, everybody else deleted after a week
+	err = c.trust.Add(id, &bob.PublicIdentity, StateAllowed,
+		map[string]string{
+			RetentionDays:   "365",
+			RetentionAction: RetainArchive,
+		}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	add := func(from string, age time.Duration, flagged bool) string {
+		spoolId, err := spoolWrite(dir, id, &MetaRecord{From: from},
+			strings.NewReader(from+age.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.inbox.Add(id, &InboxItem{
+			Id:       spoolId,
+			From:     from,
+			Received: now.Add(-age),
+			Flagged:  flagged,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return spoolId
+	}
+	day := 24 * time.Hour
+	fresh := add("carol@example.com", day, false)
+	stale := add("carol@example.com", 8*day, false)
+	flagged := add("carol@example.com", 8*day, true)
+	bobFresh := add("bob@example.com", 8*day, false)
+	bobStale := add("bob@example.com", 400*day, false)
+
+	_, err = c.SpoolExport(stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := c.inbox.List(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.retain(items, now)
+
+	want := map[string]bool{fresh: false, flagged: false, bobFresh: false,
+		bobStale: true}
+	items, err = c.inbox.List(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != len(want) {
+		t.Fatalf("unexpected items %v", items)
+	}
+	for _, v := range items {
+		archived, ok := want[v.Id]
+		if !ok || v.Archived != archived {
+			t.Errorf("unexpected item %v", v)
+		}
+	}
+	if _, err = SpoolGet(dir, id, stale); err == nil {
+		t.Errorf("%v not deleted", stale)
+	}
+	if _, err = os.Stat(dir + exportDir + stale); !os.IsNotExist(err) {
+		t.Errorf("%v export not deleted: %v", stale, err)
+	}
+
+	// what was done is in the audit log
+	records, err := VerifyAudit(dir, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := make([]string, 0)
+	for _, v := range records {
+		if v.Event == AuditRetention {
+			summary = append(summary, v.Detail)
+		}
+	}
+	if len(summary) != 2 ||
+		summary[0] != "delete 1 messages: 1 from carol@example.com" ||
+		summary[1] != "archive 1 messages: 1 from bob@example.com" {
+		t.Errorf("unexpected summary %q", summary)
+	}
+}
@@ -0,0 +1,285 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/marcopeereboom/mcrypt"
+)
+
+// Streaming encryption at rest
+//
+// Content is encrypted with a random AES-256-GCM key that is itself sealed
+// to self, the same way trust records are.  The stream is cut in chunks so
+// that it never has to be in memory at once:
+//
+//	magic			"scseal1\n"
+//	uint32 length		sealed key length
+//	sealed key		sealToSelf(key)
+//	{
+//		uint32 length	chunk length
+//		chunk		AES-GCM(key, nonce(n, final), plaintext(n))
+//	}
+//
+// The nonce is the chunk number followed by a byte that is 1 on the final
+// chunk only.  Reordered, dropped or truncated chunks therefore fail to
+// open.
+const (
+	sealMagic     = "scseal1\n"
+	sealChunkSize = 64 * 1024
+	sealMaxKey    = 64 * 1024 // sanity limit on the sealed key
+)
+
+func sealNonce(aead cipher.AEAD, n uint64, final bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], n)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+func sealAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealWriter encrypts a stream to self.  Close must be called to write the
+// final chunk, it does not close the underlying writer.
+type sealWriter struct {
+	w    io.Writer
+	aead cipher.AEAD
+	buf  []byte
+	n    uint64
+}
+
+func newSealWriter(w io.Writer, id *mcrypt.Identity) (*sealWriter, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealToSelf(id, key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := sealAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := make([]byte, len(sealMagic)+4, len(sealMagic)+4+len(sealed))
+	copy(hdr, sealMagic)
+	binary.BigEndian.PutUint32(hdr[len(sealMagic):], uint32(len(sealed)))
+	hdr = append(hdr, sealed...)
+	_, err = w.Write(hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sealWriter{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, sealChunkSize),
+	}, nil
+}
+
+func (s *sealWriter) chunk(final bool) error {
+	ct := s.aead.Seal(nil, sealNonce(s.aead, s.n, final), s.buf, nil)
+	s.n++
+	s.buf = s.buf[:0]
+
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(ct)))
+	_, err := s.w.Write(l[:])
+	if err != nil {
+		return err
+	}
+	_, err = s.w.Write(ct)
+	return err
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// only flush once more data arrives so that the last chunk
+		// can be marked final in Close
+		if len(s.buf) == sealChunkSize {
+			err := s.chunk(false)
+			if err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.buf[len(s.buf):sealChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (s *sealWriter) Close() error {
+	return s.chunk(true)
+}
+
+// sealReader decrypts a stream written by sealWriter.
+type sealReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	buf   []byte
+	n     uint64
+	final bool
+}
+
+// isSealed reports whether hdr starts a sealed stream.
+func isSealed(hdr []byte) bool {
+	return bytes.HasPrefix(hdr, []byte(sealMagic))
+}
+
+func newSealReader(r io.Reader, id *mcrypt.Identity) (*sealReader, error) {
+	hdr := make([]byte, len(sealMagic)+4)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, fmt.Errorf("sealed header: %v", err)
+	}
+	if !isSealed(hdr) {
+		return nil, fmt.Errorf("not sealed")
+	}
+	l := binary.BigEndian.Uint32(hdr[len(sealMagic):])
+	if l > sealMaxKey {
+		return nil, fmt.Errorf("invalid sealed key length %v", l)
+	}
+	sealed := make([]byte, l)
+	_, err = io.ReadFull(r, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("sealed key: %v", err)
+	}
+	var key []byte
+	err = openFromSelf(id, sealed, &key)
+	if err != nil {
+		return nil, fmt.Errorf("sealed key: %v", err)
+	}
+	aead, err := sealAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sealReader{r: r, aead: aead}, nil
+}
+
+func (s *sealReader) chunk() error {
+	var l [4]byte
+	_, err := io.ReadFull(s.r, l[:])
+	if err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("sealed stream truncated")
+		}
+		return err
+	}
+	cl := binary.BigEndian.Uint32(l[:])
+	if cl > sealChunkSize+uint32(s.aead.Overhead()) {
+		return fmt.Errorf("invalid sealed chunk length %v", cl)
+	}
+	ct := make([]byte, cl)
+	_, err = io.ReadFull(s.r, ct)
+	if err != nil {
+		return fmt.Errorf("sealed chunk %v: %v", s.n, err)
+	}
+
+	// a chunk opens either as an intermediate or as the final one
+	s.buf, err = s.aead.Open(s.buf[:0], sealNonce(s.aead, s.n, false),
+		ct, nil)
+	if err != nil {
+		s.buf, err = s.aead.Open(s.buf[:0],
+			sealNonce(s.aead, s.n, true), ct, nil)
+		if err != nil {
+			return fmt.Errorf("sealed chunk %v: %v", s.n, err)
+		}
+		s.final = true
+	}
+	s.n++
+
+	return nil
+}
+
+func (s *sealReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.final {
+			// nothing may follow the final chunk
+			var b [1]byte
+			n, _ := s.r.Read(b[:])
+			if n != 0 {
+				return 0, fmt.Errorf("data after final chunk")
+			}
+			return 0, io.EOF
+		}
+		err := s.chunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// selfKey returns a random key that is stored sealed to self in filename,
+// create creates it when missing.
+func selfKey(filename string, id *mcrypt.Identity, create bool) ([]byte,
+	error) {
+
+	var key []byte
+	blob, err := ioutil.ReadFile(filename)
+	if err == nil {
+		err = openFromSelf(id, blob, &key)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) || !create {
+		return nil, err
+	}
+
+	key = make([]byte, sha256.Size)
+	_, err = io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return nil, err
+	}
+	blob, err = sealToSelf(id, key)
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileAtomic(filename, blob)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+
+	"github.com/marcopeereboom/mcrypt"
+)
+
+func seal(t *testing.T, id *mcrypt.Identity, plaintext []byte) []byte {
+	var b bytes.Buffer
+	w, err := newSealWriter(&b, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// odd sized writes to exercise chunking
+	for p := plaintext; len(p) > 0; {
+		n := 1000
+		if n > len(p) {
+			n = len(p)
+		}
+		_, err = w.Write(p[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func unseal(id *mcrypt.Identity, sealed []byte) ([]byte, error) {
+	r, err := newSealReader(bytes.NewReader(sealed), id)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	id, err := mcrypt.NewIdentity("Alice", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 1, sealChunkSize - 1, sealChunkSize,
+		sealChunkSize + 1, 3*sealChunkSize + 17} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+		sealed := seal(t, id, plaintext)
+		if size > 16 && bytes.Contains(sealed, plaintext[:16]) {
+			t.Errorf("%v: plaintext in sealed stream", size)
+		}
+		got, err := unseal(id, sealed)
+		if err != nil {
+			t.Errorf("%v: %v", size, err)
+			continue
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("%v: content mismatch", size)
+		}
+	}
+}
+
+func TestSealTamper(t *testing.T) {
+	id, err := mcrypt.NewIdentity("Alice", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := make([]byte, 2*sealChunkSize+100)
+	rand.Read(plaintext)
+	sealed := seal(t, id, plaintext)
+
+	// drop the final chunk
+	last := len(sealed) - (100 + 16 + 4)
+	_, err = unseal(id, sealed[:last])
+	if err == nil {
+		t.Errorf("truncation not detected")
+	}
+
+	// cut in the middle of a chunk
+	_, err = unseal(id, sealed[:len(sealed)-10])
+	if err == nil {
+		t.Errorf("partial chunk not detected")
+	}
+
+	// flip a bit
+	bad := append([]byte{}, sealed...)
+	bad[len(bad)-50] ^= 1
+	_, err = unseal(id, bad)
+	if err == nil {
+		t.Errorf("modification not detected")
+	}
+
+	// trailing garbage
+	_, err = unseal(id, append(append([]byte{}, sealed...), 0))
+	if err == nil {
+		t.Errorf("trailing data not detected")
+	}
+
+	// somebody else
+	bob, err := mcrypt.NewIdentity("Bob", "bob@example.com")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = unseal(bob, sealed)
+	if err == nil {
+		t.Errorf("opened by wrong identity")
+	}
+}
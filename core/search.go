@@ -0,0 +1,432 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/marcopeereboom/mcrypt"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Search is a word index over received messages.  Words are blinded with a
+// keyed hash before they are written so the index holds no plaintext; it only
+// reveals how many messages share a word.  The key is stored sealed to self.
+//
+// Records are "t" + blinded word + spool id for every word of a message and
+// "d" + spool id with the blinded words of that message so it can be
+// removed.  Values of the former are empty.
+type Search struct {
+	mtx sync.Mutex
+	db  *leveldb.DB
+	key []byte
+}
+
+const (
+	searchDir     = "/search/"
+	searchKeyFile = "/search.key"
+
+	maxIndexed = 1024 * 1024 // bytes of content indexed per message
+	minWord    = 2
+	maxWord    = 64
+)
+
+// OpenSearch opens the search index in the scomms directory dir.
+func OpenSearch(dir string, id *mcrypt.Identity) (*Search, error) {
+	key, err := selfKey(dir+searchKeyFile, id, true)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir+searchDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	db, err := leveldb.OpenFile(dir+searchDir, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Search{db: db, key: key}, nil
+}
+
+func (s *Search) Close() {
+	s.db.Close()
+}
+
+// blind returns the keyed hash of word.
+func (s *Search) blind(word string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(word))
+	return mac.Sum(nil)
+}
+
+// words splits text into unique lower case words.
+func words(text string) []string {
+	seen := make(map[string]bool)
+	w := make([]string, 0)
+	for _, f := range strings.FieldsFunc(strings.ToLower(text),
+		func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) {
+		if len(f) < minWord || len(f) > maxWord || seen[f] {
+			continue
+		}
+		seen[f] = true
+		w = append(w, f)
+	}
+	return w
+}
+
+// Index adds the words of text to the index of spoolId, replacing what was
+// indexed before.
+func (s *Search) Index(spoolId, text string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	b := new(leveldb.Batch)
+	err := s.remove(b, spoolId)
+	if err != nil {
+		return err
+	}
+	w := words(text)
+	blinded := make([]byte, 0, len(w)*sha256.Size)
+	for _, v := range w {
+		bw := s.blind(v)
+		blinded = append(blinded, bw...)
+		b.Put(append(append([]byte("t"), bw...), spoolId...), nil)
+	}
+	b.Put([]byte("d"+spoolId), blinded)
+	return s.db.Write(b, nil)
+}
+
+// remove adds the deletion of the records of spoolId to b.
+func (s *Search) remove(b *leveldb.Batch, spoolId string) error {
+	blinded, err := s.db.Get([]byte("d"+spoolId), nil)
+	if err == leveldb.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for i := 0; i+sha256.Size <= len(blinded); i += sha256.Size {
+		b.Delete(append(append([]byte("t"), blinded[i:i+sha256.Size]...),
+			spoolId...))
+	}
+	b.Delete([]byte("d" + spoolId))
+	return nil
+}
+
+// Remove drops spoolId from the index.
+func (s *Search) Remove(spoolId string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	b := new(leveldb.Batch)
+	err := s.remove(b, spoolId)
+	if err != nil {
+		return err
+	}
+	return s.db.Write(b, nil)
+}
+
+// Ids returns the spool ids in the index.
+func (s *Search) Ids() (map[string]bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	ids := make(map[string]bool)
+	iter := s.db.NewIterator(util.BytesPrefix([]byte("d")), nil)
+	for iter.Next() {
+		ids[string(iter.Key()[1:])] = true
+	}
+	iter.Release()
+	return ids, iter.Error()
+}
+
+// Lookup returns the spool ids that contain all words.
+func (s *Search) Lookup(w []string) (map[string]bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var found map[string]bool
+	for _, v := range w {
+		prefix := append([]byte("t"), s.blind(v)...)
+		ids := make(map[string]bool)
+		iter := s.db.NewIterator(util.BytesPrefix(prefix), nil)
+		for iter.Next() {
+			id := string(iter.Key()[len(prefix):])
+			if found == nil || found[id] {
+				ids[id] = true
+			}
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return nil, err
+		}
+		found = ids
+		if len(found) == 0 {
+			break
+		}
+	}
+	return found, nil
+}
+
+// Query is a parsed search.  Words must all occur in the content, filename
+// or sender of a message, the other fields filter on metadata.
+type Query struct {
+	Words  []string
+	From   string    // part of the sender address
+	Mime   string    // mime type prefix
+	After  time.Time // received on or after
+	Before time.Time // received before
+	Tag    string    // sender is a contact with this tag
+}
+
+// ParseQuery parses words and from:, tag:, mime:, after: and before: filters,
+// dates are YYYY-MM-DD in local time, e.g. "config from:bob after:2014-06-01".
+func ParseQuery(s string) (*Query, error) {
+	q := &Query{}
+	text := make([]string, 0)
+	for _, f := range strings.Fields(s) {
+		i := strings.Index(f, ":")
+		if i < 0 {
+			text = append(text, f)
+			continue
+		}
+		value := strings.ToLower(f[i+1:])
+		var err error
+		switch strings.ToLower(f[:i]) {
+		case "from":
+			q.From = value
+		case "tag":
+			q.Tag = value
+		case "mime":
+			q.Mime = value
+		case "after":
+			q.After, err = time.ParseInLocation("2006-01-02", value,
+				time.Local)
+		case "before":
+			q.Before, err = time.ParseInLocation("2006-01-02", value,
+				time.Local)
+		default:
+			text = append(text, f)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid date %v", f)
+		}
+	}
+	q.Words = words(strings.Join(text, " "))
+	return q, nil
+}
+
+// match reports whether item passes the metadata filters of q.
+func (q *Query) match(item *InboxItem) bool {
+	switch {
+	case q.From != "" && !strings.Contains(strings.ToLower(item.From),
+		q.From):
+		return false
+	case q.Mime != "" && !strings.HasPrefix(strings.ToLower(item.Mime),
+		q.Mime):
+		return false
+	case !q.After.IsZero() && item.Received.Before(q.After):
+		return false
+	case !q.Before.IsZero() && !item.Received.Before(q.Before):
+		return false
+	}
+	return true
+}
+
+// isText reports whether content of mime type mime is worth indexing.
+func isText(mime string, content []byte) bool {
+	if mime != "" && !strings.HasPrefix(mime, "text/") &&
+		mime != "message/rfc822" {
+		return false
+	}
+	return utf8.Valid(content)
+}
+
+// openSearch opens the search index once the identity is known.
+func (c *Core) openSearch() {
+	var err error
+	c.search, err = OpenSearch(c.scommsDir, c.identity)
+	if err != nil {
+		c.popup("Could not open search index", "%v", err)
+	}
+}
+
+// partsText returns the text parts of multipart content, content may be
+// truncated.
+func partsText(mediaType string, content []byte) string {
+	mr, err := multipartReader(mediaType, bytes.NewReader(content))
+	if err != nil {
+		return ""
+	}
+	text := make([]string, 0)
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		b, err := ioutil.ReadAll(p)
+		if err == nil && len(b) != 0 &&
+			isText(p.Header.Get("Content-Type"), b) {
+			text = append(text, string(b))
+		}
+	}
+	return strings.Join(text, " ")
+}
+
+// searchAdd indexes the filename, sender and text content of item including
+// attachments.  The content of view once messages is not indexed.
+func (c *Core) searchAdd(item *InboxItem) error {
+	if c.search == nil {
+		return nil
+	}
+	text := item.From + " " + item.Filename
+	for _, v := range item.Parts {
+		text += " " + v.Filename
+	}
+	if !item.ViewOnce {
+		r, err := SpoolOpen(c.scommsDir, c.identity, item.Id)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadAll(io.LimitReader(r, maxIndexed))
+		r.Close()
+		if err != nil {
+			return err
+		}
+		if len(item.Parts) != 0 {
+			text += " " + partsText(item.Mime, content)
+		} else if isText(item.Mime, content) {
+			text += " " + string(content)
+		}
+	}
+	return c.search.Index(item.Id, text)
+}
+
+// searchSync indexes items that are missing from the index and drops what
+// is no longer in the inbox.
+func (c *Core) searchSync(items []*InboxItem) {
+	if c.search == nil {
+		return
+	}
+	ids, err := c.search.Ids()
+	if err != nil {
+		c.debugCore("searchSync: %v", err)
+		return
+	}
+	for _, v := range items {
+		if ids[v.Id] {
+			delete(ids, v.Id)
+			continue
+		}
+		err = c.searchAdd(v)
+		if err != nil {
+			c.debugCore("searchSync: %v %v", v.Id, err)
+		}
+	}
+	for id := range ids {
+		err = c.search.Remove(id)
+		if err != nil {
+			c.debugCore("searchSync: %v %v", id, err)
+		}
+	}
+}
+
+// inboxDelete deletes an inbox item, its content and its index records.
+func (c *Core) inboxDelete(id string) error {
+	c.mtxSpool.Lock()
+	err := c.inbox.Delete(c.identity, id)
+	c.mtxSpool.Unlock()
+	if err != nil {
+		return err
+	}
+	if c.search != nil {
+		err = c.search.Remove(id)
+		if err != nil {
+			c.debugCore("inboxDelete: %v %v", id, err)
+		}
+	}
+	return nil
+}
+
+// handleInboxSearch answers a search with the matching inbox items, newest
+// first.
+func (c *Core) handleInboxSearch(m *InboxSearch) {
+	r := &UiSearchResult{Query: m.Query}
+	items, err := c.searchItems(m.Query)
+	if err != nil {
+		r.Error = err.Error()
+	}
+	r.Items = items
+	c.Send(core, []string{ui}, r)
+}
+
+// searchItems returns the inbox items that match query.
+func (c *Core) searchItems(query string) ([]*InboxItem, error) {
+	q, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	items, err := c.inbox.List(c.identity)
+	if err != nil {
+		return nil, err
+	}
+	var ids map[string]bool
+	if len(q.Words) != 0 {
+		if c.search == nil {
+			return nil, fmt.Errorf("no search index")
+		}
+		ids, err = c.search.Lookup(q.Words)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var tagged map[string]bool
+	if q.Tag != "" {
+		trs, err := c.trust.ListByState(c.identity, StateAllowed)
+		if err != nil {
+			return nil, err
+		}
+		tagged = make(map[string]bool)
+		for _, tr := range Tagged(trs, q.Tag) {
+			tagged[tr.PublicIdentity.Address] = true
+		}
+	}
+	now := time.Now()
+	found := make([]*InboxItem, 0)
+	for _, v := range items {
+		if v.Expired(now) || !q.match(v) || (ids != nil && !ids[v.Id]) ||
+			(tagged != nil && !tagged[v.From]) {
+			continue
+		}
+		found = append(found, v)
+	}
+	return found, nil
+}
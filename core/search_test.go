@@ -0,0 +1,248 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	stdlog "log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcopeereboom/dbglog"
+	"github.com/marcopeereboom/mcrypt"
+)
+
+func TestSearchWords(t *testing.T) {
+	w := words("Hello, hello WORLD! a x-ray 42 " + strings.Repeat("z", 65))
+	want := []string{"hello", "world", "ray", "42"}
+	if strings.Join(w, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v want %v", w, want)
+	}
+
+	q, err := ParseQuery("Config from:Bob mime:text/ after:2014-06-01 " +
+		"before:2014-07-01 snippet tag:Ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(q.Words, " ") != "config snippet" || q.From != "bob" ||
+		q.Tag != "ops" ||
+		q.Mime != "text/" || q.After.Month() != time.June ||
+		q.Before.Month() != time.July {
+		t.Errorf("unexpected query %+v", q)
+	}
+	_, err = ParseQuery("after:yesterday")
+	if err == nil {
+		t.Error("invalid date should have tripped")
+	}
+}
+
+// searchSpool stores content the way serverSendFile does and returns the
+// spool id.
+func searchSpool(t *testing.T, c *Core, from, filename, mime,
+	content string, received time.Time) string {
+
+	spoolId, err := spoolWrite(c.scommsDir, c.identity, &MetaRecord{
+		Mime:     mime,
+		Created:  received,
+		From:     from,
+		Filename: filename,
+	}, strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := &InboxItem{
+		Id:       spoolId,
+		From:     from,
+		Filename: filename,
+		Mime:     mime,
+		Size:     int64(len(content)),
+		Received: received,
+	}
+	err = c.inbox.Add(c.identity, item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.searchAdd(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spoolId
+}
+
+// searchCore returns a core in a new directory with inbox and search index
+// open that received nginx.conf and photo.jpg from bob and notes.txt from
+// carol, and their spool ids by filename.  The caller closes the stores
+// and removes the directory.
+func searchCore(t *testing.T) (*Core, map[string]string) {
+	dir, err := ioutil.TempDir(os.TempDir(), "search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Core{
+		DbgLogger: dbglog.New(ioutil.Discard, "", stdlog.LstdFlags),
+		scommsDir: dir,
+	}
+	c.identity, err = mcrypt.NewIdentity("Alice", "alice@example.com")
+	if err == nil {
+		c.inbox, err = NewInbox(dir)
+	}
+	if err == nil {
+		c.search, err = OpenSearch(dir, c.identity)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	june := time.Date(2014, 6, 15, 12, 0, 0, 0, time.Local)
+	ids := map[string]string{
+		"nginx.conf": searchSpool(t, c, "bob@example.com", "nginx.conf",
+			"text/plain", "the config snippet: listen 443 ssl;", june),
+		"notes.txt": searchSpool(t, c, "carol@example.com", "notes.txt",
+			"text/plain", "config of the printer",
+			june.AddDate(0, 1, 0)),
+		"photo.jpg": searchSpool(t, c, "bob@example.com", "photo.jpg",
+			"image/jpeg", "snippet config", june),
+	}
+	return c, ids
+}
+
+func closeSearchCore(c *Core) {
+	c.search.Close()
+	c.inbox.Close()
+	os.RemoveAll(c.scommsDir)
+}
+
+func TestSearchItems(t *testing.T) {
+	c, _ := searchCore(t)
+	defer closeSearchCore(c)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"config", []string{"nginx.conf", "notes.txt"}},
+		{"CONFIG snippet", []string{"nginx.conf"}},
+		{"config from:carol", []string{"notes.txt"}},
+		{"nginx", []string{"nginx.conf"}},
+		{"bob", []string{"nginx.conf", "photo.jpg"}},
+		{"mime:image/", []string{"photo.jpg"}},
+		{"config before:2014-07-01", []string{"nginx.conf"}},
+		{"after:2014-07-01", []string{"notes.txt"}},
+		{"missing", []string{}},
+	}
+	for _, v := range tests {
+		items, err := c.searchItems(v.query)
+		if err != nil {
+			t.Errorf("%v: %v", v.query, err)
+			continue
+		}
+		got := make(map[string]bool)
+		for _, item := range items {
+			got[item.Filename] = true
+		}
+		if len(got) != len(v.want) {
+			t.Errorf("%v: got %v want %v", v.query, got, v.want)
+			continue
+		}
+		for _, f := range v.want {
+			if !got[f] {
+				t.Errorf("%v: got %v want %v", v.query, got, v.want)
+			}
+		}
+	}
+}
+
+func TestSearchPlaintext(t *testing.T) {
+	c, _ := searchCore(t)
+	defer closeSearchCore(c)
+
+	// close so everything is on disk
+	c.search.Close()
+	err := filepath.Walk(c.scommsDir+searchDir,
+		func(path string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return err
+			}
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			for _, v := range []string{"snippet", "printer", "nginx"} {
+				if bytes.Contains(b, []byte(v)) {
+					t.Errorf("%v contains %v", path, v)
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.search, err = OpenSearch(c.scommsDir, c.identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := c.searchItems("printer")
+	if err != nil || len(items) != 1 {
+		t.Errorf("reopened index %v %v", items, err)
+	}
+}
+
+func TestSearchRemove(t *testing.T) {
+	c, ids := searchCore(t)
+	defer closeSearchCore(c)
+
+	err := c.inboxDelete(ids["notes.txt"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := c.searchItems("printer")
+	if err != nil || len(items) != 0 {
+		t.Errorf("deleted item found %v %v", items, err)
+	}
+
+	// sync drops what is gone and indexes what is missing
+	err = c.search.Remove(ids["photo.jpg"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.search.Index("nobody", "stale words")
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := c.inbox.List(c.identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.searchSync(all)
+	found, err := c.search.Ids()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || !found[ids["photo.jpg"]] || found["nobody"] {
+		t.Errorf("unexpected ids %v", found)
+	}
+	stale, err := c.search.Lookup([]string{"stale"})
+	if err != nil || len(stale) != 0 {
+		t.Errorf("stale words %v %v", stale, err)
+	}
+}
@@ -0,0 +1,608 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/marcopeereboom/mcrypt"
+)
+
+// spool layout
+//
+//	spool.key			HMAC key, sealed to self
+//	spool/blobs/<blob>		content, sealed stream
+//	spool/meta/<spool id>		MetaRecord, sealed to self
+//	export/<spool id>/<filename>	plaintext exported by the user, removed
+//					with the spool entry
+//
+// Blobs are named by HMAC-SHA256(spool key, content) so identical content
+// is stored once without revealing what it is.  Spool ids are random.  Both
+// are hex and nothing a peer sends ends up in a path; the sender address and
+// suggested filename are only kept in the meta record.
+//
+// Older versions stored content as spool/<sender address>/<filename> next
+// to <filename>.meta, in plaintext before that.  Core migrates those on
+// start.
+const (
+	spoolDir       = "/spool/"
+	spoolKeyFile   = "/spool.key"
+	blobDir        = "blobs/"
+	metaDir        = "meta/"
+	exportDir      = "/export/"
+	metaExtension  = ".meta"
+	tmpExtension   = ".tmp"
+	metaVersion    = 6
+	spoolIdSize    = 16              // random bytes in a spool id
+	blobNameLength = 2 * sha256.Size // hex
+)
+
+// Received content as found in the spool.
+type SpoolEntry struct {
+	Id       string
+	From     string
+	Filename string // suggested by the sender, never used as a path
+	Size     int64
+	Meta     MetaRecord
+}
+
+// validHex reports whether s is a lowercase hex string of length l.
+func validHex(s string, l int) bool {
+	if len(s) != l {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// spoolMetaPath validates a spool id and returns its meta filename.
+func spoolMetaPath(dir, id string) (string, error) {
+	if !validHex(id, 2*spoolIdSize) {
+		return "", fmt.Errorf("invalid spool id %v", id)
+	}
+	return dir + spoolDir + metaDir + id, nil
+}
+
+// spoolBlobPath validates a blob name and returns its filename.
+func spoolBlobPath(dir, blob string) (string, error) {
+	if !validHex(blob, blobNameLength) {
+		return "", fmt.Errorf("invalid blob %v", blob)
+	}
+	return dir + spoolDir + blobDir + blob, nil
+}
+
+func newSpoolId() (string, error) {
+	b := make([]byte, spoolIdSize)
+	_, err := io.ReadFull(rand.Reader, b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// safeName reduces a name suggested by a peer to a single path element.
+func safeName(name string) string {
+	name = path.Base(strings.Replace(name, "\\", "/", -1))
+	if name == "." || name == ".." || name == "/" ||
+		strings.HasPrefix(name, ".") {
+		return "unknown"
+	}
+	return name
+}
+
+// readMeta reads a meta record.
+func readMeta(filename string, id *mcrypt.Identity) (*MetaRecord, error) {
+	blob, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	meta := MetaRecord{}
+	err = openFromSelf(id, blob, &meta)
+	if err != nil {
+		return nil, fmt.Errorf("meta %v: %v", path.Base(filename), err)
+	}
+	return &meta, nil
+}
+
+// SpoolGet returns the entry for a spool id.
+func SpoolGet(dir string, id *mcrypt.Identity, spoolId string) (*SpoolEntry,
+	error) {
+
+	filename, err := spoolMetaPath(dir, spoolId)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := readMeta(filename, id)
+	if err != nil {
+		return nil, err
+	}
+	return &SpoolEntry{
+		Id:       spoolId,
+		From:     meta.From,
+		Filename: meta.Filename,
+		Size:     meta.Size,
+		Meta:     *meta,
+	}, nil
+}
+
+// SpoolList returns all received content in the scomms directory dir.  It
+// does not need a running core.
+func SpoolList(dir string, id *mcrypt.Identity) ([]*SpoolEntry, error) {
+	fis, err := ioutil.ReadDir(dir + spoolDir + metaDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	entries := make([]*SpoolEntry, 0, len(fis))
+	for _, fi := range fis {
+		if !validHex(fi.Name(), 2*spoolIdSize) {
+			continue // tmp files
+		}
+		se, err := SpoolGet(dir, id, fi.Name())
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, se)
+	}
+
+	return entries, nil
+}
+
+type spoolReader struct {
+	io.Reader
+	f *os.File
+}
+
+func (s *spoolReader) Close() error {
+	return s.f.Close()
+}
+
+// openBlob opens a sealed blob for reading.
+func openBlob(filename string, id *mcrypt.Identity) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	sr, err := newSealReader(bufio.NewReader(f), id)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &spoolReader{Reader: sr, f: f}, nil
+}
+
+// SpoolOpen opens received content in the scomms directory dir by spool id
+// as returned by SpoolList.  The returned reader decrypts.
+func SpoolOpen(dir string, id *mcrypt.Identity, spoolId string) (io.ReadCloser,
+	error) {
+
+	se, err := SpoolGet(dir, id, spoolId)
+	if err != nil {
+		return nil, err
+	}
+	filename, err := spoolBlobPath(dir, se.Meta.Blob)
+	if err != nil {
+		return nil, err
+	}
+	r, err := openBlob(filename, id)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", spoolId, err)
+	}
+	return r, nil
+}
+
+// SpoolExport decrypts received content to filename, which must not exist.
+func SpoolExport(dir string, id *mcrypt.Identity, spoolId,
+	filename string) error {
+
+	r, err := SpoolOpen(dir, id, spoolId)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return writeExport(filename, r)
+}
+
+// writeExport copies r to filename, which must not exist.
+func writeExport(filename string, r io.Reader) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+		0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		os.Remove(filename)
+		return err
+	}
+	return f.Close()
+}
+
+// spoolSeal encrypts r to filename.  The content only appears once it is
+// complete.
+func spoolSeal(filename string, id *mcrypt.Identity, r io.Reader) (int64,
+	error) {
+
+	tmp := filename + tmpExtension
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	bw := bufio.NewWriter(f)
+	n, err := func() (int64, error) {
+		sw, err := newSealWriter(bw, id)
+		if err != nil {
+			return 0, err
+		}
+		n, err := io.Copy(sw, r)
+		if err != nil {
+			return n, err
+		}
+		err = sw.Close()
+		if err != nil {
+			return n, err
+		}
+		return n, bw.Flush()
+	}()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return n, os.Rename(tmp, filename)
+}
+
+// spoolWrite stores content from r and its meta record, both encrypted to
+// self, and returns the new spool id.  Content that is already stored is
+// not stored again.  The caller holds the spool lock until the reference to
+// meta.Blob is counted.
+func spoolWrite(dir string, id *mcrypt.Identity, meta *MetaRecord,
+	r io.Reader) (string, error) {
+
+	err := os.MkdirAll(dir+spoolDir+blobDir, 0700)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(dir+spoolDir+metaDir, 0700)
+	if err != nil {
+		return "", err
+	}
+	key, err := selfKey(dir+spoolKeyFile, id, true)
+	if err != nil {
+		return "", fmt.Errorf("spool key: %v", err)
+	}
+	spoolId, err := newSpoolId()
+	if err != nil {
+		return "", err
+	}
+
+	// the blob name is only known once all content was seen
+	tmp := dir + spoolDir + blobDir + spoolId
+	mac := hmac.New(sha256.New, key)
+	n, err := spoolSeal(tmp, id, io.TeeReader(r, mac))
+	if err != nil {
+		return "", err
+	}
+	meta.Blob = hex.EncodeToString(mac.Sum(nil))
+	filename, _ := spoolBlobPath(dir, meta.Blob)
+	if _, err := os.Stat(filename); err == nil {
+		os.Remove(tmp) // dup
+	} else {
+		err = os.Rename(tmp, filename)
+		if err != nil {
+			os.Remove(tmp)
+			return "", err
+		}
+	}
+
+	meta.Version = metaVersion
+	meta.Size = n
+	blob, err := sealToSelf(id, meta)
+	if err != nil {
+		return "", err
+	}
+	metaFilename, _ := spoolMetaPath(dir, spoolId)
+	err = writeFileAtomic(metaFilename, blob)
+	if err != nil {
+		return "", err
+	}
+
+	return spoolId, nil
+}
+
+// secureRemove overwrites filename before removing it.  This does not help
+// on copy on write or log structured filesystems and against backups, which
+// is why everything is encrypted to begin with.
+func secureRemove(filename string) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err == nil {
+		zero := make([]byte, 32*1024)
+		for left := fi.Size(); left > 0 && err == nil; {
+			n := int64(len(zero))
+			if n > left {
+				n = left
+			}
+			_, err = f.Write(zero[:n])
+			left -= n
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(filename)
+}
+
+// spoolDelete removes a spool entry and returns the name of its content.
+// The caller holds the spool lock and removes the content with blobDelete
+// once nothing refers to it anymore.
+func spoolDelete(dir string, id *mcrypt.Identity, spoolId string) (string,
+	error) {
+
+	se, err := SpoolGet(dir, id, spoolId)
+	if err != nil {
+		return "", err
+	}
+	metaFilename, _ := spoolMetaPath(dir, spoolId)
+	err = secureRemove(metaFilename)
+	if err != nil {
+		return "", err
+	}
+	return se.Meta.Blob, exportRemove(dir, spoolId)
+}
+
+// blobDelete removes stored content.
+func blobDelete(dir, blob string) error {
+	filename, err := spoolBlobPath(dir, blob)
+	if err != nil {
+		return err
+	}
+	err = secureRemove(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// exportRemove deletes whatever was exported from a spool entry.
+func exportRemove(dir, spoolId string) error {
+	target := dir + exportDir + spoolId
+	fis, err := ioutil.ReadDir(target)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() {
+			err = secureRemove(target + "/" + fi.Name())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return os.RemoveAll(target)
+}
+
+// exportSweep deletes exports of spool entries that no longer exist, e.g.
+// removed by an older version.
+func exportSweep(dir string) error {
+	fis, err := ioutil.ReadDir(dir + exportDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		metaFilename, err := spoolMetaPath(dir, fi.Name())
+		if err != nil {
+			continue // not ours
+		}
+		if _, err := os.Stat(metaFilename); !os.IsNotExist(err) {
+			continue
+		}
+		err = exportRemove(dir, fi.Name())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// legacyMeta reads a meta record of the old layout, sealed or plaintext.
+func legacyMeta(filename string, id *mcrypt.Identity) (*MetaRecord, error) {
+	blob, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	meta := MetaRecord{}
+	err = openFromSelf(id, blob, &meta)
+	if err == nil {
+		return &meta, nil
+	}
+	if json.Unmarshal(blob, &meta) != nil {
+		return nil, fmt.Errorf("meta %v: %v", filename, err)
+	}
+	return &meta, nil
+}
+
+// legacyOpen opens content of the old layout, sealed or plaintext.
+func legacyOpen(filename string, id *mcrypt.Identity) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	hdr, _ := br.Peek(len(sealMagic))
+	if !isSealed(hdr) {
+		return &spoolReader{Reader: br, f: f}, nil
+	}
+	sr, err := newSealReader(br, id)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%v: %v", filename, err)
+	}
+	return &spoolReader{Reader: sr, f: f}, nil
+}
+
+// spoolMigrate moves content of the old spool/<address>/<filename> layout
+// into the blob store.  It returns the new spool id by old id.
+func spoolMigrate(dir string, id *mcrypt.Identity) (map[string]string,
+	error) {
+
+	migrated := make(map[string]string)
+	senders, err := ioutil.ReadDir(dir + spoolDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return migrated, nil
+		}
+		return migrated, err
+	}
+
+	for _, sender := range senders {
+		if !sender.IsDir() || sender.Name()+"/" == blobDir ||
+			sender.Name()+"/" == metaDir {
+			continue
+		}
+		senderDir := dir + spoolDir + sender.Name() + "/"
+		fis, err := ioutil.ReadDir(senderDir)
+		if err != nil {
+			return migrated, err
+		}
+		for _, fi := range fis {
+			if fi.IsDir() ||
+				strings.HasSuffix(fi.Name(), metaExtension) ||
+				strings.HasSuffix(fi.Name(), tmpExtension) {
+				continue
+			}
+			filename := senderDir + fi.Name()
+
+			// content without meta is still content
+			meta, err := legacyMeta(filename+metaExtension, id)
+			if err != nil {
+				if !os.IsNotExist(err) {
+					return migrated, err
+				}
+				meta = &MetaRecord{Created: fi.ModTime()}
+			}
+			meta.From = sender.Name()
+			meta.Filename = fi.Name()
+
+			r, err := legacyOpen(filename, id)
+			if err != nil {
+				return migrated, err
+			}
+			spoolId, err := spoolWrite(dir, id, meta, r)
+			r.Close()
+			if err != nil {
+				return migrated, err
+			}
+
+			// a crash before this point leaves a duplicate entry
+			// behind which is harmless
+			err = os.Remove(filename)
+			if err != nil {
+				return migrated, err
+			}
+			os.Remove(filename + metaExtension)
+			migrated[sender.Name()+"/"+fi.Name()] = spoolId
+		}
+		os.Remove(senderDir) // fails if anything is left
+	}
+
+	return migrated, nil
+}
+
+// spoolGet returns the entry of content frontends may read.  Expired and
+// view once content is only handed out by handleInboxOpen.
+func (c *Core) spoolGet(spoolId string) (*SpoolEntry, error) {
+	se, err := SpoolGet(c.scommsDir, c.identity, spoolId)
+	if err != nil {
+		return nil, err
+	}
+	if se.Meta.ViewOnce {
+		return nil, fmt.Errorf("%v can only be viewed once", spoolId)
+	}
+	if se.Expired(time.Now()) {
+		return nil, fmt.Errorf("%v expired", spoolId)
+	}
+	return se, nil
+}
+
+// SpoolOpen opens received content by spool id.
+func (c *Core) SpoolOpen(spoolId string) (io.ReadCloser, error) {
+	_, err := c.spoolGet(spoolId)
+	if err != nil {
+		return nil, err
+	}
+	return SpoolOpen(c.scommsDir, c.identity, spoolId)
+}
+
+// SpoolExport decrypts received content into the export directory and
+// returns the filename.
+func (c *Core) SpoolExport(spoolId string) (string, error) {
+	se, err := c.spoolGet(spoolId)
+	if err != nil {
+		return "", err
+	}
+	filename := c.scommsDir + exportDir + spoolId + "/" +
+		safeName(se.Filename)
+	if _, err := os.Stat(filename); err == nil {
+		return filename, nil // exported before
+	}
+	err = os.MkdirAll(path.Dir(filename), 0700)
+	if err != nil {
+		return "", err
+	}
+	err = SpoolExport(c.scommsDir, c.identity, spoolId, filename)
+	if err != nil {
+		return "", err
+	}
+	return filename, nil
+}
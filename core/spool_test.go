@@ -0,0 +1,344 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	stdlog "log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcopeereboom/dbglog"
+	"github.com/marcopeereboom/mcrypt"
+)
+
+// openSpool returns a new spool directory and its owner.  The caller
+// removes the directory.
+func openSpool(t *testing.T) (string, *mcrypt.Identity) {
+	dir, err := ioutil.TempDir(os.TempDir(), "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := mcrypt.NewIdentity("Alice", "alice@example.com")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir, id
+}
+
+func spoolRead(t *testing.T, dir string, owner *mcrypt.Identity,
+	id string) string {
+
+	r, err := SpoolOpen(dir, owner, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func spoolBlobs(t *testing.T, dir string) []os.FileInfo {
+	fis, err := ioutil.ReadDir(dir + spoolDir + blobDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fis
+}
+
+func TestSpoolDedup(t *testing.T) {
+	dir, owner := openSpool(t)
+	defer os.RemoveAll(dir)
+
+	ids := make([]string, 0, 3)
+	for _, v := range []string{"same", "same", "different"} {
+		id, err := spoolWrite(dir, owner, &MetaRecord{
+			From:     "bob@example.com",
+			Filename: v,
+		}, strings.NewReader(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if ids[0] == ids[1] {
+		t.Errorf("spool ids must be unique")
+	}
+	if len(spoolBlobs(t, dir)) != 2 {
+		t.Errorf("expected 2 blobs, got %v", len(spoolBlobs(t, dir)))
+	}
+	if spoolRead(t, dir, owner, ids[1]) != "same" ||
+		spoolRead(t, dir, owner, ids[2]) != "different" {
+		t.Errorf("content mismatch")
+	}
+
+	// content stays until the caller removes it
+	blob, err := spoolDelete(dir, owner, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spoolRead(t, dir, owner, ids[1]) != "same" {
+		t.Errorf("shared content deleted")
+	}
+	err = blobDelete(dir, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spoolBlobs(t, dir)) != 1 {
+		t.Errorf("expected 1 blob, got %v", len(spoolBlobs(t, dir)))
+	}
+}
+
+func TestSpoolPaths(t *testing.T) {
+	dir, owner := openSpool(t)
+	defer os.RemoveAll(dir)
+
+	// whatever a peer sends stays in the meta record
+	evil := []string{"../../../etc/passwd", "/etc/passwd", "..", ".",
+		"a/../../b", "..\\..\\x", "spool.key", ""}
+	for _, v := range evil {
+		id, err := spoolWrite(dir, owner, &MetaRecord{
+			From:     "../" + v,
+			Filename: v,
+		}, strings.NewReader("evil"))
+		if err != nil {
+			t.Errorf("%q: %v", v, err)
+			continue
+		}
+		se, err := SpoolGet(dir, owner, id)
+		if err != nil || se.Filename != v {
+			t.Errorf("%q: %v %v", v, se, err)
+		}
+		if n := safeName(v); strings.ContainsAny(n, "/\\") ||
+			strings.HasPrefix(n, ".") {
+			t.Errorf("%q: unsafe name %q", v, n)
+		}
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		if fi.Name() != "spool" && fi.Name() != "spool.key" {
+			t.Errorf("unexpected file %v", fi.Name())
+		}
+	}
+
+	// ids are never trusted either
+	for _, v := range []string{"../spool.key", "bob@example.com/x",
+		strings.Repeat("A", 2*spoolIdSize), ""} {
+		_, err := SpoolOpen(dir, owner, v)
+		if err == nil {
+			t.Errorf("%q: opened", v)
+		}
+	}
+}
+
+// legacyFile writes content the way older versions did.
+func legacyFile(t *testing.T, dir string, owner *mcrypt.Identity, from,
+	filename string, created time.Time, sealed bool) {
+
+	dir += spoolDir + from + "/"
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("hello " + filename)
+	if sealed {
+		var b bytes.Buffer
+		w, err := newSealWriter(&b, owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(content)
+		w.Close()
+		content = b.Bytes()
+	}
+	err = ioutil.WriteFile(dir+filename, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := MetaRecord{Version: 1, Mime: "text/plain", Created: created}
+	var j []byte
+	if sealed {
+		meta.Version = 2
+		j, err = sealToSelf(owner, meta)
+	} else {
+		j, err = json.Marshal(meta)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(dir+filename+metaExtension, j, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpoolMigrate(t *testing.T) {
+	dir, owner := openSpool(t)
+	defer os.RemoveAll(dir)
+
+	created := time.Now().Add(-time.Hour).Round(time.Second)
+	legacyFile(t, dir, owner, "bob@example.com", "plain", created, false)
+	legacyFile(t, dir, owner, "bob@example.com", "sealed", created, true)
+
+	migrated, err := spoolMigrate(dir, owner)
+	if err != nil || len(migrated) != 2 {
+		t.Fatalf("migrate: %v %v", migrated, err)
+	}
+	again, err := spoolMigrate(dir, owner)
+	if err != nil || len(again) != 0 {
+		t.Fatalf("second migrate: %v %v", again, err)
+	}
+	_, err = os.Stat(dir + spoolDir + "bob@example.com")
+	if !os.IsNotExist(err) {
+		t.Errorf("legacy directory left behind: %v", err)
+	}
+
+	for _, name := range []string{"plain", "sealed"} {
+		id := migrated["bob@example.com/"+name]
+		se, err := SpoolGet(dir, owner, id)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if se.From != "bob@example.com" || se.Filename != name ||
+			se.Size != int64(len("hello "+name)) ||
+			se.Meta.Mime != "text/plain" ||
+			!se.Meta.Created.Equal(created) {
+			t.Errorf("meta lost %v", se)
+		}
+		if spoolRead(t, dir, owner, id) != "hello "+name {
+			t.Errorf("%v: content mismatch", name)
+		}
+	}
+
+	// nothing readable on disk anymore
+	for _, fi := range spoolBlobs(t, dir) {
+		blob, err := ioutil.ReadFile(dir + spoolDir + blobDir +
+			fi.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(blob, []byte("hello")) {
+			t.Errorf("%v not encrypted", fi.Name())
+		}
+	}
+}
+
+func TestSpoolExport(t *testing.T) {
+	dir, owner := openSpool(t)
+	defer os.RemoveAll(dir)
+
+	id, err := spoolWrite(dir, owner, &MetaRecord{
+		From:     "bob@example.com",
+		Filename: "note",
+	}, strings.NewReader("hello note"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	export := dir + "/exported"
+	err = SpoolExport(dir, owner, id, export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(export)
+	if err != nil || string(b) != "hello note" {
+		t.Errorf("export %q %v", b, err)
+	}
+	err = SpoolExport(dir, owner, id, export)
+	if err == nil {
+		t.Errorf("export overwrote a file")
+	}
+}
+
+func TestSpoolExportRemove(t *testing.T) {
+	dir, owner := openSpool(t)
+	defer os.RemoveAll(dir)
+	c := &Core{
+		DbgLogger: dbglog.New(ioutil.Discard, "", stdlog.LstdFlags),
+		scommsDir: dir,
+		identity:  owner,
+	}
+
+	ids := make([]string, 0, 2)
+	for _, v := range []string{"kept", "deleted"} {
+		id, err := spoolWrite(dir, owner, &MetaRecord{
+			From:     "bob@example.com",
+			Filename: v,
+		}, strings.NewReader(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.SpoolExport(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	// deleting an entry deletes its plaintext
+	_, err := spoolDelete(dir, owner, ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(dir + exportDir + ids[1])
+	if !os.IsNotExist(err) {
+		t.Errorf("export left behind: %v", err)
+	}
+	_, err = os.Stat(dir + exportDir + ids[0] + "/kept")
+	if err != nil {
+		t.Errorf("other export deleted: %v", err)
+	}
+
+	// the sweep finds what was left by older versions but nothing else
+	orphan, err := newSpoolId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{orphan, "mine"} {
+		err = os.MkdirAll(dir+exportDir+v, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(dir+exportDir+v+"/x", []byte(v), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = exportSweep(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fis, err := ioutil.ReadDir(dir + exportDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 2 || fis[0].Name() == orphan || fis[1].Name() == orphan {
+		t.Errorf("unexpected exports %v", fis)
+	}
+}
@@ -0,0 +1,281 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/marcopeereboom/mcrypt"
+)
+
+// Every message carries a random message id and, if it answers another
+// message, the id of that message.  Received messages keep both in their meta
+// record.  What we send is kept in a second spool below sent/ with the
+// recipient in To, so that the conversation with a peer can be shown in both
+// directions.  Threads are built by following InReplyTo; a message whose
+// parent is unknown, e.g. because it was deleted, starts a thread.
+
+const (
+	sentDir       = "/sent"
+	messageIdSize = 16 // random bytes in a message id
+)
+
+// A message in a thread, either received from or sent to Peer.
+type ThreadMessage struct {
+	Id        string // spool id, in the sent store if Sent
+	MessageId string
+	InReplyTo string
+	Peer      string
+	Sent      bool
+	Time      time.Time
+	Filename  string
+	Mime      string
+	Size      int64
+	Expires   time.Time
+	ViewOnce  bool
+	Parts     []*Part
+	Depth     int // replies are one deeper than what they answer
+}
+
+// Thread is a message and all replies to it, depth first in time order.
+type Thread struct {
+	Messages []*ThreadMessage
+}
+
+// newMessageId returns a random message id.
+func newMessageId() (string, error) {
+	return newSpoolId() // same size, different namespace
+}
+
+// validMessageId reports whether a peer sent a message id we could have
+// generated.
+func validMessageId(id string) bool {
+	return validHex(id, 2*messageIdSize)
+}
+
+// threads groups msgs by InReplyTo, oldest thread first.
+func threads(msgs []*ThreadMessage) []*Thread {
+	sort.SliceStable(msgs, func(a, b int) bool {
+		return msgs[a].Time.Before(msgs[b].Time)
+	})
+	byId := make(map[string]*ThreadMessage, len(msgs))
+	for _, v := range msgs {
+		if v.MessageId != "" && byId[v.MessageId] == nil {
+			byId[v.MessageId] = v
+		}
+	}
+	replies := make(map[*ThreadMessage][]*ThreadMessage)
+	for _, v := range msgs {
+		if parent := byId[v.InReplyTo]; parent != nil && parent != v {
+			replies[parent] = append(replies[parent], v)
+		}
+	}
+
+	seen := make(map[*ThreadMessage]bool, len(msgs))
+	var walk func(t *Thread, m *ThreadMessage, depth int)
+	walk = func(t *Thread, m *ThreadMessage, depth int) {
+		if seen[m] {
+			return // loop
+		}
+		seen[m] = true
+		m.Depth = depth
+		t.Messages = append(t.Messages, m)
+		for _, v := range replies[m] {
+			walk(t, v, depth+1)
+		}
+	}
+	ts := make([]*Thread, 0)
+	start := func(m *ThreadMessage) {
+		if seen[m] {
+			return
+		}
+		t := &Thread{}
+		walk(t, m, 0)
+		ts = append(ts, t)
+	}
+	for _, v := range msgs {
+		if parent := byId[v.InReplyTo]; parent == nil || parent == v {
+			start(v)
+		}
+	}
+	// messages that answer each other in a loop have no root
+	for _, v := range msgs {
+		start(v)
+	}
+	return ts
+}
+
+// threadMessage returns se as a message of a thread.
+func threadMessage(se *SpoolEntry, sent bool) *ThreadMessage {
+	m := &ThreadMessage{
+		Id:        se.Id,
+		MessageId: se.Meta.MessageId,
+		InReplyTo: se.Meta.InReplyTo,
+		Peer:      se.From,
+		Sent:      sent,
+		Time:      se.Meta.Created,
+		Filename:  se.Filename,
+		Mime:      se.Meta.Mime,
+		Size:      se.Size,
+		Expires:   se.Meta.Expires,
+		ViewOnce:  se.Meta.ViewOnce,
+		Parts:     se.Meta.Parts,
+	}
+	if sent {
+		m.Peer = se.Meta.To
+	}
+	return m
+}
+
+// History returns the threads of the conversation with peer in the scomms
+// directory dir.  It does not need a running core.
+func History(dir string, id *mcrypt.Identity, peer string) ([]*Thread,
+	error) {
+
+	received, err := SpoolList(dir, id)
+	if err != nil {
+		return nil, err
+	}
+	sent, err := SpoolList(dir+sentDir, id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	msgs := make([]*ThreadMessage, 0)
+	for _, v := range received {
+		if v.From == peer && !v.Expired(now) {
+			msgs = append(msgs, threadMessage(v, false))
+		}
+	}
+	for _, v := range sent {
+		if v.Meta.To == peer && !v.Expired(now) {
+			msgs = append(msgs, threadMessage(v, true))
+		}
+	}
+	return threads(msgs), nil
+}
+
+// ThreadOpen opens the text of a message in a thread, the body of multipart
+// messages.  View once messages are only shown from the inbox.
+func ThreadOpen(dir string, id *mcrypt.Identity, m *ThreadMessage) (
+	io.ReadCloser, error) {
+
+	if m.Sent {
+		dir += sentDir
+	}
+	se, err := SpoolGet(dir, id, m.Id)
+	if err != nil {
+		return nil, err
+	}
+	if se.Meta.ViewOnce {
+		return nil, fmt.Errorf("%v can only be viewed once", m.Id)
+	}
+	if se.Expired(time.Now()) {
+		return nil, fmt.Errorf("%v expired", m.Id)
+	}
+	if len(se.Meta.Parts) != 0 {
+		return SpoolOpenPart(dir, id, m.Id, 0)
+	}
+	return SpoolOpen(dir, id, m.Id)
+}
+
+// ThreadOpen opens the text of a message in a thread.
+func (c *Core) ThreadOpen(m *ThreadMessage) (io.ReadCloser, error) {
+	return ThreadOpen(c.scommsDir, c.identity, m)
+}
+
+// sentAdd keeps a copy of what was sent to peer.  Copies expire like the
+// original, the content of view once messages is not kept.
+func (c *Core) sentAdd(peer string, rsf *RpcSendFile) error {
+	content := rsf.Content
+	var parts []*Part
+	if rsf.ViewOnce {
+		content = nil
+	} else if IsMultipart(rsf.Mime) {
+		var err error
+		parts, err = ParseParts(rsf.Mime, bytes.NewReader(content))
+		if err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	c.mtxSpool.Lock()
+	defer c.mtxSpool.Unlock()
+	_, err := spoolWrite(c.scommsDir+sentDir, c.identity, &MetaRecord{
+		Mime:      rsf.Mime,
+		Created:   now,
+		From:      c.identity.PublicIdentity.Address,
+		To:        peer,
+		Filename:  rsf.Filename,
+		Expires:   expiresAt(now, rsf.ExpireSeconds),
+		ViewOnce:  rsf.ViewOnce,
+		Parts:     parts,
+		MessageId: rsf.MessageId,
+		InReplyTo: rsf.InReplyTo,
+	}, bytes.NewReader(content))
+	return err
+}
+
+// sentSweep removes sent copies that expired.
+func (c *Core) sentSweep(now time.Time) {
+	c.mtxSpool.Lock()
+	defer c.mtxSpool.Unlock()
+
+	entries, err := SpoolList(c.scommsDir+sentDir, c.identity)
+	if err != nil {
+		c.debugCore("sentSweep: %v", err)
+		return
+	}
+	refs := make(map[string]int, len(entries))
+	for _, v := range entries {
+		refs[v.Meta.Blob]++
+	}
+	for _, v := range entries {
+		if !v.Expired(now) {
+			continue
+		}
+		blob, err := spoolDelete(c.scommsDir+sentDir, c.identity, v.Id)
+		if err != nil {
+			c.debugCore("sentSweep: %v %v", v.Id, err)
+			continue
+		}
+		refs[blob]--
+		if refs[blob] > 0 {
+			continue
+		}
+		err = blobDelete(c.scommsDir+sentDir, blob)
+		if err != nil {
+			c.debugCore("sentSweep: %v %v", v.Id, err)
+		}
+	}
+}
+
+func (c *Core) handleHistoryView(m *HistoryView) {
+	r := &UiRenderHistory{Peer: m.Peer}
+	ts, err := History(c.scommsDir, c.identity, m.Peer)
+	if err != nil {
+		r.Error = err.Error()
+	} else {
+		r.Threads = ts
+	}
+	c.Send(core, []string{ui}, r)
+}
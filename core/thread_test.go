@@ -0,0 +1,202 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marcopeereboom/mcrypt"
+)
+
+func TestThreadTree(t *testing.T) {
+	now := time.Now()
+	msg := func(name string, minutes int, id, reply string) *ThreadMessage {
+		return &ThreadMessage{
+			Filename:  name,
+			Time:      now.Add(time.Duration(minutes) * time.Minute),
+			MessageId: id,
+			InReplyTo: reply,
+		}
+	}
+	ts := threads([]*ThreadMessage{
+		msg("reply2", 3, "c", "a"),
+		msg("root", 0, "a", ""),
+		msg("reply1", 1, "b", "a"),
+		msg("nested", 2, "d", "b"),
+		msg("orphan", 4, "e", "unknown"),
+		msg("loop1", 5, "f", "g"),
+		msg("loop2", 6, "g", "f"),
+		msg("self", 7, "h", "h"),
+		msg("old", -1, "", ""),
+	})
+
+	got := make([]string, 0)
+	for _, v := range ts {
+		names := make([]string, 0)
+		for _, m := range v.Messages {
+			names = append(names, strings.Repeat(".", m.Depth)+
+				m.Filename)
+		}
+		got = append(got, strings.Join(names, " "))
+	}
+	want := []string{
+		"old",
+		"root .reply1 ..nested .reply2",
+		"orphan",
+		"self",
+		"loop1 .loop2",
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
+
+// threadSend sends hello.txt to bob and then a view once reply to it, the
+// way sendFile does, and returns the id of the first message.  The caller
+// removes the directory.
+func threadSend(t *testing.T) (*Core, string) {
+	dir, err := ioutil.TempDir(os.TempDir(), "thread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Core{scommsDir: dir}
+	c.identity, err = mcrypt.NewIdentity("Alice", "alice@example.com")
+	if err == nil {
+		err = ioutil.WriteFile(dir+"/hello.txt", []byte("hello bob\n"),
+			0600)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	sf := &SendFile{To: "bob@example.com", Filename: dir + "/hello.txt"}
+	ids := make([]string, 0, 2)
+	for _, viewOnce := range []bool{false, true} {
+		if viewOnce {
+			sf.InReplyTo = ids[0]
+			sf.ViewOnce = true
+		}
+		rsf, err := sf.rpc()
+		if err == nil {
+			err = c.sentAdd(sf.To, rsf)
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+		if !validMessageId(rsf.MessageId) ||
+			rsf.InReplyTo != sf.InReplyTo {
+			t.Errorf("ids %v %v", rsf.MessageId, rsf.InReplyTo)
+		}
+		ids = append(ids, rsf.MessageId)
+	}
+	return c, ids[0]
+}
+
+func TestThreadSend(t *testing.T) {
+	c, _ := threadSend(t)
+	defer os.RemoveAll(c.scommsDir)
+
+	sf := &SendFile{
+		To:        "bob@example.com",
+		Filename:  c.scommsDir + "/hello.txt",
+		InReplyTo: "not an id",
+	}
+	_, err := sf.rpc()
+	if err == nil {
+		t.Error("invalid reply id should have tripped")
+	}
+
+	// view once content is not kept
+	entries, err := SpoolList(c.scommsDir+sentDir, c.identity)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("sent %v %v", entries, err)
+	}
+	for _, v := range entries {
+		if v.Meta.To != "bob@example.com" ||
+			v.From != "alice@example.com" {
+			t.Errorf("sent meta %v", v.Meta)
+		}
+		if v.Meta.ViewOnce && v.Size != 0 {
+			t.Errorf("view once content kept %v", v.Size)
+		}
+	}
+}
+
+func TestThreadHistory(t *testing.T) {
+	c, first := threadSend(t)
+	defer os.RemoveAll(c.scommsDir)
+	dir, id := c.scommsDir, c.identity
+
+	// bob answers our first message, charlie is somebody else
+	for _, from := range []string{"bob@example.com", "charlie@example.com"} {
+		_, err := spoolWrite(dir, id, &MetaRecord{
+			Mime:      "text/plain",
+			Created:   time.Now(),
+			From:      from,
+			Filename:  "answer.txt",
+			MessageId: strings.Repeat("ab", messageIdSize),
+			InReplyTo: first,
+		}, bytes.NewReader([]byte("hi alice\n")))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	ts, err := History(dir, id, "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts) != 1 || len(ts[0].Messages) != 3 {
+		t.Fatalf("threads %v", ts)
+	}
+	root := ts[0].Messages[0]
+	if !root.Sent || root.Depth != 0 || root.MessageId != first {
+		t.Errorf("root %v", root)
+		return
+	}
+	for _, v := range ts[0].Messages[1:] {
+		if v.Depth != 1 || v.Peer != "bob@example.com" {
+			t.Errorf("reply %v", v)
+			return
+		}
+	}
+
+	f, err := ThreadOpen(dir, id, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || string(b) != "hello bob\n" {
+		t.Errorf("sent content %q %v", b, err)
+		return
+	}
+	for _, v := range ts[0].Messages[1:] {
+		_, err = ThreadOpen(dir, id, v)
+		if v.ViewOnce != (err != nil) {
+			t.Errorf("open %v %v", v.Filename, err)
+		}
+	}
+}
@@ -17,19 +17,40 @@
 package core
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/marcopeereboom/mcrypt"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
+// Trust stores a TrustRecord per public key, encrypted to self.
+//
+// Every version of a record is kept as well, also encrypted, so that it can
+// be listed and reverted to.  Each kind of key has its own prefix:
+//
+//	"v"					layout version
+//	"r" + public key			record
+//	"h" + public key + big endian version	history
+//	"i" + ...				indexes, see trustindex.go
+//
+// Databases that predate the layout version keyed records by the bare
+// public key, they are moved on open.
 type Trust struct {
 	db  *leveldb.DB
 	mtx sync.RWMutex
+	key []byte // index blinding key, see indexKey
+
+	// audit records state changes when set
+	audit func(event string, pid *mcrypt.PublicIdentity, format string,
+		args ...interface{})
 }
 
 func NewTrust(path string) (*Trust, error) {
@@ -44,14 +65,97 @@ func NewTrust(path string) (*Trust, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = t.migrate()
+	if err != nil {
+		t.db.Close()
+		return nil, err
+	}
 
 	return &t, nil
 }
 
+const (
+	trustVersion = "v"
+	trustRecord  = "r"
+	trustLayout  = "1"
+)
+
+// recordKey returns the key of the record of pubKey.
+func recordKey(pubKey []byte) []byte {
+	return append([]byte(trustRecord), pubKey...)
+}
+
+// migrate moves the records of a database without a layout version under
+// their prefix and drops the indexes of that layout, they are rebuilt by
+// indexKey.  Keys of that layout were told apart by length: records had
+// the length of a public key and history and indexes did not.
+func (t *Trust) migrate() error {
+	_, err := t.db.Get([]byte(trustVersion), nil)
+	if err == nil {
+		return nil
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+
+	b := new(leveldb.Batch)
+	iter := t.db.NewIterator(nil, nil)
+	for iter.Next() {
+		k := iter.Key()
+		switch {
+		case len(k) == len(mcrypt.PublicIdentity{}.Key):
+			b.Put(recordKey(k), append([]byte{}, iter.Value()...))
+			b.Delete(append([]byte{}, k...))
+		case !bytes.HasPrefix(k, []byte("h")):
+			// index entries and key
+			b.Delete(append([]byte{}, k...))
+		}
+	}
+	iter.Release()
+	err = iter.Error()
+	if err != nil {
+		return err
+	}
+	b.Put([]byte(trustVersion), []byte(trustLayout))
+	return t.db.Write(b, nil)
+}
+
 func (t *Trust) Close() {
 	t.db.Close()
 }
 
+// TrustVersion is a record as it was stored at some point, Version counts
+// from 1.
+type TrustVersion struct {
+	Version int
+	Time    time.Time
+	Record  *TrustRecord
+}
+
+// String summarizes v: version, time, state, identity and metadata.
+func (v *TrustVersion) String() string {
+	tr := v.Record
+	s := fmt.Sprintf("%v %v %v %v <%v>", v.Version,
+		v.Time.Format("2006-01-02 15:04"), State[tr.State],
+		tr.PublicIdentity.Name, tr.PublicIdentity.Address)
+	keys := make([]string, 0, len(tr.FreeToUse))
+	for k := range tr.FreeToUse {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s += fmt.Sprintf(" %v=%q", k, tr.FreeToUse[k])
+	}
+	return s
+}
+
+// Tombstone is the TrustRecord.FreeToUse key that marks a forgotten record,
+// the value is when it was forgotten.  See Trust.Forget.
+const Tombstone = "Tombstone"
+
+// ReplacedBy is the TrustRecord.FreeToUse key that records the fingerprint
+// of the key that took over the address of a record.  See Trust.ReplaceKey.
+const ReplacedBy = "ReplacedBy"
+
 type TrustRecord struct {
 	PublicIdentity *mcrypt.PublicIdentity
 	Inserted       time.Time         // database insertion
@@ -80,8 +184,174 @@ func (t *Trust) Update(id *mcrypt.Identity, tr *TrustRecord) error {
 	t.mtx.Lock()
 	defer t.mtx.Unlock()
 
+	previous := "none"
+	dbPayload, err := t.db.Get(recordKey(tr.PublicIdentity.Key[:]), nil)
+	if err == nil {
+		if old, err := t.decrypt(id, dbPayload); err == nil {
+			previous = State[old.State]
+		}
+	}
+
 	tr.LastUpdate = time.Now()
-	return t.put(id, tr)
+	err = t.put(id, tr)
+	if err != nil {
+		return err
+	}
+	if t.audit != nil {
+		t.audit(AuditTrustUpdate, tr.PublicIdentity, "%v -> %v",
+			previous, State[tr.State])
+	}
+	return nil
+}
+
+// Delete removes the trust record of trustee and its history.  If it comes
+// back it is unknown again.
+func (t *Trust) Delete(id *mcrypt.Identity, trustee *mcrypt.PublicIdentity) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	dbPayload, err := t.db.Get(recordKey(trustee.Key[:]), nil)
+	if err != nil {
+		return fmt.Errorf("public key not found")
+	}
+	old, err := t.decrypt(id, dbPayload)
+	if err != nil {
+		return err
+	}
+	key, err := t.indexKey(id)
+	if err != nil {
+		return err
+	}
+	b := new(leveldb.Batch)
+	err = t.removeHistory(b, trustee.Key[:])
+	if err != nil {
+		return err
+	}
+	stageIndex(b, key, old, nil)
+	b.Delete(recordKey(trustee.Key[:]))
+	err = t.db.Write(b, nil)
+	if err != nil {
+		return err
+	}
+	if t.audit != nil {
+		t.audit(AuditTrustDelete, trustee, "deleted")
+	}
+	return nil
+}
+
+// Forget replaces the trust record of trustee and its history with a denied
+// tombstone that only keeps its key and address, the key is denied should it
+// come back.
+func (t *Trust) Forget(id *mcrypt.Identity, trustee *mcrypt.PublicIdentity) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	_, err := t.db.Get(recordKey(trustee.Key[:]), nil)
+	if err != nil {
+		return fmt.Errorf("public key not found")
+	}
+	now := time.Now()
+	tr := &TrustRecord{
+		PublicIdentity: &mcrypt.PublicIdentity{
+			Address: trustee.Address,
+			Key:     trustee.Key,
+		},
+		Inserted:   now,
+		LastUpdate: now,
+		State:      StateDenied,
+		FreeToUse: map[string]string{
+			Tombstone: now.Format(time.RFC3339),
+		},
+	}
+	b := new(leveldb.Batch)
+	err = t.removeHistory(b, trustee.Key[:])
+	if err != nil {
+		return err
+	}
+	err = t.stage(b, id, tr, true)
+	if err != nil {
+		return err
+	}
+	err = t.db.Write(b, nil)
+	if err != nil {
+		return err
+	}
+	if t.audit != nil {
+		t.audit(AuditTrustDelete, trustee, "forgotten, key blocked")
+	}
+	return nil
+}
+
+// ReplaceKey moves the address of the record of previous to the new key
+// pid.  The new record takes over state and metadata, the previous one is
+// denied and remembers what replaced it.  A record pid already had becomes
+// a new version.
+func (t *Trust) ReplaceKey(id *mcrypt.Identity, previous,
+	pid *mcrypt.PublicIdentity) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	dbPayload, err := t.db.Get(recordKey(previous.Key[:]), nil)
+	if err != nil {
+		return fmt.Errorf("public key not found")
+	}
+	old, err := t.decrypt(id, dbPayload)
+	if err != nil {
+		return err
+	}
+	if _, ok := old.FreeToUse[ReplacedBy]; ok {
+		return fmt.Errorf("public key already replaced")
+	}
+	now := time.Now()
+	inserted := now
+	var existing *TrustRecord
+	dbPayload, err = t.db.Get(recordKey(pid.Key[:]), nil)
+	if err == nil {
+		existing, err = t.decrypt(id, dbPayload)
+		if err != nil {
+			return err
+		}
+		inserted = existing.Inserted
+	}
+
+	tr := &TrustRecord{
+		PublicIdentity: pid,
+		Inserted:       inserted,
+		LastUpdate:     now,
+		State:          old.State,
+		FreeToUse:      make(map[string]string, len(old.FreeToUse)),
+	}
+	for k, v := range old.FreeToUse {
+		if k != ReplacedBy {
+			tr.FreeToUse[k] = v
+		}
+	}
+	state := old.State
+	old.State = StateDenied
+	old.LastUpdate = now
+	if old.FreeToUse == nil {
+		old.FreeToUse = make(map[string]string)
+	}
+	old.FreeToUse[ReplacedBy] = pid.Fingerprint()
+
+	b := new(leveldb.Batch)
+	err = t.stage(b, id, old, false)
+	if err != nil {
+		return err
+	}
+	err = t.stage(b, id, tr, existing == nil)
+	if err != nil {
+		return err
+	}
+	err = t.db.Write(b, nil)
+	if err != nil {
+		return err
+	}
+	if t.audit != nil {
+		t.audit(AuditKeyChange, pid, "%v replaces %v, %v",
+			pid.Fingerprint(), previous.Fingerprint(), State[state])
+	}
+	return nil
 }
 
 // Store public identity in database
@@ -93,7 +363,7 @@ func (t *Trust) Add(id *mcrypt.Identity, trustee *mcrypt.PublicIdentity,
 
 	// see if it already exists
 	if overwrite == false {
-		_, err := t.db.Get(trustee.Key[:], nil)
+		_, err := t.db.Get(recordKey(trustee.Key[:]), nil)
 		if err == nil {
 			return fmt.Errorf("public key already exists")
 		}
@@ -106,34 +376,225 @@ func (t *Trust) Add(id *mcrypt.Identity, trustee *mcrypt.PublicIdentity,
 		FreeToUse:      freeToUse,
 	}
 
-	return t.put(id, tr)
+	err := t.put(id, tr)
+	if err != nil {
+		return err
+	}
+	if t.audit != nil {
+		t.audit(AuditTrustAdd, trustee, "%v", State[state])
+	}
+	return nil
 }
 
+// put stores tr and a new version of it in one batch.
 func (t *Trust) put(id *mcrypt.Identity, tr *TrustRecord) error {
-	// marshal so that we can encrypt
-	payload, err := json.Marshal(tr)
+	b := new(leveldb.Batch)
+	err := t.stage(b, id, tr, false)
 	if err != nil {
 		return err
 	}
 
+	// plop it in db
+	return t.db.Write(b, nil)
+}
+
+// stage adds storing tr, a new version of it and its index entries to b.
+// Records that predate history get their previous content as version 1
+// unless fresh starts the history over.
+func (t *Trust) stage(b *leveldb.Batch, id *mcrypt.Identity, tr *TrustRecord,
+	fresh bool) error {
+	key := tr.PublicIdentity.Key[:]
+	ik, err := t.indexKey(id)
+	if err != nil {
+		return err
+	}
+	var otr *TrustRecord
+	old, err := t.db.Get(recordKey(key), nil)
+	if err == nil {
+		otr, err = t.decrypt(id, old)
+		if err != nil {
+			return err
+		}
+	}
+	stageIndex(b, ik, otr, tr)
+
+	last := 0
+	if !fresh {
+		last, err = t.lastVersion(key)
+		if err != nil {
+			return err
+		}
+		if last == 0 && otr != nil {
+			last++
+			err = t.putVersion(b, id, key, legacyVersion(otr))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	last++
+	err = t.putVersion(b, id, key, &TrustVersion{
+		Version: last,
+		Time:    time.Now(),
+		Record:  tr,
+	})
+	if err != nil {
+		return err
+	}
+
+	dbPayload, err := t.encrypt(id, tr)
+	if err != nil {
+		return err
+	}
+	b.Put(recordKey(key), dbPayload)
+	return nil
+}
+
+// encrypt marshals v and encrypts it to self.
+func (t *Trust) encrypt(id *mcrypt.Identity, v interface{}) ([]byte, error) {
+	// marshal so that we can encrypt
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
 	// note that we are encrypting to self
 	msg, err := id.Encrypt(id.PublicIdentity.Key, payload)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// marshall mcrypt.Message for db insertion
-	dbPayload, err := msg.Marshal()
+	return msg.Marshal()
+}
+
+// legacyVersion returns the first version of a record that predates history.
+func legacyVersion(tr *TrustRecord) *TrustVersion {
+	v := &TrustVersion{Version: 1, Time: tr.LastUpdate, Record: tr}
+	if v.Time.IsZero() {
+		v.Time = tr.Inserted
+	}
+	return v
+}
+
+// historyKey returns the key of version of the record of pubKey.
+func historyKey(pubKey []byte, version int) []byte {
+	k := append([]byte("h"), pubKey...)
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(version))
+	return append(k, v...)
+}
+
+// lastVersion returns the last version of the record of pubKey, 0 if there
+// is no history.
+func (t *Trust) lastVersion(pubKey []byte) (int, error) {
+	iter := t.db.NewIterator(util.BytesPrefix(append([]byte("h"),
+		pubKey...)), nil)
+	last := 0
+	if iter.Last() {
+		k := iter.Key()
+		last = int(binary.BigEndian.Uint64(k[len(k)-8:]))
+	}
+	iter.Release()
+	return last, iter.Error()
+}
+
+func (t *Trust) putVersion(b *leveldb.Batch, id *mcrypt.Identity,
+	pubKey []byte, v *TrustVersion) error {
+	payload, err := t.encrypt(id, v)
 	if err != nil {
 		return err
 	}
+	b.Put(historyKey(pubKey, v.Version), payload)
+	return nil
+}
 
-	// plop it in db
-	err = t.db.Put(tr.PublicIdentity.Key[:], dbPayload, nil)
+// removeHistory adds the deletion of all versions of pubKey to b.
+func (t *Trust) removeHistory(b *leveldb.Batch, pubKey []byte) error {
+	iter := t.db.NewIterator(util.BytesPrefix(append([]byte("h"),
+		pubKey...)), nil)
+	for iter.Next() {
+		b.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	return iter.Error()
+}
+
+// History returns the versions of the record of trustee, oldest first.
+func (t *Trust) History(id *mcrypt.Identity,
+	trustee *mcrypt.PublicIdentity) ([]*TrustVersion, error) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	versions := make([]*TrustVersion, 0)
+	iter := t.db.NewIterator(util.BytesPrefix(append([]byte("h"),
+		trustee.Key[:]...)), nil)
+	for iter.Next() {
+		v := TrustVersion{}
+		err := t.open(id, iter.Value(), &v)
+		if err != nil {
+			iter.Release()
+			return nil, err
+		}
+		versions = append(versions, &v)
+	}
+	iter.Release()
+	err := iter.Error()
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		// predates history
+		dbPayload, err := t.db.Get(recordKey(trustee.Key[:]), nil)
+		if err != nil {
+			return nil, err
+		}
+		tr, err := t.decrypt(id, dbPayload)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, legacyVersion(tr))
+	}
+	return versions, nil
+}
+
+// Revert makes version the current record of trustee.  This is a change as
+// well and becomes a new version.
+func (t *Trust) Revert(id *mcrypt.Identity, trustee *mcrypt.PublicIdentity,
+	version int) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	dbPayload, err := t.db.Get(recordKey(trustee.Key[:]), nil)
+	if err != nil {
+		return fmt.Errorf("public key not found")
+	}
+	current, err := t.decrypt(id, dbPayload)
+	if err != nil {
+		return err
+	}
+	payload, err := t.db.Get(historyKey(trustee.Key[:], version), nil)
+	if err != nil {
+		return fmt.Errorf("version %v not found", version)
+	}
+	v := TrustVersion{}
+	err = t.open(id, payload, &v)
 	if err != nil {
 		return err
 	}
 
+	tr := v.Record
+	tr.LastUpdate = time.Now()
+	err = t.put(id, tr)
+	if err != nil {
+		return err
+	}
+	if t.audit != nil {
+		t.audit(AuditTrustUpdate, trustee, "%v -> %v, reverted to "+
+			"version %v", State[current.State], State[tr.State],
+			version)
+	}
 	return nil
 }
 
@@ -142,7 +603,7 @@ func (t *Trust) get(pubKey []byte) ([]byte, error) {
 	t.mtx.RLock()
 	defer t.mtx.RUnlock()
 
-	dbPayload, err := t.db.Get(pubKey, nil)
+	dbPayload, err := t.db.Get(recordKey(pubKey), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -153,26 +614,33 @@ func (t *Trust) get(pubKey []byte) ([]byte, error) {
 func (t *Trust) decrypt(id *mcrypt.Identity,
 	dbPayload []byte) (*TrustRecord, error) {
 
-	// unmarshal mcrypt.Message
-	msg, err := mcrypt.UnmarshalMessage(dbPayload)
+	// recreate trust record
+	tr := TrustRecord{}
+	err := t.open(id, dbPayload, &tr)
 	if err != nil {
 		return nil, err
 	}
 
-	// note that we are decrypting from self
-	ct, err := id.Decrypt(id.PublicIdentity.Key, msg)
+	return &tr, nil
+}
+
+// open decrypts dbPayload and unmarshals it into v.
+func (t *Trust) open(id *mcrypt.Identity, dbPayload []byte,
+	v interface{}) error {
+
+	// unmarshal mcrypt.Message
+	msg, err := mcrypt.UnmarshalMessage(dbPayload)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// recreate trust record
-	tr := TrustRecord{}
-	err = json.Unmarshal(ct, &tr)
+	// note that we are decrypting from self
+	ct, err := id.Decrypt(id.PublicIdentity.Key, msg)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &tr, nil
+	return json.Unmarshal(ct, v)
 }
 
 // Get public identity from database
@@ -194,9 +662,8 @@ func (t *Trust) GetAll(id *mcrypt.Identity) ([]*TrustRecord, error) {
 
 	array := make([]*TrustRecord, 0, 100)
 
-	iter := t.db.NewIterator(nil, nil)
+	iter := t.db.NewIterator(util.BytesPrefix([]byte(trustRecord)), nil)
 	for iter.Next() {
-		//pubKey := iter.Key()
 		dbPayload := iter.Value()
 		tr, err := t.decrypt(id, dbPayload)
 		if err != nil {
@@ -0,0 +1,207 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/marcopeereboom/mcrypt"
+)
+
+// openHistory returns a trust database in a new directory in which alice
+// queued bob, then allowed him and then denied him with a nickname.  The
+// caller closes the database and removes the directory.
+func openHistory(t *testing.T) (string, *Trust, *mcrypt.Identity,
+	*mcrypt.PublicIdentity) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "trusthistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trust, err := NewTrust(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	fail := func(err error) {
+		trust.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	alice, err := mcrypt.NewIdentity("Alice", "alice@example.com")
+	if err != nil {
+		fail(err)
+	}
+	id, err := mcrypt.NewIdentity("Bob", "bob@example.com")
+	if err != nil {
+		fail(err)
+	}
+	bob := &id.PublicIdentity
+	err = trust.Add(alice, bob, StateQueued, nil, false)
+	if err != nil {
+		fail(err)
+	}
+	tr, err := trust.Get(alice, bob)
+	if err != nil {
+		fail(err)
+	}
+	tr.State = StateAllowed
+	err = trust.Update(alice, tr)
+	if err != nil {
+		fail(err)
+	}
+	SetContact(tr, "bobby", "", nil)
+	tr.State = StateDenied
+	err = trust.Update(alice, tr)
+	if err != nil {
+		fail(err)
+	}
+	return dir, trust, alice, bob
+}
+
+func TestTrustHistoryVersions(t *testing.T) {
+	dir, trust, alice, bob := openHistory(t)
+	defer os.RemoveAll(dir)
+	defer trust.Close()
+
+	versions, err := trust.History(alice, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{StateQueued, StateAllowed, StateDenied}
+	if len(versions) != len(want) {
+		t.Fatalf("versions %v", len(versions))
+	}
+	for i, v := range versions {
+		if v.Version != i+1 || v.Record.State != want[i] {
+			t.Errorf("version %v: %v", i, v)
+		}
+	}
+	if versions[2].Record.FreeToUse[Nickname] != "bobby" ||
+		versions[1].Record.FreeToUse[Nickname] != "" {
+		t.Error("metadata not versioned")
+	}
+
+	// history is not a record
+	trs, err := trust.GetAll(alice)
+	if err != nil || len(trs) != 1 {
+		t.Errorf("records %v %v", len(trs), err)
+	}
+}
+
+func TestTrustHistoryRevert(t *testing.T) {
+	dir, trust, alice, bob := openHistory(t)
+	defer os.RemoveAll(dir)
+	defer trust.Close()
+
+	err := trust.Revert(alice, bob, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, err := trust.Get(alice, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.State != StateAllowed || tr.FreeToUse[Nickname] != "" {
+		t.Fatalf("not reverted %v", tr)
+	}
+	versions, err := trust.History(alice, bob)
+	if err != nil || len(versions) != 4 ||
+		versions[3].Record.State != StateAllowed {
+		t.Fatalf("revert not recorded %v %v", len(versions), err)
+	}
+
+	err = trust.Revert(alice, bob, 42)
+	if err == nil {
+		t.Error("unknown version should have tripped")
+	}
+}
+
+func TestTrustHistoryLegacy(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "trusthistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	alice, err := mcrypt.NewIdentity("Alice", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a record written before history existed
+	carol, err := mcrypt.NewIdentity("Carol", "carol@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &TrustRecord{
+		PublicIdentity: &carol.PublicIdentity,
+		State:          StateAllowed,
+	}
+	legacyTrust(t, dir, alice, []*TrustRecord{tr})
+	trust, err := NewTrust(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trust.Close()
+	versions, err := trust.History(alice, &carol.PublicIdentity)
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("legacy history %v %v", len(versions), err)
+	}
+
+	tr.State = StateDenied
+	err = trust.Update(alice, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, err = trust.History(alice, &carol.PublicIdentity)
+	if err != nil || len(versions) != 2 ||
+		versions[0].Record.State != StateAllowed ||
+		versions[1].Record.State != StateDenied {
+		t.Errorf("legacy update %v %v", len(versions), err)
+	}
+}
+
+func TestTrustHistoryPurge(t *testing.T) {
+	dir, trust, alice, bob := openHistory(t)
+	defer os.RemoveAll(dir)
+	defer trust.Close()
+
+	err := trust.Forget(alice, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, err := trust.History(alice, bob)
+	if err != nil || len(versions) != 1 ||
+		versions[0].Record.PublicIdentity.Name != "" {
+		t.Fatalf("forget kept history %v %v", len(versions), err)
+	}
+
+	err = trust.Delete(alice, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = trust.History(alice, bob)
+	if err == nil {
+		t.Fatal("delete kept history")
+	}
+	last, err := trust.lastVersion(bob.Key[:])
+	if err != nil || last != 0 {
+		t.Errorf("versions left %v %v", last, err)
+	}
+}
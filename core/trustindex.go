@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/marcopeereboom/mcrypt"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Secondary trust indexes
+//
+// Records can be looked up by address and listed by state without
+// decrypting all of them.  The index entries do not leak either, the value
+// is blinded with a random key that is sealed to self:
+//
+//	"ik"					sealed blinding key
+//	"ia" + HMAC(key, address) + public key	empty
+//	"is" + HMAC(key, state) + public key	empty
+//
+// Addresses are indexed in lower case.  Entries are written in the same
+// batch as the record they point to.  Databases that predate the indexes
+// are indexed in one batch together with the creation of the key.
+const (
+	trustIndex        = "i"
+	trustIndexKey     = trustIndex + "k"
+	trustIndexAddress = 'a'
+	trustIndexState   = 's'
+)
+
+// indexKey returns the blinding key and creates it, and the indexes, if
+// this database has none yet.  Must be called with the write lock held.
+func (t *Trust) indexKey(id *mcrypt.Identity) ([]byte, error) {
+	if t.key != nil {
+		return t.key, nil
+	}
+
+	blob, err := t.db.Get([]byte(trustIndexKey), nil)
+	if err == nil {
+		var key []byte
+		err = openFromSelf(id, blob, &key)
+		if err != nil {
+			return nil, err
+		}
+		t.key = key
+		return t.key, nil
+	}
+	if err != leveldb.ErrNotFound {
+		return nil, err
+	}
+
+	key := make([]byte, sha256.Size)
+	_, err = io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return nil, err
+	}
+	blob, err = sealToSelf(id, key)
+	if err != nil {
+		return nil, err
+	}
+	b := new(leveldb.Batch)
+	b.Put([]byte(trustIndexKey), blob)
+	iter := t.db.NewIterator(util.BytesPrefix([]byte(trustRecord)), nil)
+	for iter.Next() {
+		tr, err := t.decrypt(id, iter.Value())
+		if err != nil {
+			iter.Release()
+			return nil, err
+		}
+		stageIndex(b, key, nil, tr)
+	}
+	iter.Release()
+	err = iter.Error()
+	if err != nil {
+		return nil, err
+	}
+	err = t.db.Write(b, nil)
+	if err != nil {
+		return nil, err
+	}
+	t.key = key
+	return t.key, nil
+}
+
+// readIndexKey is indexKey for readers that do not hold the lock.
+func (t *Trust) readIndexKey(id *mcrypt.Identity) ([]byte, error) {
+	t.mtx.RLock()
+	key := t.key
+	t.mtx.RUnlock()
+	if key != nil {
+		return key, nil
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.indexKey(id)
+}
+
+// indexPrefix returns the blinded prefix of all entries of kind for value.
+func indexPrefix(key []byte, kind byte, value string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte{kind})
+	mac.Write([]byte(value))
+	return append([]byte{trustIndex[0], kind}, mac.Sum(nil)...)
+}
+
+// indexKeys returns the index entries of tr.
+func indexKeys(key []byte, tr *TrustRecord) [][]byte {
+	pubKey := tr.PublicIdentity.Key[:]
+	return [][]byte{
+		append(indexPrefix(key, trustIndexAddress,
+			strings.ToLower(tr.PublicIdentity.Address)), pubKey...),
+		append(indexPrefix(key, trustIndexState,
+			strconv.Itoa(tr.State)), pubKey...),
+	}
+}
+
+// stageIndex adds replacing the index entries of old with those of tr to b,
+// either may be nil.
+func stageIndex(b *leveldb.Batch, key []byte, old, tr *TrustRecord) {
+	if old != nil {
+		for _, k := range indexKeys(key, old) {
+			b.Delete(k)
+		}
+	}
+	if tr != nil {
+		for _, k := range indexKeys(key, tr) {
+			b.Put(k, []byte{})
+		}
+	}
+}
+
+// lookup returns the records that have an index entry under prefix and
+// satisfy match.
+func (t *Trust) lookup(id *mcrypt.Identity, prefix []byte,
+	match func(*TrustRecord) bool) ([]*TrustRecord, error) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	trs := make([]*TrustRecord, 0)
+	iter := t.db.NewIterator(util.BytesPrefix(prefix), nil)
+	for iter.Next() {
+		dbPayload, err := t.db.Get(recordKey(iter.Key()[len(prefix):]),
+			nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		} else if err != nil {
+			iter.Release()
+			return nil, err
+		}
+		tr, err := t.decrypt(id, dbPayload)
+		if err != nil {
+			iter.Release()
+			return nil, err
+		}
+		if match(tr) {
+			trs = append(trs, tr)
+		}
+	}
+	iter.Release()
+	err := iter.Error()
+	if err != nil {
+		return nil, err
+	}
+	return trs, nil
+}
+
+// GetByAddress returns the records of address, there is more than one if the
+// address was seen with different keys.
+func (t *Trust) GetByAddress(id *mcrypt.Identity,
+	address string) ([]*TrustRecord, error) {
+	key, err := t.readIndexKey(id)
+	if err != nil {
+		return nil, err
+	}
+	return t.lookup(id, indexPrefix(key, trustIndexAddress,
+		strings.ToLower(address)), func(tr *TrustRecord) bool {
+		return strings.EqualFold(tr.PublicIdentity.Address, address)
+	})
+}
+
+// ListByState returns the records in state.
+func (t *Trust) ListByState(id *mcrypt.Identity,
+	state int) ([]*TrustRecord, error) {
+	key, err := t.readIndexKey(id)
+	if err != nil {
+		return nil, err
+	}
+	return t.lookup(id, indexPrefix(key, trustIndexState,
+		strconv.Itoa(state)), func(tr *TrustRecord) bool {
+		return tr.State == state
+	})
+}
@@ -0,0 +1,269 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/marcopeereboom/mcrypt"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// legacyTrust writes records of id to the trust database in dir the way
+// they were stored before the layout was versioned, keyed by public key.
+// extra keys are written as well.
+func legacyTrust(t *testing.T, dir string, id *mcrypt.Identity,
+	trs []*TrustRecord, extra ...string) {
+
+	db, err := leveldb.OpenFile(dir+"/trust/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, tr := range trs {
+		payload, err := sealToSelf(id, tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.Put(tr.PublicIdentity.Key[:], payload, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, k := range extra {
+		err = db.Put([]byte(k), []byte{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// openIndex returns a trust database in a new directory with a queued
+// record for bob that was written before the indexes and the layout
+// version existed.  bob2 is another key for the same address.  The caller
+// closes the database and removes the directory.
+func openIndex(t *testing.T) (string, *Trust, *mcrypt.Identity,
+	*mcrypt.Identity, *mcrypt.Identity) {
+
+	dir, err := ioutil.TempDir(os.TempDir(), "trustindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]*mcrypt.Identity, 0, 3)
+	for _, name := range []string{"alice", "bob", "bob"} {
+		id, err := mcrypt.NewIdentity(name, name+"@example.com")
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	alice, bob := ids[0], ids[1]
+	legacyTrust(t, dir, alice, []*TrustRecord{{
+		PublicIdentity: &bob.PublicIdentity,
+		State:          StateQueued,
+	}})
+
+	trust, err := NewTrust(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return dir, trust, alice, bob, ids[2]
+}
+
+// allowBob allows bob and queues bob2.
+func allowBob(t *testing.T, trust *Trust, alice, bob,
+	bob2 *mcrypt.Identity) {
+
+	tr, err := trust.Get(alice, &bob.PublicIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.State = StateAllowed
+	err = trust.Update(alice, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = trust.Add(alice, &bob2.PublicIdentity, StateQueued, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrustIndexLegacy(t *testing.T) {
+	dir, trust, alice, bob, _ := openIndex(t)
+	defer os.RemoveAll(dir)
+	defer trust.Close()
+
+	trs, err := trust.GetByAddress(alice, "Bob@Example.com")
+	if err != nil || len(trs) != 1 ||
+		*trs[0].PublicIdentity.Key != *bob.PublicIdentity.Key {
+		t.Fatalf("legacy address %v %v", len(trs), err)
+	}
+	trs, err = trust.ListByState(alice, StateQueued)
+	if err != nil || len(trs) != 1 {
+		t.Errorf("legacy state %v %v", len(trs), err)
+	}
+}
+
+func TestTrustIndexUpdate(t *testing.T) {
+	dir, trust, alice, bob, bob2 := openIndex(t)
+	defer os.RemoveAll(dir)
+	defer trust.Close()
+
+	allowBob(t, trust, alice, bob, bob2)
+	for _, v := range []struct {
+		state int
+		want  int
+	}{
+		{StateQueued, 1},
+		{StateAllowed, 1},
+		{StateDenied, 0},
+	} {
+		trs, err := trust.ListByState(alice, v.state)
+		if err != nil || len(trs) != v.want {
+			t.Errorf("state %v: %v %v", v.state, len(trs), err)
+		}
+	}
+
+	// same address, other key
+	trs, err := trust.GetByAddress(alice, "bob@example.com")
+	if err != nil || len(trs) != 2 {
+		t.Errorf("address keys %v %v", len(trs), err)
+	}
+	trs, err = trust.GetByAddress(alice, "carol@example.com")
+	if err != nil || len(trs) != 0 {
+		t.Errorf("unknown address %v %v", len(trs), err)
+	}
+}
+
+func TestTrustIndexBlinded(t *testing.T) {
+	dir, trust, alice, bob, bob2 := openIndex(t)
+	defer os.RemoveAll(dir)
+	defer trust.Close()
+
+	allowBob(t, trust, alice, bob, bob2)
+	iter := trust.db.NewIterator(nil, nil)
+	for iter.Next() {
+		if bytes.Contains(bytes.ToLower(iter.Key()), []byte("bob")) {
+			t.Errorf("address in key %x", iter.Key())
+		}
+	}
+	iter.Release()
+}
+
+func TestTrustIndexReopen(t *testing.T) {
+	dir, trust, alice, bob, bob2 := openIndex(t)
+	defer os.RemoveAll(dir)
+
+	allowBob(t, trust, alice, bob, bob2)
+	trust.Close()
+	trust, err := NewTrust(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trust.Close()
+	trs, err := trust.ListByState(alice, StateQueued)
+	if err != nil || len(trs) != 1 ||
+		*trs[0].PublicIdentity.Key != *bob2.PublicIdentity.Key {
+		t.Errorf("reopen %v %v", len(trs), err)
+	}
+}
+
+func TestTrustIndexDelete(t *testing.T) {
+	dir, trust, alice, bob, bob2 := openIndex(t)
+	defer os.RemoveAll(dir)
+	defer trust.Close()
+
+	allowBob(t, trust, alice, bob, bob2)
+	err := trust.Forget(alice, &bob.PublicIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trs, err := trust.ListByState(alice, StateAllowed)
+	if err != nil || len(trs) != 0 {
+		t.Errorf("forgotten still allowed %v %v", len(trs), err)
+	}
+	trs, err = trust.ListByState(alice, StateDenied)
+	if err != nil || len(trs) != 1 {
+		t.Errorf("tombstone not denied %v %v", len(trs), err)
+	}
+
+	err = trust.Delete(alice, &bob2.PublicIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trs, err = trust.GetByAddress(alice, "bob@example.com")
+	if err != nil || len(trs) != 1 ||
+		*trs[0].PublicIdentity.Key != *bob.PublicIdentity.Key {
+		t.Errorf("deleted still indexed %v %v", len(trs), err)
+	}
+}
+
+func TestTrustMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "trustindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	alice, err := mcrypt.NewIdentity("Alice", "alice@localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := mcrypt.NewIdentity("Bob", "bob@localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a record and index entries of the layout without a version
+	stale := "a" + strings.Repeat("x", 64)
+	legacyTrust(t, dir, alice, []*TrustRecord{{
+		PublicIdentity: &bob.PublicIdentity,
+		State:          StateAllowed,
+	}}, "k", stale)
+
+	trust, err := NewTrust(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trust.Close()
+	for _, k := range []string{"k", stale} {
+		_, err = trust.db.Get([]byte(k), nil)
+		if err != leveldb.ErrNotFound {
+			t.Errorf("%q not dropped: %v", k, err)
+		}
+	}
+	trs, err := trust.GetAll(alice)
+	if err != nil || len(trs) != 1 {
+		t.Fatalf("records %v %v", len(trs), err)
+	}
+	trs, err = trust.GetByAddress(alice, "bob@localhost")
+	if err != nil || len(trs) != 1 {
+		t.Fatalf("not indexed %v %v", len(trs), err)
+	}
+
+	// and the indexes do not show up as records
+	trs, err = trust.GetAll(alice)
+	if err != nil || len(trs) != 1 {
+		t.Errorf("indexes as records %v %v", len(trs), err)
+	}
+}
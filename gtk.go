@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/conformal/gotk3/gdk"
 	"github.com/conformal/gotk3/glib"
@@ -43,9 +44,35 @@ type GtkContext struct {
 	fingerprintEntry *gtk.Entry
 	picture          *gtk.Image
 
+	// message tab
+	sendEntry  *gtk.Entry
+	replyLabel *gtk.Label
+	replyTo    string         // message id the next message answers
+	completion *gtk.ListStore // of sendEntry
+	// text and files of the next message
+	messageView *gtk.TextView
+	attachments []*attachment
+	attachBox   *gtk.Box
+	attachSw    *gtk.ScrolledWindow
+	attachLabel *gtk.Label
+	progress    *gtk.ProgressBar
+
 	// trust tab
+	trust        []*core.TrustRecord
+	trustUsage   map[string]*core.QuotaUsage
+	trustFilter  string // see core.MatchTrust
+	trustBox     *gtk.Box
+	trustSw      *gtk.ScrolledWindow
 	trustListbox *gtk.ListBox
 	lblTrust     *gtk.Label
+
+	// inbox tab
+	inbox         []*core.InboxItem
+	inboxBox      *gtk.Box
+	inboxSw       *gtk.ScrolledWindow
+	inboxArchived *gtk.CheckButton
+	inboxQuery    string            // search shown instead of the inbox
+	inboxResults  []*core.InboxItem // of inboxQuery
 }
 
 func (g *GtkContext) Exit() {
@@ -166,7 +193,14 @@ func GtkInit(c *core.Core) (*GtkContext, error) {
 	}
 	g.notebook.AppendPage(g.createMessage(), l)
 
-	// create trust tab
+	// create inbox tab
+	l, err = gtk.LabelNew("Inbox")
+	if err != nil {
+		return nil, err
+	}
+	g.notebook.AppendPage(g.createInbox(), l)
+
+	// create trust tab, must be last
 	g.lblTrust, err = gtk.LabelNew("Trust")
 	if err != nil {
 		return nil, err
@@ -184,6 +218,18 @@ func GtkInit(c *core.Core) (*GtkContext, error) {
 	return &g, err
 }
 
+// messagePage is the notebook index of the message tab.
+const messagePage = 1
+
+// reply addresses the next message to the sender of item as an answer.  Must
+// be called on the gtk thread.
+func (g *GtkContext) reply(item *core.InboxItem) {
+	g.sendEntry.SetText(item.From)
+	g.replyTo = item.MessageId
+	g.replyLabel.SetText("In reply to " + item.Filename)
+	g.notebook.SetCurrentPage(messagePage)
+}
+
 // createMessage generates the Message tab.
 func (g *GtkContext) createMessage() (widget *gtk.Widget) {
 	grid, err := gtk.GridNew()
@@ -210,6 +256,22 @@ func (g *GtkContext) createMessage() (widget *gtk.Widget) {
 	sendEntry.SetHExpand(true)
 	//sendEntry.SetText(g.Id)
 	grid.Attach(sendEntry, 1, 0, 1, 1)
+	g.sendEntry = sendEntry
+
+	// complete allowed contacts, see renderCompletions
+	g.completion, err = gtk.ListStoreNew(glib.TYPE_STRING)
+	if err != nil {
+		g.DebugUi("createMessage %v", err)
+		return
+	}
+	ec, err := gtk.EntryCompletionNew()
+	if err != nil {
+		g.DebugUi("createMessage %v", err)
+		return
+	}
+	ec.SetModel(g.completion)
+	ec.SetTextColumn(0)
+	sendEntry.SetCompletion(ec)
 
 	b, err := gtk.ButtonNew()
 	if err != nil {
@@ -225,25 +287,99 @@ func (g *GtkContext) createMessage() (widget *gtk.Widget) {
 		g.DebugUi("createMessage %v", err)
 		return
 	}
+
+	// expiry, see core.ParseExpiry
+	lbl, err = gtk.LabelNew("Expires (e.g. 12h, 7d or once)")
+	if err != nil {
+		g.DebugUi("createMessage %v", err)
+		return
+	}
+	grid.Attach(lbl, 0, 1, 1, 1)
+
+	expireEntry, err := gtk.EntryNew()
+	if err != nil {
+		g.DebugUi("createMessage %v", err)
+		return
+	}
+	expireEntry.SetHExpand(true)
+	grid.Attach(expireEntry, 1, 1, 1, 1)
+
+	g.replyLabel, err = gtk.LabelNew("")
+	if err != nil {
+		g.DebugUi("createMessage %v", err)
+		return
+	}
+	grid.Attach(g.replyLabel, 2, 1, 1, 1)
+
 	tv.SetHExpand(true)
 	tv.SetVExpand(true)
-	grid.Attach(tv, 0, 1, 3, 1)
+	grid.Attach(tv, 0, 2, 3, 1)
+	g.messageView = tv
+
+	// attachments
+	ab, err := gtk.ButtonNew()
+	if err != nil {
+		g.DebugUi("createMessage %v", err)
+		return
+	}
+	ab.SetLabel("Attach file")
+	grid.Attach(ab, 0, 3, 1, 1)
+	ab.Connect("clicked", func() {
+		g.chooseAttachment()
+	})
+
+	cb, err := gtk.ButtonNew()
+	if err != nil {
+		g.DebugUi("createMessage %v", err)
+		return
+	}
+	cb.SetLabel("Contacts")
+	grid.Attach(cb, 1, 3, 1, 1)
+	cb.Connect("clicked", func() {
+		g.chooseContact()
+	})
+
+	g.progress, err = gtk.ProgressBarNew()
+	if err != nil {
+		g.DebugUi("createMessage %v", err)
+		return
+	}
+	g.progress.SetShowText(true)
+	grid.Attach(g.progress, 2, 3, 1, 1)
+
+	g.attachBox, err = gtk.BoxNew(gtk.ORIENTATION_VERTICAL, 0)
+	if err != nil {
+		g.DebugUi("createMessage %v", err)
+		return
+	}
+	g.attachLabel, err = gtk.LabelNew("")
+	if err != nil {
+		g.DebugUi("createMessage %v", err)
+		return
+	}
+	g.attachBox.PackStart(g.attachLabel, false, false, 0)
+	grid.Attach(g.attachBox, 0, 4, 3, 1)
+	g.dropTarget(&g.attachBox.Container.Widget)
+	g.dropTarget(&tv.Container.Widget)
+	g.renderAttachments()
 
 	b.Connect("clicked", func() {
 		g.DebugUi("createMessage clicked")
 
-		tmpDir, err := ioutil.TempDir(os.TempDir(), "scomms")
+		expire, err := expireEntry.GetText()
 		if err != nil {
 			g.DebugUi("createMessage %v", err)
 			return
 		}
-		tmpFd, err := ioutil.TempFile(tmpDir, "scmsg")
+		d, once, err := core.ParseExpiry(strings.TrimSpace(expire))
 		if err != nil {
-			g.DebugUi("createMessage %v", err)
+			go g.Popup(&core.UiPopup{
+				Title:   "Invalid expiry",
+				Message: err.Error(),
+			})
 			return
 		}
-		tmpFile := tmpFd.Name()
-		tmpFd.Close() // we no longer need the fd
+
 		bf, err := tv.GetBuffer()
 		if err != nil {
 			g.DebugUi("createMessage %v", err)
@@ -255,23 +391,45 @@ func (g *GtkContext) createMessage() (widget *gtk.Widget) {
 			g.DebugUi("createMessage %v", err)
 			return
 		}
-		err = ioutil.WriteFile(tmpFile, []byte(text), 0600)
-		if err != nil {
-			g.DebugUi("createMessage %v", err)
+		if text == "" && len(g.attachments) == 0 {
+			go g.Popup(&core.UiPopup{
+				Title:   "Nothing to send",
+				Message: "Type a message or attach a file",
+			})
 			return
 		}
+		var attachments []string
+		for _, a := range g.attachments {
+			attachments = append(attachments, a.path)
+		}
 
 		to, err := sendEntry.GetText()
 		if err != nil {
 			g.DebugUi("createMessage %v", err)
 			return
 		}
+		to = core.RecipientAddress(to)
+		if to == "" {
+			go g.Popup(&core.UiPopup{
+				Title:   "No recipient",
+				Message: "Enter an address or pick a contact",
+			})
+			return
+		}
+		if !g.confirmRecipient(to) {
+			return
+		}
 		m := &core.SendFile{
-			To:       to,
-			Filename: tmpFile,
-			Mime:     "message/rfc822", // TODO lies for now
+			To:          to,
+			Body:        text,
+			Attachments: attachments,
+			Expire:      d,
+			ViewOnce:    once,
+			InReplyTo:   g.replyTo,
 		}
 		g.SendCore(m)
+		g.replyTo = ""
+		g.replyLabel.SetText("")
 	})
 
 	return &grid.Container.Widget
@@ -350,6 +508,30 @@ func (g *GtkContext) createOverview() (widget *gtk.Widget) {
 	g.picture.SetVExpand(true)
 	grid.Attach(g.picture, 0, 4, 2, 1)
 
+	// collect messages from domain host
+	b, err := gtk.ButtonNew()
+	if err != nil {
+		g.DebugUi("createOverview %v", err)
+		return
+	}
+	b.SetLabel("Collect messages")
+	grid.Attach(b, 0, 5, 2, 1)
+	b.Connect("clicked", func() {
+		g.SendCore(&core.FetchMailbox{})
+	})
+
+	// audit log viewer
+	b, err = gtk.ButtonNew()
+	if err != nil {
+		g.DebugUi("createOverview %v", err)
+		return
+	}
+	b.SetLabel("Audit log")
+	grid.Attach(b, 0, 6, 2, 1)
+	b.Connect("clicked", func() {
+		g.SendCore(&core.AuditView{})
+	})
+
 	return &grid.Container.Widget
 }
 
@@ -506,7 +688,7 @@ func (g *GtkContext) createChangeDefaultsDialog(m *core.UiConfirmIdentity,
 	d.Connect("response", func(_ *gtk.Dialog, rt gtk.ResponseType) {
 		switch rt {
 		case gtk.RESPONSE_OK:
-			ucir := &core.UiConfirmIdentityReply{}
+			ucir := &core.UiConfirmIdentityReply{Id: m.Id}
 
 			idf, err := mcrypt.NewIdentifier(core.ProfilePicture,
 				fc.GetFilename())
@@ -533,20 +715,17 @@ func (g *GtkContext) createChangeDefaultsDialog(m *core.UiConfirmIdentity,
 }
 
 // ChangeDefaults prompts the user to confirm ID and name.
-// Won't return until dialog completes.
+// The dialog replies to core on its own.
 func (g *GtkContext) ConfirmIdentity(ci *core.UiConfirmIdentity) {
 	g.DebugUi("ConfirmIdentity")
-	reply := make(chan bool)
+	reply := make(chan bool, 1)
 	glib.IdleAdd(func() {
 		d := g.createChangeDefaultsDialog(ci, reply)
 		if d != nil {
 			d.Run()
 			d.Destroy()
-		} else {
-			close(reply)
 		}
 	})
-	_ = <-reply
 }
 
 // Display annoying message.
@@ -566,3 +745,65 @@ func (g *GtkContext) Popup(p *core.UiPopup) {
 	})
 	_ = <-b
 }
+
+// Show the audit log and whether it verified.
+func (g *GtkContext) RenderAudit(m *core.UiRenderAudit) {
+	g.DebugUi("RenderAudit")
+	glib.IdleAdd(func() {
+		d, err := gtk.DialogNew()
+		if err != nil {
+			g.DebugUi("RenderAudit %v", err)
+			return
+		}
+		d.SetTitle("Audit log")
+		d.SetDefaultSize(800, 480)
+		d.AddButton("_OK", gtk.RESPONSE_OK)
+
+		b, err := d.GetContentArea()
+		if err != nil {
+			g.DebugUi("RenderAudit %v", err)
+			return
+		}
+		lb, err := gtk.ListBoxNew()
+		if err != nil {
+			g.DebugUi("RenderAudit %v", err)
+			return
+		}
+		sw, err := gtk.ScrolledWindowNew(nil, nil)
+		if err != nil {
+			g.DebugUi("RenderAudit %v", err)
+			return
+		}
+		sw.Add(lb)
+		sw.SetHExpand(true)
+		sw.SetVExpand(true)
+		b.Add(sw)
+
+		status := "Verified"
+		if m.Error != "" {
+			status = "Verification FAILED: " + m.Error
+		}
+		g.addItem(lb, "Status", status)
+		for _, r := range m.Records {
+			g.addItem(lb, fmt.Sprintf("%v %v", r.Seq,
+				r.Time.Format("2006-01-02 15:04:05")),
+				fmt.Sprintf("%v %v %v", r.Event, r.Address,
+					r.Detail))
+		}
+
+		d.SetTransientFor(g.w)
+		d.SetPosition(gtk.WIN_POS_CENTER_ON_PARENT)
+		d.ShowAll()
+		d.Run()
+		d.Destroy()
+	})
+}
+
+// Tell user that a message arrived.
+func (g *GtkContext) NewMessage(m *core.UiNewMessage) {
+	g.Popup(&core.UiPopup{
+		Title: "New message",
+		Message: fmt.Sprintf("You have received %v from %v, it is "+
+			"in the inbox\n", m.Filename, m.From),
+	})
+}
@@ -0,0 +1,584 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/conformal/gotk3/glib"
+	"github.com/conformal/gotk3/gtk"
+	"github.com/marcopeereboom/scomms/core"
+)
+
+const maxView = 64 * 1024 // bytes of received content shown
+
+// createInbox generates the Inbox tab.
+func (g *GtkContext) createInbox() (widget *gtk.Widget) {
+	var err error
+	g.inboxBox, err = gtk.BoxNew(gtk.ORIENTATION_VERTICAL, 0)
+	if err != nil {
+		g.DebugUi("createInbox %v", err)
+		return
+	}
+
+	g.inboxArchived, err = gtk.CheckButtonNewWithLabel("Show archived")
+	if err != nil {
+		g.DebugUi("createInbox %v", err)
+		return
+	}
+	g.inboxArchived.Connect("toggled", func() {
+		g.renderInbox()
+	})
+
+	// search, see core.ParseQuery
+	search, err := gtk.EntryNew()
+	if err != nil {
+		g.DebugUi("createInbox %v", err)
+		return
+	}
+	search.SetPlaceholderText("Search: words from: mime: after: before:")
+	search.SetHExpand(true)
+	search.Connect("activate", func() {
+		query, err := search.GetText()
+		if err != nil {
+			g.DebugUi("createInbox %v", err)
+			return
+		}
+		g.inboxQuery = strings.TrimSpace(query)
+		g.inboxResults = nil
+		if g.inboxQuery != "" {
+			g.SendCore(&core.InboxSearch{Query: g.inboxQuery})
+		}
+		g.renderInbox()
+	})
+
+	bar, err := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 6)
+	if err != nil {
+		g.DebugUi("createInbox %v", err)
+		return
+	}
+	bar.PackStart(g.inboxArchived, false, false, 0)
+	bar.PackStart(search, true, true, 0)
+
+	export, err := gtk.ButtonNew()
+	if err != nil {
+		g.DebugUi("createInbox %v", err)
+		return
+	}
+	export.SetLabel("Export mail")
+	export.Connect("clicked", func() {
+		g.mailExport()
+	})
+	bar.PackStart(export, false, false, 0)
+	g.inboxBox.PackStart(bar, false, false, 0)
+
+	return &g.inboxBox.Container.Widget
+}
+
+// mailExport asks where to export messages to.  Must be called on the gtk
+// thread.
+func (g *GtkContext) mailExport() {
+	d, err := gtk.DialogNew()
+	if err != nil {
+		g.DebugUi("mailExport %v", err)
+		return
+	}
+	defer d.Destroy()
+	d.SetTitle("Export mail")
+	d.AddButton("_Maildir", gtk.RESPONSE_YES)
+	d.AddButton("mbo_x", gtk.RESPONSE_NO)
+	d.AddButton("_Cancel", gtk.RESPONSE_CANCEL)
+
+	b, err := d.GetContentArea()
+	if err != nil {
+		g.DebugUi("mailExport %v", err)
+		return
+	}
+	l, err := gtk.LabelNew("Messages that were not exported to the target " +
+		"before are written to it.  Target is an absolute path.")
+	if err != nil {
+		g.DebugUi("mailExport %v", err)
+		return
+	}
+	b.Add(l)
+	target, err := gtk.EntryNew()
+	if err != nil {
+		g.DebugUi("mailExport %v", err)
+		return
+	}
+	b.Add(target)
+
+	d.SetTransientFor(g.w)
+	d.SetPosition(gtk.WIN_POS_CENTER_ON_PARENT)
+	d.ShowAll()
+	format := core.MailMaildir
+	switch d.Run() {
+	case int(gtk.RESPONSE_YES):
+	case int(gtk.RESPONSE_NO):
+		format = core.MailMbox
+	default:
+		return
+	}
+	t, err := target.GetText()
+	if err != nil {
+		g.DebugUi("mailExport %v", err)
+		return
+	}
+	g.SendCore(&core.MailExport{Format: format,
+		Target: strings.TrimSpace(t)})
+}
+
+// expires describes when item is deleted.
+func expires(item *core.InboxItem) string {
+	switch {
+	case item.ViewOnce:
+		return "view once"
+	case item.Expires.IsZero():
+		return ""
+	}
+	return "expires " + item.Expires.Format("2006-01-02 15:04")
+}
+
+// renderInboxItem adds one row to lb.
+func (g *GtkContext) renderInboxItem(lb *gtk.ListBox, item *core.InboxItem) {
+	gr, err := gtk.GridNew()
+	if err != nil {
+		g.DebugUi("renderInboxItem %v", err)
+		return
+	}
+
+	from := item.From
+	if !item.Read {
+		from = "* " + from
+	}
+	if item.Flagged {
+		from = "! " + from
+	}
+	filename := item.Filename
+	if len(item.Parts) > 1 {
+		filename += fmt.Sprintf(" (+%v)", len(item.Parts)-1)
+	}
+	labels := []string{
+		item.Received.Format("2006-01-02 15:04"),
+		from,
+		filename,
+		item.Mime,
+		fmt.Sprintf("%v", item.Size),
+		expires(item),
+	}
+	for i, s := range labels {
+		l, err := gtk.LabelNew(s)
+		if err != nil {
+			g.DebugUi("renderInboxItem %v", err)
+			return
+		}
+		l.SetHExpand(true)
+		gr.Attach(l, i, 0, 1, 1)
+	}
+
+	button := func(col int, label string, f func()) {
+		b, err := gtk.ButtonNew()
+		if err != nil {
+			g.DebugUi("renderInboxItem %v", err)
+			return
+		}
+		b.SetLabel(label)
+		gr.Attach(b, col, 0, 1, 1)
+		b.Connect("clicked", f)
+	}
+	col := len(labels)
+	button(col, "Open", func() {
+		g.SendCore(&core.InboxOpen{Id: item.Id})
+	})
+	archive := "Archive"
+	if item.Archived {
+		archive = "Unarchive"
+	}
+	button(col+1, "Reply", func() {
+		g.reply(item)
+	})
+	button(col+2, archive, func() {
+		g.SendCore(&core.InboxMark{
+			Id:       item.Id,
+			Read:     item.Read,
+			Archived: !item.Archived,
+			Flagged:  item.Flagged,
+		})
+	})
+	flag := "Flag"
+	if item.Flagged {
+		flag = "Unflag"
+	}
+	button(col+3, flag, func() {
+		g.SendCore(&core.InboxMark{
+			Id:       item.Id,
+			Read:     item.Read,
+			Archived: item.Archived,
+			Flagged:  !item.Flagged,
+		})
+	})
+	button(col+4, "Delete", func() {
+		glib.IdleAdd(func() {
+			d := gtk.MessageDialogNew(g.w, gtk.DIALOG_MODAL,
+				gtk.MESSAGE_QUESTION, gtk.BUTTONS_YES_NO,
+				"Delete %v from %v?", item.Filename, item.From)
+			if d.Run() == int(gtk.RESPONSE_YES) {
+				g.SendCore(&core.InboxDelete{Id: item.Id})
+			}
+			d.Destroy()
+		})
+	})
+
+	lb.Insert(gr, -1)
+}
+
+// renderInbox replaces the inbox list.  Must be called on the gtk thread.
+func (g *GtkContext) renderInbox() {
+	// we can't delete items out of the listbox so recreate it
+	if g.inboxSw != nil {
+		g.inboxBox.Remove(g.inboxSw)
+	}
+
+	lb, err := gtk.ListBoxNew()
+	if err != nil {
+		g.DebugUi("renderInbox %v", err)
+		return
+	}
+	g.inboxSw, err = gtk.ScrolledWindowNew(nil, nil)
+	if err != nil {
+		g.DebugUi("renderInbox %v", err)
+		return
+	}
+	g.inboxSw.Add(lb)
+	lb.SetHExpand(true)
+	lb.SetVExpand(true)
+	g.inboxBox.PackStart(g.inboxSw, true, true, 0)
+
+	if g.inboxQuery != "" {
+		for _, item := range g.inboxResults {
+			g.renderInboxItem(lb, item)
+		}
+		g.inboxBox.ShowAll()
+		return
+	}
+
+	archived := g.inboxArchived.GetActive()
+	for _, item := range g.inbox {
+		if item.Archived && !archived {
+			continue
+		}
+		g.renderInboxItem(lb, item)
+	}
+	g.inboxBox.ShowAll()
+}
+
+func (g *GtkContext) RenderInbox(m *core.UiRenderInbox) {
+	glib.IdleAdd(func() {
+		g.DebugUi("RenderInbox")
+		g.inbox = m.Items
+		if g.inboxQuery != "" {
+			// results may have changed as well
+			g.SendCore(&core.InboxSearch{Query: g.inboxQuery})
+		}
+		g.renderInbox()
+	})
+}
+
+func (g *GtkContext) SearchResult(m *core.UiSearchResult) {
+	if m.Error != "" {
+		g.Popup(&core.UiPopup{
+			Title:   "Search failed",
+			Message: m.Error,
+		})
+	}
+	glib.IdleAdd(func() {
+		g.DebugUi("SearchResult")
+		if m.Query != g.inboxQuery {
+			return
+		}
+		g.inboxResults = m.Items
+		g.renderInbox()
+	})
+}
+
+// Show an opened inbox item.  Text is displayed, anything else gets a save
+// button that decrypts it into the export directory.  Multipart messages show
+// their body with a save button per attachment.  View once items are never
+// written to disk.
+func (g *GtkContext) InboxItem(m *core.UiInboxItem) {
+	g.DebugUi("InboxItem %v", m.Item.Id)
+
+	text := ""
+	mimeType := m.Item.Mime
+	multipart := len(m.Item.Parts) != 0
+	if multipart {
+		mimeType = m.Item.Parts[0].Mime
+	}
+	save := false // whole item, it can't be shown
+	var err error
+	if m.Content != nil {
+		b := m.Content
+		if multipart {
+			var r io.Reader
+			r, err = core.ReadPart(m.Item.Mime, bytes.NewReader(b), 0)
+			if err == nil {
+				b, err = ioutil.ReadAll(io.LimitReader(r, maxView))
+			}
+		}
+		if len(b) > maxView {
+			b = b[:maxView]
+		}
+		text = string(b)
+	} else {
+		var f io.ReadCloser
+		if multipart {
+			f, err = g.SpoolOpenPart(m.Item.Id, 0)
+		} else {
+			f, err = g.SpoolOpen(m.Item.Id)
+		}
+		if err == nil {
+			var b []byte
+			b, err = ioutil.ReadAll(io.LimitReader(f, maxView))
+			f.Close()
+			text = string(b)
+		}
+	}
+	if err != nil || !utf8.ValidString(text) ||
+		(mimeType != "" && !strings.HasPrefix(mimeType, "text/") &&
+			mimeType != "message/rfc822") {
+		if m.Item.ViewOnce {
+			g.Popup(&core.UiPopup{
+				Title: m.Item.Filename,
+				Message: fmt.Sprintf("View once message from %v "+
+					"can not be displayed and was deleted\n",
+					m.Item.From),
+			})
+			return
+		}
+		save = true
+		text = fmt.Sprintf("%v (%v, %v bytes) can not be displayed.\n",
+			m.Item.Filename, m.Item.Mime, m.Item.Size)
+	}
+
+	glib.IdleAdd(func() {
+		d, err := gtk.DialogNew()
+		if err != nil {
+			g.DebugUi("InboxItem %v", err)
+			return
+		}
+		d.SetTitle(m.Item.From + " " + m.Item.Filename)
+		d.SetDefaultSize(640, 480)
+		d.AddButton("_OK", gtk.RESPONSE_OK)
+
+		b, err := d.GetContentArea()
+		if err != nil {
+			g.DebugUi("InboxItem %v", err)
+			return
+		}
+		tv, err := gtk.TextViewNew()
+		if err != nil {
+			g.DebugUi("InboxItem %v", err)
+			return
+		}
+		tv.SetEditable(false)
+		bf, err := tv.GetBuffer()
+		if err != nil {
+			g.DebugUi("InboxItem %v", err)
+			return
+		}
+		bf.SetText(text)
+		sw, err := gtk.ScrolledWindowNew(nil, nil)
+		if err != nil {
+			g.DebugUi("InboxItem %v", err)
+			return
+		}
+		sw.Add(tv)
+		sw.SetHExpand(true)
+		sw.SetVExpand(true)
+		b.Add(sw)
+
+		if save {
+			sb, err := gtk.ButtonNew()
+			if err != nil {
+				g.DebugUi("InboxItem %v", err)
+				return
+			}
+			sb.SetLabel("Save " + m.Item.Filename)
+			sb.Connect("clicked", func() {
+				filename, err := g.SpoolExport(m.Item.Id)
+				if err != nil {
+					go g.Popup(&core.UiPopup{
+						Title:   "Could not export message",
+						Message: err.Error(),
+					})
+					return
+				}
+				go g.Popup(&core.UiPopup{
+					Title: m.Item.Filename,
+					Message: fmt.Sprintf("Message is saved "+
+						"in: %v\n", filename),
+				})
+			})
+			b.Add(sb)
+		}
+
+		for i, p := range m.Item.Parts {
+			if i == 0 {
+				continue // body
+			}
+			label := fmt.Sprintf("%v (%v, %v bytes)", p.Filename,
+				p.Mime, p.Size)
+			if m.Item.ViewOnce {
+				l, err := gtk.LabelNew(label)
+				if err != nil {
+					g.DebugUi("InboxItem %v", err)
+					return
+				}
+				b.Add(l)
+				continue
+			}
+			n, title := i, p.Filename
+			sb, err := gtk.ButtonNew()
+			if err != nil {
+				g.DebugUi("InboxItem %v", err)
+				return
+			}
+			sb.SetLabel("Save " + label)
+			sb.Connect("clicked", func() {
+				filename, err := g.SpoolExportPart(m.Item.Id, n)
+				if err != nil {
+					go g.Popup(&core.UiPopup{
+						Title:   "Could not save attachment",
+						Message: err.Error(),
+					})
+					return
+				}
+				go g.Popup(&core.UiPopup{
+					Title: title,
+					Message: fmt.Sprintf("Attachment is saved "+
+						"in: %v\n", filename),
+				})
+			})
+			b.Add(sb)
+		}
+
+		d.SetTransientFor(g.w)
+		d.SetPosition(gtk.WIN_POS_CENTER_ON_PARENT)
+		d.ShowAll()
+		d.Run()
+		d.Destroy()
+	})
+}
+
+// RenderHistory shows the conversation with a peer.  Replies are indented
+// below what they answer, text is shown inline.
+func (g *GtkContext) RenderHistory(m *core.UiRenderHistory) {
+	g.DebugUi("RenderHistory %v", m.Peer)
+	if m.Error != "" {
+		g.Popup(&core.UiPopup{
+			Title:   "Could not show history",
+			Message: m.Error,
+		})
+		return
+	}
+
+	var text bytes.Buffer
+	for i, t := range m.Threads {
+		if i != 0 {
+			text.WriteString("\n")
+		}
+		for _, v := range t.Messages {
+			indent := strings.Repeat("    ", v.Depth)
+			who := "From " + v.Peer
+			if v.Sent {
+				who = "To " + v.Peer
+			}
+			fmt.Fprintf(&text, "%v%v %v: %v\n", indent,
+				v.Time.Format("2006-01-02 15:04"), who, v.Filename)
+			if v.ViewOnce || (!strings.HasPrefix(v.Mime, "text/") &&
+				len(v.Parts) == 0) {
+				continue
+			}
+			f, err := g.ThreadOpen(v)
+			if err != nil {
+				fmt.Fprintf(&text, "%v  %v\n", indent, err)
+				continue
+			}
+			b, err := ioutil.ReadAll(io.LimitReader(f, maxView))
+			f.Close()
+			if err != nil || !utf8.Valid(b) {
+				continue
+			}
+			for _, l := range strings.Split(strings.TrimRight(
+				string(b), "\n"), "\n") {
+				fmt.Fprintf(&text, "%v  %v\n", indent, l)
+			}
+		}
+	}
+	if len(m.Threads) == 0 {
+		text.WriteString("No messages\n")
+	}
+
+	glib.IdleAdd(func() {
+		d, err := gtk.DialogNew()
+		if err != nil {
+			g.DebugUi("RenderHistory %v", err)
+			return
+		}
+		d.SetTitle("History " + m.Peer)
+		d.SetDefaultSize(640, 480)
+		d.AddButton("_OK", gtk.RESPONSE_OK)
+
+		b, err := d.GetContentArea()
+		if err != nil {
+			g.DebugUi("RenderHistory %v", err)
+			return
+		}
+		tv, err := gtk.TextViewNew()
+		if err != nil {
+			g.DebugUi("RenderHistory %v", err)
+			return
+		}
+		tv.SetEditable(false)
+		bf, err := tv.GetBuffer()
+		if err != nil {
+			g.DebugUi("RenderHistory %v", err)
+			return
+		}
+		bf.SetText(text.String())
+		sw, err := gtk.ScrolledWindowNew(nil, nil)
+		if err != nil {
+			g.DebugUi("RenderHistory %v", err)
+			return
+		}
+		sw.Add(tv)
+		sw.SetHExpand(true)
+		sw.SetVExpand(true)
+		b.Add(sw)
+
+		d.SetTransientFor(g.w)
+		d.SetPosition(gtk.WIN_POS_CENTER_ON_PARENT)
+		d.ShowAll()
+		d.Run()
+		d.Destroy()
+	})
+}
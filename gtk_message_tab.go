@@ -0,0 +1,395 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/conformal/gotk3/gdk"
+	"github.com/conformal/gotk3/glib"
+	"github.com/conformal/gotk3/gtk"
+	"github.com/marcopeereboom/scomms/core"
+)
+
+// attachment is a file that will be sent with the next message.
+type attachment struct {
+	path string
+	size int64
+}
+
+// attach adds a file to the next message.  Must be called on the gtk thread.
+func (g *GtkContext) attach(path string) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		go g.Popup(&core.UiPopup{
+			Title:   "Can't attach file",
+			Message: err.Error(),
+		})
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		go g.Popup(&core.UiPopup{
+			Title:   "Can't attach file",
+			Message: fmt.Sprintf("%v is not a regular file", path),
+		})
+		return
+	}
+	for _, a := range g.attachments {
+		if a.path == path {
+			return
+		}
+	}
+	g.attachments = append(g.attachments, &attachment{
+		path: path,
+		size: fi.Size(),
+	})
+	g.renderAttachments()
+}
+
+// renderAttachments replaces the list of pending attachments.  Must be called
+// on the gtk thread.
+func (g *GtkContext) renderAttachments() {
+	// we can't delete items out of the listbox so recreate it
+	if g.attachSw != nil {
+		g.attachBox.Remove(g.attachSw)
+	}
+
+	lb, err := gtk.ListBoxNew()
+	if err != nil {
+		g.DebugUi("renderAttachments %v", err)
+		return
+	}
+	g.attachSw, err = gtk.ScrolledWindowNew(nil, nil)
+	if err != nil {
+		g.DebugUi("renderAttachments %v", err)
+		return
+	}
+	g.attachSw.Add(lb)
+	lb.SetHExpand(true)
+	g.attachSw.SetSizeRequest(-1, 100)
+	g.attachBox.PackStart(g.attachSw, false, true, 0)
+
+	total := int64(0)
+	for i, a := range g.attachments {
+		total += a.size
+
+		gr, err := gtk.GridNew()
+		if err != nil {
+			g.DebugUi("renderAttachments %v", err)
+			return
+		}
+		gr.SetColumnHomogeneous(true)
+		for col, text := range []string{
+			filepath.Base(a.path),
+			fmt.Sprintf("%v", a.size),
+		} {
+			l, err := gtk.LabelNew(text)
+			if err != nil {
+				g.DebugUi("renderAttachments %v", err)
+				return
+			}
+			l.SetHExpand(true)
+			gr.Attach(l, col, 0, 1, 1)
+		}
+		b, err := gtk.ButtonNew()
+		if err != nil {
+			g.DebugUi("renderAttachments %v", err)
+			return
+		}
+		b.SetLabel("Remove")
+		gr.Attach(b, 2, 0, 1, 1)
+		n := i
+		b.Connect("clicked", func() {
+			g.attachments = append(g.attachments[:n],
+				g.attachments[n+1:]...)
+			g.renderAttachments()
+		})
+		lb.Insert(gr, -1)
+	}
+
+	text := "Drop files here to attach them"
+	if len(g.attachments) != 0 {
+		text = fmt.Sprintf("%v attachments, %v bytes",
+			len(g.attachments), total)
+	}
+	g.attachLabel.SetText(text)
+	g.attachBox.ShowAll()
+}
+
+// chooseAttachment lets the user pick a file to attach.
+func (g *GtkContext) chooseAttachment() {
+	d, err := gtk.DialogNew()
+	if err != nil {
+		g.DebugUi("chooseAttachment %v", err)
+		return
+	}
+	d.SetTitle("Attach file")
+	d.SetDefaultSize(640, 480)
+	d.SetTransientFor(g.w)
+
+	fc, err := gtk.FileChooserWidgetNew(gtk.FILE_CHOOSER_ACTION_OPEN)
+	if err != nil {
+		g.DebugUi("chooseAttachment %v", err)
+		d.Destroy()
+		return
+	}
+	fc.SetHExpand(true)
+	fc.SetVExpand(true)
+	ca, err := d.GetContentArea()
+	if err != nil {
+		g.DebugUi("chooseAttachment %v", err)
+		d.Destroy()
+		return
+	}
+	ca.Add(fc)
+	d.AddButton("_Attach", gtk.RESPONSE_ACCEPT)
+	d.AddButton("_Cancel", gtk.RESPONSE_CANCEL)
+	d.SetPosition(gtk.WIN_POS_CENTER_ON_PARENT)
+	d.ShowAll()
+	if d.Run() == int(gtk.RESPONSE_ACCEPT) && fc.GetFilename() != "" {
+		g.attach(fc.GetFilename())
+	}
+	d.Destroy()
+}
+
+// dropTarget makes w accept files dragged from a file manager as
+// attachments.
+func (g *GtkContext) dropTarget(w *gtk.Widget) {
+	te, err := gtk.TargetEntryNew("text/uri-list", gtk.TARGET_OTHER_APP, 0)
+	if err != nil {
+		g.DebugUi("dropTarget %v", err)
+		return
+	}
+	w.DragDestSet(gtk.DEST_DEFAULT_ALL, []gtk.TargetEntry{*te},
+		gdk.ACTION_COPY)
+	w.Connect("drag-data-received", func(_ glib.IObject,
+		ctx *gdk.DragContext, x, y int, data uintptr, info, t uint) {
+		for _, path := range dropPaths(string(gtk.GetData(data))) {
+			g.attach(path)
+		}
+	})
+}
+
+// dropPaths returns the local files in a text/uri-list.
+func dropPaths(uris string) []string {
+	var paths []string
+	for _, line := range strings.Split(uris, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		u, err := url.Parse(line)
+		if err != nil || u.Scheme != "file" || u.Path == "" {
+			continue
+		}
+		paths = append(paths, u.Path)
+	}
+	return paths
+}
+
+// Show how much of the message being sent went out.
+func (g *GtkContext) SendProgress(m *core.UiSendProgress) {
+	glib.IdleAdd(func() {
+		g.progress.SetFraction(float64(m.Sent) / float64(m.Total))
+		g.progress.SetText(fmt.Sprintf("Sending to %v", m.To))
+	})
+}
+
+// Sending failures were already shown by core.  On success the message is
+// cleared.
+func (g *GtkContext) SendFileResult(m *core.UiSendFileResult) {
+	g.DebugUi("SendFileResult %v %v %v", m.To, m.Filename, m.Error)
+	glib.IdleAdd(func() {
+		g.progress.SetFraction(0)
+		g.progress.SetText("")
+		if m.Error != "" {
+			return
+		}
+		bf, err := g.messageView.GetBuffer()
+		if err != nil {
+			g.DebugUi("SendFileResult %v", err)
+			return
+		}
+		bf.SetText("")
+		g.attachments = nil
+		g.renderAttachments()
+	})
+}
+
+// renderCompletions offers the allowed contacts and their tags in the
+// recipient entry.  Must be called on the gtk thread.
+func (g *GtkContext) renderCompletions() {
+	var all []string
+	for _, tr := range core.Contacts(g.trust, "") {
+		all = append(all, core.Completions(tr)...)
+	}
+	for _, t := range core.AllTags(g.trust) {
+		all = append(all, core.TagPrefix+t)
+	}
+
+	g.completion.Clear()
+	for _, s := range all {
+		err := g.completion.SetValue(g.completion.Append(), 0, s)
+		if err != nil {
+			g.DebugUi("renderCompletions %v", err)
+			return
+		}
+	}
+}
+
+// renderContact adds a contact with a button that addresses the next message
+// to it.
+func (g *GtkContext) renderContact(lb *gtk.ListBox, tr *core.TrustRecord,
+	selected func()) {
+	pid := tr.PublicIdentity
+	gr, err := gtk.GridNew()
+	if err != nil {
+		g.DebugUi("renderContact %v", err)
+		return
+	}
+	gr.SetColumnHomogeneous(true)
+
+	pic, err := gtk.ImageNew()
+	if err != nil {
+		g.DebugUi("renderContact %v", err)
+		return
+	}
+	pic.SetSizeRequest(64, 64)
+	gr.Attach(pic, 0, 0, 1, 2)
+	setFromFile(pid, pic)
+
+	name := pid.Name
+	if nick := tr.FreeToUse[core.Nickname]; nick != "" {
+		name = fmt.Sprintf("%v (%v)", name, nick)
+	}
+	for i, text := range []string{name, pid.Address, pid.Fingerprint()} {
+		l, err := gtk.LabelNew(text)
+		if err != nil {
+			g.DebugUi("renderContact %v", err)
+			return
+		}
+		l.SetHExpand(true)
+		if i < 2 {
+			gr.Attach(l, 1+i, 0, 1, 1)
+		} else {
+			gr.Attach(l, 1, 1, 2, 1)
+		}
+	}
+
+	b, err := gtk.ButtonNew()
+	if err != nil {
+		g.DebugUi("renderContact %v", err)
+		return
+	}
+	b.SetLabel("Select")
+	gr.Attach(b, 3, 0, 1, 2)
+	b.Connect("clicked", func() {
+		g.sendEntry.SetText(pid.Address)
+		selected()
+	})
+
+	lb.Insert(gr, -1)
+}
+
+// chooseContact lets the user pick the recipient out of the allowed contacts.
+func (g *GtkContext) chooseContact() {
+	d, err := gtk.DialogNew()
+	if err != nil {
+		g.DebugUi("chooseContact %v", err)
+		return
+	}
+	d.SetTitle("Contacts")
+	d.SetDefaultSize(640, 480)
+	d.AddButton("_Cancel", gtk.RESPONSE_CANCEL)
+
+	ca, err := d.GetContentArea()
+	if err != nil {
+		g.DebugUi("chooseContact %v", err)
+		d.Destroy()
+		return
+	}
+	search, err := gtk.EntryNew()
+	if err != nil {
+		g.DebugUi("chooseContact %v", err)
+		d.Destroy()
+		return
+	}
+	search.SetPlaceholderText("Name, address, nickname or tag:<tag>")
+	ca.PackStart(search, false, false, 0)
+
+	// we can't delete items out of the listbox so recreate it
+	var sw *gtk.ScrolledWindow
+	render := func() {
+		if sw != nil {
+			ca.Remove(sw)
+		}
+		lb, err := gtk.ListBoxNew()
+		if err != nil {
+			g.DebugUi("chooseContact %v", err)
+			return
+		}
+		sw, err = gtk.ScrolledWindowNew(nil, nil)
+		if err != nil {
+			g.DebugUi("chooseContact %v", err)
+			return
+		}
+		sw.Add(lb)
+		lb.SetHExpand(true)
+		lb.SetVExpand(true)
+		ca.PackStart(sw, true, true, 0)
+
+		text, err := search.GetText()
+		if err != nil {
+			g.DebugUi("chooseContact %v", err)
+			return
+		}
+		for _, tr := range core.Contacts(g.trust, text) {
+			g.renderContact(lb, tr, func() {
+				d.Response(gtk.RESPONSE_OK)
+			})
+		}
+		ca.ShowAll()
+	}
+	search.Connect("changed", render)
+	render()
+
+	d.SetTransientFor(g.w)
+	d.SetPosition(gtk.WIN_POS_CENTER_ON_PARENT)
+	d.ShowAll()
+	d.Run()
+	d.Destroy()
+}
+
+// confirmRecipient warns before dialing an address without an allowed trust
+// record and returns true if the user wants to send anyway.  Must be called
+// on the gtk thread.
+func (g *GtkContext) confirmRecipient(to string) bool {
+	if core.IsContact(g.trust, to) {
+		return true
+	}
+	d := gtk.MessageDialogNew(g.w, gtk.DIALOG_MODAL,
+		gtk.MESSAGE_WARNING, gtk.BUTTONS_YES_NO,
+		"%v is not an allowed contact, check the address.  Sending "+
+			"dials it and may ask you to trust an identity you "+
+			"have not verified.  Send anyway?", to)
+	defer d.Destroy()
+	return d.Run() == int(gtk.RESPONSE_YES)
+}
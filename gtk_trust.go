@@ -127,6 +127,7 @@ func (g *GtkContext) createConfirmPublicIdentity(m *core.UiConfirmPublicIdentity
 
 	d.Connect("response", func(_ *gtk.Dialog, rt gtk.ResponseType) {
 		msg := &core.UiConfirmPublicIdentityReply{}
+		msg.Id = m.Id
 		msg.PublicIdentity = m.PublicIdentity
 		switch rt {
 		case gtk.RESPONSE_ACCEPT:
@@ -146,15 +147,51 @@ func (g *GtkContext) createConfirmPublicIdentity(m *core.UiConfirmPublicIdentity
 
 func (g *GtkContext) ConfirmPublicIdentity(ci *core.UiConfirmPublicIdentity) {
 	g.DebugUi("ConfirmPublicIdentity")
-	reply := make(chan bool)
+	reply := make(chan bool, 1)
 	glib.IdleAdd(func() {
 		d := g.createConfirmPublicIdentity(ci, reply)
 		if d != nil {
 			d.Run()
 			d.Destroy()
-		} else {
-			close(reply)
 		}
 	})
-	<-reply
+}
+
+// KeyChange warns that a known address answered with a different key and
+// asks what to do about it.  Core always gets exactly one reply.
+func (g *GtkContext) KeyChange(m *core.UiKeyChange) {
+	g.DebugUi("KeyChange")
+	pid := m.PublicIdentity
+	previous := m.Previous.PublicIdentity
+	glib.IdleAdd(func() {
+		d := gtk.MessageDialogNew(g.w, gtk.DIALOG_MODAL,
+			gtk.MESSAGE_WARNING, gtk.BUTTONS_NONE,
+			"WARNING: %v answered with a different key.\n\n"+
+				"This may be a new installation or an "+
+				"impersonation.\n\n"+
+				"Previous fingerprint (%v):\n%v\n\n"+
+				"New fingerprint:\n%v",
+			pid.Address, core.State[m.Previous.State],
+			previous.Fingerprint(), pid.Fingerprint())
+		d.SetTitle("Public Identity Changed")
+		d.AddButton("_Accept", gtk.RESPONSE_ACCEPT)
+		d.AddButton("Accept if _previous key confirms",
+			gtk.RESPONSE_APPLY)
+		d.AddButton("_Reject", gtk.RESPONSE_REJECT)
+		d.AddButton("_Cancel", gtk.RESPONSE_CANCEL)
+
+		msg := &core.UiKeyChangeReply{Id: m.Id}
+		switch d.Run() {
+		case int(gtk.RESPONSE_ACCEPT):
+			msg.Decision = core.KeyChangeAccept
+		case int(gtk.RESPONSE_APPLY):
+			msg.Decision = core.KeyChangeVerify
+		case int(gtk.RESPONSE_REJECT):
+			msg.Decision = core.KeyChangeReject
+		default:
+			msg.Decision = core.KeyChangeCancel
+		}
+		d.Destroy()
+		g.SendCore(msg)
+	})
 }
@@ -17,12 +17,18 @@
 package main
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/conformal/gotk3/glib"
 	"github.com/conformal/gotk3/gtk"
 	"github.com/marcopeereboom/mcrypt"
 	"github.com/marcopeereboom/scomms/core"
 )
 
+// trustPage is the notebook index of the trust tab, it must be the last one.
+const trustPage = 3
+
 // createTrust generates the Message tab.
 func (g *GtkContext) createTrust() (widget *gtk.Widget) {
 	grid, err := gtk.GridNew()
@@ -33,24 +39,66 @@ func (g *GtkContext) createTrust() (widget *gtk.Widget) {
 
 	grid.SetColumnHomogeneous(true)
 
-	// listbox
-	g.trustListbox, err = gtk.ListBoxNew()
+	// filter, see core.MatchTrust
+	filter, err := gtk.EntryNew()
 	if err != nil {
 		g.DebugUi("createTrust %v", err)
 		return nil
 	}
-	sw, err := gtk.ScrolledWindowNew(nil, nil)
+	filter.SetPlaceholderText("Filter by name, address, nickname, " +
+		"notes or tag:<tag>")
+	filter.SetText(g.trustFilter)
+	filter.Connect("changed", func() {
+		text, err := filter.GetText()
+		if err != nil {
+			g.DebugUi("createTrust %v", err)
+			return
+		}
+		g.trustFilter = text
+		g.renderTrustList()
+	})
+	grid.Attach(filter, 0, 0, 1, 1)
+
+	// listbox, see renderTrustList
+	g.trustBox, err = gtk.BoxNew(gtk.ORIENTATION_VERTICAL, 0)
 	if err != nil {
 		g.DebugUi("createTrust %v", err)
 		return nil
 	}
-	sw.Add(g.trustListbox)
+	g.trustSw = nil
+	grid.Attach(g.trustBox, 0, 1, 1, 1)
+
+	return &grid.Container.Widget
+}
+
+// renderTrustList replaces the list of trust records that match the filter.
+// Must be called on the gtk thread.
+func (g *GtkContext) renderTrustList() {
+	// we can't delete items out of the listbox so recreate it
+	if g.trustSw != nil {
+		g.trustBox.Remove(g.trustSw)
+	}
+
+	var err error
+	g.trustListbox, err = gtk.ListBoxNew()
+	if err != nil {
+		g.DebugUi("renderTrustList %v", err)
+		return
+	}
+	g.trustSw, err = gtk.ScrolledWindowNew(nil, nil)
+	if err != nil {
+		g.DebugUi("renderTrustList %v", err)
+		return
+	}
+	g.trustSw.Add(g.trustListbox)
 	g.trustListbox.SetHExpand(true)
 	g.trustListbox.SetVExpand(true)
+	g.trustBox.PackStart(g.trustSw, true, true, 0)
 
-	grid.Attach(sw, 0, 0, 1, 1)
-
-	return &grid.Container.Widget
+	for _, v := range core.MatchTrust(g.trust, g.trustFilter) {
+		g.renderTrustItem(v, g.trustUsage[v.PublicIdentity.Address])
+	}
+	g.trustBox.ShowAll()
 }
 
 func (g *GtkContext) createIdentifiersDialog(pid *mcrypt.PublicIdentity) *gtk.Dialog {
@@ -188,7 +236,126 @@ func (g *GtkContext) createStateDialog(tr *core.TrustRecord) *gtk.Dialog {
 	return d
 }
 
-func (g *GtkContext) renderTrustItem(tr *core.TrustRecord) {
+// createContactDialog edits the nickname, notes and tags of a contact.
+func (g *GtkContext) createContactDialog(tr *core.TrustRecord) *gtk.Dialog {
+	g.DebugUi("createContactDialog")
+
+	d, err := gtk.DialogNew()
+	if err != nil {
+		g.DebugUi("%v", err)
+		return nil
+	}
+	d.SetTitle("Contact " + tr.PublicIdentity.Address)
+	d.SetDefaultSize(640, 480)
+
+	d.AddButton("_OK", gtk.RESPONSE_OK)
+	d.AddButton("_Cancel", gtk.RESPONSE_CANCEL)
+
+	grid, err := gtk.GridNew()
+	if err != nil {
+		g.DebugUi("%v", err)
+		return nil
+	}
+	grid.SetHExpand(true)
+	grid.SetVExpand(true)
+	b, err := d.GetContentArea()
+	if err != nil {
+		g.DebugUi("%v", err)
+		return nil
+	}
+	b.Add(grid)
+	b.SetHExpand(true)
+	b.SetVExpand(true)
+
+	entry := func(row int, label, text string) *gtk.Entry {
+		l, err := gtk.LabelNew(label)
+		if err != nil {
+			g.DebugUi("%v", err)
+			return nil
+		}
+		grid.Attach(l, 0, row, 1, 1)
+		e, err := gtk.EntryNew()
+		if err != nil {
+			g.DebugUi("%v", err)
+			return nil
+		}
+		e.SetHExpand(true)
+		e.SetText(text)
+		grid.Attach(e, 1, row, 1, 1)
+		return e
+	}
+	nick := entry(0, "Nickname", tr.FreeToUse[core.Nickname])
+	tags := entry(1, "Tags (e.g. ops, vendor)",
+		strings.Join(core.ContactTags(tr), ", "))
+	if nick == nil || tags == nil {
+		return nil
+	}
+
+	lbl, err := gtk.LabelNew("Notes")
+	if err != nil {
+		g.DebugUi("%v", err)
+		return nil
+	}
+	grid.Attach(lbl, 0, 2, 1, 1)
+	notes, err := gtk.TextViewNew()
+	if err != nil {
+		g.DebugUi("%v", err)
+		return nil
+	}
+	notes.SetHExpand(true)
+	notes.SetVExpand(true)
+	grid.Attach(notes, 1, 2, 1, 1)
+	bf, err := notes.GetBuffer()
+	if err != nil {
+		g.DebugUi("%v", err)
+		return nil
+	}
+	bf.SetText(tr.FreeToUse[core.Notes])
+
+	// put on top of main window
+	d.SetTransientFor(g.w)
+	d.SetPosition(gtk.WIN_POS_CENTER_ON_PARENT)
+	d.ShowAll()
+
+	d.Connect("response", func(_ *gtk.Dialog, rt gtk.ResponseType) {
+		if rt != gtk.RESPONSE_OK {
+			return
+		}
+		n, err := nick.GetText()
+		if err != nil {
+			g.DebugUi("%v", err)
+			return
+		}
+		t, err := tags.GetText()
+		if err != nil {
+			g.DebugUi("%v", err)
+			return
+		}
+		start, end := bf.GetBounds()
+		o, err := bf.GetText(start, end, true)
+		if err != nil {
+			g.DebugUi("%v", err)
+			return
+		}
+		tl, err := core.ParseTags(t)
+		if err != nil {
+			go g.Popup(&core.UiPopup{
+				Title:   "Invalid tags",
+				Message: err.Error(),
+			})
+			return
+		}
+		core.SetContact(tr, n, o, tl)
+
+		// tell core to update trust db
+		g.SendCore(&core.UpdateTrustRecord{TrustRecord: tr})
+	})
+
+	return d
+}
+
+func (g *GtkContext) renderTrustItem(tr *core.TrustRecord,
+	usage *core.QuotaUsage) {
 	pid := tr.PublicIdentity
 	gr, err := gtk.GridNew()
 	if err != nil {
@@ -217,7 +384,20 @@ func (g *GtkContext) renderTrustItem(tr *core.TrustRecord) {
 	})
 
 	// name
-	lblName, err := gtk.LabelNew(pid.Name)
+	name := pid.Name
+	if nick := tr.FreeToUse[core.Nickname]; nick != "" {
+		name = fmt.Sprintf("%v (%v)", name, nick)
+	}
+	if tags := core.ContactTags(tr); len(tags) != 0 {
+		name = fmt.Sprintf("%v [%v]", name, strings.Join(tags, ", "))
+	}
+	if _, ok := tr.FreeToUse[core.ReplacedBy]; ok {
+		name += " (replaced)"
+	}
+	if _, ok := tr.FreeToUse[core.Tombstone]; ok {
+		name = "(forgotten)"
+	}
+	lblName, err := gtk.LabelNew(name)
 	if err != nil {
 		g.DebugUi("renderTrustItem %v", err)
 		return
@@ -243,6 +423,15 @@ func (g *GtkContext) renderTrustItem(tr *core.TrustRecord) {
 	lblFingerprint.SetHExpand(true)
 	gr.Attach(lblFingerprint, 3, 0, 1, 1)
 
+	// storage used
+	lblUsage, err := gtk.LabelNew(usage.String())
+	if err != nil {
+		g.DebugUi("renderTrustItem %v", err)
+		return
+	}
+	lblUsage.SetHExpand(true)
+	gr.Attach(lblUsage, 5, 0, 1, 1)
+
 	// identifiers
 	b, err := gtk.ButtonNew()
 	if err != nil {
@@ -262,27 +451,186 @@ func (g *GtkContext) renderTrustItem(tr *core.TrustRecord) {
 		})
 	})
 
+	// conversation
+	b, err = gtk.ButtonNew()
+	if err != nil {
+		g.DebugUi("renderTrustItem %v", err)
+		return
+	}
+	b.SetLabel("History")
+	b.SetHExpand(true)
+	gr.Attach(b, 6, 0, 1, 1)
+	b.Connect("clicked", func() {
+		g.SendCore(&core.HistoryView{Peer: pid.Address})
+	})
+
+	// nickname, notes and tags
+	b, err = gtk.ButtonNew()
+	if err != nil {
+		g.DebugUi("renderTrustItem %v", err)
+		return
+	}
+	b.SetLabel("Contact")
+	b.SetHExpand(true)
+	gr.Attach(b, 7, 0, 1, 1)
+	if notes := tr.FreeToUse[core.Notes]; notes != "" {
+		b.SetTooltipText(notes)
+	}
+	b.Connect("clicked", func() {
+		glib.IdleAdd(func() {
+			d := g.createContactDialog(tr)
+			if d != nil {
+				d.Run()
+				d.Destroy()
+			}
+		})
+	})
+
+	// versions of the record
+	b, err = gtk.ButtonNew()
+	if err != nil {
+		g.DebugUi("renderTrustItem %v", err)
+		return
+	}
+	b.SetLabel("Changes")
+	b.SetHExpand(true)
+	gr.Attach(b, 9, 0, 1, 1)
+	b.Connect("clicked", func() {
+		g.SendCore(&core.TrustHistoryView{PublicIdentity: pid})
+	})
+
+	// delete, optionally keeping the key denied
+	b, err = gtk.ButtonNew()
+	if err != nil {
+		g.DebugUi("renderTrustItem %v", err)
+		return
+	}
+	b.SetLabel("Delete")
+	b.SetHExpand(true)
+	gr.Attach(b, 8, 0, 1, 1)
+	b.Connect("clicked", func() {
+		glib.IdleAdd(func() {
+			d := gtk.MessageDialogNew(g.w, gtk.DIALOG_MODAL,
+				gtk.MESSAGE_QUESTION, gtk.BUTTONS_NONE,
+				"Delete %v?  Forget and block keeps denying its "+
+					"key should it come back.", pid.Address)
+			d.AddButton("_Delete", gtk.RESPONSE_ACCEPT)
+			d.AddButton("_Forget and block", gtk.RESPONSE_REJECT)
+			d.AddButton("_Cancel", gtk.RESPONSE_CANCEL)
+			switch d.Run() {
+			case int(gtk.RESPONSE_ACCEPT):
+				g.SendCore(&core.TrustDelete{PublicIdentity: pid})
+			case int(gtk.RESPONSE_REJECT):
+				g.SendCore(&core.TrustDelete{
+					PublicIdentity: pid,
+					Forget:         true,
+				})
+			}
+			d.Destroy()
+		})
+	})
+
 	g.trustListbox.Insert(gr, -1)
 }
 
+// RenderTrustHistory shows the versions of a trust record, each can be made
+// current again.
+func (g *GtkContext) RenderTrustHistory(m *core.UiRenderTrustHistory) {
+	g.DebugUi("RenderTrustHistory")
+	if m.Error != "" {
+		g.Popup(&core.UiPopup{
+			Title:   "Trust record history",
+			Message: m.Error,
+		})
+		return
+	}
+	glib.IdleAdd(func() {
+		d, err := gtk.DialogNew()
+		if err != nil {
+			g.DebugUi("RenderTrustHistory %v", err)
+			return
+		}
+		d.SetTitle("Changes " + m.PublicIdentity.Address)
+		d.SetDefaultSize(800, 480)
+		d.AddButton("_OK", gtk.RESPONSE_OK)
+
+		b, err := d.GetContentArea()
+		if err != nil {
+			g.DebugUi("RenderTrustHistory %v", err)
+			return
+		}
+		lb, err := gtk.ListBoxNew()
+		if err != nil {
+			g.DebugUi("RenderTrustHistory %v", err)
+			return
+		}
+		sw, err := gtk.ScrolledWindowNew(nil, nil)
+		if err != nil {
+			g.DebugUi("RenderTrustHistory %v", err)
+			return
+		}
+		sw.Add(lb)
+		sw.SetHExpand(true)
+		sw.SetVExpand(true)
+		b.Add(sw)
+
+		for i, v := range m.Versions {
+			gr, err := gtk.GridNew()
+			if err != nil {
+				g.DebugUi("RenderTrustHistory %v", err)
+				return
+			}
+			l, err := gtk.LabelNew(v.String())
+			if err != nil {
+				g.DebugUi("RenderTrustHistory %v", err)
+				return
+			}
+			l.SetHExpand(true)
+			l.SetLineWrap(true)
+			gr.Attach(l, 0, 0, 1, 1)
+			if i != len(m.Versions)-1 {
+				rb, err := gtk.ButtonNew()
+				if err != nil {
+					g.DebugUi("RenderTrustHistory %v", err)
+					return
+				}
+				rb.SetLabel("Revert")
+				gr.Attach(rb, 1, 0, 1, 1)
+				version := v.Version
+				rb.Connect("clicked", func() {
+					g.SendCore(&core.TrustRevert{
+						PublicIdentity: m.PublicIdentity,
+						Version:        version,
+					})
+					d.Response(gtk.RESPONSE_OK)
+				})
+			}
+			lb.Insert(gr, -1)
+		}
+
+		d.SetTransientFor(g.w)
+		d.SetPosition(gtk.WIN_POS_CENTER_ON_PARENT)
+		d.ShowAll()
+		d.Run()
+		d.Destroy()
+	})
+}
+
 func (g *GtkContext) RenderTrust(rt *core.UiRenderTrust) {
 	glib.IdleAdd(func() {
 		g.DebugUi("RenderTrust")
+		g.trust = rt.TrustRecords
+		g.trustUsage = rt.Usage
+		g.renderCompletions()
 
 		// we need to recreate the tab here because we can't delete items
 		// out of the listbox
 		current := g.notebook.GetCurrentPage()
 		w := g.createTrust()
-		g.notebook.RemovePage(2) // make sure trust stays here!
+		g.notebook.RemovePage(trustPage)
 		g.notebook.AppendPage(w, g.lblTrust)
 
-		for _, v := range rt.TrustRecords {
-			if v == nil {
-				return
-			}
-			g.renderTrustItem(v)
-		}
-		g.trustListbox.ShowAll()
+		g.renderTrustList()
 
 		// this is part of the hack to recreate the tab
 		g.notebook.ShowAll()
@@ -17,36 +17,40 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 
-	"github.com/marcopeereboom/queueb"
 	"github.com/marcopeereboom/scomms/core"
 )
 
-// handleIncoming decodes and handles incomming ui messages.
-func (g *GtkContext) handleIncoming(msg *queueb.QueuebMessage) {
-	switch m := msg.Message.(type) {
-	case *core.UiRenderIdentity:
-		g.RenderIdentity(m)
-	case *core.UiConfirmIdentity:
-		g.ConfirmIdentity(m)
-	case *core.UiPopup:
-		g.Popup(m)
-	case *core.UiConfirmPublicIdentity:
-		g.ConfirmPublicIdentity(m)
-	case *core.UiRenderTrust:
-		g.RenderTrust(m)
-	default:
-		g.DebugUi("unhandled message %T\n", msg.Message)
-	}
-}
-
 func _main() error {
+	domain := flag.String("domain", "", "host all registered users of "+
+		"this domain")
+	register := flag.String("register", "", "register public identity "+
+		"file with the hosted domain and exit")
+	export := flag.String("export", "", "export public identity to file "+
+		"and exit")
+	flag.Parse()
+
 	c, err := core.New()
 	if err != nil {
 		return err
 	}
+
+	if *export != "" {
+		return c.ExportPublicIdentity(*export)
+	}
+	if *domain != "" {
+		err = c.HostDomain(*domain)
+		if err != nil {
+			return err
+		}
+	}
+	if *register != "" {
+		return c.RegisterHostedUser(*register)
+	}
+
 	c.Start()
 
 	// launch main window
@@ -55,29 +59,11 @@ func _main() error {
 		return err
 	}
 
-	// tell core we are ready to render
-	err = c.SendCore(&core.UiReady{})
-	if err != nil {
-		return err
-	}
-
 	g.DebugUi("ready\n")
-	for {
-		m, err := c.ReceiveUi()
-		if err != nil {
-			return err
-		}
-		g.DebugUi("received %T\n", m.Message)
-		switch m.Message.(type) {
-		case *core.Exit:
-			g.Exit()
-			return nil
-		default:
-			g.handleIncoming(m)
-		}
-	}
+	err = c.Run(g)
+	g.Exit()
 
-	return nil
+	return err
 }
 
 // main is the start of day of the application.
@@ -0,0 +1,1119 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+// scomms is a command line client.  It talks to scommsd over the control
+// socket when it is running, otherwise it runs core without listening.  All
+// core prompts are answered non-interactively.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"github.com/marcopeereboom/mcrypt"
+	"github.com/marcopeereboom/scomms/control"
+	"github.com/marcopeereboom/scomms/core"
+)
+
+const usage = `usage: scomms [-d] <command> [arguments]
+
+commands:
+	init -name <name> -address <address>
+	whoami [-export <file>]
+	send [-accept|-reject|-fingerprint <fp>] [-mime <type>]
+	    [-keychange accept|verify|reject]
+	    [-expire <duration|once>] [-attach <file> ...]
+	    [-reply <message id>] <to> [<file>|-]
+	trust list [<filter>]
+	trust allow|deny <address|fingerprint>
+	trust delete [-forget] <address|fingerprint>
+	trust history <address|fingerprint>
+	trust revert <address|fingerprint> <version>
+	trust contact [-nick <nickname>] [-notes <text>] [-tags <tags>]
+	    <address|fingerprint>
+	trust quota <address|fingerprint> <bytes> <messages>
+	trust retention <address|fingerprint> <days>|default [delete|archive]
+	inbox ls [<address>]
+	inbox cat <id> [<part>]
+	inbox export <id> <file> [<part>]
+	inbox maildir|mbox <target>
+	history <address>
+	search <words> [from:<address>] [tag:<tag>] [mime:<type>]
+	    [after:<yyyy-mm-dd>] [before:<yyyy-mm-dd>]
+	audit [verify]
+`
+
+// backend is either an in process core or a running scommsd.
+type backend interface {
+	SendCore(m interface{}) error
+	Receive() (interface{}, error)
+}
+
+// local runs core in process.
+type local struct {
+	*core.Core
+}
+
+func (l *local) Receive() (interface{}, error) {
+	m, err := l.ReceiveUi()
+	if err != nil {
+		return nil, err
+	}
+	l.DebugUi("received %T\n", m.Message)
+	return m.Message, nil
+}
+
+type cli struct {
+	backend
+
+	dir      string
+	debug    bool
+	identity *core.UiRenderIdentity
+	trust    *core.UiRenderTrust
+}
+
+// next returns the next UI bound message.  Popups are reported on stderr and
+// identity prompts are refused since there is nobody to answer them.
+func (c *cli) next() (interface{}, error) {
+	for {
+		m, err := c.Receive()
+		if err != nil {
+			return nil, err
+		}
+		switch msg := m.(type) {
+		case *core.UiPopup:
+			fmt.Fprintf(os.Stderr, "%v: %v\n", msg.Title, msg.Message)
+		case *core.UiConfirmIdentity:
+			return nil, fmt.Errorf("no identity, run scomms init " +
+				"first")
+		case *core.UiRenderIdentity:
+			c.identity = msg
+		case *core.UiRenderTrust:
+			c.trust = msg
+			return msg, nil
+		default:
+			return msg, nil
+		}
+	}
+}
+
+// connect prefers a running scommsd, core can only run once.  Otherwise it
+// runs core in process.
+func (c *cli) connect() error {
+	rc, err := control.Dial(c.dir + control.SocketFilename)
+	if err == nil {
+		err = rc.Subscribe(false)
+		if err != nil {
+			rc.Close()
+			return err
+		}
+		c.backend = rc
+		return nil
+	}
+
+	cc, err := core.New()
+	if err != nil {
+		return err
+	}
+	if !c.debug {
+		cc.SetMask(0)
+	}
+	cc.SetListeners(nil)
+	cc.Start()
+	c.backend = &local{Core: cc}
+	return nil
+}
+
+// decline hands a prompt that is not ours back to scommsd.  It is fine if
+// somebody else answered it already.
+func (c *cli) decline(id core.PromptId) error {
+	rc, ok := c.backend.(*control.Client)
+	if !ok {
+		return nil
+	}
+	err := rc.Decline(id)
+	if e, ok := err.(*control.Error); ok &&
+		e.Code == control.ErrInvalidParams {
+		return nil
+	}
+	return err
+}
+
+// close hangs up on scommsd.
+func (c *cli) close() {
+	if rc, ok := c.backend.(*control.Client); ok {
+		rc.Close()
+	}
+}
+
+// ready tells core that we are up and waits for identity and trust.
+func (c *cli) ready() error {
+	err := c.SendCore(&core.UiReady{})
+	if err != nil {
+		return err
+	}
+	for c.identity == nil || c.trust == nil {
+		_, err := c.next()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cli) init(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	name := fs.String("name", "", "full name, e.g. John Doe")
+	address := fs.String("address", "", "address, e.g. jd@mydomain.com")
+	fs.Parse(args)
+	if *name == "" || *address == "" {
+		return fmt.Errorf("init requires -name and -address")
+	}
+
+	err := c.SendCore(&core.UiReady{})
+	if err != nil {
+		return err
+	}
+	for {
+		m, err := c.Receive()
+		if err != nil {
+			return err
+		}
+		switch msg := m.(type) {
+		case *core.UiConfirmIdentity:
+			err = c.SendCore(&core.UiConfirmIdentityReply{
+				Id:      msg.Id,
+				Name:    *name,
+				Address: *address,
+			})
+			if err != nil {
+				return err
+			}
+		case *core.UiRenderIdentity:
+			if msg.PublicIdentity.Address != *address {
+				return fmt.Errorf("identity %v already exists",
+					msg.PublicIdentity.Address)
+			}
+			fmt.Printf("%v\n", msg.PublicIdentity.Fingerprint())
+			return nil
+		}
+	}
+}
+
+func (c *cli) whoami(args []string) error {
+	fs := flag.NewFlagSet("whoami", flag.ExitOnError)
+	export := fs.String("export", "", "export public identity to file")
+	fs.Parse(args)
+
+	err := c.ready()
+	if err != nil {
+		return err
+	}
+	pid := c.identity.PublicIdentity
+	if *export != "" {
+		j, err := pid.Marshal()
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(*export, j, 0600)
+	}
+	fmt.Printf("Name:        %v\n", pid.Name)
+	fmt.Printf("Address:     %v\n", pid.Address)
+	fmt.Printf("Fingerprint: %v\n", pid.Fingerprint())
+
+	return nil
+}
+
+// fileList is a repeatable flag.
+type fileList []string
+
+func (f *fileList) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *fileList) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+func (c *cli) send(args []string) error {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	accept := fs.Bool("accept", false, "trust unknown recipient")
+	reject := fs.Bool("reject", false, "deny unknown recipient")
+	fingerprint := fs.String("fingerprint", "", "trust unknown "+
+		"recipient if its fingerprint matches")
+	keyChange := fs.String("keychange", "", "when a known recipient "+
+		"answers with a new key: accept, verify (accept if the "+
+		"previous key confirms) or reject")
+	mimeType := fs.String("mime", "", "content type, sniffed when empty")
+	expire := fs.String("expire", "", "recipient deletes the message "+
+		"after a duration, e.g. 12h or 7d, or once it was viewed")
+	var attach fileList
+	fs.Var(&attach, "attach", "attach file, <file> or stdin becomes the "+
+		"message body; may be repeated")
+	reply := fs.String("reply", "", "message id of the message this "+
+		"answers, see history")
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return fmt.Errorf(usage)
+	}
+	if *accept && *reject {
+		return fmt.Errorf("-accept and -reject are mutually exclusive")
+	}
+	keyChanges := map[string]int{
+		"":       core.KeyChangeCancel,
+		"accept": core.KeyChangeAccept,
+		"verify": core.KeyChangeVerify,
+		"reject": core.KeyChangeReject,
+	}
+	if _, ok := keyChanges[*keyChange]; !ok {
+		return fmt.Errorf("invalid -keychange %v", *keyChange)
+	}
+	d, once, err := core.ParseExpiry(*expire)
+	if err != nil {
+		return err
+	}
+
+	err = c.ready()
+	if err != nil {
+		return err
+	}
+
+	// scommsd decides by policy unless we were told what to answer
+	rc, ok := c.backend.(*control.Client)
+	if ok && (*accept || *reject || *fingerprint != "" ||
+		*keyChange != "") {
+		err = rc.Subscribe(true)
+		if err != nil {
+			return err
+		}
+	}
+
+	sf := &core.SendFile{
+		To:        fs.Arg(0),
+		Mime:      *mimeType,
+		Expire:    d,
+		ViewOnce:  once,
+		InReplyTo: *reply,
+	}
+	stdin := fs.NArg() == 1 || fs.Arg(1) == "-"
+	switch {
+	case stdin:
+		body, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		if !utf8.Valid(body) {
+			return fmt.Errorf("stdin is not text, send it as a file")
+		}
+		sf.Body = string(body)
+	case len(attach) != 0:
+		body, err := ioutil.ReadFile(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		sf.Body = string(body)
+	default:
+		sf.Filename, err = filepath.Abs(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+	}
+	for _, v := range attach {
+		filename, err := filepath.Abs(v)
+		if err != nil {
+			return err
+		}
+		sf.Attachments = append(sf.Attachments, filename)
+	}
+
+	// a tag is sent to every contact carrying it, each answers
+	recipients := map[string]bool{sf.To: true}
+	if tag, ok := core.SendTag(sf.To); ok {
+		for _, tr := range core.Tagged(c.trust.TrustRecords, tag) {
+			recipients[tr.PublicIdentity.Address] = true
+		}
+		if len(recipients) > 1 {
+			delete(recipients, sf.To)
+		}
+	}
+
+	err = c.SendCore(sf)
+	if err != nil {
+		return err
+	}
+	var failed error
+	for {
+		m, err := c.next()
+		if err != nil {
+			return err
+		}
+		switch msg := m.(type) {
+		case *core.UiConfirmPublicIdentity:
+			pid := msg.PublicIdentity
+			if !recipients[pid.Address] {
+				// someone else's prompt
+				err = c.decline(msg.Id)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			reply := &core.UiConfirmPublicIdentityReply{
+				Id:             msg.Id,
+				PublicIdentity: pid,
+			}
+			switch {
+			case *fingerprint != "":
+				if *fingerprint == pid.Fingerprint() {
+					reply.State = core.StateAllowed
+				} else {
+					fmt.Fprintf(os.Stderr, "fingerprint "+
+						"mismatch: %v has %v\n",
+						pid.Address, pid.Fingerprint())
+				}
+			case *accept:
+				reply.State = core.StateAllowed
+			case *reject:
+				reply.State = core.StateDenied
+			default:
+				fmt.Fprintf(os.Stderr, "unknown identity %v "+
+					"<%v> fingerprint %v\n", pid.Name,
+					pid.Address, pid.Fingerprint())
+			}
+			err = c.SendCore(reply)
+			if err != nil {
+				return err
+			}
+		case *core.UiKeyChange:
+			pid := msg.PublicIdentity
+			if !recipients[pid.Address] {
+				err = c.decline(msg.Id)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "WARNING: %v answered with a "+
+				"different key\n  previous %v (%v)\n  new      "+
+				"%v\n", pid.Address,
+				msg.Previous.PublicIdentity.Fingerprint(),
+				core.State[msg.Previous.State], pid.Fingerprint())
+			reply := &core.UiKeyChangeReply{
+				Id:       msg.Id,
+				Decision: keyChanges[*keyChange],
+			}
+			switch {
+			case *fingerprint != "" && *keyChange == "":
+				if *fingerprint == pid.Fingerprint() {
+					reply.Decision = core.KeyChangeAccept
+				}
+			case *reject && *keyChange == "":
+				reply.Decision = core.KeyChangeReject
+			case *keyChange == "":
+				fmt.Fprintf(os.Stderr, "use -keychange to "+
+					"decide\n")
+			}
+			err = c.SendCore(reply)
+			if err != nil {
+				return err
+			}
+		case *core.UiSendFileResult:
+			if !recipients[msg.To] {
+				continue
+			}
+			delete(recipients, msg.To)
+			switch {
+			case msg.Error == "":
+			case msg.To == sf.To:
+				return fmt.Errorf("%v", msg.Error)
+			default:
+				fmt.Fprintf(os.Stderr, "%v: %v\n", msg.To,
+					msg.Error)
+				failed = fmt.Errorf("sending to %v failed", sf.To)
+			}
+			if len(recipients) == 0 {
+				return failed
+			}
+		}
+	}
+}
+
+// trustList lists the trust records that match filter, see core.MatchTrust.
+func (c *cli) trustList(filter string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "STATE\tADDRESS\tNAME\tFINGERPRINT\tUSAGE\t"+
+		"RETENTION\tNICKNAME\tTAGS\tNOTES\n")
+	for _, v := range core.MatchTrust(c.trust.TrustRecords, filter) {
+		retention := "default"
+		if days, ok := v.FreeToUse[core.RetentionDays]; ok {
+			d, _ := strconv.Atoi(days)
+			retention = core.Retention{Days: d,
+				Action: v.FreeToUse[core.RetentionAction]}.String()
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			core.State[v.State], v.PublicIdentity.Address,
+			v.PublicIdentity.Name, v.PublicIdentity.Fingerprint(),
+			c.trust.Usage[v.PublicIdentity.Address], retention,
+			v.FreeToUse[core.Nickname],
+			strings.Join(core.ContactTags(v), ","),
+			strings.Join(strings.Fields(v.FreeToUse[core.Notes]), " "))
+	}
+	if c.trust.Total != nil && filter == "" {
+		fmt.Fprintf(w, "\t\t\ttotal\t%v\t\t\t\t\n", c.trust.Total)
+	}
+	return w.Flush()
+}
+
+// trustFind returns the trust record of an address or fingerprint.
+func (c *cli) trustFind(who string) (*core.TrustRecord, error) {
+	var found []*core.TrustRecord
+	for _, v := range c.trust.TrustRecords {
+		if v.PublicIdentity.Address == who ||
+			v.PublicIdentity.Fingerprint() == who {
+			found = append(found, v)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("%v not found in trust database", who)
+	case 1:
+	default:
+		return nil, fmt.Errorf("%v is ambiguous, use the fingerprint",
+			who)
+	}
+	return found[0], nil
+}
+
+func (c *cli) trustSet(who string, state int) error {
+	tr, err := c.trustFind(who)
+	if err != nil {
+		return err
+	}
+	tr.State = state
+	return c.trustUpdate(tr)
+}
+
+// trustQuota sets the per peer quota, 0 is unlimited.
+func (c *cli) trustQuota(who, bytes, messages string) error {
+	b, err := strconv.ParseInt(bytes, 10, 64)
+	if err != nil || b < 0 {
+		return fmt.Errorf("invalid bytes %v", bytes)
+	}
+	m, err := strconv.Atoi(messages)
+	if err != nil || m < 0 {
+		return fmt.Errorf("invalid messages %v", messages)
+	}
+	tr, err := c.trustFind(who)
+	if err != nil {
+		return err
+	}
+	if tr.FreeToUse == nil {
+		tr.FreeToUse = make(map[string]string)
+	}
+	tr.FreeToUse[core.QuotaBytes] = strconv.FormatInt(b, 10)
+	tr.FreeToUse[core.QuotaMessages] = strconv.Itoa(m)
+	return c.trustUpdate(tr)
+}
+
+// trustRetention sets how long messages of a peer are kept, 0 days is
+// forever and default uses config.json.
+func (c *cli) trustRetention(who, days, action string) error {
+	d, err := strconv.Atoi(days)
+	if days != "default" && (err != nil || d < 0) {
+		return fmt.Errorf("invalid days %v", days)
+	}
+	if action != core.RetainDelete && action != core.RetainArchive {
+		return fmt.Errorf("invalid action %v", action)
+	}
+	tr, err := c.trustFind(who)
+	if err != nil {
+		return err
+	}
+	if tr.FreeToUse == nil {
+		tr.FreeToUse = make(map[string]string)
+	}
+	if days == "default" {
+		delete(tr.FreeToUse, core.RetentionDays)
+		delete(tr.FreeToUse, core.RetentionAction)
+	} else {
+		tr.FreeToUse[core.RetentionDays] = strconv.Itoa(d)
+		tr.FreeToUse[core.RetentionAction] = action
+	}
+	return c.trustUpdate(tr)
+}
+
+// trustContact sets the nickname, notes and tags of a contact, flags that are
+// not given are left alone.
+func (c *cli) trustContact(args []string) error {
+	fs := flag.NewFlagSet("trust contact", flag.ExitOnError)
+	nick := fs.String("nick", "", "local name of the contact")
+	notes := fs.String("notes", "", "free form notes")
+	tags := fs.String("tags", "", "comma separated tags, e.g. ops,vendor")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf(usage)
+	}
+	tr, err := c.trustFind(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	n, o, t := tr.FreeToUse[core.Nickname], tr.FreeToUse[core.Notes],
+		core.ContactTags(tr)
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "nick":
+			n = *nick
+		case "notes":
+			o = *notes
+		case "tags":
+			t, err = core.ParseTags(*tags)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	core.SetContact(tr, n, o, t)
+	return c.trustUpdate(tr)
+}
+
+// trustDelete removes a trust record, with -forget a tombstone keeps the key
+// denied.
+func (c *cli) trustDelete(args []string) error {
+	fs := flag.NewFlagSet("trust delete", flag.ExitOnError)
+	forget := fs.Bool("forget", false, "forget the contact but keep "+
+		"denying its key")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf(usage)
+	}
+	tr, err := c.trustFind(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return c.trustSend(&core.TrustDelete{
+		PublicIdentity: tr.PublicIdentity,
+		Forget:         *forget,
+	})
+}
+
+// trustHistory lists the versions of a trust record, with version it makes
+// that one current again first.
+func (c *cli) trustHistory(who, version string) error {
+	tr, err := c.trustFind(who)
+	if err != nil {
+		return err
+	}
+	var m interface{} = &core.TrustHistoryView{
+		PublicIdentity: tr.PublicIdentity,
+	}
+	if version != "" {
+		n, err := strconv.Atoi(version)
+		if err != nil {
+			return fmt.Errorf("invalid version %v", version)
+		}
+		m = &core.TrustRevert{
+			PublicIdentity: tr.PublicIdentity,
+			Version:        n,
+		}
+	}
+	err = c.SendCore(m)
+	if err != nil {
+		return err
+	}
+	for {
+		m, err := c.next()
+		if err != nil {
+			return err
+		}
+		h, ok := m.(*core.UiRenderTrustHistory)
+		if !ok {
+			continue
+		}
+		if h.Error != "" {
+			return fmt.Errorf("%v", h.Error)
+		}
+		for _, v := range h.Versions {
+			fmt.Println(v)
+		}
+		return nil
+	}
+}
+
+func (c *cli) trustUpdate(tr *core.TrustRecord) error {
+	return c.trustSend(&core.UpdateTrustRecord{TrustRecord: tr})
+}
+
+// trustSend sends a trust change to core.
+func (c *cli) trustSend(m interface{}) error {
+	err := c.SendCore(m)
+	if err != nil {
+		return err
+	}
+
+	// core rerenders trust once the update is done
+	for {
+		m, err := c.next()
+		if err != nil {
+			return err
+		}
+		if _, ok := m.(*core.UiRenderTrust); ok {
+			return nil
+		}
+	}
+}
+
+func (c *cli) trustCmd(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf(usage)
+	}
+	err := c.ready()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		switch len(args) {
+		case 1:
+			return c.trustList("")
+		case 2:
+			return c.trustList(args[1])
+		}
+		return fmt.Errorf(usage)
+	case "contact":
+		return c.trustContact(args[1:])
+	case "delete":
+		return c.trustDelete(args[1:])
+	case "history":
+		if len(args) != 2 {
+			return fmt.Errorf(usage)
+		}
+		return c.trustHistory(args[1], "")
+	case "revert":
+		if len(args) != 3 {
+			return fmt.Errorf(usage)
+		}
+		return c.trustHistory(args[1], args[2])
+	case "allow", "deny":
+		if len(args) != 2 {
+			return fmt.Errorf(usage)
+		}
+		state := core.StateAllowed
+		if args[0] == "deny" {
+			state = core.StateDenied
+		}
+		return c.trustSet(args[1], state)
+	case "quota":
+		if len(args) != 4 {
+			return fmt.Errorf(usage)
+		}
+		return c.trustQuota(args[1], args[2], args[3])
+	case "retention":
+		action := core.RetainDelete
+		switch len(args) {
+		case 3:
+		case 4:
+			action = args[3]
+		default:
+			return fmt.Errorf(usage)
+		}
+		return c.trustRetention(args[1], args[2], action)
+	}
+
+	return fmt.Errorf(usage)
+}
+
+// search lists the inbox items that match a query, see core.ParseQuery.
+func (c *cli) search(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf(usage)
+	}
+	err := c.ready()
+	if err != nil {
+		return err
+	}
+	query := strings.Join(args, " ")
+	err = c.SendCore(&core.InboxSearch{Query: query})
+	if err != nil {
+		return err
+	}
+
+	for {
+		m, err := c.next()
+		if err != nil {
+			return err
+		}
+		r, ok := m.(*core.UiSearchResult)
+		if !ok || r.Query != query {
+			continue
+		}
+		if r.Error != "" {
+			return fmt.Errorf("%v", r.Error)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+		fmt.Fprintf(w, "ID\tRECEIVED\tFROM\tSIZE\tMIME\tNAME\n")
+		for _, v := range r.Items {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%q\n", v.Id,
+				v.Received.Format(time.RFC3339), v.From, v.Size,
+				v.Mime, v.Filename)
+		}
+		return w.Flush()
+	}
+}
+
+// spoolGet returns a spool entry that has not expired.
+func (c *cli) spoolGet(id *mcrypt.Identity, spoolId string) (*core.SpoolEntry,
+	error) {
+
+	se, err := core.SpoolGet(c.dir, id, spoolId)
+	if err != nil {
+		return nil, err
+	}
+	if se.Expired(time.Now()) {
+		return nil, fmt.Errorf("%v expired", spoolId)
+	}
+	return se, nil
+}
+
+// part returns the index of part s of a multipart message, 0 is the body.
+func (c *cli) part(se *core.SpoolEntry, s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n >= len(se.Meta.Parts) {
+		return 0, fmt.Errorf("%v has no part %v", se.Id, s)
+	}
+	return n, nil
+}
+
+// viewOnce has core hand out view once content, core deletes it before it
+// does, and writes it or part n of it to stdout.  Part -1 is everything.
+func (c *cli) viewOnce(se *core.SpoolEntry, n int) error {
+	err := c.connect()
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	err = c.ready()
+	if err != nil {
+		return err
+	}
+	err = c.SendCore(&core.InboxOpen{Id: se.Id})
+	if err != nil {
+		return err
+	}
+
+	for {
+		m, err := c.Receive()
+		if err != nil {
+			return err
+		}
+		switch msg := m.(type) {
+		case *core.UiPopup:
+			// see handleInboxOpen
+			switch msg.Title {
+			case "Could not open message",
+				"Could not delete view once message":
+				return fmt.Errorf("%v", msg.Message)
+			}
+			fmt.Fprintf(os.Stderr, "%v: %v\n", msg.Title,
+				msg.Message)
+		case *core.UiInboxItem:
+			if msg.Item.Id != se.Id {
+				continue
+			}
+			var r io.Reader = bytes.NewReader(msg.Content)
+			if n >= 0 {
+				r, err = core.ReadPart(msg.Item.Mime, r, n)
+				if err != nil {
+					return err
+				}
+			}
+			_, err = io.Copy(os.Stdout, r)
+			return err
+		}
+	}
+}
+
+// inboxCmd reads the spool directly and works while core is running.  View
+// once content is handed out by core.
+func (c *cli) inboxCmd(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf(usage)
+	}
+	id, err := core.OpenIdentity(c.dir)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "ls":
+		entries, err := core.SpoolList(c.dir, id)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+		fmt.Fprintf(w, "ID\tRECEIVED\tFROM\tSIZE\tMIME\tEXPIRES\t"+
+			"PARTS\tNAME\n")
+		now := time.Now()
+		for _, v := range entries {
+			if len(args) > 1 && v.From != args[1] {
+				continue
+			}
+			if v.Expired(now) {
+				continue
+			}
+			expires := "-"
+			switch {
+			case v.Meta.ViewOnce:
+				expires = core.ExpireOnce
+			case !v.Meta.Expires.IsZero():
+				expires = v.Meta.Expires.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%q\n",
+				v.Id, v.Meta.Created.Format(time.RFC3339),
+				v.From, v.Size, v.Meta.Mime, expires,
+				len(v.Meta.Parts), v.Filename)
+			for i, p := range v.Meta.Parts {
+				if i == 0 {
+					continue // body
+				}
+				fmt.Fprintf(w, "\t\t\t%v\t%v\t\t%v\t%q\n",
+					p.Size, p.Mime, i, p.Filename)
+			}
+		}
+		return w.Flush()
+	case "cat":
+		if len(args) != 2 && len(args) != 3 {
+			return fmt.Errorf(usage)
+		}
+		se, err := c.spoolGet(id, args[1])
+		if err != nil {
+			return err
+		}
+		n := -1
+		if len(args) == 3 {
+			n, err = c.part(se, args[2])
+			if err != nil {
+				return err
+			}
+		}
+		if se.Meta.ViewOnce {
+			return c.viewOnce(se, n)
+		}
+		var f io.ReadCloser
+		if n >= 0 {
+			f, err = core.SpoolOpenPart(c.dir, id, se.Id, n)
+		} else {
+			f, err = core.SpoolOpen(c.dir, id, se.Id)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(os.Stdout, f)
+		f.Close()
+		return err
+	case "export":
+		if len(args) != 3 && len(args) != 4 {
+			return fmt.Errorf(usage)
+		}
+		se, err := c.spoolGet(id, args[1])
+		if err != nil {
+			return err
+		}
+		if se.Meta.ViewOnce {
+			return fmt.Errorf("%v can only be viewed once, use cat",
+				se.Id)
+		}
+		if len(args) == 4 {
+			n, err := c.part(se, args[3])
+			if err != nil {
+				return err
+			}
+			return core.SpoolExportPart(c.dir, id, se.Id, n,
+				args[2])
+		}
+		return core.SpoolExport(c.dir, id, se.Id, args[2])
+	case core.MailMaildir, core.MailMbox:
+		if len(args) != 2 {
+			return fmt.Errorf(usage)
+		}
+		target, err := filepath.Abs(args[1])
+		if err != nil {
+			return err
+		}
+		n, err := core.ExportMail(c.dir, id, args[0], target)
+		fmt.Printf("%v messages exported to %v\n", n, target)
+		return err
+	}
+
+	return fmt.Errorf(usage)
+}
+
+// historyCmd shows the threads of the conversation with a peer, replies are
+// indented.  It reads the spool directly and works while core is running.
+func (c *cli) historyCmd(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf(usage)
+	}
+	id, err := core.OpenIdentity(c.dir)
+	if err != nil {
+		return err
+	}
+	threads, err := core.History(c.dir, id, args[0])
+	if err != nil {
+		return err
+	}
+
+	for i, t := range threads {
+		if i != 0 {
+			fmt.Println()
+		}
+		for _, m := range t.Messages {
+			indent := strings.Repeat("    ", m.Depth)
+			who := "from " + m.Peer
+			if m.Sent {
+				who = "to " + m.Peer
+			}
+			fmt.Printf("%v%v %v %q %v\n", indent,
+				m.Time.Format(time.RFC3339), who, m.Filename,
+				m.MessageId)
+
+			text := strings.HasPrefix(m.Mime, "text/") ||
+				len(m.Parts) != 0
+			if !text || m.ViewOnce {
+				continue
+			}
+			f, err := core.ThreadOpen(c.dir, id, m)
+			if err != nil {
+				return err
+			}
+			b, err := ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			for _, l := range strings.Split(strings.TrimRight(
+				string(b), "\n"), "\n") {
+				fmt.Printf("%v  %v\n", indent, l)
+			}
+		}
+	}
+	return nil
+}
+
+// auditCmd verifies the audit log and lists it unless only verifying.  It
+// reads the files directly and works while core is running.
+func (c *cli) auditCmd(args []string) error {
+	quiet := false
+	switch {
+	case len(args) == 0:
+	case len(args) == 1 && args[0] == "verify":
+		quiet = true
+	default:
+		return fmt.Errorf(usage)
+	}
+
+	id, err := core.OpenIdentity(c.dir)
+	if err != nil {
+		return err
+	}
+	records, err := core.VerifyAudit(c.dir, id)
+	if !quiet {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+		fmt.Fprintf(w, "SEQ\tTIME\tEVENT\tADDRESS\tDETAIL\n")
+		for _, r := range records {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", r.Seq,
+				r.Time.Format(time.RFC3339), r.Event, r.Address,
+				r.Detail)
+		}
+		w.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("audit log verification failed: %v", err)
+	}
+	if quiet {
+		fmt.Printf("audit log verified, %v records\n", len(records))
+	}
+	return nil
+}
+
+func _main() error {
+	var err error
+
+	c := cli{}
+	flag.BoolVar(&c.debug, "d", false, "enable debug output")
+	flag.Usage = func() { fmt.Fprintf(os.Stderr, usage) }
+	flag.Parse()
+	if flag.NArg() < 1 {
+		return fmt.Errorf(usage)
+	}
+
+	c.dir, err = core.DefaultDir()
+	if err != nil {
+		return err
+	}
+
+	cmd := strings.ToLower(flag.Arg(0))
+	switch cmd {
+	case "audit":
+		return c.auditCmd(flag.Args()[1:])
+	case "inbox":
+		return c.inboxCmd(flag.Args()[1:])
+	case "history":
+		return c.historyCmd(flag.Args()[1:])
+	}
+
+	err = c.connect()
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	args := flag.Args()[1:]
+	switch cmd {
+	case "init":
+		return c.init(args)
+	case "whoami":
+		return c.whoami(args)
+	case "send":
+		return c.send(args)
+	case "trust":
+		return c.trustCmd(args)
+	case "search":
+		return c.search(args)
+	}
+
+	return fmt.Errorf(usage)
+}
+
+// main is the start of day of the application.
+func main() {
+	err := _main()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
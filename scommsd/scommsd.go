@@ -0,0 +1,334 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+// scommsd runs scomms core without a user interface.  Everything core wants
+// to show to a user is logged and appended to an event journal in the scomms
+// directory and forwarded to control socket subscribers.  Public identity
+// confirmations and key changes are decided by policy.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/marcopeereboom/scomms/control"
+	"github.com/marcopeereboom/scomms/core"
+)
+
+const (
+	eventsFilename = "/scommsd.events"
+
+	policyAllow = "allow"
+	policyDeny  = "deny"
+	policyQueue = "queue"
+	policyAsk   = "ask" // ask control subscribers, queue if there are none
+)
+
+// Event is a journal entry for a UI bound message.
+type Event struct {
+	Time    time.Time   `json:"time"`
+	Type    string      `json:"type"`
+	Action  string      `json:"action,omitempty"`
+	Message interface{} `json:"message"`
+}
+
+type daemon struct {
+	*core.Core
+
+	name    string
+	address string
+	policy  string
+	control *control.Server
+
+	mtx    sync.Mutex
+	events *os.File
+}
+
+// journal appends a UI bound message to the event journal.
+func (d *daemon) journal(action string, m interface{}) {
+	e := Event{
+		Time:    time.Now(),
+		Type:    strings.TrimPrefix(fmt.Sprintf("%T", m), "*core."),
+		Action:  action,
+		Message: m,
+	}
+	j, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("journal: %v", err)
+		return
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	_, err = fmt.Fprintf(d.events, "%s\n", j)
+	if err != nil {
+		log.Printf("journal: %v", err)
+	}
+}
+
+func (d *daemon) ConfirmIdentity(m *core.UiConfirmIdentity) {
+	reply := &core.UiConfirmIdentityReply{
+		Id:      m.Id,
+		Name:    m.Name,
+		Address: m.Address,
+	}
+	if d.name != "" {
+		reply.Name = d.name
+	}
+	if d.address != "" {
+		reply.Address = d.address
+	}
+	log.Printf("creating identity %v <%v>", reply.Name, reply.Address)
+	d.journal("created", m)
+	d.SendCore(reply)
+}
+
+func (d *daemon) ConfirmPublicIdentity(m *core.UiConfirmPublicIdentity) {
+	if d.policy == policyAsk && d.control.Prompt(m, func() {
+		d.confirmPublicIdentity(m)
+	}) {
+		log.Printf("public identity %v %v: asking", m.PublicIdentity.Address,
+			m.PublicIdentity.Fingerprint())
+		d.journal("asked", m)
+		return
+	}
+	d.confirmPublicIdentity(m)
+}
+
+// confirmPublicIdentity decides by policy.
+func (d *daemon) confirmPublicIdentity(m *core.UiConfirmPublicIdentity) {
+	reply := &core.UiConfirmPublicIdentityReply{
+		Id:             m.Id,
+		PublicIdentity: m.PublicIdentity,
+	}
+	switch d.policy {
+	case policyAllow:
+		reply.State = core.StateAllowed
+	case policyDeny:
+		reply.State = core.StateDenied
+	default:
+		reply.State = core.StateQueued
+	}
+	log.Printf("public identity %v %v: %v", m.PublicIdentity.Address,
+		m.PublicIdentity.Fingerprint(), core.State[reply.State])
+	d.journal(core.State[reply.State], m)
+	d.SendCore(reply)
+}
+
+// KeyChange never takes a new key on policy alone: allow accepts it once the
+// previous key confirmed it, deny rejects it and queue leaves it for later.
+func (d *daemon) KeyChange(m *core.UiKeyChange) {
+	previous := m.Previous.PublicIdentity
+	log.Printf("key change %v: %v was %v", m.PublicIdentity.Address,
+		m.PublicIdentity.Fingerprint(), previous.Fingerprint())
+	if d.policy == policyAsk && d.control.Prompt(m, func() {
+		d.keyChange(m)
+	}) {
+		d.journal("asked", m)
+		return
+	}
+	d.keyChange(m)
+}
+
+// keyChange decides by policy.
+func (d *daemon) keyChange(m *core.UiKeyChange) {
+	reply := &core.UiKeyChangeReply{Id: m.Id}
+	action := "cancel"
+	switch d.policy {
+	case policyAllow:
+		reply.Decision = core.KeyChangeVerify
+		action = "verify"
+	case policyDeny:
+		reply.Decision = core.KeyChangeReject
+		action = "reject"
+	}
+	log.Printf("key change %v: %v", m.PublicIdentity.Address, action)
+	d.journal(action, m)
+	d.SendCore(reply)
+}
+
+func (d *daemon) RenderIdentity(m *core.UiRenderIdentity) {
+	d.control.Event(m)
+	log.Printf("identity %v <%v> %v", m.PublicIdentity.Name,
+		m.PublicIdentity.Address, m.PublicIdentity.Fingerprint())
+}
+
+func (d *daemon) Popup(m *core.UiPopup) {
+	d.control.Event(m)
+	log.Printf("%v: %v", m.Title, m.Message)
+	d.journal("", m)
+}
+
+func (d *daemon) SendProgress(m *core.UiSendProgress) {
+	d.control.Event(m)
+}
+
+func (d *daemon) SendFileResult(m *core.UiSendFileResult) {
+	d.control.Event(m)
+	if m.Error != "" {
+		log.Printf("send %v to %v failed: %v", m.Filename, m.To, m.Error)
+	}
+	d.journal("", m)
+}
+
+func (d *daemon) NewMessage(m *core.UiNewMessage) {
+	d.control.Event(m)
+	log.Printf("new message %v from %v", m.Filename, m.From)
+	d.journal("", m)
+}
+
+func (d *daemon) RenderAudit(m *core.UiRenderAudit) {
+	d.control.Event(m)
+	if m.Error != "" {
+		log.Printf("audit log: %v", m.Error)
+	}
+}
+
+func (d *daemon) RenderInbox(m *core.UiRenderInbox) {
+	d.control.Event(m)
+}
+
+func (d *daemon) InboxItem(m *core.UiInboxItem) {
+	d.control.Event(m)
+}
+
+func (d *daemon) SearchResult(m *core.UiSearchResult) {
+	d.control.Event(m)
+}
+
+func (d *daemon) RenderHistory(m *core.UiRenderHistory) {
+	d.control.Event(m)
+}
+
+func (d *daemon) RenderTrustHistory(m *core.UiRenderTrustHistory) {
+	d.control.Event(m)
+}
+
+func (d *daemon) RenderTrust(m *core.UiRenderTrust) {
+	d.control.Event(m)
+	queued := 0
+	for _, v := range m.TrustRecords {
+		if v.State == core.StateQueued {
+			queued++
+		}
+	}
+	log.Printf("trust database: %v records, %v queued",
+		len(m.TrustRecords), queued)
+}
+
+func _main() error {
+	name := flag.String("name", "", "full name used when creating the "+
+		"identity on first run")
+	address := flag.String("address", "", "address used when creating "+
+		"the identity on first run")
+	policy := flag.String("policy", policyQueue, "action on unknown public "+
+		"identities: allow, deny, queue or ask")
+	listen := flag.String("listen", ":12345", "comma separated listen "+
+		"addresses")
+	domain := flag.String("domain", "", "host all registered users of "+
+		"this domain")
+	register := flag.String("register", "", "register public identity "+
+		"file with the hosted domain and exit")
+	collect := flag.Duration("collect", 0, "collect messages from our "+
+		"domain host at this interval")
+	flag.Parse()
+
+	switch *policy {
+	case policyAllow, policyDeny, policyQueue, policyAsk:
+	default:
+		return fmt.Errorf("invalid policy %v", *policy)
+	}
+
+	c, err := core.New()
+	if err != nil {
+		return err
+	}
+	if *domain != "" {
+		err = c.HostDomain(*domain)
+		if err != nil {
+			return err
+		}
+	}
+	if *register != "" {
+		return c.RegisterHostedUser(*register)
+	}
+	var listeners []string
+	for _, v := range strings.Split(*listen, ",") {
+		if v != "" {
+			listeners = append(listeners, v)
+		}
+	}
+	c.SetListeners(listeners)
+
+	d := daemon{
+		Core:    c,
+		name:    *name,
+		address: *address,
+		policy:  *policy,
+	}
+	d.events, err = os.OpenFile(c.Dir()+eventsFilename,
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer d.events.Close()
+
+	d.control, err = control.NewServer(c, c.Dir()+control.SocketFilename)
+	if err != nil {
+		return err
+	}
+	defer d.control.Close()
+
+	c.Start()
+
+	// shutdown on signal
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-sigs
+		log.Printf("received %v, shutting down", s)
+		d.SendCore(&core.Shutdown{})
+	}()
+
+	if *collect != 0 {
+		go func() {
+			for {
+				time.Sleep(*collect)
+				d.SendCore(&core.FetchMailbox{})
+			}
+		}()
+	}
+
+	log.Printf("ready, policy %v", d.policy)
+	return c.Run(&d)
+}
+
+// main is the start of day of the application.
+func main() {
+	err := _main()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
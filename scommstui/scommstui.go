@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+// scommstui runs scomms with a terminal user interface, e.g. over ssh.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/marcopeereboom/queueb"
+	"github.com/marcopeereboom/scomms/core"
+	"github.com/nsf/termbox-go"
+)
+
+func _main() error {
+	debug := flag.Bool("d", false, "enable debug output on stderr, "+
+		"redirect it away from the terminal")
+	flag.Parse()
+
+	c, err := core.New()
+	if err != nil {
+		return err
+	}
+	if !*debug {
+		c.SetMask(0)
+	}
+	c.Start()
+
+	err = termbox.Init()
+	if err != nil {
+		return err
+	}
+	defer termbox.Close()
+
+	t := newTui(c)
+
+	// tell core we are ready to render
+	err = c.SendCore(&core.UiReady{})
+	if err != nil {
+		return err
+	}
+
+	// core and terminal events are handled on this goroutine only
+	ui := make(chan *queueb.QueuebMessage)
+	go func() {
+		for {
+			m, err := c.ReceiveUi()
+			if err != nil {
+				close(ui)
+				return
+			}
+			ui <- m
+		}
+	}()
+	keys := make(chan termbox.Event)
+	go func() {
+		for {
+			keys <- termbox.PollEvent()
+		}
+	}()
+
+	t.DebugUi("ready\n")
+	for {
+		t.draw()
+		select {
+		case m, ok := <-ui:
+			if !ok {
+				return fmt.Errorf("core went away")
+			}
+			t.DebugUi("received %T\n", m.Message)
+			if _, ok := m.Message.(*core.Exit); ok {
+				return nil
+			}
+			if !core.Dispatch(t, m.Message) {
+				t.DebugUi("unhandled message %T\n", m.Message)
+			}
+		case e := <-keys:
+			switch e.Type {
+			case termbox.EventKey:
+				t.key(e)
+			case termbox.EventError:
+				return e.Err
+			}
+		}
+	}
+}
+
+// main is the start of day of the application.
+func main() {
+	err := _main()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,1108 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/marcopeereboom/mcrypt"
+	"github.com/marcopeereboom/scomms/core"
+	"github.com/nsf/termbox-go"
+)
+
+// focusable panes, tab cycles through them in this order
+const (
+	focusTo = iota
+	focusBody
+	focusTrust
+	focusInbox
+	focusMax
+)
+
+const (
+	helpLine = "Tab next pane  ^S send  ^E expiry  ^F collect  ^A audit  " +
+		"Enter select  ^Q quit"
+	inboxHelp = "Enter open  r reply  h history  a archive  u unread  " +
+		"f flag  d delete  x show archived  / search  m export mail  " +
+		"Tab next pane"
+
+	maxView = 64 * 1024 // bytes of received content shown
+)
+
+// field is an editable line or text.
+type field struct {
+	label     string
+	value     []rune
+	multiline bool
+}
+
+// edit applies a key press to the field.
+func (f *field) edit(e termbox.Event) {
+	switch e.Key {
+	case termbox.KeyBackspace, termbox.KeyBackspace2:
+		if len(f.value) > 0 {
+			f.value = f.value[:len(f.value)-1]
+		}
+	case termbox.KeyEnter:
+		if f.multiline {
+			f.value = append(f.value, '\n')
+		}
+	case termbox.KeySpace:
+		f.value = append(f.value, ' ')
+	default:
+		if e.Ch != 0 {
+			f.value = append(f.value, e.Ch)
+		}
+	}
+}
+
+// modal is a prompt on top of the panes.  Enter submits, escape cancels and
+// keys maps shortcuts when there are no fields.  A nil cancel means the
+// prompt must be answered.
+type modal struct {
+	title  string
+	lines  []string
+	fields []*field
+	cur    int
+	off    int // scroll offset of lines
+	keys   map[rune]func()
+	help   string
+	submit func()
+	cancel func()
+}
+
+type tui struct {
+	*core.Core
+
+	identity *mcrypt.PublicIdentity
+	trust    []*core.TrustRecord
+	usage    map[string]*core.QuotaUsage // by address
+	inbox    []*core.InboxItem
+	archived bool              // show archived inbox items
+	query    string            // search shown instead of the inbox
+	results  []*core.InboxItem // of query
+	status   string
+
+	focus    int
+	to       field
+	body     field
+	expire   string // expiry of the next message, see core.ParseExpiry
+	reply    string // message id the next message answers
+	trustSel int
+	inboxSel int
+
+	modals []*modal
+}
+
+func newTui(c *core.Core) *tui {
+	t := tui{
+		Core: c,
+		to:   field{label: "To"},
+		body: field{label: "Message", multiline: true},
+	}
+	return &t
+}
+
+// shown returns the inbox items that are listed.
+func (t *tui) shown() []*core.InboxItem {
+	if t.query != "" {
+		return t.results
+	}
+	items := make([]*core.InboxItem, 0, len(t.inbox))
+	for _, item := range t.inbox {
+		if item.Archived && !t.archived {
+			continue
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func (t *tui) push(m *modal) {
+	t.modals = append(t.modals, m)
+}
+
+func (t *tui) pop() {
+	t.modals = t.modals[:len(t.modals)-1]
+}
+
+func (t *tui) RenderIdentity(m *core.UiRenderIdentity) {
+	t.identity = m.PublicIdentity
+}
+
+func (t *tui) RenderTrust(m *core.UiRenderTrust) {
+	t.trust = m.TrustRecords
+	t.usage = m.Usage
+	if t.trustSel >= len(t.trust) {
+		t.trustSel = 0
+	}
+}
+
+func (t *tui) Popup(m *core.UiPopup) {
+	t.push(&modal{
+		title:  m.Title,
+		lines:  strings.Split(m.Message, "\n"),
+		help:   "Enter ok",
+		cancel: func() {},
+	})
+}
+
+// ConfirmIdentity prompts the user to confirm address and name.
+func (t *tui) ConfirmIdentity(m *core.UiConfirmIdentity) {
+	address := &field{label: "Address", value: []rune(m.Address)}
+	name := &field{label: "Name", value: []rune(m.Name)}
+	t.push(&modal{
+		title:  "Change identity defaults",
+		lines:  strings.Split(m.Message, "\n"),
+		fields: []*field{address, name},
+		help:   "Tab next field  Enter ok",
+		submit: func() {
+			t.SendCore(&core.UiConfirmIdentityReply{
+				Id:      m.Id,
+				Address: string(address.value),
+				Name:    string(name.value),
+			})
+		},
+	})
+}
+
+// ConfirmPublicIdentity asks whether to trust a remote identity.  Core
+// always gets exactly one reply.
+func (t *tui) ConfirmPublicIdentity(m *core.UiConfirmPublicIdentity) {
+	reply := func(state int) func() {
+		return func() {
+			t.SendCore(&core.UiConfirmPublicIdentityReply{
+				Id:             m.Id,
+				PublicIdentity: m.PublicIdentity,
+				State:          state,
+			})
+		}
+	}
+	pid := m.PublicIdentity
+	t.push(&modal{
+		title: "Confirm Public Identity",
+		lines: []string{
+			"Name        " + pid.Name,
+			"Address     " + pid.Address,
+			"Fingerprint " + pid.Fingerprint(),
+		},
+		keys: map[rune]func(){
+			'a': reply(core.StateAllowed),
+			'r': reply(core.StateDenied),
+			'c': reply(core.StateInvalid),
+		},
+		help:   "a accept  r reject  c cancel",
+		cancel: reply(core.StateInvalid),
+	})
+}
+
+// KeyChange warns that a known address answered with a different key.  Core
+// always gets exactly one reply.
+func (t *tui) KeyChange(m *core.UiKeyChange) {
+	reply := func(decision int) func() {
+		return func() {
+			t.SendCore(&core.UiKeyChangeReply{
+				Id:       m.Id,
+				Decision: decision,
+			})
+		}
+	}
+	pid := m.PublicIdentity
+	previous := m.Previous.PublicIdentity
+	t.push(&modal{
+		title: "WARNING: Public Identity Changed",
+		lines: []string{
+			pid.Address + " answered with a different key.",
+			"This may be a new installation or an impersonation.",
+			"",
+			"Previous    " + previous.Fingerprint() + " (" +
+				core.State[m.Previous.State] + ")",
+			"New         " + pid.Fingerprint(),
+			"Name        " + pid.Name,
+		},
+		keys: map[rune]func(){
+			'a': reply(core.KeyChangeAccept),
+			'v': reply(core.KeyChangeVerify),
+			'r': reply(core.KeyChangeReject),
+			'c': reply(core.KeyChangeCancel),
+		},
+		help: "a accept  v accept if the previous key confirms  " +
+			"r reject  c cancel",
+		cancel: reply(core.KeyChangeCancel),
+	})
+}
+
+func (t *tui) SendProgress(m *core.UiSendProgress) {
+	t.status = fmt.Sprintf("sending to %v: %v%%", m.To, m.Sent*100/m.Total)
+}
+
+func (t *tui) SendFileResult(m *core.UiSendFileResult) {
+	if m.Error != "" {
+		t.status = fmt.Sprintf("send to %v failed: %v", m.To, m.Error)
+		return
+	}
+	t.status = "sent to " + m.To
+}
+
+func (t *tui) RenderAudit(m *core.UiRenderAudit) {
+	lines := make([]string, 0, len(m.Records)+1)
+	if m.Error != "" {
+		lines = append(lines, "VERIFICATION FAILED: "+m.Error)
+	} else {
+		lines = append(lines, "verified")
+	}
+	for _, r := range m.Records {
+		lines = append(lines, fmt.Sprintf("%v %v %v %v %v", r.Seq,
+			r.Time.Format("2006-01-02 15:04:05"), r.Event, r.Address,
+			r.Detail))
+	}
+	t.push(&modal{
+		title:  "Audit log",
+		lines:  lines,
+		help:   "Up/Down scroll  Esc close",
+		cancel: func() {},
+	})
+}
+
+func (t *tui) NewMessage(m *core.UiNewMessage) {
+	t.status = fmt.Sprintf("new message %v from %v", m.Filename, m.From)
+}
+
+func (t *tui) RenderInbox(m *core.UiRenderInbox) {
+	t.inbox = m.Items
+	if t.query != "" {
+		// results may have changed as well
+		t.SendCore(&core.InboxSearch{Query: t.query})
+	}
+}
+
+func (t *tui) SearchResult(m *core.UiSearchResult) {
+	if m.Query != t.query {
+		return
+	}
+	if m.Error != "" {
+		t.status = m.Error
+	}
+	t.results = m.Items
+}
+
+// mailExport prompts for a Maildir or mbox to export to.
+func (t *tui) mailExport() {
+	format := &field{label: "Format", value: []rune(core.MailMaildir)}
+	target := &field{label: "Target"}
+	t.push(&modal{
+		title: "Export mail",
+		lines: []string{
+			"Exports messages that were not exported to the target",
+			"before.  Format is maildir or mbox, target an absolute path.",
+		},
+		fields: []*field{format, target},
+		help:   "Tab next field  Enter export  Esc cancel",
+		submit: func() {
+			t.SendCore(&core.MailExport{
+				Format: strings.TrimSpace(string(format.value)),
+				Target: strings.TrimSpace(string(target.value)),
+			})
+			t.status = "exporting mail"
+		},
+		cancel: func() {},
+	})
+}
+
+// search prompts for a query, an empty one shows the inbox again.
+func (t *tui) search() {
+	f := &field{label: "Search", value: []rune(t.query)}
+	t.push(&modal{
+		title: "Search",
+		lines: []string{
+			"Words and from:<address> mime:<type>",
+			"after:<yyyy-mm-dd> before:<yyyy-mm-dd>.",
+			"Empty shows the inbox.",
+		},
+		fields: []*field{f},
+		help:   "Enter search  Esc cancel",
+		submit: func() {
+			t.query = strings.TrimSpace(string(f.value))
+			t.results = nil
+			t.inboxSel = 0
+			if t.query != "" {
+				t.SendCore(&core.InboxSearch{Query: t.query})
+			}
+		},
+		cancel: func() {},
+	})
+}
+
+func (t *tui) InboxItem(m *core.UiInboxItem) {
+	if m.Content != nil {
+		b := m.Content
+		if len(m.Item.Parts) != 0 {
+			r, err := core.ReadPart(m.Item.Mime, bytes.NewReader(b), 0)
+			if err == nil {
+				b, err = ioutil.ReadAll(r)
+			}
+			if err != nil {
+				t.status = err.Error()
+				return
+			}
+		}
+		t.show(m.Item, b)
+		return
+	}
+	t.view(m.Item)
+}
+
+// RenderHistory shows the conversation with a peer, replies are indented
+// below what they answer.
+func (t *tui) RenderHistory(m *core.UiRenderHistory) {
+	if m.Error != "" {
+		t.status = m.Error
+		return
+	}
+	lines := make([]string, 0)
+	for i, th := range m.Threads {
+		if i != 0 {
+			lines = append(lines, "")
+		}
+		for _, v := range th.Messages {
+			indent := strings.Repeat("  ", v.Depth)
+			dir := "<"
+			if v.Sent {
+				dir = ">"
+			}
+			lines = append(lines, fmt.Sprintf("%v%v %v %v", indent,
+				dir, v.Time.Format("01-02 15:04"), v.Filename))
+			text := strings.HasPrefix(v.Mime, "text/") ||
+				len(v.Parts) != 0
+			if !text || v.ViewOnce {
+				continue
+			}
+			f, err := t.ThreadOpen(v)
+			if err != nil {
+				lines = append(lines, indent+"  "+err.Error())
+				continue
+			}
+			b, err := ioutil.ReadAll(io.LimitReader(f, maxView))
+			f.Close()
+			if err != nil {
+				lines = append(lines, indent+"  "+err.Error())
+				continue
+			}
+			for _, l := range strings.Split(strings.TrimRight(
+				string(b), "\n"), "\n") {
+				lines = append(lines, indent+"  "+l)
+			}
+		}
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "No messages")
+	}
+	t.push(&modal{
+		title:  "History " + m.Peer,
+		lines:  lines,
+		help:   "Up/Down scroll  Esc close",
+		cancel: func() {},
+	})
+}
+
+// RenderTrustHistory shows the versions of a trust record, r reverts to one.
+func (t *tui) RenderTrustHistory(m *core.UiRenderTrustHistory) {
+	if m.Error != "" {
+		t.status = m.Error
+		return
+	}
+	lines := make([]string, 0, len(m.Versions))
+	for _, v := range m.Versions {
+		lines = append(lines, v.String())
+	}
+	revert := func() {
+		f := &field{label: "Version"}
+		t.push(&modal{
+			title:  "Revert " + m.PublicIdentity.Address,
+			lines:  []string{"Make an earlier version current again."},
+			fields: []*field{f},
+			help:   "Enter revert  Esc cancel",
+			submit: func() {
+				n, err := strconv.Atoi(strings.TrimSpace(
+					string(f.value)))
+				if err != nil {
+					t.status = "invalid version"
+					return
+				}
+				t.SendCore(&core.TrustRevert{
+					PublicIdentity: m.PublicIdentity,
+					Version:        n,
+				})
+			},
+			cancel: func() {},
+		})
+	}
+	t.push(&modal{
+		title:  "Changes " + m.PublicIdentity.Address,
+		lines:  lines,
+		keys:   map[rune]func(){'r': revert},
+		help:   "Up/Down scroll  r revert  Esc close",
+		cancel: func() {},
+	})
+}
+
+// send sends the composed message.
+func (t *tui) send() {
+	to := core.RecipientAddress(string(t.to.value))
+	if to == "" {
+		t.status = "no recipient"
+		return
+	}
+	d, once, err := core.ParseExpiry(t.expire)
+	if err != nil {
+		t.status = err.Error()
+		return
+	}
+	send := func() {
+		t.SendCore(&core.SendFile{
+			To:        to,
+			Body:      string(t.body.value),
+			Expire:    d,
+			ViewOnce:  once,
+			InReplyTo: t.reply,
+		})
+		t.body.value = nil
+		t.expire = ""
+		t.reply = ""
+		t.status = "sending to " + to
+	}
+	if core.IsContact(t.trust, to) {
+		send()
+		return
+	}
+
+	// dialing an unknown address may prompt for an unverified identity
+	t.push(&modal{
+		title: "Unknown recipient",
+		lines: []string{
+			to + " is not an allowed contact, check the address.",
+			"Sending dials it and may ask you to trust an identity",
+			"you have not verified.  Send anyway?",
+		},
+		keys:   map[rune]func(){'y': send},
+		help:   "y send  Esc cancel",
+		cancel: func() {},
+	})
+}
+
+// setExpiry prompts for the expiry of the next message.
+func (t *tui) setExpiry() {
+	f := &field{label: "Expires", value: []rune(t.expire)}
+	t.push(&modal{
+		title: "Expiry",
+		lines: []string{
+			"Recipient deletes the next message after a duration,",
+			"e.g. 12h or 7d, or once it was viewed (once).",
+			"Empty keeps it.",
+		},
+		fields: []*field{f},
+		help:   "Enter set  Esc cancel",
+		submit: func() {
+			expire := strings.TrimSpace(string(f.value))
+			_, _, err := core.ParseExpiry(expire)
+			if err != nil {
+				t.status = err.Error()
+				return
+			}
+			t.expire = expire
+			if expire == "" {
+				t.status = "next message does not expire"
+			} else {
+				t.status = "next message expires: " + expire
+			}
+		},
+		cancel: func() {},
+	})
+}
+
+// changeState mirrors the trust tab state dialog.
+func (t *tui) changeState(tr *core.TrustRecord) {
+	set := func(state int) func() {
+		return func() {
+			ntr := *tr
+			ntr.State = state
+			t.SendCore(&core.UpdateTrustRecord{TrustRecord: &ntr})
+		}
+	}
+	t.push(&modal{
+		title: "Change State",
+		lines: []string{
+			tr.PublicIdentity.Name + " <" + tr.PublicIdentity.Address + ">",
+			"Currently " + core.State[tr.State],
+		},
+		keys: map[rune]func(){
+			'a': set(core.StateAllowed),
+			'd': set(core.StateDenied),
+		},
+		help:   "a allow  d deny  Esc cancel",
+		cancel: func() {},
+	})
+}
+
+// editContact prompts for the nickname, notes and tags of a contact.
+func (t *tui) editContact(tr *core.TrustRecord) {
+	nick := &field{label: "Nickname",
+		value: []rune(tr.FreeToUse[core.Nickname])}
+	notes := &field{label: "Notes", value: []rune(tr.FreeToUse[core.Notes])}
+	tags := &field{label: "Tags",
+		value: []rune(strings.Join(core.ContactTags(tr), ","))}
+	t.push(&modal{
+		title: "Contact",
+		lines: []string{
+			tr.PublicIdentity.Name + " <" + tr.PublicIdentity.Address + ">",
+			"Tags are comma separated, e.g. ops,vendor.",
+		},
+		fields: []*field{nick, notes, tags},
+		help:   "Enter save  Esc cancel",
+		submit: func() {
+			tl, err := core.ParseTags(string(tags.value))
+			if err != nil {
+				t.status = err.Error()
+				return
+			}
+			ntr := *tr
+			ntr.FreeToUse = make(map[string]string, len(tr.FreeToUse))
+			for k, v := range tr.FreeToUse {
+				ntr.FreeToUse[k] = v
+			}
+			core.SetContact(&ntr, string(nick.value),
+				string(notes.value), tl)
+			t.SendCore(&core.UpdateTrustRecord{TrustRecord: &ntr})
+		},
+		cancel: func() {},
+	})
+}
+
+// removeTrust asks before deleting a trust record, b keeps a tombstone that
+// denies the key should it come back.
+func (t *tui) removeTrust(tr *core.TrustRecord) {
+	remove := func(forget bool) func() {
+		return func() {
+			t.SendCore(&core.TrustDelete{
+				PublicIdentity: tr.PublicIdentity,
+				Forget:         forget,
+			})
+		}
+	}
+	t.push(&modal{
+		title: "Delete",
+		lines: []string{
+			"Delete " + tr.PublicIdentity.Address + "?",
+			"Forget and block keeps denying its key should it",
+			"come back.",
+		},
+		keys: map[rune]func(){
+			'y': remove(false),
+			'b': remove(true),
+		},
+		help:   "y delete  b forget and block  Esc cancel",
+		cancel: func() {},
+	})
+}
+
+// remove asks before deleting an inbox item.
+func (t *tui) remove(item *core.InboxItem) {
+	t.push(&modal{
+		title: "Delete",
+		lines: []string{
+			"Delete " + item.Filename + " from " + item.From + "?",
+		},
+		keys: map[rune]func(){
+			'y': func() {
+				t.SendCore(&core.InboxDelete{Id: item.Id})
+			},
+		},
+		help:   "y delete  Esc cancel",
+		cancel: func() {},
+	})
+}
+
+// view shows received content, the body of multipart messages.
+func (t *tui) view(item *core.InboxItem) {
+	var (
+		f   io.ReadCloser
+		err error
+	)
+	if len(item.Parts) != 0 {
+		f, err = t.SpoolOpenPart(item.Id, 0)
+	} else {
+		f, err = t.SpoolOpen(item.Id)
+	}
+	if err != nil {
+		t.status = err.Error()
+		return
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(f, maxView))
+	if err != nil {
+		t.status = err.Error()
+		return
+	}
+	t.show(item, b)
+}
+
+// show renders content in a modal followed by the attachments, which can be
+// saved unless it is a view once message.
+func (t *tui) show(item *core.InboxItem, b []byte) {
+	if len(b) > maxView {
+		b = b[:maxView]
+	}
+	text := strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n':
+			return r
+		case r == '\t':
+			return ' '
+		case !unicode.IsPrint(r):
+			return '.'
+		}
+		return r
+	}, string(b))
+	lines := strings.Split(text, "\n")
+	help := "Up/Down scroll  Esc close"
+	var keys map[rune]func()
+	if len(item.Parts) > 1 {
+		lines = append(lines, "", "Attachments:")
+		keys = make(map[rune]func())
+		for i, p := range item.Parts[1:] {
+			n := i + 1
+			lines = append(lines, fmt.Sprintf("%v %v %v (%v)", n,
+				p.Filename, p.Mime, p.Size))
+			if item.ViewOnce || n > 9 {
+				continue
+			}
+			keys[rune('0'+n)] = func() {
+				filename, err := t.SpoolExportPart(item.Id, n)
+				if err != nil {
+					t.status = err.Error()
+					return
+				}
+				t.status = "saved " + filename
+			}
+		}
+		if !item.ViewOnce {
+			help = "1-9 save attachment  " + help
+		}
+	}
+	t.push(&modal{
+		title:  item.From + " " + item.Filename,
+		lines:  lines,
+		keys:   keys,
+		help:   help,
+		cancel: func() {},
+	})
+}
+
+// key handles a key press.
+func (t *tui) key(e termbox.Event) {
+	if len(t.modals) != 0 {
+		t.modalKey(t.modals[len(t.modals)-1], e)
+		return
+	}
+
+	switch e.Key {
+	case termbox.KeyCtrlQ:
+		t.SendCore(&core.Shutdown{})
+		return
+	case termbox.KeyTab:
+		t.focus = (t.focus + 1) % focusMax
+		return
+	case termbox.KeyCtrlF:
+		t.SendCore(&core.FetchMailbox{})
+		t.status = "collecting messages"
+		return
+	case termbox.KeyCtrlS:
+		t.send()
+		return
+	case termbox.KeyCtrlA:
+		t.SendCore(&core.AuditView{})
+		return
+	case termbox.KeyCtrlE:
+		t.setExpiry()
+		return
+	}
+
+	switch t.focus {
+	case focusTo:
+		if e.Key == termbox.KeyEnter {
+			t.focus = focusBody
+			return
+		}
+		t.to.edit(e)
+	case focusBody:
+		t.body.edit(e)
+	case focusTrust:
+		t.trustSel = move(t.trustSel, len(t.trust), e)
+		if len(t.trust) == 0 {
+			return
+		}
+		switch {
+		case e.Key == termbox.KeyEnter:
+			t.changeState(t.trust[t.trustSel])
+		case e.Ch == 'h':
+			t.SendCore(&core.HistoryView{
+				Peer: t.trust[t.trustSel].PublicIdentity.Address,
+			})
+		case e.Ch == 'e':
+			t.editContact(t.trust[t.trustSel])
+		case e.Ch == 'd':
+			t.removeTrust(t.trust[t.trustSel])
+		case e.Ch == 'v':
+			t.SendCore(&core.TrustHistoryView{
+				PublicIdentity: t.trust[t.trustSel].PublicIdentity,
+			})
+		}
+	case focusInbox:
+		switch e.Ch {
+		case 'x':
+			t.archived = !t.archived
+		case '/':
+			t.search()
+			return
+		case 'm':
+			t.mailExport()
+			return
+		}
+		items := t.shown()
+		t.inboxSel = move(t.inboxSel, len(items), e)
+		if len(items) == 0 {
+			return
+		}
+		item := items[t.inboxSel]
+		switch {
+		case e.Key == termbox.KeyEnter:
+			t.SendCore(&core.InboxOpen{Id: item.Id})
+		case e.Ch == 'a':
+			t.SendCore(&core.InboxMark{Id: item.Id, Read: item.Read,
+				Archived: !item.Archived, Flagged: item.Flagged})
+		case e.Ch == 'u':
+			t.SendCore(&core.InboxMark{Id: item.Id, Read: !item.Read,
+				Archived: item.Archived, Flagged: item.Flagged})
+		case e.Ch == 'f':
+			t.SendCore(&core.InboxMark{Id: item.Id, Read: item.Read,
+				Archived: item.Archived, Flagged: !item.Flagged})
+		case e.Ch == 'd':
+			t.remove(item)
+		case e.Ch == 'r':
+			t.to.value = []rune(item.From)
+			t.reply = item.MessageId
+			t.focus = focusBody
+			t.status = "replying to " + item.Filename
+		case e.Ch == 'h':
+			t.SendCore(&core.HistoryView{Peer: item.From})
+		}
+	}
+}
+
+// move returns the list selection after a key press.
+func move(sel, n int, e termbox.Event) int {
+	switch e.Key {
+	case termbox.KeyArrowUp:
+		sel--
+	case termbox.KeyArrowDown:
+		sel++
+	}
+	if sel >= n {
+		sel = n - 1
+	}
+	if sel < 0 {
+		sel = 0
+	}
+	return sel
+}
+
+func (t *tui) modalKey(m *modal, e termbox.Event) {
+	switch e.Key {
+	case termbox.KeyEsc:
+		if m.cancel != nil {
+			t.pop()
+			m.cancel()
+		}
+		return
+	case termbox.KeyEnter:
+		if m.submit != nil {
+			t.pop()
+			m.submit()
+		} else if m.keys == nil {
+			t.pop()
+		}
+		return
+	case termbox.KeyTab:
+		if len(m.fields) != 0 {
+			m.cur = (m.cur + 1) % len(m.fields)
+		}
+		return
+	case termbox.KeyArrowUp:
+		if m.off > 0 {
+			m.off--
+		}
+		return
+	case termbox.KeyArrowDown:
+		if m.off < len(m.lines)-1 {
+			m.off++
+		}
+		return
+	}
+
+	if len(m.fields) != 0 {
+		m.fields[m.cur].edit(e)
+		return
+	}
+	if f, ok := m.keys[e.Ch]; ok {
+		t.pop()
+		f()
+	}
+}
+
+// text writes s at x, y clipped to width cells and returns the x after it.
+func text(x, y, width int, fg, bg termbox.Attribute, s string) int {
+	end := x + width
+	for _, r := range s {
+		if x >= end {
+			break
+		}
+		termbox.SetCell(x, y, r, fg, bg)
+		x++
+	}
+	return x
+}
+
+// fill clears a rectangle.
+func fill(x, y, w, h int, bg termbox.Attribute) {
+	for j := y; j < y+h; j++ {
+		for i := x; i < x+w; i++ {
+			termbox.SetCell(i, j, ' ', termbox.ColorDefault, bg)
+		}
+	}
+}
+
+func (t *tui) header(x, y, width int, title string, focus bool) {
+	attr := termbox.ColorDefault | termbox.AttrBold
+	if focus {
+		attr |= termbox.AttrReverse
+	}
+	text(x, y, width, attr, termbox.ColorDefault, title)
+}
+
+// list draws items with the selection kept in view.
+func list(x, y, width, height, sel int, items []string, focus bool) {
+	start := 0
+	if sel >= height {
+		start = sel - height + 1
+	}
+	for i := start; i < len(items) && i-start < height; i++ {
+		fg := termbox.ColorDefault
+		if focus && i == sel {
+			fg |= termbox.AttrReverse
+		}
+		text(x, y+i-start, width, fg, termbox.ColorDefault, items[i])
+	}
+}
+
+func (t *tui) draw() {
+	termbox.Clear(termbox.ColorDefault, termbox.ColorDefault)
+	termbox.HideCursor()
+	w, h := termbox.Size()
+	if w < 20 || h < 8 {
+		termbox.Flush()
+		return
+	}
+
+	// identity
+	id := "no identity"
+	if t.identity != nil {
+		id = fmt.Sprintf("%v <%v> %v", t.identity.Name,
+			t.identity.Address, t.identity.Fingerprint())
+	}
+	fill(0, 0, w, 1, termbox.ColorBlue)
+	text(0, 0, w, termbox.ColorWhite|termbox.AttrBold, termbox.ColorBlue,
+		"scomms "+id)
+
+	lw := w / 2
+	mid := 1 + (h-2)/2
+
+	// trust
+	t.header(0, 1, lw-1, "Trust", t.focus == focusTrust)
+	items := make([]string, 0, len(t.trust))
+	for _, tr := range t.trust {
+		name := tr.PublicIdentity.Name
+		if nick := tr.FreeToUse[core.Nickname]; nick != "" {
+			name += " (" + nick + ")"
+		}
+		if tags := core.ContactTags(tr); len(tags) != 0 {
+			name += " [" + strings.Join(tags, ",") + "]"
+		}
+		if _, ok := tr.FreeToUse[core.ReplacedBy]; ok {
+			name += " (replaced)"
+		}
+		if _, ok := tr.FreeToUse[core.Tombstone]; ok {
+			name = "(forgotten)"
+		}
+		items = append(items, fmt.Sprintf("%-8v %v <%v> %v",
+			core.State[tr.State], name, tr.PublicIdentity.Address,
+			t.usage[tr.PublicIdentity.Address]))
+	}
+	list(0, 2, lw-1, mid-2, t.trustSel, items, t.focus == focusTrust)
+
+	// inbox
+	title := "Inbox"
+	if t.query != "" {
+		title = "Search: " + t.query
+	} else if t.archived {
+		title = "Inbox (all)"
+	}
+	t.header(0, mid, lw-1, title, t.focus == focusInbox)
+	shown := t.shown()
+	items = make([]string, 0, len(shown))
+	for _, item := range shown {
+		flag := " "
+		if !item.Read {
+			flag = "*"
+		} else if item.Archived {
+			flag = "a"
+		}
+		if item.Flagged {
+			flag += "!"
+		} else {
+			flag += " "
+		}
+		if item.ViewOnce {
+			flag += "1"
+		} else if !item.Expires.IsZero() {
+			flag += "e"
+		} else {
+			flag += " "
+		}
+		name := item.Filename
+		if len(item.Parts) > 1 {
+			name += fmt.Sprintf(" +%v", len(item.Parts)-1)
+		}
+		items = append(items, fmt.Sprintf("%v %v %v %v (%v)", flag,
+			item.Received.Format("01-02 15:04"), item.From, name,
+			item.Size))
+	}
+	list(0, mid+1, lw-1, h-2-mid, t.inboxSel, items, t.focus == focusInbox)
+
+	// compose
+	for y := 1; y < h-1; y++ {
+		termbox.SetCell(lw-1, y, '|', termbox.ColorDefault,
+			termbox.ColorDefault)
+	}
+	t.header(lw, 1, 4, "To:", t.focus == focusTo)
+	x := text(lw+4, 1, w-lw-4, termbox.ColorDefault, termbox.ColorDefault,
+		string(t.to.value))
+	if t.focus == focusTo {
+		termbox.SetCursor(x, 1)
+	}
+	title = "Message"
+	if t.reply != "" {
+		title += " (reply)"
+	}
+	t.header(lw, 2, w-lw, title, t.focus == focusBody)
+	lines := strings.Split(string(t.body.value), "\n")
+	height := h - 4
+	start := 0
+	if len(lines) > height {
+		start = len(lines) - height
+	}
+	for i := start; i < len(lines); i++ {
+		x = text(lw, 3+i-start, w-lw, termbox.ColorDefault,
+			termbox.ColorDefault, lines[i])
+		if t.focus == focusBody && i == len(lines)-1 {
+			termbox.SetCursor(x, 3+i-start)
+		}
+	}
+
+	// status
+	help := helpLine
+	if t.focus == focusInbox {
+		help = inboxHelp
+	}
+	status := help
+	if t.status != "" {
+		status = t.status + "  |  " + help
+	}
+	text(0, h-1, w, termbox.AttrReverse, termbox.ColorDefault, status)
+
+	if len(t.modals) != 0 {
+		t.drawModal(t.modals[len(t.modals)-1], w, h)
+	}
+
+	termbox.Flush()
+}
+
+func (t *tui) drawModal(m *modal, w, h int) {
+	mw := w - 4
+	if mw > 76 {
+		mw = 76
+	}
+	mh := len(m.lines) + len(m.fields) + 4
+	if mh > h-2 {
+		mh = h - 2
+	}
+	x := (w - mw) / 2
+	y := (h - mh) / 2
+
+	fill(x, y, mw, mh, termbox.ColorDefault)
+	for i := x; i < x+mw; i++ {
+		termbox.SetCell(i, y, '-', termbox.ColorDefault, termbox.ColorDefault)
+		termbox.SetCell(i, y+mh-1, '-', termbox.ColorDefault,
+			termbox.ColorDefault)
+	}
+	for j := y; j < y+mh; j++ {
+		termbox.SetCell(x, j, '|', termbox.ColorDefault, termbox.ColorDefault)
+		termbox.SetCell(x+mw-1, j, '|', termbox.ColorDefault,
+			termbox.ColorDefault)
+	}
+	text(x+2, y, mw-4, termbox.AttrBold, termbox.ColorDefault,
+		" "+m.title+" ")
+	text(x+2, y+mh-1, mw-4, termbox.ColorDefault, termbox.ColorDefault,
+		" "+m.help+" ")
+
+	// fields stay visible, lines get what is left
+	room := mh - 3 - len(m.fields)
+	row := y + 1
+	for i := m.off; i < len(m.lines) && row < y+1+room; i++ {
+		text(x+2, row, mw-4, termbox.ColorDefault, termbox.ColorDefault,
+			m.lines[i])
+		row++
+	}
+	row = y + 1 + room
+	for i, f := range m.fields {
+		attr := termbox.ColorDefault
+		if i == m.cur {
+			attr |= termbox.AttrBold
+		}
+		cx := text(x+2, row, mw-4, attr, termbox.ColorDefault,
+			f.label+": "+string(f.value))
+		if i == m.cur {
+			termbox.SetCursor(cx, row)
+		}
+		row++
+	}
+}
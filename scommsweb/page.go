@@ -0,0 +1,521 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+// page is the entire browser user interface.  It mirrors the GTK tabs.
+const page = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>scomms</title>
+<style>
+body { font-family: sans-serif; margin: 0; }
+nav { background: #ddd; }
+nav button { border: 0; padding: 0.6em 1.2em; background: none; }
+nav button.active { background: #fff; }
+section { padding: 1em; display: none; }
+section.active { display: block; }
+table { border-collapse: collapse; width: 100%; }
+td, th { text-align: left; padding: 0.3em; }
+textarea { width: 100%; height: 20em; }
+tr.unread td { font-weight: bold; }
+tr.flagged td:first-child::before { content: "! "; }
+.dialog { position: fixed; top: 10%; left: 20%; right: 20%; padding: 1em;
+	background: #fff; border: 1px solid #888; box-shadow: 0 0 1em #888; }
+.dialog.warning { border: 3px solid #c00; }
+.dialog.warning h3 { color: #c00; }
+</style>
+</head>
+<body>
+<nav>
+<button data-tab="overview" class="active">Overview</button>
+<button data-tab="inbox">Inbox</button>
+<button data-tab="message">Message</button>
+<button data-tab="trust">Trust</button>
+<button data-tab="audit">Audit</button>
+</nav>
+
+<section id="overview" class="active">
+<table>
+<tr><th>Name</th><td id="name"></td></tr>
+<tr><th>Address</th><td id="address"></td></tr>
+<tr><th>Fingerprint</th><td id="fingerprint"></td></tr>
+</table>
+<p><button id="collect">Collect messages</button></p>
+</section>
+
+<section id="inbox">
+<p><label><input type="checkbox" id="showArchived"> Show archived</label>
+<input id="query" size="40" placeholder="words from: mime: after: before:">
+<button id="search">Search</button> <button id="clearSearch">Clear</button></p>
+<p>Export new messages to <select id="mailFormat">
+<option value="maildir">Maildir</option>
+<option value="mbox">mbox</option>
+</select> <input id="mailTarget" size="40" placeholder="/absolute/path">
+<button id="mailExport">Export</button></p>
+<table>
+<thead><tr><th>Received</th><th>From</th><th>Name</th><th>Mime</th><th>Size</th><th>Expires</th><th></th></tr></thead>
+<tbody id="inboxItems"></tbody>
+</table>
+</section>
+
+<section id="message">
+<p>To identity <input id="to" size="40">
+Expires <select id="expire">
+<option value="">never</option>
+<option value="once">once viewed</option>
+<option value="1h">after an hour</option>
+<option value="1d">after a day</option>
+<option value="7d">after a week</option>
+</select>
+<button id="send">Send</button> <span id="replying"></span>
+<progress id="progress" max="100" value="0"></progress></p>
+<textarea id="text"></textarea>
+</section>
+
+<section id="trust">
+<table>
+<thead><tr><th>State</th><th>Name</th><th>Address</th><th>Fingerprint</th><th>Storage used</th><th></th></tr></thead>
+<tbody id="trustRecords"></tbody>
+</table>
+<p id="trustTotal"></p>
+</section>
+
+<section id="audit">
+<p><button id="verify">Verify audit log</button> <span id="auditStatus"></span></p>
+<table>
+<thead><tr><th>#</th><th>Time</th><th>Event</th><th>Address</th><th>Detail</th></tr></thead>
+<tbody id="auditRecords"></tbody>
+</table>
+</section>
+
+<div id="dialogs"></div>
+
+<script>
+"use strict";
+var token = new URLSearchParams(location.search).get("token");
+var states = {0: "Invalid", 1: "Queued", 2: "Denied", 100: "Allowed"};
+var ws;
+
+function $(id) { return document.getElementById(id); }
+
+function el(tag, text) {
+	var e = document.createElement(tag);
+	if (text !== undefined) e.textContent = text;
+	return e;
+}
+
+function send(type, message) {
+	ws.send(JSON.stringify({Type: type, Message: message || {}}));
+}
+
+function dialog(id, title, rows, buttons) {
+	var d = el("div");
+	d.className = "dialog";
+	d.id = id;
+	d.appendChild(el("h3", title));
+	var t = el("table");
+	rows.forEach(function(r) {
+		var tr = el("tr");
+		tr.appendChild(el("th", r[0]));
+		var td = el("td");
+		if (typeof r[1] === "string") td.textContent = r[1];
+		else td.appendChild(r[1]);
+		tr.appendChild(td);
+		t.appendChild(tr);
+	});
+	d.appendChild(t);
+	buttons.forEach(function(b) {
+		var e = el("button", b[0]);
+		e.onclick = function() { b[1](); d.remove(); };
+		d.appendChild(e);
+	});
+	$("dialogs").appendChild(d);
+}
+
+var handlers = {
+	UiRenderIdentity: function(m, o) {
+		$("name").textContent = m.PublicIdentity.Name;
+		$("address").textContent = m.PublicIdentity.Address;
+		$("fingerprint").textContent = o.Fingerprint;
+	},
+	UiPopup: function(m) {
+		dialog("", m.Title || "scomms", [["", m.Message]],
+			[["OK", function() {}]]);
+	},
+	UiConfirmIdentity: function(m) {
+		if ($("prompt-" + m.Id)) return;
+		var name = el("input"), address = el("input");
+		name.value = m.Name;
+		address.value = m.Address;
+		dialog("prompt-" + m.Id, "Change identity defaults",
+			[["", m.Message], ["Address", address], ["Name", name]],
+			[["OK", function() {
+				send("UiConfirmIdentityReply",
+					{Id: m.Id, Name: name.value,
+					 Address: address.value});
+			}]]);
+	},
+	UiConfirmPublicIdentity: function(m, o) {
+		var fp = o.Fingerprint;
+		if ($("prompt-" + m.Id)) return;
+		var reply = function(state) {
+			return function() {
+				send("UiConfirmPublicIdentityReply",
+					{Id: m.Id, State: state});
+			};
+		};
+		dialog("prompt-" + m.Id, "Confirm Public Identity",
+			[["Name", m.PublicIdentity.Name],
+			 ["Address", m.PublicIdentity.Address],
+			 ["Fingerprint", fp]],
+			[["Accept", reply(100)], ["Reject", reply(2)],
+			 ["Cancel", reply(0)]]);
+	},
+	UiKeyChange: function(m, o) {
+		if ($("prompt-" + m.Id)) return;
+		var reply = function(decision) {
+			return function() {
+				send("UiKeyChangeReply",
+					{Id: m.Id, Decision: decision});
+			};
+		};
+		dialog("prompt-" + m.Id, "WARNING: Public Identity Changed",
+			[["Address", m.PublicIdentity.Address + " answered " +
+			  "with a different key. This may be a new " +
+			  "installation or an impersonation."],
+			 ["Previous", o.Fingerprints[0] + " (" +
+			  (states[m.Previous.State] || m.Previous.State) + ")"],
+			 ["New", o.Fingerprint],
+			 ["Name", m.PublicIdentity.Name]],
+			[["Accept", reply(1)],
+			 ["Accept if the previous key confirms", reply(2)],
+			 ["Reject", reply(3)], ["Cancel", reply(0)]]);
+		$("prompt-" + m.Id).className += " warning";
+	},
+	UiRenderTrust: function(m, o) {
+		var tb = $("trustRecords");
+		tb.textContent = "";
+		(m.TrustRecords || []).forEach(function(tr, i) {
+			var fp = o.Fingerprints[i];
+			var row = el("tr"), td = el("td");
+			var b = el("button", states[tr.State] || tr.State);
+			b.onclick = function() {
+				var next = tr.State === 100 ? 2 : 100;
+				if (confirm("Change state to " + states[next] + "?"))
+					send("UpdateTrustRecord",
+						{Fingerprint: fp, State: next});
+			};
+			td.appendChild(b);
+			row.appendChild(td);
+			row.appendChild(el("td", tr.PublicIdentity.Name));
+			row.appendChild(el("td", tr.PublicIdentity.Address));
+			row.appendChild(el("td", fp));
+			row.appendChild(el("td",
+				usage((m.Usage || {})[tr.PublicIdentity.Address])));
+			td = el("td");
+			td.appendChild(button("History", function() {
+				send("HistoryView", {Peer: tr.PublicIdentity.Address});
+			}));
+			td.appendChild(button("Changes", function() {
+				send("TrustHistoryView", {Fingerprint: fp});
+			}));
+			td.appendChild(button("Delete", function() {
+				var a = tr.PublicIdentity.Address;
+				dialog("delete-" + fp, "Delete " + a,
+					[["Forget and block", "keeps denying the " +
+					  "key should it come back"]],
+					[["Delete", function() {
+						send("TrustDelete", {Fingerprint: fp});
+					 }],
+					 ["Forget and block", function() {
+						send("TrustDelete",
+							{Fingerprint: fp, Forget: true});
+					 }],
+					 ["Cancel", function() {}]]);
+			}));
+			row.appendChild(td);
+			tb.appendChild(row);
+		});
+		$("trustTotal").textContent = m.Total ?
+			"Total storage used: " + usage(m.Total) : "";
+	},
+	UiRenderTrustHistory: function(m, o) {
+		if (m.Error) {
+			alert(m.Error);
+			return;
+		}
+		var fp = o.Fingerprint, id = "changes-" + fp;
+		var old = $(id);
+		if (old) old.remove();
+		dialog(id, "Changes " + m.PublicIdentity.Address,
+			(m.Versions || []).map(function(v) {
+				var tr = v.Record, d = el("span",
+					(states[tr.State] || tr.State) + " " +
+					tr.PublicIdentity.Name + " <" +
+					tr.PublicIdentity.Address + "> " +
+					JSON.stringify(tr.FreeToUse || {}) + " ");
+				d.appendChild(button("Revert", function() {
+					send("TrustRevert",
+						{Fingerprint: fp, Version: v.Version});
+					$(id).remove();
+				}));
+				return [v.Version + " " + new Date(v.Time).
+					toLocaleString(), d];
+			}),
+			[["Close", function() {}]]);
+	},
+	UiSendProgress: function(m) {
+		$("progress").value = 100 * m.Sent / m.Total;
+	},
+	UiSendFileResult: function(m) {
+		$("progress").value = 0;
+		if (m.Error) return;
+		$("text").value = "";
+		reply(null);
+	},
+	UiRenderHistory: function(m) {
+		if (m.Error) {
+			dialog("", "History failed", [["", m.Error]],
+				[["OK", function() {}]]);
+			return;
+		}
+		var rows = [];
+		(m.Threads || []).forEach(function(t) {
+			t.Messages.forEach(function(v) {
+				var d = el("div");
+				d.style.paddingLeft = (2 * v.Depth) + "em";
+				d.appendChild(historyLink(v));
+				rows.push([(v.Sent ? "to " : "from ") +
+					new Date(v.Time).toLocaleString(), d]);
+			});
+		});
+		if (!rows.length) rows.push(["", "No messages"]);
+		dialog("", "History " + m.Peer, rows, [["OK", function() {}]]);
+	},
+	UiRenderInbox: function(m) {
+		inbox = m.Items || [];
+		if (query) send("InboxSearch", {Query: query});
+		renderInbox();
+	},
+	UiSearchResult: function(m) {
+		if (m.Query !== query) return;
+		if (m.Error) dialog("", "Search failed", [["", m.Error]],
+			[["OK", function() {}]]);
+		results = m.Items || [];
+		renderInbox();
+	},
+	UiInboxItem: function(m) {
+		if (!m.Content) return; // downloaded from /spool
+		var b = Uint8Array.from(atob(m.Content),
+			function(c) { return c.charCodeAt(0); });
+		var pre = el("pre", body(m.Item, new TextDecoder().decode(b)));
+		var lines = [["", pre]];
+		(m.Item.Parts || []).slice(1).forEach(function(p) {
+			lines.push(["Attachment", p.filename + " (" + p.size + ")"]);
+		});
+		lines.push(["", "It was deleted and can not be opened again."]);
+		dialog("", m.Item.From + " " + m.Item.Filename, lines,
+			[["OK", function() {}]]);
+	},
+	UiRenderAudit: function(m) {
+		$("auditStatus").textContent = m.Error ?
+			"FAILED: " + m.Error : "verified";
+		var tb = $("auditRecords");
+		tb.textContent = "";
+		(m.Records || []).forEach(function(r) {
+			var row = el("tr");
+			[r.Seq, r.Time, r.Event, r.Address, r.Detail].forEach(
+				function(v) { row.appendChild(el("td", v || "")); });
+			tb.appendChild(row);
+		});
+	},
+	Done: function(m) {
+		var d = $("prompt-" + m.Id);
+		if (d) d.remove();
+	}
+};
+
+var inbox = [];
+var query = "", results = null; // search shown instead of the inbox
+var replyTo = ""; // message id the next message answers
+
+function bytes(n) {
+	var units = ["B", "KiB", "MiB", "GiB", "TiB"], i = 0;
+	while (n >= 1024 && i < units.length - 1) {
+		n /= 1024;
+		i++;
+	}
+	return (i ? n.toFixed(1) : n) + " " + units[i];
+}
+
+function usage(u) {
+	if (!u) return "";
+	var s = bytes(u.Bytes);
+	if (u.MaxBytes) s += " of " + bytes(u.MaxBytes);
+	s += ", " + u.Messages;
+	if (u.MaxMessages) s += " of " + u.MaxMessages;
+	return s + " messages";
+}
+
+function button(label, f) {
+	var b = el("button", label);
+	b.onclick = f;
+	return b;
+}
+
+function expires(item) {
+	if (item.ViewOnce) return "once viewed";
+	var t = new Date(item.Expires);
+	return t.getFullYear() > 1 ? t.toLocaleString() : "";
+}
+
+// body returns the first part of multipart content, parts are not transfer
+// encoded.
+function body(item, text) {
+	var m = /boundary="?([^";]+)"?/.exec(item.Mime);
+	if (!item.Parts || !m) return text;
+	var p = text.split("--" + m[1])[1] || "";
+	var i = p.indexOf("\r\n\r\n");
+	return i < 0 ? "" : p.slice(i + 4, p.length - 2);
+}
+
+function spoolLink(item, part, name) {
+	var a = el("a", name);
+	a.href = "/spool?token=" + encodeURIComponent(token) +
+		"&id=" + encodeURIComponent(item.Id) +
+		(part === undefined ? "" : "&part=" + part);
+	a.onclick = function() {
+		send("InboxOpen", {Id: item.Id});
+	};
+	return a;
+}
+
+// historyLink opens the text of a message in a thread.
+function historyLink(v) {
+	if (v.ViewOnce) return el("span", v.Filename + " (view once)");
+	if (!v.Sent) return spoolLink(v, v.Parts ? 0 : undefined, v.Filename);
+	var a = el("a", v.Filename);
+	a.href = "/spool?token=" + encodeURIComponent(token) +
+		"&sent=1&id=" + encodeURIComponent(v.Id);
+	return a;
+}
+
+function reply(item) {
+	replyTo = item ? item.MessageId || "" : "";
+	$("replying").textContent = item ? "in reply to " + item.Filename : "";
+	if (item) $("to").value = item.From;
+}
+
+function renderInbox() {
+	var tb = $("inboxItems"), archived = $("showArchived").checked;
+	tb.textContent = "";
+	(results || inbox).forEach(function(item) {
+		if (item.Archived && !archived && !results) return;
+		var row = el("tr"), td = el("td");
+		if (!item.Read) row.classList.add("unread");
+		if (item.Flagged) row.classList.add("flagged");
+		if (item.ViewOnce) {
+			// content arrives as UiInboxItem and is gone after that
+			td.appendChild(button("Open once " + item.Filename,
+				function() { send("InboxOpen", {Id: item.Id}); }));
+		} else if (item.Parts) {
+			td.appendChild(spoolLink(item, 0, item.Filename));
+			item.Parts.slice(1).forEach(function(p, i) {
+				td.appendChild(document.createTextNode(" "));
+				td.appendChild(spoolLink(item, i + 1, p.filename));
+			});
+		} else {
+			td.appendChild(spoolLink(item, undefined, item.Filename));
+		}
+		row.appendChild(el("td", new Date(item.Received).toLocaleString()));
+		row.appendChild(el("td", item.From));
+		row.appendChild(td);
+		row.appendChild(el("td", item.Mime));
+		row.appendChild(el("td", item.Size));
+		row.appendChild(el("td", expires(item)));
+		var actions = el("td");
+		actions.appendChild(button(item.Read ? "Unread" : "Read",
+			function() {
+				send("InboxMark", {Id: item.Id, Read: !item.Read,
+					Archived: item.Archived, Flagged: item.Flagged});
+			}));
+		actions.appendChild(button(item.Archived ? "Unarchive" : "Archive",
+			function() {
+				send("InboxMark", {Id: item.Id, Read: item.Read,
+					Archived: !item.Archived, Flagged: item.Flagged});
+			}));
+		actions.appendChild(button(item.Flagged ? "Unflag" : "Flag",
+			function() {
+				send("InboxMark", {Id: item.Id, Read: item.Read,
+					Archived: item.Archived, Flagged: !item.Flagged});
+			}));
+		actions.appendChild(button("Reply", function() { reply(item); }));
+		actions.appendChild(button("Delete", function() {
+			if (confirm("Delete " + item.Filename + "?"))
+				send("InboxDelete", {Id: item.Id});
+		}));
+		row.appendChild(actions);
+		tb.appendChild(row);
+	});
+}
+
+function connect() {
+	ws = new WebSocket("ws://" + location.host + "/ws?token=" +
+		encodeURIComponent(token));
+	ws.onmessage = function(e) {
+		var m = JSON.parse(e.data);
+		if (handlers[m.Type]) handlers[m.Type](m.Message, m);
+	};
+	ws.onclose = function() { setTimeout(connect, 1000); };
+}
+
+document.querySelectorAll("nav button").forEach(function(b) {
+	b.onclick = function() {
+		document.querySelectorAll(".active").forEach(function(e) {
+			e.classList.remove("active");
+		});
+		b.classList.add("active");
+		$(b.dataset.tab).classList.add("active");
+	};
+});
+$("showArchived").onchange = renderInbox;
+$("search").onclick = function() {
+	query = $("query").value.trim();
+	results = null;
+	if (query) send("InboxSearch", {Query: query});
+	renderInbox();
+};
+$("mailExport").onclick = function() {
+	send("MailExport", {Format: $("mailFormat").value,
+		Target: $("mailTarget").value});
+};
+$("clearSearch").onclick = function() {
+	$("query").value = "";
+	$("search").onclick();
+};
+$("verify").onclick = function() { send("AuditView"); };
+$("collect").onclick = function() { send("FetchMailbox"); };
+$("send").onclick = function() {
+	send("Message", {To: $("to").value, Text: $("text").value,
+		Expire: $("expire").value, InReplyTo: replyTo});
+};
+connect();
+</script>
+</body>
+</html>
+`
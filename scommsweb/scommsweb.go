@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+// scommsweb runs scomms with a user interface in the browser.  The page is
+// served on the loopback interface and protected by a random session token
+// that is printed on start.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/marcopeereboom/scomms/core"
+)
+
+func _main() error {
+	listen := flag.String("listen", "127.0.0.1:12346", "address the web "+
+		"interface listens on")
+	remote := flag.Bool("remote", false, "allow listening on non loopback "+
+		"addresses; anyone with the token controls scomms")
+	domain := flag.String("domain", "", "host all registered users of "+
+		"this domain")
+	flag.Parse()
+
+	c, err := core.New()
+	if err != nil {
+		return err
+	}
+	if *domain != "" {
+		err = c.HostDomain(*domain)
+		if err != nil {
+			return err
+		}
+	}
+
+	w, err := newWeb(c, *listen, *remote)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	c.Start()
+
+	// shutdown on signal
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		c.SendCore(&core.Shutdown{})
+	}()
+
+	fmt.Printf("open %v\n", w.URL())
+	return c.Run(w)
+}
+
+// main is the start of day of the application.
+func main() {
+	err := _main()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
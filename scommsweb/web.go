@@ -0,0 +1,636 @@
+/*
+ * Copyright (c) 2014 Marco Peereboom <marco@peereboom.us>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/marcopeereboom/scomms/core"
+)
+
+// Browser protocol
+//
+// Everything is a JSON object {"Type":"...","Message":{...}} on the
+// websocket.  Core to UI messages are forwarded as is and named after their
+// type, e.g. UiPopup.  The browser sends:
+//
+//	Message				{To, Text, Expire, InReplyTo}
+//	FetchMailbox			{}
+//	AuditView			{}
+//	InboxOpen			{Id}
+//	InboxMark			{Id, Read, Archived, Flagged}
+//	InboxDelete			{Id}
+//	InboxSearch			{Query}
+//	MailExport			{Format, Target}
+//	HistoryView			{Peer}
+//	UpdateTrustRecord		{Fingerprint, State}
+//	TrustDelete			{Fingerprint, Forget}
+//	TrustHistoryView		{Fingerprint}
+//	TrustRevert			{Fingerprint, Version}
+//	UiConfirmIdentityReply		{Id, Name, Address}
+//	UiConfirmPublicIdentityReply	{Id, State}
+//	UiKeyChangeReply		{Id, Decision}
+//
+// Once a prompt is answered all browsers are sent Done {Id}.  The browser
+// only refers to identities by fingerprint or prompt id; they are looked up
+// in what core told us so a page can not inject identities.  Expire is
+// parsed with core.ParseExpiry.  View once content is not downloadable, it is
+// only sent as UiInboxItem {Item, Content} when opened.  /spool?sent=1
+// downloads the text of a message we sent, see UiRenderHistory.  UiKeyChange
+// carries the new fingerprint in Fingerprint and the previous one in
+// Fingerprints.
+
+// Envelope is a message on the websocket.
+type Envelope struct {
+	Type    string
+	Message json.RawMessage
+}
+
+// outgoing carries computed fingerprints next to identities since they are
+// not part of their JSON encoding.
+type outgoing struct {
+	Type         string
+	Message      interface{}
+	Fingerprint  string   `json:",omitempty"`
+	Fingerprints []string `json:",omitempty"` // per trust record
+}
+
+type webMessage struct {
+	To        string
+	Text      string
+	Expire    string
+	InReplyTo string
+}
+
+type webState struct {
+	Id          core.PromptId
+	Fingerprint string
+	State       int
+}
+
+type webDelete struct {
+	Fingerprint string
+	Forget      bool
+}
+
+type webRevert struct {
+	Fingerprint string
+	Version     int
+}
+
+type webKeyChange struct {
+	Id       core.PromptId
+	Decision int
+}
+
+type webIdentity struct {
+	Id      core.PromptId
+	Name    string
+	Address string
+}
+
+// typeName returns the name m is known by on the websocket.
+func typeName(m interface{}) string {
+	if _, ok := m.(*webDone); ok {
+		return "Done"
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", m), "*core.")
+}
+
+type wsConn struct {
+	*websocket.Conn
+	mtx sync.Mutex
+}
+
+func (w *wsConn) write(m interface{}) error {
+	o := outgoing{
+		Type:    typeName(m),
+		Message: m,
+	}
+	switch msg := m.(type) {
+	case *core.UiRenderIdentity:
+		o.Fingerprint = msg.PublicIdentity.Fingerprint()
+	case *core.UiConfirmPublicIdentity:
+		o.Fingerprint = msg.PublicIdentity.Fingerprint()
+	case *core.UiRenderTrustHistory:
+		o.Fingerprint = msg.PublicIdentity.Fingerprint()
+	case *core.UiKeyChange:
+		o.Fingerprint = msg.PublicIdentity.Fingerprint()
+		o.Fingerprints = []string{
+			msg.Previous.PublicIdentity.Fingerprint(),
+		}
+	case *core.UiRenderTrust:
+		for _, v := range msg.TrustRecords {
+			o.Fingerprints = append(o.Fingerprints,
+				v.PublicIdentity.Fingerprint())
+		}
+	}
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.WriteJSON(&o)
+}
+
+type web struct {
+	c     *core.Core
+	token string
+	l     net.Listener
+
+	mtx      sync.Mutex
+	conns    map[*wsConn]struct{}
+	identity *core.UiRenderIdentity
+	trust    *core.UiRenderTrust
+	inbox    *core.UiRenderInbox
+	confirm  *core.UiConfirmIdentity // pending
+	pending  map[core.PromptId]*core.UiConfirmPublicIdentity
+	changes  map[core.PromptId]*core.UiKeyChange // pending
+}
+
+// isLoopback returns true if listen only binds to the loopback interface.
+func isLoopback(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func newWeb(c *core.Core, listen string, remote bool) (*web, error) {
+	if !remote && !isLoopback(listen) {
+		return nil, fmt.Errorf("refusing to listen on non loopback "+
+			"address %v", listen)
+	}
+
+	t := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, t)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	w := web{
+		c:       c,
+		token:   hex.EncodeToString(t),
+		l:       l,
+		conns:   make(map[*wsConn]struct{}),
+		pending: make(map[core.PromptId]*core.UiConfirmPublicIdentity),
+		changes: make(map[core.PromptId]*core.UiKeyChange),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", w.handleIndex)
+	mux.HandleFunc("/ws", w.handleWebsocket)
+	mux.HandleFunc("/spool", w.handleSpool)
+	go http.Serve(l, mux)
+
+	return &w, nil
+}
+
+// URL returns the address the browser must be pointed at.
+func (w *web) URL() string {
+	return fmt.Sprintf("http://%v/?token=%v", w.l.Addr(), w.token)
+}
+
+func (w *web) Close() error {
+	return w.l.Close()
+}
+
+// authorized validates the session token of a request.
+func (w *web) authorized(r *http.Request) bool {
+	t := r.URL.Query().Get("token")
+	return subtle.ConstantTimeCompare([]byte(t), []byte(w.token)) == 1
+}
+
+func (w *web) handleIndex(rw http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(rw, r)
+		return
+	}
+	if !w.authorized(r) {
+		http.Error(rw, "invalid token", http.StatusForbidden)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Content-Security-Policy", "default-src 'self' "+
+		"'unsafe-inline'; connect-src 'self' ws: ; img-src 'self' data:")
+	rw.Header().Set("X-Frame-Options", "DENY")
+	io.WriteString(rw, page)
+}
+
+// handleSpool downloads received content or one part of it, or the text of
+// sent content.
+func (w *web) handleSpool(rw http.ResponseWriter, r *http.Request) {
+	if !w.authorized(r) {
+		http.Error(rw, "invalid token", http.StatusForbidden)
+		return
+	}
+	var (
+		f   io.ReadCloser
+		err error
+	)
+	id, part := r.URL.Query().Get("id"), r.URL.Query().Get("part")
+	switch {
+	case r.URL.Query().Get("sent") != "":
+		f, err = w.c.ThreadOpen(&core.ThreadMessage{Id: id, Sent: true})
+	case part != "":
+		var n int
+		n, err = strconv.Atoi(part)
+		if err == nil {
+			f, err = w.c.SpoolOpenPart(id, n)
+		}
+	default:
+		f, err = w.c.SpoolOpen(id)
+	}
+	if err != nil {
+		http.NotFound(rw, r)
+		return
+	}
+	defer f.Close()
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Set("Content-Disposition", "attachment")
+	io.Copy(rw, f)
+}
+
+func (w *web) handleWebsocket(rw http.ResponseWriter, r *http.Request) {
+	if !w.authorized(r) {
+		http.Error(rw, "invalid token", http.StatusForbidden)
+		return
+	}
+	// default CheckOrigin rejects cross origin pages
+	u := websocket.Upgrader{ReadBufferSize: 4096, WriteBufferSize: 4096}
+	conn, err := u.Upgrade(rw, r, nil)
+	if err != nil {
+		w.c.DebugUi("handleWebsocket: %v\n", err)
+		return
+	}
+	wc := &wsConn{Conn: conn}
+
+	// catch up on what happened before the page was loaded
+	w.mtx.Lock()
+	w.conns[wc] = struct{}{}
+	replay := []interface{}{}
+	if w.identity != nil {
+		replay = append(replay, w.identity)
+	}
+	if w.trust != nil {
+		replay = append(replay, w.trust)
+	}
+	if w.inbox != nil {
+		replay = append(replay, w.inbox)
+	}
+	if w.confirm != nil {
+		replay = append(replay, w.confirm)
+	}
+	for _, v := range w.pending {
+		replay = append(replay, v)
+	}
+	for _, v := range w.changes {
+		replay = append(replay, v)
+	}
+	w.mtx.Unlock()
+	for _, v := range replay {
+		wc.write(v)
+	}
+
+	defer func() {
+		w.mtx.Lock()
+		delete(w.conns, wc)
+		w.mtx.Unlock()
+		conn.Close()
+	}()
+	for {
+		e := Envelope{}
+		err := conn.ReadJSON(&e)
+		if err != nil {
+			return
+		}
+		err = w.handleBrowser(&e)
+		if err != nil {
+			wc.write(&core.UiPopup{
+				Title:   "Error",
+				Message: err.Error(),
+			})
+		}
+	}
+}
+
+// findTrust returns the trust record for fingerprint.
+func (w *web) findTrust(fingerprint string) *core.TrustRecord {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if w.trust == nil {
+		return nil
+	}
+	for _, v := range w.trust.TrustRecords {
+		if v.PublicIdentity.Fingerprint() == fingerprint {
+			return v
+		}
+	}
+	return nil
+}
+
+func validState(state int) bool {
+	return state == core.StateAllowed || state == core.StateDenied
+}
+
+// handleBrowser handles a message from a browser.
+func (w *web) handleBrowser(e *Envelope) error {
+	w.c.DebugUi("handleBrowser %v\n", e.Type)
+
+	switch e.Type {
+	case "Message":
+		m := webMessage{}
+		err := json.Unmarshal(e.Message, &m)
+		if err != nil {
+			return err
+		}
+		if m.To == "" {
+			return fmt.Errorf("no recipient")
+		}
+		d, once, err := core.ParseExpiry(m.Expire)
+		if err != nil {
+			return err
+		}
+		return w.c.SendCore(&core.SendFile{
+			To:        m.To,
+			Body:      m.Text,
+			Expire:    d,
+			ViewOnce:  once,
+			InReplyTo: m.InReplyTo,
+		})
+
+	case "FetchMailbox":
+		return w.c.SendCore(&core.FetchMailbox{})
+
+	case "AuditView":
+		return w.c.SendCore(&core.AuditView{})
+
+	case "InboxOpen":
+		m := core.InboxOpen{}
+		err := json.Unmarshal(e.Message, &m)
+		if err != nil {
+			return err
+		}
+		return w.c.SendCore(&m)
+
+	case "InboxMark":
+		m := core.InboxMark{}
+		err := json.Unmarshal(e.Message, &m)
+		if err != nil {
+			return err
+		}
+		return w.c.SendCore(&m)
+
+	case "InboxDelete":
+		m := core.InboxDelete{}
+		err := json.Unmarshal(e.Message, &m)
+		if err != nil {
+			return err
+		}
+		return w.c.SendCore(&m)
+
+	case "InboxSearch":
+		m := core.InboxSearch{}
+		err := json.Unmarshal(e.Message, &m)
+		if err != nil {
+			return err
+		}
+		return w.c.SendCore(&m)
+
+	case "MailExport":
+		m := core.MailExport{}
+		err := json.Unmarshal(e.Message, &m)
+		if err != nil {
+			return err
+		}
+		return w.c.SendCore(&m)
+
+	case "HistoryView":
+		m := core.HistoryView{}
+		err := json.Unmarshal(e.Message, &m)
+		if err != nil {
+			return err
+		}
+		return w.c.SendCore(&m)
+
+	case "UpdateTrustRecord":
+		m := webState{}
+		err := json.Unmarshal(e.Message, &m)
+		if err != nil {
+			return err
+		}
+		if !validState(m.State) {
+			return fmt.Errorf("invalid state %v", m.State)
+		}
+		tr := w.findTrust(m.Fingerprint)
+		if tr == nil {
+			return fmt.Errorf("unknown fingerprint %v", m.Fingerprint)
+		}
+		ntr := *tr
+		ntr.State = m.State
+		return w.c.SendCore(&core.UpdateTrustRecord{TrustRecord: &ntr})
+
+	case "TrustHistoryView", "TrustRevert":
+		m := webRevert{}
+		err := json.Unmarshal(e.Message, &m)
+		if err != nil {
+			return err
+		}
+		tr := w.findTrust(m.Fingerprint)
+		if tr == nil {
+			return fmt.Errorf("unknown fingerprint %v", m.Fingerprint)
+		}
+		if e.Type == "TrustHistoryView" {
+			return w.c.SendCore(&core.TrustHistoryView{
+				PublicIdentity: tr.PublicIdentity,
+			})
+		}
+		return w.c.SendCore(&core.TrustRevert{
+			PublicIdentity: tr.PublicIdentity,
+			Version:        m.Version,
+		})
+
+	case "TrustDelete":
+		m := webDelete{}
+		err := json.Unmarshal(e.Message, &m)
+		if err != nil {
+			return err
+		}
+		tr := w.findTrust(m.Fingerprint)
+		if tr == nil {
+			return fmt.Errorf("unknown fingerprint %v", m.Fingerprint)
+		}
+		return w.c.SendCore(&core.TrustDelete{
+			PublicIdentity: tr.PublicIdentity,
+			Forget:         m.Forget,
+		})
+
+	case "UiConfirmIdentityReply":
+		m := webIdentity{}
+		err := json.Unmarshal(e.Message, &m)
+		if err != nil {
+			return err
+		}
+		w.mtx.Lock()
+		pending := w.confirm != nil && w.confirm.Id == m.Id
+		if pending {
+			w.confirm = nil
+		}
+		w.mtx.Unlock()
+		if !pending {
+			return fmt.Errorf("no pending identity confirmation")
+		}
+		w.broadcast(&webDone{Id: m.Id})
+		return w.c.SendCore(&core.UiConfirmIdentityReply{
+			Id:      m.Id,
+			Name:    m.Name,
+			Address: m.Address,
+		})
+
+	case "UiConfirmPublicIdentityReply":
+		m := webState{}
+		err := json.Unmarshal(e.Message, &m)
+		if err != nil {
+			return err
+		}
+		w.mtx.Lock()
+		ci, ok := w.pending[m.Id]
+		delete(w.pending, m.Id)
+		w.mtx.Unlock()
+		if !ok {
+			return fmt.Errorf("no pending confirmation %v", m.Id)
+		}
+		if !validState(m.State) {
+			m.State = core.StateInvalid
+		}
+		// other tabs can close their dialog
+		w.broadcast(&webDone{Id: m.Id})
+		return w.c.SendCore(&core.UiConfirmPublicIdentityReply{
+			Id:             m.Id,
+			PublicIdentity: ci.PublicIdentity,
+			State:          m.State,
+		})
+
+	case "UiKeyChangeReply":
+		m := webKeyChange{}
+		err := json.Unmarshal(e.Message, &m)
+		if err != nil {
+			return err
+		}
+		w.mtx.Lock()
+		_, ok := w.changes[m.Id]
+		delete(w.changes, m.Id)
+		w.mtx.Unlock()
+		if !ok {
+			return fmt.Errorf("no pending key change %v", m.Id)
+		}
+		switch m.Decision {
+		case core.KeyChangeAccept, core.KeyChangeVerify,
+			core.KeyChangeReject:
+		default:
+			m.Decision = core.KeyChangeCancel
+		}
+		w.broadcast(&webDone{Id: m.Id})
+		return w.c.SendCore(&core.UiKeyChangeReply{
+			Id:       m.Id,
+			Decision: m.Decision,
+		})
+	}
+
+	return fmt.Errorf("unknown message %v", e.Type)
+}
+
+// webDone tells browsers a prompt was answered.
+type webDone struct {
+	Id core.PromptId
+}
+
+// broadcast sends m to all browsers.
+func (w *web) broadcast(m interface{}) {
+	w.mtx.Lock()
+	conns := make([]*wsConn, 0, len(w.conns))
+	for c := range w.conns {
+		conns = append(conns, c)
+	}
+	w.mtx.Unlock()
+
+	for _, c := range conns {
+		err := c.write(m)
+		if err != nil {
+			c.Close()
+		}
+	}
+}
+
+// Event forwards a core to UI message to all browsers.
+func (w *web) Event(m interface{}) {
+	w.mtx.Lock()
+	switch msg := m.(type) {
+	case *core.UiRenderIdentity:
+		w.identity = msg
+	case *core.UiRenderTrust:
+		w.trust = msg
+	case *core.UiRenderInbox:
+		w.inbox = msg
+	case *core.UiConfirmIdentity:
+		w.confirm = msg
+	case *core.UiConfirmPublicIdentity:
+		w.pending[msg.Id] = msg
+	case *core.UiKeyChange:
+		w.changes[msg.Id] = msg
+	}
+	w.mtx.Unlock()
+
+	w.broadcast(m)
+}
+
+// Frontend methods, browsers get everything.
+
+func (w *web) RenderIdentity(m *core.UiRenderIdentity)               { w.Event(m) }
+func (w *web) ConfirmIdentity(m *core.UiConfirmIdentity)             { w.Event(m) }
+func (w *web) Popup(m *core.UiPopup)                                 { w.Event(m) }
+func (w *web) ConfirmPublicIdentity(m *core.UiConfirmPublicIdentity) { w.Event(m) }
+func (w *web) RenderTrust(m *core.UiRenderTrust)                     { w.Event(m) }
+func (w *web) SendFileResult(m *core.UiSendFileResult)               { w.Event(m) }
+func (w *web) NewMessage(m *core.UiNewMessage)                       { w.Event(m) }
+func (w *web) RenderAudit(m *core.UiRenderAudit)                     { w.Event(m) }
+func (w *web) RenderInbox(m *core.UiRenderInbox)                     { w.Event(m) }
+func (w *web) InboxItem(m *core.UiInboxItem)                         { w.Event(m) }
+func (w *web) SearchResult(m *core.UiSearchResult)                   { w.Event(m) }
+func (w *web) SendProgress(m *core.UiSendProgress)                   { w.Event(m) }
+func (w *web) RenderHistory(m *core.UiRenderHistory)                 { w.Event(m) }
+func (w *web) RenderTrustHistory(m *core.UiRenderTrustHistory)       { w.Event(m) }
+func (w *web) KeyChange(m *core.UiKeyChange)                         { w.Event(m) }